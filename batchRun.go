@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A batch parameter file is either a top-level array of event objects, or a single event object
+// whose path_perpendicular_offset_from_center_km is an array of offsets. Each event is run
+// headless (as if the second argument were false) and its output files are numbered (for example
+// lightCurvePlot_3.png). When consecutive events differ only in their observation path (dX, dY,
+// offset, path endpoints, camera exposure, title ...), the diffraction calculation of the previous event is reused.
+// A ground shadow rotated to a 90 degree PA depends on dX and dY, so then they must match as well.
+
+// expandBatchTables returns the list of event tables described by a parsed parameter file, and
+// whether the file describes a batch run at all. An error is returned for a malformed batch.
+func expandBatchTables(parsed interface{}) ([]map[string]interface{}, bool, error) {
+	switch v := parsed.(type) {
+	case []interface{}:
+		if len(v) == 0 {
+			return nil, true, fmt.Errorf("the array of events is empty")
+		}
+		var tables []map[string]interface{}
+		for i, element := range v {
+			table, ok := element.(map[string]interface{})
+			if !ok {
+				return nil, true, fmt.Errorf("event %d in the array is not an object", i+1)
+			}
+			expanded, err := expandOffsets(table)
+			if err != nil {
+				return nil, true, fmt.Errorf("event %d: %w", i+1, err)
+			}
+			tables = append(tables, expanded...)
+		}
+		return tables, true, nil
+	case map[string]interface{}:
+		if _, isArray := v["path_perpendicular_offset_from_center_km"].([]interface{}); !isArray {
+			return nil, false, nil
+		}
+		tables, err := expandOffsets(v)
+		return tables, true, err
+	default:
+		return nil, false, fmt.Errorf("the file must contain an object or an array of objects")
+	}
+}
+
+// expandOffsets returns one copy of table per entry if its path_perpendicular_offset_from_center_km
+// value is an array, otherwise table itself.
+func expandOffsets(table map[string]interface{}) ([]map[string]interface{}, error) {
+	offsets, isArray := table["path_perpendicular_offset_from_center_km"].([]interface{})
+	if !isArray {
+		return []map[string]interface{}{table}, nil
+	}
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("path_perpendicular_offset_from_center_km: the array of offsets is empty")
+	}
+	var tables []map[string]interface{}
+	for _, offset := range offsets {
+		copied := make(map[string]interface{}, len(table))
+		for key, value := range table {
+			copied[key] = value
+		}
+		copied["path_perpendicular_offset_from_center_km"] = offset
+		tables = append(tables, copied)
+	}
+	return tables, nil
+}
+
+// diffractionInputs returns a copy of a freshly validated event with the fields that only affect
+// the observation path cleared, so that two events with equal diffractionInputs have identical
+// (pre exposure smear) intensity matrices.
+func diffractionInputs(event OccultationEvent) OccultationEvent {
+	if !event.RotateGroundShadowTo90pa {
+		// A ground shadow rotated to a 90 degree PA depends on the velocity, so it is kept then
+		event.DxKmPerSec = 0.0
+		event.DyKmPerSec = 0.0
+	}
+	event.PathOffsetFromCenterKm = 0.0
+	event.PathEndpointsPixels = [4]float64{}
+	event.PathEndpointsGiven = false
+	event.CameraExposureSecs = 0.0
+	event.KmGridSpacingKm = 0.0
+	event.DisplayOffset = 0.0
+	event.DisplayBitDepth = 0
+	event.PathMarkers = ""
+	event.MinEdgeSeparationKm = 0.0
+	event.PlotResidual = false
+	event.PlotHalfLightEdges = false
+	event.PlotGeometricStep = false
+	event.PlotXTickStepKm = 0.0
+	event.PlotYTickStep = 0.0
+	event.PlotXTickFormat = ""
+	event.PlotYTickFormat = ""
+	event.Title = ""
+	event.WindowSizePixels = 0
+	event.ShowInput = false
+	event.SaveGeometricShadow = false
+	event.SaveIntensityMatrixGz = false
+	event.WriteLog = false
+	event.ReportAsymmetry = false
+	return event
+}
+
+// numberedFilename inserts _n before the extension of filename (lightCurvePlot.png -> lightCurvePlot_3.png)
+func numberedFilename(filename string, n int) string {
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(filename, ext), n, ext)
+}
+
+// runBatch runs every event in tables, reusing the diffraction calculation between consecutive
+// events that share the same geometry. autosize is passed on to autosizePlane. The batch stops at
+// the first error, which is returned.
+func runBatch(tables []map[string]interface{}, autosize bool) error {
+	var previous *diffractionRun
+
+	for i, jsonTable := range tables {
+		n := i + 1
+		eventStart := time.Now()
+		logInfo("\n========== Batch event %d of %d ==========\n", n, len(tables))
+
+		event, err := eventFromTable(jsonTable)
+		if err != nil {
+			return exitWith(4, fmt.Errorf("Event %d: %w", n, err))
+		}
+
+		// The log starts with the first event that asks for it
+		if event.WriteLog {
+			if err := startRunLog(runLogFilename); err != nil {
+				return exitWith(27, fmt.Errorf("\n\tThe run log could not be created: %w\n", err))
+			}
+		}
+
+		if event.ShowInput {
+			logInfo("\nEvent %d parameters: %v\n", n, jsonTable)
+		}
+
+		opts := SimulationOptions{Autosize: autosize, SaveLightCurvePlot: true}
+		previous, err = runSimulation(context.Background(), &event, opts,
+			func(name string) string { return numberedFilename(name, n) }, previous)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(console, runSummary(&event, fmt.Sprintf("event=%d", n), time.Since(eventStart)))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	json "github.com/KevinWang15/go-json5"
+)
+
+// batchOutput runs the batch described by params (in the current folder) and returns its console output.
+func batchOutput(t *testing.T, params string) string {
+	t.Helper()
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(params), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	tables, isBatch, err := expandBatchTables(parsed)
+	if err != nil || !isBatch {
+		t.Fatalf("expandBatchTables: %v (batch %v)", err, isBatch)
+	}
+
+	var out bytes.Buffer
+	console = &out
+	defer func() { console = os.Stdout }()
+	if err := runBatch(tables, false); err != nil {
+		t.Fatalf("runBatch: %v", err)
+	}
+	return out.String()
+}
+
+// batchSummaries runs the batch described by params (in the current folder) and returns its summary
+// lines with the run times removed.
+func batchSummaries(t *testing.T, params string) []string {
+	t.Helper()
+	var summaries []string
+	for _, line := range regexp.MustCompile(`summary .* runtime_s=`).FindAllString(batchOutput(t, params), -1) {
+		summaries = append(summaries, regexp.MustCompile(`event=\d+ `).ReplaceAllString(line, ""))
+	}
+	return summaries
+}
+
+func TestBatchRotatedEventsDifferingInVelocity(t *testing.T) {
+	t.Chdir(t.TempDir())
+	const common = `
+		fundamental_plane_width_km : 10,
+		fundamental_plane_width_num_points : 100,
+		distance_au : 2.33,
+		observation_wavelength_nm : 500,
+		rotate_ground_shadow_to_90_degree_pa_bool : true,
+		main_body : { x_center_km : 0, y_center_km : 0, major_axis_km : 6, minor_axis_km : 2, major_axis_pa_degrees : 0 },`
+	eastWest := `{` + common + ` dX_km_per_sec : 5.0, dY_km_per_sec : 0.0 }`
+	northSouth := `{` + common + ` dX_km_per_sec : 0.0, dY_km_per_sec : 5.0 }`
+
+	// The second event must not reuse a plane rotated for the first event's path angle
+	batch := batchSummaries(t, `[`+eastWest+`,`+northSouth+`]`)
+	alone := batchSummaries(t, `[`+northSouth+`]`)
+	if len(batch) != 2 || len(alone) != 1 {
+		t.Fatalf("got %d and %d summaries, want 2 and 1", len(batch), len(alone))
+	}
+	if batch[0] == batch[1] {
+		t.Errorf("both events gave %q, but their chords cross the ellipse in different directions", batch[0])
+	}
+	if batch[1] != alone[0] {
+		t.Errorf("the second event of the batch gave %q, but run alone it gives %q", batch[1], alone[0])
+	}
+
+	// An event that reuses the rotated plane must turn its own velocity to the rotated plane too
+	offset := `{` + common + ` dX_km_per_sec : 0.0, dY_km_per_sec : 5.0, path_perpendicular_offset_from_center_km : [0, 0.5] }`
+	reused := batchSummaries(t, offset)
+	alone = batchSummaries(t, `[{`+common+` dX_km_per_sec : 0.0, dY_km_per_sec : 5.0, path_perpendicular_offset_from_center_km : 0.5 }]`)
+	if len(reused) != 2 || len(alone) != 1 {
+		t.Fatalf("got %d and %d summaries, want 2 and 1", len(reused), len(alone))
+	}
+	if reused[1] != alone[0] {
+		t.Errorf("the reused event gave %q, but run alone it gives %q", reused[1], alone[0])
+	}
+}
+
+func TestBatchReusedGeometricShadowIsFlipped(t *testing.T) {
+	t.Chdir(t.TempDir())
+	batchSummaries(t, `{
+		fundamental_plane_width_km : 10,
+		fundamental_plane_width_num_points : 64,
+		distance_au : 2.33,
+		observation_wavelength_nm : 500,
+		dX_km_per_sec : 5.0,
+		dY_km_per_sec : 0.0,
+		flip_horizontal_bool : true,
+		save_geometric_shadow_bool : true,
+		main_body : { x_center_km : 2, y_center_km : 1, major_axis_km : 3, minor_axis_km : 2, major_axis_pa_degrees : 30 },
+		path_perpendicular_offset_from_center_km : [0, 0.5],
+	}`)
+
+	// The second event reuses the first event's plane, so its saved shadow must be flipped the same way
+	first, err := os.ReadFile("geometricShadow_1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.ReadFile("geometricShadow_2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("geometricShadow_2.png differs from geometricShadow_1.png")
+	}
+}
+
+func TestBatchReportsLikeASingleRun(t *testing.T) {
+	t.Chdir(t.TempDir())
+	out := batchOutput(t, `{
+		fundamental_plane_width_km : 10,
+		fundamental_plane_width_num_points : 64,
+		distance_au : 2.33,
+		observation_wavelength_nm : 500,
+		dX_km_per_sec : 5.0,
+		dY_km_per_sec : 0.0,
+		main_body : { x_center_km : 0, y_center_km : 0, major_axis_km : 2, minor_axis_km : 2, major_axis_pa_degrees : 0 },
+		path_perpendicular_offset_from_center_km : [0, 0.5],
+	}`)
+
+	// Both the computed and the reused event report the central flash and the Poisson spot of the disk
+	for _, report := range []string{"The path passes", "Poisson spot intensity"} {
+		if count := strings.Count(out, report); count != 2 {
+			t.Errorf("%q is reported %d times, want once for each of the 2 events", report, count)
+		}
+	}
+}
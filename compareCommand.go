@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bob-anderson-ok/IOTAdiffraction/lightcurve"
+)
+
+// runCompare loads two 16-bit intensity images (as written to targetImage16bit.png), reports the
+// maximum absolute and RMS differences between them, and writes a stretched difference image
+// to differenceImage8bit.png. If one image is a whole multiple of the other's size, it is first
+// rebinned to that size.
+func runCompare(pathA, pathB string) error {
+	// The scale factor of 4000 matches what the main application uses to write targetImage16bit.png
+	a, err := lightcurve.LoadGray16PNG(pathA, 4000.0)
+	if err != nil {
+		return err
+	}
+	b, err := lightcurve.LoadGray16PNG(pathB, 4000.0)
+	if err != nil {
+		return err
+	}
+
+	// A result at a multiple of the other's resolution is block-averaged down to it
+	a, b, err = rebinToMatch(a, b)
+	if err != nil {
+		return fmt.Errorf("comparison of %q and %q failed: %w", pathA, pathB, err)
+	}
+
+	maxAbs, rmse, err := CompareMatrices(a, b)
+	if err != nil {
+		return fmt.Errorf("comparison of %q and %q failed: %w", pathA, pathB, err)
+	}
+	fmt.Fprintf(console, "Comparing %q with %q (%dx%d pixels)\n", pathA, pathB, len(a[0]), len(a))
+	fmt.Fprintf(console, "Maximum absolute difference: %0.6g\n", maxAbs)
+	fmt.Fprintf(console, "RMS difference: %0.6g\n", rmse)
+	fmt.Fprintf(console, "(The 16-bit quantization step is %0.6g)\n", 1.0/4000.0)
+
+	diff, err := SubtractMatrices(a, b)
+	if err != nil {
+		return err
+	}
+	diffImage, err := MatrixToGrayViewPercentile(diff, 0.0, 100)
+	if err != nil {
+		return fmt.Errorf("creation of the difference image failed: %w", err)
+	}
+	err = SaveGrayPNG("differenceImage8bit.png", diffImage)
+	if err != nil {
+		return fmt.Errorf("writing of %q failed: %w", "differenceImage8bit.png", err)
+	}
+	fmt.Fprintln(console, "Difference image saved to differenceImage8bit.png")
+
+	return nil
+}
+
+// rebinToMatch returns a and b with the larger one rebinned (see RebinMatrix) to the size of the
+// smaller one when its size is a whole multiple of it. Other sizes are returned unchanged.
+func rebinToMatch(a, b [][]float64) ([][]float64, [][]float64, error) {
+	if len(a) == 0 || len(b) == 0 || len(a) == len(b) {
+		return a, b, nil
+	}
+	large, small := &a, b
+	if len(b) > len(a) {
+		large, small = &b, a
+	}
+	factor := len(*large) / len(small)
+	if len(*large) != factor*len(small) || len((*large)[0]) != factor*len(small[0]) {
+		return a, b, nil
+	}
+	rebinned, err := RebinMatrix(*large, factor)
+	if err != nil {
+		return nil, nil, err
+	}
+	logInfo("The %dx%d image is rebinned by %d to %dx%d\n", len((*large)[0]), len(*large), factor,
+		len(small[0]), len(small))
+	*large = rebinned
+	return a, b, nil
+}
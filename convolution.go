@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"math"
+	"math/cmplx"
 
 	"gonum.org/v1/gonum/dsp/fourier"
 )
@@ -15,6 +17,22 @@ const (
 	ConvValid
 )
 
+// convModeNames are the names of the ConvMode values, as used in file names.
+var convModeNames = map[ConvMode]string{ConvSame: "Same", ConvFull: "Full", ConvValid: "Valid"}
+
+// parseConvMode returns the ConvMode named by s ("same", "full" or "valid"). An empty s is ConvSame.
+func parseConvMode(s string) (ConvMode, error) {
+	switch s {
+	case "", "same":
+		return ConvSame, nil
+	case "full":
+		return ConvFull, nil
+	case "valid":
+		return ConvValid, nil
+	}
+	return ConvSame, fmt.Errorf("%q is not a convolution mode (same, full or valid)", s)
+}
+
 type PaddingMode int
 
 const (
@@ -59,6 +77,57 @@ func BuildStarPsf(starDiamKm, resolutionPointsPerKm, limbDarkeningCoeff float64)
 	return starMatrix, sumOfWeights
 }
 
+// BuildMotionBlurKernel builds a line kernel of the given length (in pixels) oriented along the
+// shadow motion direction. pathAngleDegrees is measured the same way as PathAngleDegrees
+// (CCW from the y-axis), so the line has image direction (sin(theta), cos(theta)).
+// Returns the kernel and the sum of its weights (for use with ConvolvePSFFFT).
+func BuildMotionBlurKernel(lengthPixels, pathAngleDegrees float64) ([][]float64, float64) {
+	theta := pathAngleDegrees * math.Pi / 180.0
+	dx := math.Sin(theta)
+	dy := math.Cos(theta)
+
+	// Same sizing scheme as BuildStarPsf: even width plus a border
+	kernelWidthPixels := int(math.Ceil(lengthPixels))
+	if kernelWidthPixels%2 != 0 {
+		kernelWidthPixels++
+	}
+	kernelWidthPixels += 4
+	kernel := make([][]float64, kernelWidthPixels)
+	for row := range kernel {
+		kernel[row] = make([]float64, kernelWidthPixels)
+	}
+	center := kernelWidthPixels / 2
+
+	// Walk the line at 4 samples per pixel, depositing equal weight in the nearest pixel. The offset
+	// from the center is rounded (rather than the absolute position) so that samples exactly half way
+	// between pixels are deposited symmetrically and the kernel does not shift the image.
+	numSamples := int(math.Ceil(lengthPixels*4)) + 1
+	sumOfWeights := 0.0
+	for _, t := range Linspace(-lengthPixels/2, lengthPixels/2, numSamples) {
+		col := center + int(math.Round(t*dx))
+		row := center + int(math.Round(t*dy))
+		kernel[row][col] += 1.0
+		sumOfWeights += 1.0
+	}
+	return kernel, sumOfWeights
+}
+
+// ApplyExposureSmear models a finite camera exposure by convolving the intensity matrix with a
+// line kernel of length exposureSecs * shadowSpeedKmPerSec / kmPerPixel pixels oriented in the
+// shadow motion direction. If the smear is shorter than one pixel the matrix is returned unchanged.
+func ApplyExposureSmear(m [][]float64, exposureSecs, shadowSpeedKmPerSec, kmPerPixel,
+	pathAngleDegrees float64) ([][]float64, error) {
+	if kmPerPixel <= 0 {
+		return nil, errors.New("kmPerPixel must be > 0")
+	}
+	lengthPixels := exposureSecs * shadowSpeedKmPerSec / kmPerPixel
+	if lengthPixels < 1.0 {
+		return m, nil
+	}
+	kernel, sumOfWeights := BuildMotionBlurKernel(lengthPixels, pathAngleDegrees)
+	return ConvolvePSFFFT(m, kernel, sumOfWeights, ConvSame, PadReplicate, false)
+}
+
 // ConvolvePSFFFT convolves image with a centered PSF using 2D FFT.
 //
 // image: HxW
@@ -177,7 +246,9 @@ func ConvolvePSFFFT(image, psf [][]float64, starSum float64, mode ConvMode, pad
 		return full, nil
 
 	case ConvSame:
-		// Centered crop of a full result to HxW: offset = floor(Ph/2), floor(Pw/2)
+		// Centered crop of a full result to HxW: offset = floor(Ph/2), floor(Pw/2). For an even
+		// dimension this assumes the psf center is at index Ph/2 (not (Ph-1)/2), which is how
+		// BuildStarPsf and BuildMotionBlurKernel lay out their kernels, so there is no half pixel shift.
 		offY := Ph / 2
 		offX := Pw / 2
 		out := make([][]float64, H)
@@ -240,6 +311,38 @@ func fft2InPlace(a [][]complex128, forward bool) {
 	}
 }
 
+// PowerSpectrum returns the log-magnitude, log10(1 + |F|), of the 2D FFT of m, shifted so that
+// the DC term is at the center (row h/2, column w/2). Energy piled up at the edges of the
+// spectrum is a sign that the fundamental plane is undersampled.
+func PowerSpectrum(m [][]float64) ([][]float64, error) {
+	h, w, err := rectSize(m)
+	if err != nil {
+		return nil, err
+	}
+	if h == 0 || w == 0 {
+		return nil, errors.New("empty matrix")
+	}
+
+	a := makeComplex2D(h, w)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			a[y][x] = complex(m[y][x], 0)
+		}
+	}
+	fft2InPlace(a, true)
+
+	out := make([][]float64, h)
+	for y := 0; y < h; y++ {
+		out[y] = make([]float64, w)
+		yy := (y + h - h/2) % h // fftshift: frequency 0 ends up at row h/2
+		for x := 0; x < w; x++ {
+			xx := (x + w - w/2) % w
+			out[y][x] = math.Log10(1 + cmplx.Abs(a[yy][xx]))
+		}
+	}
+	return out, nil
+}
+
 // -------------------- Padding + shifting --------------------
 
 func sample2D(img [][]float64, y, x int, mode PaddingMode) float64 {
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// testMatrix returns an h x w matrix of deterministic, irregular values.
+func testMatrix(h, w int, seed float64) [][]float64 {
+	m := make([][]float64, h)
+	for y := 0; y < h; y++ {
+		m[y] = make([]float64, w)
+		for x := 0; x < w; x++ {
+			m[y][x] = math.Sin(seed*float64(y*w+x+1)) + 0.5*math.Cos(float64(3*y-x)*seed)
+		}
+	}
+	return m
+}
+
+// directConvolveFull is the textbook O(n^4) linear convolution of image with psf (zero padding),
+// normalized by starSum. The result is (H+Ph-1) x (W+Pw-1).
+func directConvolveFull(image, psf [][]float64, starSum float64) [][]float64 {
+	H, W := len(image), len(image[0])
+	Ph, Pw := len(psf), len(psf[0])
+	full := make([][]float64, H+Ph-1)
+	for y := range full {
+		full[y] = make([]float64, W+Pw-1)
+		for x := range full[y] {
+			sum := 0.0
+			for i := 0; i < H; i++ {
+				for j := 0; j < W; j++ {
+					py, px := y-i, x-j
+					if py < 0 || py >= Ph || px < 0 || px >= Pw {
+						continue
+					}
+					sum += image[i][j] * psf[py][px]
+				}
+			}
+			full[y][x] = sum / starSum
+		}
+	}
+	return full
+}
+
+// crop returns the h x w sub-matrix of m starting at (y0, x0).
+func crop(m [][]float64, y0, x0, h, w int) [][]float64 {
+	out := make([][]float64, h)
+	for y := 0; y < h; y++ {
+		out[y] = append([]float64(nil), m[y0+y][x0:x0+w]...)
+	}
+	return out
+}
+
+func assertMatricesClose(t *testing.T, got, want [][]float64, tol float64) {
+	t.Helper()
+	if len(got) != len(want) || len(got[0]) != len(want[0]) {
+		t.Fatalf("size = %dx%d, want %dx%d", len(got), len(got[0]), len(want), len(want[0]))
+	}
+	for y := range want {
+		for x := range want[y] {
+			if math.Abs(got[y][x]-want[y][x]) > tol {
+				t.Fatalf("[%d][%d] = %g, want %g", y, x, got[y][x], want[y][x])
+			}
+		}
+	}
+}
+
+func TestConvolvePSFFFTMatchesDirectConvolution(t *testing.T) {
+	image := testMatrix(7, 9, 0.37)
+	psf := testMatrix(3, 5, 1.91) // Deliberately asymmetric, odd dimensions
+	const starSum = 2.5
+
+	full := directConvolveFull(image, psf, starSum)
+	tests := []struct {
+		name string
+		mode ConvMode
+		want [][]float64
+	}{
+		{"full", ConvFull, full},
+		{"same", ConvSame, crop(full, 3/2, 5/2, 7, 9)},
+		{"valid", ConvValid, crop(full, 3-1, 5-1, 7-3+1, 9-5+1)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ConvolvePSFFFT(image, psf, starSum, tc.mode, PadZeros, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertMatricesClose(t, got, tc.want, 1e-9)
+		})
+	}
+}
+
+func TestConvolvePSFFFTValidRejectsLargePsf(t *testing.T) {
+	if _, err := ConvolvePSFFFT(testMatrix(3, 3, 0.5), testMatrix(4, 4, 0.7), 1.0, ConvValid, PadZeros, false); err == nil {
+		t.Error("expected an error for a psf larger than the image")
+	}
+}
+
+// centroid returns the intensity-weighted (row, col) centroid of m.
+func centroid(m [][]float64) (float64, float64) {
+	var sum, sumY, sumX float64
+	for y := range m {
+		for x, v := range m[y] {
+			sum += v
+			sumY += v * float64(y)
+			sumX += v * float64(x)
+		}
+	}
+	return sumY / sum, sumX / sum
+}
+
+func TestConvSameDoesNotShiftEvenPsf(t *testing.T) {
+	const n = 41
+	const y0, x0 = 17, 23
+	image := make([][]float64, n)
+	for y := range image {
+		image[y] = make([]float64, n)
+	}
+	image[y0][x0] = 1.0
+
+	starPsf, starSum := BuildStarPsf(1.7, 0.25, 0.6)
+	blurKernel, blurSum := BuildMotionBlurKernel(6.0, 90.0)
+	tests := []struct {
+		name string
+		psf  [][]float64
+		sum  float64
+	}{
+		{"star", starPsf, starSum},
+		{"motion blur", blurKernel, blurSum},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.psf)%2 != 0 {
+				t.Fatalf("expected an even psf, got width %d", len(tc.psf))
+			}
+			out, err := ConvolvePSFFFT(image, tc.psf, tc.sum, ConvSame, PadZeros, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cy, cx := centroid(out)
+			if math.Abs(cy-y0) > 1e-9 || math.Abs(cx-x0) > 1e-9 {
+				t.Errorf("centroid = (%g, %g), want (%d, %d)", cy, cx, y0, x0)
+			}
+		})
+	}
+}
+
+func TestConvFullContainsConvSame(t *testing.T) {
+	img := testMatrix(12, 12, 0.37)
+	psf, sum := BuildStarPsf(0.5, 0.1, 0.6)
+	same, err := ConvolvePSFFFT(img, psf, sum, ConvSame, PadReplicate, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := ConvolvePSFFFT(img, psf, sum, ConvFull, PadReplicate, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// psf_conv_mode full hands the path this block of the full result
+	offY, offX := len(psf)/2, len(psf[0])/2
+	for y := range same {
+		for x := range same[y] {
+			if math.Abs(full[y+offY][x+offX]-same[y][x]) > 1e-12 {
+				t.Fatalf("full[%d][%d] = %g, but same[%d][%d] = %g", y+offY, x+offX, full[y+offY][x+offX], y, x, same[y][x])
+			}
+		}
+	}
+
+	for name, want := range map[string]ConvMode{"": ConvSame, "same": ConvSame, "full": ConvFull, "valid": ConvValid} {
+		if got, err := parseConvMode(name); err != nil || got != want {
+			t.Errorf("parseConvMode(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := parseConvMode("Full"); err == nil {
+		t.Errorf("parseConvMode(%q) should fail", "Full")
+	}
+}
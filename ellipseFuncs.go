@@ -8,7 +8,15 @@ import (
 
 func insideGeneralizedEllipse(x, y, x0, y0, xDiam, yDiam, thetaDegrees float64) bool {
 	//#Returns boolean: True if x,y is inside or on the ellipse boundary - False if x,y is outside the ellipse
+	rhoSquared, _ := generalizedEllipseCoordinates(x, y, x0, y0, xDiam, yDiam, thetaDegrees)
+	return rhoSquared <= 1.0
+}
+
+func generalizedEllipseCoordinates(x, y, x0, y0, xDiam, yDiam, thetaDegrees float64) (rhoSquared, r float64) {
+	// Returns the squared normalized ellipse radius of x,y (1.0 on the boundary) and the distance of x,y from the center.
 	// The fundamental plane coordinate system is y (row) pointing up and x (column) pointing left.
+	// (After AddEllipses negates the centers and swaps row and column, x_center_km > 0 is right of center
+	// in the image: TestFundamentalPlaneCoordinateConvention pins the net km to pixel transform.)
 	// x0,y0 are the coordinates of the center of the ellipse.
 	// theta_degrees is the counter-clockwise rotation (in degrees) around x0,y0 with North at zero degrees
 	xSemi := xDiam / 2.0
@@ -20,7 +28,7 @@ func insideGeneralizedEllipse(x, y, x0, y0, xDiam, yDiam, thetaDegrees float64)
 	thetaRadians := (thetaDegrees + 90.0) * (math.Pi / 180.0) // Add 90.0 so angles are ccw from North
 	t1 := ((x-xc)*math.Cos(thetaRadians) + (y+yc)*math.Sin(thetaRadians)) / xSemi
 	t2 := ((-x+xc)*math.Sin(thetaRadians) + (y+yc)*math.Cos(thetaRadians)) / ySemi
-	return t1*t1+t2*t2 <= 1.0
+	return t1*t1 + t2*t2, math.Sqrt((x-xc)*(x-xc) + (y+yc)*(y+yc))
 }
 
 func ColorModelString(m color.Model) string {
@@ -64,13 +72,6 @@ func AddEllipses(event OccultationEvent, occulter bool) {
 		return
 	}
 
-	var objectFill uint8
-	if occulter {
-		objectFill = 0
-	} else {
-		objectFill = 255
-	}
-
 	// In the fundamental plane, x is most positive at the left.
 	xVals := Linspace(
 		event.FundamentalPlaneWidthKm/2,
@@ -93,6 +94,7 @@ func AddEllipses(event OccultationEvent, occulter bool) {
 		xDiam = event.MainbodyMinorAxisKm
 		yDiam = event.MainbodyMajorAxisKm
 		rotation = event.MainbodyMajorAxisPaDegrees
+		objectFill := ellipseFill(event.MainbodyOpacity, occulter)
 
 		for row := 0; row < event.FundamentalPlaneWidthPoints; row++ {
 			for col := 0; col < event.FundamentalPlaneWidthPoints; col++ {
@@ -109,6 +111,7 @@ func AddEllipses(event OccultationEvent, occulter bool) {
 		xDiam = event.SatelliteMinorAxisKm
 		yDiam = event.SatelliteMajorAxisKm
 		rotation = event.SatelliteMajorAxisPaDegrees
+		objectFill := ellipseFill(event.SatelliteOpacity, occulter)
 
 		for row := 0; row < event.FundamentalPlaneWidthPoints; row++ {
 			for col := 0; col < event.FundamentalPlaneWidthPoints; col++ {
@@ -119,3 +122,70 @@ func AddEllipses(event OccultationEvent, occulter bool) {
 		}
 	}
 }
+
+// ellipseFill returns the gray level drawn inside an ellipse of the given opacity: 255 * (1 - opacity)
+// for an occulter (black on white) and 255 * opacity for an aperture (white on black). An opacity of
+// 0 means that none was given, so the ellipse is opaque.
+func ellipseFill(opacity float64, occulter bool) uint8 {
+	if opacity <= 0.0 || opacity > 1.0 {
+		opacity = 1.0
+	}
+	if occulter {
+		return uint8(math.Round(255.0 * (1.0 - opacity)))
+	}
+	return uint8(math.Round(255.0 * opacity))
+}
+
+// hasPartialOpacity reports whether the main body or satellite is drawn with a gray level, so that
+// the source plane must be built with ConvertSourcePlaneImageToComplexGraded.
+func hasPartialOpacity(event OccultationEvent) bool {
+	return (event.MainBodyGiven && ellipseFill(event.MainbodyOpacity, true) != 0) ||
+		(event.SatelliteGiven && ellipseFill(event.SatelliteOpacity, true) != 0)
+}
+
+// AddAtmosphere surrounds the main body ellipse with a graded (partially opaque) atmosphere. The
+// amplitude opacity falls off as exp(-h / AtmosphereScaleHeightKm), where h is the (radial) height
+// above the limb in km. The opacity is written into the gray image as 255 * (1 - opacity), so the
+// solid body stays at 0 and the far sky at 255. Use ConvertSourcePlaneImageToComplexGraded to turn
+// the result into a source plane.
+func AddAtmosphere(event OccultationEvent) {
+	if !event.MainBodyGiven || event.AtmosphereScaleHeightKm <= 0.0 {
+		return
+	}
+
+	// In the fundamental plane, x is most positive at the left.
+	xVals := Linspace(
+		event.FundamentalPlaneWidthKm/2,
+		-event.FundamentalPlaneWidthKm/2,
+		event.FundamentalPlaneWidthPoints,
+	)
+
+	// In the fundamental plane, y is most positive at the top.
+	yVals := Linspace(
+		event.FundamentalPlaneWidthKm/2,
+		-event.FundamentalPlaneWidthKm/2,
+		event.FundamentalPlaneWidthPoints,
+	)
+
+	x0 := -event.MainBodyXCenterKm
+	y0 := -event.MainBodyYCenterKm
+	xDiam := event.MainbodyMinorAxisKm
+	yDiam := event.MainbodyMajorAxisKm
+	rotation := event.MainbodyMajorAxisPaDegrees
+
+	for row := 0; row < event.FundamentalPlaneWidthPoints; row++ {
+		for col := 0; col < event.FundamentalPlaneWidthPoints; col++ {
+			rhoSquared, r := generalizedEllipseCoordinates(xVals[col], yVals[row], x0, y0, xDiam, yDiam, rotation)
+			if rhoSquared <= 1.0 {
+				continue // The solid body was already drawn by AddEllipses()
+			}
+			// Height above the limb measured along the radius through x,y
+			h := r * (1.0 - 1.0/math.Sqrt(rhoSquared))
+			opacity := math.Exp(-h / event.AtmosphereScaleHeightKm)
+			fill := uint8(math.Round(255.0 * (1.0 - opacity)))
+			if fill < event.FplaneImage.GrayAt(row, col).Y { // Never lighten (a satellite may be there)
+				event.FplaneImage.Set(row, col, color.Gray{Y: fill})
+			}
+		}
+	}
+}
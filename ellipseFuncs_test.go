@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"math"
+	"testing"
+)
+
+// renderEllipse draws an elongated main body (16 km x 4 km) at the given position angle, centered
+// on a 20 km, 101 point plane, and returns the image. As displayed, North is up and East is left.
+func renderEllipse(paDegrees float64) *image.Gray {
+	const n = 101
+	event := OccultationEvent{
+		FundamentalPlaneWidthKm:     20,
+		FundamentalPlaneWidthPoints: n,
+		MainBodyGiven:               true,
+		MainbodyMajorAxisKm:         16,
+		MainbodyMinorAxisKm:         4,
+		MainbodyMajorAxisPaDegrees:  paDegrees,
+		FplaneImage:                 image.NewGray(image.Rect(0, 0, n, n)),
+	}
+	FillFplane(event.FplaneImage, true)
+	AddEllipses(event, true)
+	return event.FplaneImage
+}
+
+// occulted reports whether the displayed pixel at (x, y) is part of the occulter.
+func occulted(img *image.Gray, x, y int) bool {
+	return img.GrayAt(x, y).Y == 0
+}
+
+func TestAddEllipsesPositionAngle(t *testing.T) {
+	const c = 50    // Center pixel
+	const far = 30  // 6 km from the center: inside the 8 km semi-major axis, outside the 2 km semi-minor axis
+	const diag = 21 // About 6 km from the center along a diagonal
+
+	tests := []struct {
+		name     string
+		pa       float64
+		inside   [][2]int // Displayed (x, y) pixels that must be occulted
+		outside  [][2]int // Displayed (x, y) pixels that must not be
+		longAxis string
+	}{
+		{"PA 0: long axis North-South", 0,
+			[][2]int{{c, c - far}, {c, c + far}}, [][2]int{{c - far, c}, {c + far, c}}, "vertical"},
+		{"PA 90: long axis East-West", 90,
+			[][2]int{{c - far, c}, {c + far, c}}, [][2]int{{c, c - far}, {c, c + far}}, "horizontal"},
+		{"PA 45: long axis North-East to South-West", 45,
+			[][2]int{{c - diag, c - diag}, {c + diag, c + diag}}, [][2]int{{c + diag, c - diag}, {c - diag, c + diag}}, "NE-SW"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			img := renderEllipse(tc.pa)
+			if !occulted(img, c, c) {
+				t.Fatal("the ellipse center is not occulted")
+			}
+			for _, p := range tc.inside {
+				if !occulted(img, p[0], p[1]) {
+					t.Errorf("pixel (%d, %d) should be inside the %s ellipse", p[0], p[1], tc.longAxis)
+				}
+			}
+			for _, p := range tc.outside {
+				if occulted(img, p[0], p[1]) {
+					t.Errorf("pixel (%d, %d) should be outside the %s ellipse", p[0], p[1], tc.longAxis)
+				}
+			}
+		})
+	}
+}
+
+// renderShapes draws the ellipses of event on a fresh 20 km, 101 point plane (occulter mode) and
+// returns the image.
+func renderShapes(event OccultationEvent) *image.Gray {
+	const n = 101
+	event.FundamentalPlaneWidthKm = 20
+	event.FundamentalPlaneWidthPoints = n
+	event.FplaneImage = image.NewGray(image.Rect(0, 0, n, n))
+	FillFplane(event.FplaneImage, true)
+	AddEllipses(event, true)
+	return event.FplaneImage
+}
+
+// shadowStats returns the number of occulted pixels of img, their centroid in displayed (x, y)
+// pixels, and a checksum of all the pixel values.
+func shadowStats(img *image.Gray) (count int, cx, cy float64, checksum string) {
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			if occulted(img, x, y) {
+				count++
+				cx += float64(x)
+				cy += float64(y)
+			}
+		}
+	}
+	if count > 0 {
+		cx /= float64(count)
+		cy /= float64(count)
+	}
+	return count, cx, cy, fmt.Sprintf("%x", sha256.Sum256(img.Pix))
+}
+
+func TestGeometricShadowKnownShapes(t *testing.T) {
+	const kmPerPixel = 0.2 // 20 km over 100 intervals
+
+	tests := []struct {
+		name     string
+		event    OccultationEvent
+		area     float64 // km^2
+		cx, cy   float64 // Expected centroid (displayed pixels)
+		inside   [][2]int
+		outside  [][2]int
+		checksum string
+	}{
+		{"centered circle",
+			OccultationEvent{MainBodyGiven: true, MainbodyMajorAxisKm: 8, MainbodyMinorAxisKm: 8},
+			math.Pi * 4 * 4, 50, 50,
+			[][2]int{{50, 50}, {50, 31}, {69, 50}}, [][2]int{{50, 29}, {71, 50}, {66, 66}},
+			"ea17793a69cf254bf22d0b838e2a88ec2021b0ebd2dc8ad115c79d4527ba90c9"},
+		// x_center_km is to the right (+20 pixels) and y_center_km up (-10 pixels)
+		{"off-center ellipse at PA 45",
+			OccultationEvent{MainBodyGiven: true, MainBodyXCenterKm: 4, MainBodyYCenterKm: 2,
+				MainbodyMajorAxisKm: 10, MainbodyMinorAxisKm: 4, MainbodyMajorAxisPaDegrees: 45},
+			math.Pi * 5 * 2, 70, 40,
+			[][2]int{{70, 40}, {60, 30}, {80, 50}}, [][2]int{{50, 50}, {80, 30}, {60, 50}},
+			"72b2c925df00436c7de5960cea3ff7ad6c8b3f6efebfd29dce475f4ecbb3aa9b"},
+		{"main body and satellite",
+			OccultationEvent{MainBodyGiven: true, MainBodyXCenterKm: -4, MainbodyMajorAxisKm: 6, MainbodyMinorAxisKm: 6,
+				SatelliteGiven: true, SatelliteXCenterKm: 5, SatelliteYCenterKm: -5, SatelliteMajorAxisKm: 2, SatelliteMinorAxisKm: 2},
+			math.Pi*3*3 + math.Pi*1*1, (30*9 + 75*1) / 10.0, (50*9 + 75*1) / 10.0, // Centroid weighted by area
+			[][2]int{{30, 50}, {75, 75}}, [][2]int{{50, 50}, {75, 25}, {25, 75}},
+			"4dabaa429d15edebb00e3e133d190cbd87d83dcde2c5d65af8b17e0400aad60e"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			img := renderShapes(tc.event)
+			count, cx, cy, checksum := shadowStats(img)
+
+			wantCount := tc.area / (kmPerPixel * kmPerPixel)
+			if math.Abs(float64(count)-wantCount) > 0.01*wantCount {
+				t.Errorf("%d pixels are occulted, want about %0.0f", count, wantCount)
+			}
+			if math.Abs(cx-tc.cx) > 0.5 || math.Abs(cy-tc.cy) > 0.5 {
+				t.Errorf("the occulted pixels are centered on (%0.2f, %0.2f), want (%g, %g)", cx, cy, tc.cx, tc.cy)
+			}
+			for _, p := range tc.inside {
+				if !occulted(img, p[0], p[1]) {
+					t.Errorf("pixel (%d, %d) should be occulted", p[0], p[1])
+				}
+			}
+			for _, p := range tc.outside {
+				if occulted(img, p[0], p[1]) {
+					t.Errorf("pixel (%d, %d) should not be occulted", p[0], p[1])
+				}
+			}
+			for _, v := range img.Pix {
+				if v != 0 && v != 255 {
+					t.Fatalf("found the gray level %d: the shapes should be 0 on a 255 background", v)
+				}
+			}
+
+			// The checksum pins every pixel: update it only for a deliberate change of the drawing
+			if checksum != tc.checksum {
+				t.Errorf("the shadow checksum is %s, want %s", checksum, tc.checksum)
+			}
+		})
+	}
+}
+
+func TestAddEllipsesApertureFill(t *testing.T) {
+	const n = 21
+	event := OccultationEvent{
+		FundamentalPlaneWidthKm:     20,
+		FundamentalPlaneWidthPoints: n,
+		MainBodyGiven:               true,
+		MainbodyMajorAxisKm:         6,
+		MainbodyMinorAxisKm:         6,
+		FplaneImage:                 image.NewGray(image.Rect(0, 0, n, n)),
+	}
+	FillFplane(event.FplaneImage, false)
+	AddEllipses(event, false)
+	if got := event.FplaneImage.GrayAt(10, 10).Y; got != 255 {
+		t.Errorf("the aperture center is %d, want 255", got)
+	}
+	if got := event.FplaneImage.GrayAt(0, 0).Y; got != 0 {
+		t.Errorf("the background is %d, want 0", got)
+	}
+}
+
+func TestAddEllipsesOpacity(t *testing.T) {
+	const n = 21
+	event := OccultationEvent{
+		FundamentalPlaneWidthKm:     20,
+		FundamentalPlaneWidthPoints: n,
+		MainBodyGiven:               true,
+		MainbodyMajorAxisKm:         6,
+		MainbodyMinorAxisKm:         6,
+		MainbodyOpacity:             0.5,
+		SatelliteGiven:              true,
+		SatelliteXCenterKm:          -6,
+		SatelliteMajorAxisKm:        2,
+		SatelliteMinorAxisKm:        2,
+		FplaneImage:                 image.NewGray(image.Rect(0, 0, n, n)),
+	}
+	if !hasPartialOpacity(event) {
+		t.Errorf("a main body opacity of 0.5 should need a graded source plane")
+	}
+	FillFplane(event.FplaneImage, true)
+	AddEllipses(event, true)
+	if got := event.FplaneImage.GrayAt(10, 10).Y; got != 128 {
+		t.Errorf("the main body center is %d, want 255 * (1 - 0.5) = 128", got)
+	}
+	// The satellite has no opacity set, so it is opaque
+	if got := event.FplaneImage.GrayAt(4, 10).Y; got != 0 {
+		t.Errorf("the satellite center is %d, want 0", got)
+	}
+
+	event.MainbodyOpacity = 1.0
+	if hasPartialOpacity(event) {
+		t.Errorf("opaque bodies should not need a graded source plane")
+	}
+}
+
+// TestFundamentalPlaneCoordinateConvention is the executable statement of how fundamental plane
+// kilometers map to image pixels. The comments in generalizedEllipseCoordinates and AddEllipses speak
+// of x positive to the left, but that describes their internal variables: after AddEllipses negates
+// the centers and swaps row and column, the net transform for an N point plane W km wide is
+//
+//	col = (N-1)/2 + x_km * (N-1)/W    (x_center_km > 0 is right of center)
+//	row = (N-1)/2 - y_km * (N-1)/W    (y_center_km > 0 is above center)
+//
+// The image, GeometricMatrix, IntensityMatrix and ObservationPath all use that (col, row), indexed
+// as matrix[row][col] and sampled at (x = col, y = row). The shadow velocity is in image directions:
+// dX > 0 moves the path toward larger col, and dY > 0 toward larger row, i.e. toward negative y_km.
+func TestFundamentalPlaneCoordinateConvention(t *testing.T) {
+	const n = 101
+	const widthKm = 10.0
+	center := float64(n-1) / 2
+	pixelsPerKm := float64(n-1) / widthKm
+
+	for _, c := range [][2]float64{{3, 0}, {-3, 0}, {0, 2}, {0, -2}, {2.5, -1.5}} {
+		event := OccultationEvent{FundamentalPlaneWidthKm: widthKm, FundamentalPlaneWidthPoints: n,
+			MainBodyGiven: true, MainBodyXCenterKm: c[0], MainBodyYCenterKm: c[1],
+			MainbodyMajorAxisKm: 0.35, MainbodyMinorAxisKm: 0.35, FplaneImage: image.NewGray(image.Rect(0, 0, n, n))}
+		FillFplane(event.FplaneImage, true)
+		AddEllipses(event, true)
+		geometric := ConvertSourcePlaneImageToMatrix(event.FplaneImage)
+
+		var sumCol, sumRow, count float64
+		for row := range geometric {
+			for col, v := range geometric[row] {
+				if v == 1.0 {
+					sumCol += float64(col)
+					sumRow += float64(row)
+					count++
+				}
+			}
+		}
+		if count == 0 {
+			t.Fatalf("body at (%g, %g) km was not drawn", c[0], c[1])
+		}
+		wantCol := center + c[0]*pixelsPerKm
+		wantRow := center - c[1]*pixelsPerKm
+		if math.Abs(sumCol/count-wantCol) > 0.25 || math.Abs(sumRow/count-wantRow) > 0.25 {
+			t.Errorf("body at (x, y) = (%g, %g) km is at (col, row) = (%0.2f, %0.2f), want (%0.2f, %0.2f)",
+				c[0], c[1], sumCol/count, sumRow/count, wantCol, wantRow)
+		}
+	}
+
+	for _, v := range [][2]float64{{5, 0}, {0, 5}} {
+		event := OccultationEvent{DxKmPerSec: v[0], DyKmPerSec: v[1], FundamentalPlaneWidthKm: widthKm,
+			FundamentalPlaneWidthPoints: n, PathAngleDegrees: math.Atan2(-v[0], -v[1]) * 180.0 / math.Pi}
+		if _, _, _, err := processPathDirection(n, AnnotatedPoint{}, AnnotatedPoint{}, &event); err != nil {
+			t.Fatal(err)
+		}
+		dCol, dRow := event.PathEnd[0]-event.PathStart[0], event.PathEnd[1]-event.PathStart[1]
+		if (v[0] > 0 && dCol <= 0) || (v[1] > 0 && dRow <= 0) {
+			t.Errorf("velocity (dX, dY) = %v runs from %v to %v in (col, row)", v, event.PathStart, event.PathEnd)
+		}
+	}
+}
@@ -16,11 +16,23 @@ func MatMulSquareComplex(A, B []complex128, n int) ([]complex128, error) {
 	if n <= 0 {
 		return nil, fmt.Errorf("n must be > 0")
 	}
-	if len(A) != n*n || len(B) != n*n {
-		return nil, fmt.Errorf("A and B must have length n*n")
+	C := make([]complex128, n*n)
+	if err := MatMulSquareComplexInto(C, A, B, n); err != nil {
+		return nil, err
 	}
+	return C, nil
+}
 
-	C := make([]complex128, n*n)
+// MatMulSquareComplexInto is MatMulSquareComplex writing A @ B into the caller's C (length n*n,
+// which must not overlap A or B), so that the buffer can be reused.
+func MatMulSquareComplexInto(C, A, B []complex128, n int) error {
+	if n <= 0 {
+		return fmt.Errorf("n must be > 0")
+	}
+	if len(A) != n*n || len(B) != n*n || len(C) != n*n {
+		return fmt.Errorf("A, B and C must have length n*n")
+	}
+	clear(C)
 
 	// Tune these if you benchmark:
 	// - block controls cache behavior
@@ -85,7 +97,7 @@ func MatMulSquareComplex(A, B []complex128, n int) ([]complex128, error) {
 	close(tasks)
 	wg.Wait()
 
-	return C, nil
+	return nil
 }
 
 //func min(a, b int) int {
@@ -8,69 +8,272 @@ import (
 	"image/draw"
 	"image/png"
 	"math"
+	"math/cmplx"
 	"math/rand"
 	"os"
 	"sort"
+
+	"github.com/bob-anderson-ok/IOTAdiffraction/lightcurve"
 )
 
-func interpolate(matrix [][]float64, x, y float64) float64 {
-	n := len(matrix)
-	if n == 0 {
-		return 0
+func addScaledComplexInPlace(a []complex128, b []complex128, scaleB float64) {
+	if len(a) != len(b) {
+		panic("vector lengths don't match")
 	}
 
-	// Clamp to valid range (that is, at the edges of matrix
-	if x < 0 {
-		x = 0
+	for i := range a {
+		a[i] = a[i] + complex(scaleB, 0)*b[i]
 	}
-	if y < 0 {
-		y = 0
+}
+
+func scaleComplex(v []complex128, scale float64) {
+	s := complex(scale, 0)
+	for i := range v {
+		v[i] *= s
+	}
+}
+
+// ApplyMagDrop reduces the depth of the occultation in m (in place) to the given percent of the
+// full drop, so that the deepest shadow is never fully black:
+//
+//	v' = v*s + baseline*(1 - s)    where s = percent/100
+//
+// baseline is the unocculted intensity level, estimated as the median of the outermost ring of
+// pixels (normally 1.0, but star smoothing and edge padding can alter it slightly). If the
+// estimate is not usable, 1.0 is assumed. percent values above 100 are clamped to 100 and
+// values <= 0 leave m unchanged (a full drop). Returns the percent actually applied.
+func ApplyMagDrop(m [][]float64, percent float64) float64 {
+	if percent <= 0 || math.IsNaN(percent) {
+		return 100.0
 	}
-	if x >= float64(n-1) {
-		x = float64(n-1) - 1e-9
+	if percent > 100 {
+		percent = 100.0
 	}
-	if y >= float64(n-1) {
-		y = float64(n-1) - 1e-9
+	if len(m) == 0 || len(m[0]) == 0 {
+		return percent
 	}
 
-	// Integer indices
-	x0 := int(x)
-	y0 := int(y)
-	x1 := x0 + 1
-	y1 := y0 + 1
+	baseline := magDropBaseline(m)
+	scaleFactor := percent / 100.0
+	shiftUp := baseline * (1.0 - scaleFactor)
+	for row := 0; row < len(m); row++ {
+		for col := 0; col < len(m[row]); col++ {
+			m[row][col] *= scaleFactor
+			m[row][col] += shiftUp
+		}
+	}
+	return percent
+}
 
-	// Fractional parts
-	xFrac := x - float64(x0)
-	yFrac := y - float64(y0)
+// magDropBaseline estimates the unocculted intensity of m as the median of its border pixels.
+func magDropBaseline(m [][]float64) float64 {
+	h := len(m)
+	w := len(m[0])
+	var border []float64
+	for row := 0; row < h; row++ {
+		for col := 0; col < len(m[row]); col++ {
+			if row == 0 || row == h-1 || col == 0 || col == w-1 {
+				v := m[row][col]
+				if !math.IsNaN(v) && !math.IsInf(v, 0) {
+					border = append(border, v)
+				}
+			}
+		}
+	}
+	if len(border) == 0 {
+		return 1.0
+	}
+	sort.Float64s(border)
+	baseline := border[len(border)/2]
+	if len(border)%2 == 0 {
+		baseline = (border[len(border)/2-1] + border[len(border)/2]) / 2
+	}
+	if baseline <= 0 {
+		return 1.0
+	}
+	return baseline
+}
 
-	// Four surrounding values
-	v00 := matrix[y0][x0]
-	v01 := matrix[y0][x1]
-	v10 := matrix[y1][x0]
-	v11 := matrix[y1][x1]
+// SubtractMatrices returns a - b element by element. The matrices must have the same dimensions.
+func SubtractMatrices(a, b [][]float64) ([][]float64, error) {
+	h, w, err := rectSize(a)
+	if err != nil {
+		return nil, err
+	}
+	hb, wb, err := rectSize(b)
+	if err != nil {
+		return nil, err
+	}
+	if h != hb || w != wb {
+		return nil, fmt.Errorf("size mismatch: %dx%d vs %dx%d", h, w, hb, wb)
+	}
 
-	// Bilinear interpolation
-	v0 := v00*(1-xFrac) + v01*xFrac
-	v1 := v10*(1-xFrac) + v11*xFrac
+	diff := make([][]float64, h)
+	for row := 0; row < h; row++ {
+		diff[row] = make([]float64, w)
+		for col := 0; col < w; col++ {
+			diff[row][col] = a[row][col] - b[row][col]
+		}
+	}
+	return diff, nil
+}
 
-	return v0*(1-yFrac) + v1*yFrac
+// AddMatrices returns a + scaleB*b element by element. The matrices must have the same dimensions.
+func AddMatrices(a, b [][]float64, scaleB float64) ([][]float64, error) {
+	h, w, err := rectSize(a)
+	if err != nil {
+		return nil, err
+	}
+	hb, wb, err := rectSize(b)
+	if err != nil {
+		return nil, err
+	}
+	if h != hb || w != wb {
+		return nil, fmt.Errorf("size mismatch: %dx%d vs %dx%d", h, w, hb, wb)
+	}
+
+	sum := make([][]float64, h)
+	for row := 0; row < h; row++ {
+		sum[row] = make([]float64, w)
+		for col := 0; col < w; col++ {
+			sum[row][col] = a[row][col] + scaleB*b[row][col]
+		}
+	}
+	return sum, nil
 }
 
-func addScaledComplexInPlace(a []complex128, b []complex128, scaleB float64) {
-	if len(a) != len(b) {
-		panic("vector lengths don't match")
+// ShiftMatrix returns a copy of m moved dRow rows down and dCol columns right. Fractional shifts
+// are bilinearly interpolated and the edge values are replicated into the uncovered margin.
+func ShiftMatrix(m [][]float64, dRow, dCol float64) ([][]float64, error) {
+	h, w, err := rectSize(m)
+	if err != nil {
+		return nil, err
 	}
 
-	for i := range a {
-		a[i] = a[i] + complex(scaleB, 0)*b[i]
+	out := make([][]float64, h)
+	for row := 0; row < h; row++ {
+		out[row] = make([]float64, w)
+		for col := 0; col < w; col++ {
+			out[row][col] = BilinearSample(m, float64(row)-dRow, float64(col)-dCol)
+		}
 	}
+	return out, nil
 }
 
-func scaleComplex(v []complex128, scale float64) {
-	s := complex(scale, 0)
-	for i := range v {
-		v[i] *= s
+// BilinearSample returns m at the fractional position (row, col), interpolated between the four
+// nearest elements. Positions beyond the edges take the edge values.
+func BilinearSample(m [][]float64, row, col float64) float64 {
+	row0 := int(math.Floor(row))
+	col0 := int(math.Floor(col))
+	fRow := row - float64(row0)
+	fCol := col - float64(col0)
+	return (1-fRow)*(1-fCol)*sample2D(m, row0, col0, PadReplicate) +
+		(1-fRow)*fCol*sample2D(m, row0, col0+1, PadReplicate) +
+		fRow*(1-fCol)*sample2D(m, row0+1, col0, PadReplicate) +
+		fRow*fCol*sample2D(m, row0+1, col0+1, PadReplicate)
+}
+
+// SubtractOffsetClamped returns a copy of m with offset subtracted from every element, and with
+// negative results set to zero. m itself is not changed.
+func SubtractOffsetClamped(m [][]float64, offset float64) [][]float64 {
+	out := make([][]float64, len(m))
+	for row := range m {
+		out[row] = make([]float64, len(m[row]))
+		for col, v := range m[row] {
+			out[row][col] = math.Max(v-offset, 0.0)
+		}
+	}
+	return out
+}
+
+// RebinMatrix returns m reduced in size by factor in both dimensions, each element the average of
+// a factor x factor block. Both dimensions of m must be multiples of factor. It lets a high
+// resolution result be compared with a coarse one by CompareMatrices. For two planes of the same
+// width the block centers are within half a coarse pixel of the coarse pixel centers (the pixels
+// of either plane span the full width), so the comparison is only approximate where the intensity
+// changes quickly.
+func RebinMatrix(m [][]float64, factor int) ([][]float64, error) {
+	h, w, err := rectSize(m)
+	if err != nil {
+		return nil, err
+	}
+	if factor < 1 {
+		return nil, fmt.Errorf("rebin factor %d is less than 1", factor)
+	}
+	if h%factor != 0 || w%factor != 0 {
+		return nil, fmt.Errorf("%dx%d matrix is not a multiple of the rebin factor %d", h, w, factor)
+	}
+
+	blockArea := float64(factor * factor)
+	rebinned := make([][]float64, h/factor)
+	for row := range rebinned {
+		rebinned[row] = make([]float64, w/factor)
+		for col := range rebinned[row] {
+			sum := 0.0
+			for i := 0; i < factor; i++ {
+				for j := 0; j < factor; j++ {
+					sum += m[row*factor+i][col*factor+j]
+				}
+			}
+			rebinned[row][col] = sum / blockArea
+		}
+	}
+	return rebinned, nil
+}
+
+// Asymmetry returns the root-mean-square difference between m and m rotated by 180 degrees about
+// the fractional position (row, col). Only elements whose rotated position lies inside m are
+// compared, interpolating between the four nearest elements. A pattern with point symmetry about
+// (row, col), such as the shadow of a lone ellipse centered there, gives 0.
+func Asymmetry(m [][]float64, row, col float64) (float64, error) {
+	h, w, err := rectSize(m)
+	if err != nil {
+		return 0, err
+	}
+	sumSq, count := 0.0, 0
+	for r := 0; r < h; r++ {
+		rotatedRow := 2*row - float64(r)
+		if rotatedRow < 0 || rotatedRow > float64(h-1) {
+			continue
+		}
+		for c := 0; c < w; c++ {
+			rotatedCol := 2*col - float64(c)
+			if rotatedCol < 0 || rotatedCol > float64(w-1) {
+				continue
+			}
+			d := m[r][c] - BilinearSample(m, rotatedRow, rotatedCol)
+			sumSq += d * d
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("the center (%g, %g) is outside the %dx%d matrix", row, col, h, w)
+	}
+	return math.Sqrt(sumSq / float64(count)), nil
+}
+
+// CompareMatrices reports the maximum absolute difference and the root-mean-square difference
+// between a and b. It is intended for signing off numerical changes to the diffraction engine.
+func CompareMatrices(a, b [][]float64) (maxAbs, rmse float64, err error) {
+	diff, err := SubtractMatrices(a, b)
+	if err != nil {
+		return 0, 0, err
 	}
+	if len(diff) == 0 || len(diff[0]) == 0 {
+		return 0, 0, errors.New("empty matrix")
+	}
+
+	sumSq := 0.0
+	for row := range diff {
+		for _, d := range diff[row] {
+			if math.Abs(d) > maxAbs {
+				maxAbs = math.Abs(d)
+			}
+			sumSq += d * d
+		}
+	}
+	rmse = math.Sqrt(sumSq / float64(len(diff)*len(diff[0])))
+	return maxAbs, rmse, nil
 }
 
 // -------------------- I/O --------------------
@@ -87,17 +290,43 @@ func scaleComplex(v []complex128, scale float64) {
 // MatrixToGray16Data -------------------- Data PNG (Gray16, fixed physical scaling) --------------------
 // Mapping: Y16 = round(v * scale), clamped to [0, 65535]
 func MatrixToGray16Data(m [][]float64, scale float64) (*image.Gray16, error) {
+	img, _, err := MatrixToGray16DataClamped(m, scale, 0.0)
+	return img, err
+}
+
+// Gray16ClampCounts reports how many pixels MatrixToGray16DataClamped could not store as is.
+type Gray16ClampCounts struct {
+	Low     int // Below the floor (this includes negative values)
+	High    int // Above 65535 / scale
+	Invalid int // NaN or Inf, written as 0
+}
+
+// Total returns the number of clamped pixels.
+func (c Gray16ClampCounts) Total() int {
+	return c.Low + c.High + c.Invalid
+}
+
+// MatrixToGray16DataClamped is MatrixToGray16Data with a floor: Y16 = round(v * scale), clamped to
+// [round(floor * scale), 65535]. A nonzero floor makes the deepest shadow a known nonzero value (for
+// later log display, for example). NaN and Inf are always written as 0 so that they stay
+// distinguishable. The counts of clamped pixels are returned so that the caller can warn about them.
+func MatrixToGray16DataClamped(m [][]float64, scale, floor float64) (*image.Gray16, Gray16ClampCounts, error) {
+	var counts Gray16ClampCounts
 	if len(m) == 0 || len(m[0]) == 0 {
-		return nil, errors.New("empty matrix")
+		return nil, counts, errors.New("empty matrix")
 	}
 	if scale <= 0 {
-		return nil, errors.New("scale must be > 0")
+		return nil, counts, errors.New("scale must be > 0")
+	}
+	floorY16 := math.Round(floor * scale)
+	if floorY16 < 0 || floorY16 > 65535 {
+		return nil, counts, fmt.Errorf("floor %g is outside the range 0 to %g", floor, 65535/scale)
 	}
 	h := len(m)
 	w := len(m[0])
 	for y := 1; y < h; y++ {
 		if len(m[y]) != w {
-			return nil, errors.New("ragged matrix")
+			return nil, counts, errors.New("ragged matrix")
 		}
 	}
 
@@ -110,14 +339,17 @@ func MatrixToGray16Data(m [][]float64, scale float64) (*image.Gray16, error) {
 				// write 0
 				i := row + 2*x
 				img.Pix[i], img.Pix[i+1] = 0, 0
+				counts.Invalid++
 				continue
 			}
 
 			u := math.Round(v * scale)
-			if u < 0 {
-				u = 0
+			if u < floorY16 {
+				u = floorY16
+				counts.Low++
 			} else if u > 65535 {
 				u = 65535
+				counts.High++
 			}
 			y16 := uint16(u)
 
@@ -127,7 +359,7 @@ func MatrixToGray16Data(m [][]float64, scale float64) (*image.Gray16, error) {
 			img.Pix[i+1] = uint8(y16)
 		}
 	}
-	return img, nil
+	return img, counts, nil
 }
 
 // MatrixToGrayViewPercentile -------------------- View PNG (Gray8, auto-stretch) --------------------
@@ -138,18 +370,58 @@ func MatrixToGray16Data(m [][]float64, scale float64) (*image.Gray16, error) {
 //
 // This implements percentile stretch: map pLow to pHigh to 0..255 and clamp.
 func MatrixToGrayViewPercentile(m [][]float64, pLow, pHigh float64) (*image.Gray, error) {
+	lo, hi, err := percentileStretchLimits(m, pLow, pHigh)
+	if err != nil {
+		return nil, err
+	}
+
+	h := len(m)
+	w := len(m[0])
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row := y * img.Stride
+		for x := 0; x < w; x++ {
+			img.Pix[row+x] = uint8(math.Round(stretchValue(m[y][x], lo, hi) * 255.0))
+		}
+	}
+	return img, nil
+}
+
+// MatrixToGray16ViewPercentile is MatrixToGrayViewPercentile with 16-bit output: the same percentile
+// stretch is mapped to 0..65535. It is a display image for high bit depth monitors or later tone
+// mapping, not a linear physical product like MatrixToGray16Data.
+func MatrixToGray16ViewPercentile(m [][]float64, pLow, pHigh float64) (*image.Gray16, error) {
+	lo, hi, err := percentileStretchLimits(m, pLow, pHigh)
+	if err != nil {
+		return nil, err
+	}
+
+	h := len(m)
+	w := len(m[0])
+	img := image.NewGray16(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetGray16(x, y, color.Gray16{Y: uint16(math.Round(stretchValue(m[y][x], lo, hi) * 65535.0))})
+		}
+	}
+	return img, nil
+}
+
+// percentileStretchLimits returns the values at the pLow and pHigh percentiles of the finite
+// elements of m, which a display stretch maps to black and white.
+func percentileStretchLimits(m [][]float64, pLow, pHigh float64) (lo, hi float64, err error) {
 	if len(m) == 0 || len(m[0]) == 0 {
-		return nil, errors.New("empty matrix")
+		return 0, 0, errors.New("empty matrix")
 	}
 	h := len(m)
 	w := len(m[0])
 	for y := 1; y < h; y++ {
 		if len(m[y]) != w {
-			return nil, errors.New("ragged matrix")
+			return 0, 0, errors.New("ragged matrix")
 		}
 	}
 	if !(0 <= pLow && pLow < pHigh && pHigh <= 100) {
-		return nil, errors.New("percentiles must satisfy 0 <= p Low < pHigh <= 100")
+		return 0, 0, errors.New("percentiles must satisfy 0 <= p Low < pHigh <= 100")
 	}
 
 	// Collect finite values for percentile computation
@@ -163,7 +435,7 @@ func MatrixToGrayViewPercentile(m [][]float64, pLow, pHigh float64) (*image.Gray
 		}
 	}
 	if len(vals) == 0 {
-		return nil, errors.New("matrix has no finite values")
+		return 0, 0, errors.New("matrix has no finite values")
 	}
 
 	sort.Float64s(vals)
@@ -185,31 +457,64 @@ func MatrixToGrayViewPercentile(m [][]float64, pLow, pHigh float64) (*image.Gray
 		return vals[i]*(1-f) + vals[i+1]*f
 	}
 
-	lo := percentile(pLow)
-	hi := percentile(pHigh)
+	lo = percentile(pLow)
+	hi = percentile(pHigh)
 	if hi == lo {
 		hi = lo + 1 // avoid divide-by-zero; image becomes mostly constant
 	}
+	return lo, hi, nil
+}
 
-	img := image.NewGray(image.Rect(0, 0, w, h))
-	for y := 0; y < h; y++ {
-		row := y * img.Stride
-		for x := 0; x < w; x++ {
-			v := m[y][x]
-			if math.IsNaN(v) || math.IsInf(v, 0) {
-				img.Pix[row+x] = 0
-				continue
-			}
-			t := (v - lo) / (hi - lo) // normalize
-			if t < 0 {
-				t = 0
-			} else if t > 1 {
-				t = 1
-			}
-			img.Pix[row+x] = uint8(math.Round(t * 255.0))
-		}
+// stretchValue maps v linearly from lo..hi to 0..1, clamping outside that range. NaN and Inf map to 0.
+func stretchValue(v, lo, hi float64) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0
 	}
-	return img, nil
+	t := (v - lo) / (hi - lo) // normalize
+	if t < 0 {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+	return t
+}
+
+// SaveEFieldImages writes the amplitude and phase of a flattened (row-major) npts x npts complex
+// e-field as two 16-bit PNGs. The amplitude uses the same scale (4000) as targetImage16bit.png.
+// The phase (radians, -pi..pi) is stored as (phase + pi) * 65535 / 2pi.
+func SaveEFieldImages(field []complex128, npts int, amplitudeFilename, phaseFilename string) error {
+	if len(field) != npts*npts {
+		return fmt.Errorf("size mismatch: have %d, want %d", len(field), npts*npts)
+	}
+	amplitude := make([]float64, len(field))
+	phase := make([]float64, len(field))
+	for i, v := range field {
+		amplitude[i] = cmplx.Abs(v)
+		phase[i] = cmplx.Phase(v) + math.Pi
+	}
+
+	amplitudeMatrix, err := Reshape1DTo2D(amplitude, npts, npts)
+	if err != nil {
+		return err
+	}
+	amplitudeImage, err := MatrixToGray16Data(amplitudeMatrix, 4000)
+	if err != nil {
+		return err
+	}
+	err = SaveGray16PNG(amplitudeFilename, amplitudeImage)
+	if err != nil {
+		return err
+	}
+
+	phaseMatrix, err := Reshape1DTo2D(phase, npts, npts)
+	if err != nil {
+		return err
+	}
+	phaseImage, err := MatrixToGray16Data(phaseMatrix, 65535/(2*math.Pi))
+	if err != nil {
+		return err
+	}
+	return SaveGray16PNG(phaseFilename, phaseImage)
 }
 
 func SaveGrayPNG(filename string, img *image.Gray) error {
@@ -265,6 +570,66 @@ func ConvertSourcePlaneImageToComplex(img *image.Gray) [][]complex128 {
 	return m
 }
 
+// ConvertSourcePlaneImageToComplexGraded is like ConvertSourcePlaneImageToComplex but keeps the
+// gray levels: the aperture amplitude is 1 - Y/255, so a graded (atmosphere) edge drawn by
+// AddAtmosphere becomes a partially transmitting aperture edge.
+func ConvertSourcePlaneImageToComplexGraded(img *image.Gray) [][]complex128 {
+	m := make([][]complex128, img.Bounds().Dy())
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		m[y] = make([]complex128, img.Bounds().Dx())
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			m[y][x] = complex(1.0-float64(img.GrayAt(x, y).Y)/255.0, 0.0)
+		}
+	}
+	return m
+}
+
+// hasTransparency reports whether any pixel of img is not fully opaque.
+func hasTransparency(img image.Image) bool {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// opacityToGray converts an image with transparency to the black (occulter) on white (sky)
+// convention of the fundamental plane image: Y = 255 * (1 - opacity), so that
+// ConvertSourcePlaneImageToComplexGraded turns the opacity into the aperture amplitude.
+func opacityToGray(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			_, _, _, a := img.At(x, y).RGBA()
+			gray.SetGray(x-bounds.Min.X, y-bounds.Min.Y, color.Gray{Y: 255 - uint8(a>>8)})
+		}
+	}
+	return gray
+}
+
+// opacityToGrayLevel converts an occulter opacity (0 sky to 1 solid, clamped to that range) to
+// the gray level of the fundamental plane image, which is black (0) for a solid occulter.
+func opacityToGrayLevel(opacity float64) uint8 {
+	return uint8(math.Round(255.0 * (1.0 - math.Max(0.0, math.Min(1.0, opacity)))))
+}
+
+// opacityMatrixToGray converts a source plane loaded from a .npy file to the black (occulter) on
+// white (sky) fundamental plane image, using the magnitude of each value as the occulter opacity.
+func opacityMatrixToGray(m [][]complex128) *image.Gray {
+	gray := image.NewGray(image.Rect(0, 0, len(m[0]), len(m)))
+	for y, row := range m {
+		for x, v := range row {
+			gray.SetGray(x, y, color.Gray{Y: opacityToGrayLevel(cmplx.Abs(v))})
+		}
+	}
+	return gray
+}
+
 func ConvertSourcePlaneImageToMatrix(img *image.Gray) [][]float64 {
 	m := make([][]float64, img.Bounds().Dy())
 	for y := 0; y < img.Bounds().Dy(); y++ {
@@ -280,6 +645,135 @@ func ConvertSourcePlaneImageToMatrix(img *image.Gray) [][]float64 {
 	return m
 }
 
+// sourcePlaneCoverage counts the pixels of a black on white source plane image that are fully
+// opaque (0) and the pixels that block any light at all (below 255, which includes graded edges).
+func sourcePlaneCoverage(img *image.Gray) (opaque, blocking, total int) {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			switch v := img.GrayAt(x, y).Y; {
+			case v == 0:
+				opaque++
+				blocking++
+			case v < 255:
+				blocking++
+			}
+		}
+	}
+	return opaque, blocking, bounds.Dx() * bounds.Dy()
+}
+
+// RotateGrayImage returns img rotated by angleDegrees (counter-clockwise as displayed) about its
+// center, using bilinear resampling. Pixels that come from outside img are set to fill. If
+// threshold is true the result is made two-level again (< 128 becomes 0, the rest 255) so that a
+// black on white shadow stays black on white.
+func RotateGrayImage(img *image.Gray, angleDegrees float64, fill uint8, threshold bool) *image.Gray {
+	bounds := img.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+	out := image.NewGray(image.Rect(0, 0, w, h))
+
+	cx := float64(w-1) / 2.0
+	cy := float64(h-1) / 2.0
+	angle := angleDegrees * math.Pi / 180.0
+	cosA := math.Cos(angle)
+	sinA := math.Sin(angle)
+
+	valueAt := func(x, y int) float64 {
+		if x < 0 || x >= w || y < 0 || y >= h {
+			return float64(fill)
+		}
+		return float64(img.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y)
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// Inverse mapping: find where this output pixel comes from in the source image.
+			// With y pointing down, a counter-clockwise (as displayed) rotation is clockwise in x,y.
+			dx := float64(x) - cx
+			dy := float64(y) - cy
+			srcX := cx + dx*cosA - dy*sinA
+			srcY := cy + dx*sinA + dy*cosA
+
+			x0 := int(math.Floor(srcX))
+			y0 := int(math.Floor(srcY))
+			xFrac := srcX - float64(x0)
+			yFrac := srcY - float64(y0)
+
+			v0 := valueAt(x0, y0)*(1-xFrac) + valueAt(x0+1, y0)*xFrac
+			v1 := valueAt(x0, y0+1)*(1-xFrac) + valueAt(x0+1, y0+1)*xFrac
+			v := v0*(1-yFrac) + v1*yFrac
+
+			if threshold {
+				if v < 128 {
+					v = 0
+				} else {
+					v = 255
+				}
+			}
+			out.SetGray(x, y, color.Gray{Y: uint8(math.Round(v))})
+		}
+	}
+	return out
+}
+
+// FlipGrayImage returns a mirrored copy of img. horizontal swaps left and right (E-W) and
+// vertical swaps top and bottom (N-S).
+func FlipGrayImage(img *image.Gray, horizontal, vertical bool) *image.Gray {
+	bounds := img.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+	out := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			srcX, srcY := x, y
+			if horizontal {
+				srcX = w - 1 - x
+			}
+			if vertical {
+				srcY = h - 1 - y
+			}
+			out.SetGray(x, y, img.GrayAt(bounds.Min.X+srcX, bounds.Min.Y+srcY))
+		}
+	}
+	return out
+}
+
+// FlipMatrix returns a mirrored copy of m in the same way as FlipGrayImage (m[row][col] is
+// displayed at y = row, x = col). Flipping twice restores the original.
+func FlipMatrix(m [][]float64, horizontal, vertical bool) [][]float64 {
+	rows := len(m)
+	out := make([][]float64, rows)
+	for row := range out {
+		srcRow := row
+		if vertical {
+			srcRow = rows - 1 - row
+		}
+		cols := len(m[srcRow])
+		out[row] = make([]float64, cols)
+		for col := range out[row] {
+			if horizontal {
+				out[row][col] = m[srcRow][cols-1-col]
+			} else {
+				out[row][col] = m[srcRow][col]
+			}
+		}
+	}
+	return out
+}
+
+// FlipOverlayPoint mirrors a point of an overlay drawn on an n x n image that has been flipped
+// by FlipGrayImage. Overlays are drawn with pixel x covering x to x+1, so the mirror of x is n - x.
+func FlipOverlayPoint(x, y float64, n int, horizontal, vertical bool) (float64, float64) {
+	if horizontal {
+		x = float64(n) - x
+	}
+	if vertical {
+		y = float64(n) - y
+	}
+	return x, y
+}
+
 func FillFplane(img *image.Gray, occulterWanted bool) {
 	var fill uint8
 
@@ -335,22 +829,18 @@ func Flatten2D(m [][]complex128) ([]complex128, error) {
 //}
 
 // DrawPathOnImage draws the observation path on a grayscale image and returns a new RGBA image.
-// The path line is drawn in red from (x1,y1) to (x2,y2).
-// A red dot is drawn at the start point and a green dot at the end point.
+// The path line is drawn from (x1,y1) to (x2,y2), with the start and end markers at the start and
+// end points, all in the given style (lightcurve.DefaultPathStyle gives a red line, a red dot at
+// the start and a green dot at the end).
 func DrawPathOnImage(gray *image.Gray, x1, y1, x2, y2 float64,
-	startX, startY, endX, endY float64) *image.RGBA {
+	startX, startY, endX, endY float64, style lightcurve.PathStyle) *image.RGBA {
 	bounds := gray.Bounds()
 	result := image.NewRGBA(bounds)
 	draw.Draw(result, bounds, gray, bounds.Min, draw.Src)
 
-	// Draw the line in red
-	drawLineOnImage(result, x1, y1, x2, y2, color.RGBA{R: 255, A: 255})
-
-	// Draw the start dot (red)
-	drawDotOnImage(result, startX, startY, 5, color.RGBA{R: 255, A: 255})
-
-	// Draw the end dot (green)
-	drawDotOnImage(result, endX, endY, 5, color.RGBA{G: 255, A: 255})
+	drawLineOnImage(result, x1, y1, x2, y2, style.LineColor)
+	lightcurve.DrawMarker(result, startX, startY, style.MarkerRadius, style.StartShape, style.StartColor)
+	lightcurve.DrawMarker(result, endX, endY, style.MarkerRadius, style.EndShape, style.EndColor)
 
 	return result
 }
@@ -395,21 +885,6 @@ func drawLineOnImage(img *image.RGBA, x1, y1, x2, y2 float64, col color.Color) {
 	}
 }
 
-// drawDotOnImage draws a filled circle on the image.
-func drawDotOnImage(img *image.RGBA, cx, cy float64, radius int, col color.Color) {
-	for y := -radius; y <= radius; y++ {
-		for x := -radius; x <= radius; x++ {
-			if x*x+y*y <= radius*radius {
-				px := int(cx) + x
-				py := int(cy) + y
-				if px >= 0 && px < img.Bounds().Dx() && py >= 0 && py < img.Bounds().Dy() {
-					img.Set(px, py, col)
-				}
-			}
-		}
-	}
-}
-
 // SaveImagePNG saves any image.Image to a PNG file.
 func SaveImagePNG(filename string, img image.Image) error {
 	f, err := os.Create(filename)
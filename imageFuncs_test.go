@@ -0,0 +1,416 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/bob-anderson-ok/IOTAdiffraction/lightcurve"
+)
+
+// occultationMatrix returns an n x n matrix at the given baseline level with a fully dark
+// (zero) square occupying the central half of the plane.
+func occultationMatrix(n int, baseline float64) [][]float64 {
+	m := make([][]float64, n)
+	for row := 0; row < n; row++ {
+		m[row] = make([]float64, n)
+		for col := 0; col < n; col++ {
+			if row >= n/4 && row < 3*n/4 && col >= n/4 && col < 3*n/4 {
+				m[row][col] = 0.0
+			} else {
+				m[row][col] = baseline
+			}
+		}
+	}
+	return m
+}
+
+func TestApplyMagDrop(t *testing.T) {
+	tests := []struct {
+		name        string
+		baseline    float64
+		percent     float64
+		wantApplied float64
+		wantFloor   float64 // value of a formerly fully dark pixel
+		wantTop     float64 // value of a baseline pixel
+	}{
+		{"full drop", 1.0, 100, 100, 0.0, 1.0},
+		{"75 percent", 1.0, 75, 75, 0.25, 1.0},
+		{"too large is clamped", 1.0, 150, 100, 0.0, 1.0},
+		{"negative is ignored", 1.0, -20, 100, 0.0, 1.0},
+		{"baseline below one", 0.9, 75, 75, 0.225, 0.9},
+		{"baseline above one", 1.2, 50, 50, 0.6, 1.2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := occultationMatrix(20, tc.baseline)
+			applied := ApplyMagDrop(m, tc.percent)
+			if applied != tc.wantApplied {
+				t.Errorf("applied percent = %g, want %g", applied, tc.wantApplied)
+			}
+			if got := m[10][10]; math.Abs(got-tc.wantFloor) > 1e-12 {
+				t.Errorf("floor = %g, want %g", got, tc.wantFloor)
+			}
+			if got := m[0][0]; math.Abs(got-tc.wantTop) > 1e-12 {
+				t.Errorf("baseline pixel = %g, want %g", got, tc.wantTop)
+			}
+		})
+	}
+}
+
+// TestGray16RoundTrip writes a matrix with MatrixToGray16Data and SaveGray16PNG and reads it back
+// with lightcurve.LoadGray16PNG, as the replot workflow does with targetImage16bit.png.
+func TestGray16RoundTrip(t *testing.T) {
+	const scale = 4000.0
+	m := [][]float64{
+		{0.0, 0.25, 1.0, 1.23456789},
+		{0.5 / scale, 16.38375, 16.4, 1000.0}, // 16.38375 * 4000 = 65535; larger values clamp
+		{-0.5, math.NaN(), math.Inf(1), math.Inf(-1)},
+	}
+	want := [][]float64{
+		{0.0, 0.25, 1.0, 1.23456789},
+		{0.5 / scale, 16.38375, 65535 / scale, 65535 / scale},
+		{0.0, 0.0, 0.0, 0.0}, // Negative values clamp to 0; NaN and Inf are written as 0
+	}
+
+	img, err := MatrixToGray16Data(m, scale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "roundTrip16bit.png")
+	if err := SaveGray16PNG(filename, img); err != nil {
+		t.Fatal(err)
+	}
+	got, err := lightcurve.LoadGray16PNG(filename, scale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) || len(got[0]) != len(want[0]) {
+		t.Fatalf("size = %dx%d, want %dx%d", len(got), len(got[0]), len(want), len(want[0]))
+	}
+	quantizationStep := 1.0 / scale
+	for y := range want {
+		for x := range want[y] {
+			if math.Abs(got[y][x]-want[y][x]) > quantizationStep/2+1e-12 {
+				t.Errorf("[%d][%d]: read back %g, want %g (within %g)", y, x, got[y][x], want[y][x], quantizationStep/2)
+			}
+		}
+	}
+}
+
+func TestMatrixToGray16DataClampedCounts(t *testing.T) {
+	m := [][]float64{
+		{-1.0, 0.0, 0.01, 0.5},
+		{20.0, math.NaN(), 1.0, 100.0},
+	}
+	img, counts, err := MatrixToGray16DataClamped(m, 4000, 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Gray16ClampCounts{Low: 3, High: 2, Invalid: 1}
+	if counts != want || counts.Total() != 6 {
+		t.Errorf("counts = %+v, want %+v", counts, want)
+	}
+	if got := img.Gray16At(0, 0).Y; got != 1000 {
+		t.Errorf("value below the floor written as %d, want 1000", got)
+	}
+	if got := img.Gray16At(1, 1).Y; got != 0 {
+		t.Errorf("NaN written as %d, want 0", got)
+	}
+
+	if _, _, err := MatrixToGray16DataClamped(m, 4000, 20.0); err == nil {
+		t.Error("expected an error for a floor above the 16-bit range")
+	}
+}
+
+func TestFlipMatrixAndImageAgree(t *testing.T) {
+	m := [][]float64{
+		{1, 2, 3},
+		{4, 5, 6},
+	}
+	tests := []struct {
+		horizontal, vertical bool
+		want                 [][]float64
+	}{
+		{false, false, [][]float64{{1, 2, 3}, {4, 5, 6}}},
+		{true, false, [][]float64{{3, 2, 1}, {6, 5, 4}}},
+		{false, true, [][]float64{{4, 5, 6}, {1, 2, 3}}},
+		{true, true, [][]float64{{6, 5, 4}, {3, 2, 1}}},
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 3, 2))
+	for row := range m {
+		for col := range m[row] {
+			img.Pix[row*img.Stride+col] = uint8(m[row][col])
+		}
+	}
+
+	for _, tc := range tests {
+		got := FlipMatrix(m, tc.horizontal, tc.vertical)
+		flipped := FlipGrayImage(img, tc.horizontal, tc.vertical)
+		for row := range tc.want {
+			for col := range tc.want[row] {
+				if got[row][col] != tc.want[row][col] {
+					t.Errorf("FlipMatrix(h=%v, v=%v)[%d][%d] = %g, want %g",
+						tc.horizontal, tc.vertical, row, col, got[row][col], tc.want[row][col])
+				}
+				if v := float64(flipped.GrayAt(col, row).Y); v != tc.want[row][col] {
+					t.Errorf("FlipGrayImage(h=%v, v=%v) at (%d, %d) = %g, want %g",
+						tc.horizontal, tc.vertical, col, row, v, tc.want[row][col])
+				}
+			}
+		}
+		if back := FlipMatrix(got, tc.horizontal, tc.vertical); back[1][0] != m[1][0] || back[0][2] != m[0][2] {
+			t.Errorf("flipping twice (h=%v, v=%v) did not restore the matrix", tc.horizontal, tc.vertical)
+		}
+	}
+}
+
+func TestSubtractOffsetClamped(t *testing.T) {
+	m := [][]float64{{0.1, 0.5}, {1.0, 1.3}}
+	got := SubtractOffsetClamped(m, 0.3)
+	want := [][]float64{{0, 0.2}, {0.7, 1.0}}
+	for row := range want {
+		for col := range want[row] {
+			if math.Abs(got[row][col]-want[row][col]) > 1e-12 {
+				t.Errorf("[%d][%d] = %g, want %g", row, col, got[row][col], want[row][col])
+			}
+		}
+	}
+	if m[0][0] != 0.1 {
+		t.Errorf("the input matrix was changed")
+	}
+}
+
+func TestMatrixToGray16ViewPercentileMatches8Bit(t *testing.T) {
+	m := occultationMatrix(16, 0.8)
+	m[3][4] = 1.3
+	img8, err := MatrixToGrayViewPercentile(m, 0.0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img16, err := MatrixToGray16ViewPercentile(m, 0.0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := range m {
+		for x := range m[y] {
+			v8 := float64(img8.GrayAt(x, y).Y) / 255.0
+			v16 := float64(img16.Gray16At(x, y).Y) / 65535.0
+			if math.Abs(v8-v16) > 0.5/255.0 {
+				t.Fatalf("pixel (%d, %d): 8 bit %g and 16 bit %g of full scale differ", x, y, v8, v16)
+			}
+		}
+	}
+	if img16.Gray16At(4, 3).Y != 65535 || img16.Gray16At(8, 8).Y != 0 {
+		t.Errorf("the maximum and minimum are %d and %d, want 65535 and 0", img16.Gray16At(4, 3).Y, img16.Gray16At(8, 8).Y)
+	}
+}
+
+func TestRotateGrayImage(t *testing.T) {
+	// An asymmetric graded shape (an L of distinct gray levels), so that any mix-up of the axes shows
+	const n = 9
+	img := image.NewGray(image.Rect(0, 0, n, n))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	for k := 1; k < 7; k++ {
+		img.SetGray(2, k, color.Gray{Y: uint8(10 * k)})    // The upright of the L
+		img.SetGray(k+1, 6, color.Gray{Y: uint8(100 + k)}) // Its foot
+	}
+
+	same := RotateGrayImage(img, 0.0, 255, false)
+	for i := range img.Pix {
+		if same.Pix[i] != img.Pix[i] {
+			t.Fatalf("a rotation by 0 changed pixel %d from %d to %d", i, img.Pix[i], same.Pix[i])
+		}
+	}
+
+	// A counter-clockwise (as displayed) quarter turn is a transpose followed by a vertical flip
+	transposed := image.NewGray(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			transposed.SetGray(x, y, img.GrayAt(y, x))
+		}
+	}
+	want := FlipGrayImage(transposed, false, true)
+	got := RotateGrayImage(img, 90.0, 255, false)
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if got.GrayAt(x, y).Y != want.GrayAt(x, y).Y {
+				t.Errorf("rotated by 90 degrees, (%d, %d) is %d, want %d", x, y, got.GrayAt(x, y).Y, want.GrayAt(x, y).Y)
+			}
+		}
+	}
+}
+
+func TestSourcePlaneCoverage(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 4, 3))
+	FillFplane(img, true)
+	if opaque, blocking, total := sourcePlaneCoverage(img); opaque != 0 || blocking != 0 || total != 12 {
+		t.Errorf("an open plane gives %d opaque and %d blocking of %d pixels, want 0, 0 of 12", opaque, blocking, total)
+	}
+	img.SetGray(1, 1, color.Gray{Y: 0})
+	img.SetGray(2, 1, color.Gray{Y: 128}) // A graded edge pixel blocks some light
+	if opaque, blocking, _ := sourcePlaneCoverage(img); opaque != 1 || blocking != 2 {
+		t.Errorf("got %d opaque and %d blocking pixels, want 1 and 2", opaque, blocking)
+	}
+	FillFplane(img, false)
+	if opaque, blocking, total := sourcePlaneCoverage(img); opaque != total || blocking != total {
+		t.Errorf("a covered plane gives %d opaque and %d blocking of %d pixels", opaque, blocking, total)
+	}
+}
+
+func TestShiftMatrix(t *testing.T) {
+	m := occultationMatrix(16, 1.0)
+
+	// A whole-pixel shift moves the dark square, replicating the edge into the margin
+	shifted, err := ShiftMatrix(m, 2, -3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for row := 0; row < 16; row++ {
+		for col := 0; col < 16; col++ {
+			if want := sample2D(m, row-2, col+3, PadReplicate); shifted[row][col] != want {
+				t.Fatalf("shifted[%d][%d] = %g, want %g", row, col, shifted[row][col], want)
+			}
+		}
+	}
+
+	// A half-pixel shift averages neighbours
+	half, _ := ShiftMatrix(m, 0, 0.5)
+	if got := half[8][4]; got != 0.5 {
+		t.Errorf("half pixel shift at the square's left edge = %g, want 0.5", got)
+	}
+
+	// Shifting there and back (whole pixels, away from the margin) is lossless
+	back, _ := ShiftMatrix(shifted, -2, 3)
+	if maxAbs, _, _ := CompareMatrices(back[2:13], m[2:13]); maxAbs != 0 {
+		t.Errorf("shift and shift back differs by %g", maxAbs)
+	}
+}
+
+func TestAddMatrices(t *testing.T) {
+	sum, err := AddMatrices([][]float64{{1, 2}, {3, 4}}, [][]float64{{1, 1}, {2, 2}}, 0.5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sum[0][0] != 1.5 || sum[0][1] != 2.5 || sum[1][0] != 4 || sum[1][1] != 5 {
+		t.Errorf("sum = %v", sum)
+	}
+	if _, err := AddMatrices([][]float64{{1, 2}}, [][]float64{{1}}, 1); err == nil {
+		t.Error("mismatched sizes should give an error")
+	}
+}
+
+func TestRebinMatrix(t *testing.T) {
+	m := [][]float64{
+		{1, 3, 0, 0, 2, 2},
+		{1, 3, 0, 4, 2, 2},
+		{5, 5, 1, 1, 0, 1},
+		{5, 5, 1, 1, 0, 3},
+	}
+	got, err := RebinMatrix(m, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := [][]float64{{2, 1, 2}, {5, 1, 1}}
+	if maxAbs, _, err := CompareMatrices(got, want); err != nil || maxAbs != 0 {
+		t.Errorf("RebinMatrix(m, 2) = %v, want %v", got, want)
+	}
+	if same, _ := RebinMatrix(m, 1); same[1][3] != 4 || len(same) != 4 {
+		t.Errorf("a factor of 1 should leave m as it is: %v", same)
+	}
+	for _, factor := range []int{0, 3, 4} {
+		if _, err := RebinMatrix(m, factor); err == nil {
+			t.Errorf("factor %d: want an error for a 4x6 matrix", factor)
+		}
+	}
+
+	// compare rebins the larger image, whichever it is
+	coarse := [][]float64{{2, 1, 2}, {5, 1, 1}}
+	for _, pair := range [][2][][]float64{{m, coarse}, {coarse, m}} {
+		a, b, err := rebinToMatch(pair[0], pair[1])
+		if err != nil || len(a) != 2 || len(b) != 2 {
+			t.Errorf("rebinToMatch gave %d and %d rows (err %v), want 2 and 2", len(a), len(b), err)
+		}
+	}
+}
+
+func TestAsymmetry(t *testing.T) {
+	m := occultationMatrix(16, 1.0) // The dark square is centered on (7.5, 7.5)
+	if a, err := Asymmetry(m, 7.5, 7.5); err != nil || a != 0 {
+		t.Errorf("asymmetry about the square's center = %g (err %v), want 0", a, err)
+	}
+	if a, _ := Asymmetry(m, 7, 7.5); a == 0 {
+		t.Error("asymmetry about a point off the square's center should not be 0")
+	}
+	m[2][3] = 0.0
+	if a, _ := Asymmetry(m, 7.5, 7.5); a == 0 {
+		t.Error("a dark pixel on one side only should give some asymmetry")
+	}
+	if _, err := Asymmetry(m, -1, 20); err == nil {
+		t.Error("a center outside the matrix should give an error")
+	}
+}
+
+func TestOpacityToGray(t *testing.T) {
+	// The color channels are ignored: only the opacity sets the gray level (black is a solid occulter)
+	for _, tc := range []struct {
+		alpha uint8
+		want  uint8
+	}{
+		{0, 255},   // Fully transparent: open sky
+		{64, 191},  // Partly transparent
+		{128, 127}, // Half
+		{255, 0},   // Opaque: solid occulter
+	} {
+		img := image.NewNRGBA(image.Rect(3, 5, 5, 7))
+		for y := 5; y < 7; y++ {
+			for x := 3; x < 5; x++ {
+				img.SetNRGBA(x, y, color.NRGBA{R: 200, G: 30, B: 90, A: tc.alpha})
+			}
+		}
+		gray := opacityToGray(img)
+		if gray.Bounds() != image.Rect(0, 0, 2, 2) {
+			t.Fatalf("alpha %d: the gray image has bounds %v, want them to start at 0, 0", tc.alpha, gray.Bounds())
+		}
+		if got := gray.GrayAt(1, 1).Y; got != tc.want {
+			t.Errorf("alpha %d: gray level %d, want %d", tc.alpha, got, tc.want)
+		}
+	}
+}
+
+func TestHasTransparency(t *testing.T) {
+	opaque := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			opaque.SetNRGBA(x, y, color.NRGBA{R: 10, G: 20, B: 30, A: 255})
+		}
+	}
+	partly := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			partly.SetNRGBA(x, y, color.NRGBA{A: 255})
+		}
+	}
+	partly.SetNRGBA(2, 3, color.NRGBA{A: 254})
+
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+		want bool
+	}{
+		{"gray", image.NewGray(image.Rect(0, 0, 4, 4)), false},
+		{"opaque NRGBA", opaque, false},
+		{"NRGBA with one pixel not quite opaque", partly, true},
+		{"fully transparent NRGBA", image.NewNRGBA(image.Rect(0, 0, 4, 4)), true},
+	} {
+		if got := hasTransparency(tc.img); got != tc.want {
+			t.Errorf("%s: hasTransparency is %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package shared
+
+import (
+	"errors"
+	"image/color"
+	"math"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// GeometricStep returns the geometric (no diffraction) light curve at distance: 0 inside an
+// occulted interval and 1 outside. Consecutive pairs of edges (disappearance, reappearance) bound
+// the occulted intervals, and an odd final edge means the curve ends inside the shadow. distance
+// and edges must be in the same units.
+func GeometricStep(distance float64, edges []float64) float64 {
+	for i := 0; i < len(edges); i += 2 {
+		if distance < edges[i] {
+			continue
+		}
+		if i+1 == len(edges) || distance < edges[i+1] {
+			return 0.0
+		}
+	}
+	return 1.0
+}
+
+// GeometricStepLine returns the geometric step at edges as a thin gray line over the distance range
+// of pts, to be drawn with the light curve pts (both in km). The line rises and falls vertically at
+// each edge.
+func GeometricStepLine(pts plotter.XYs, edges []float64) (*plotter.Line, error) {
+	if len(pts) == 0 {
+		return nil, errors.New("no light curve points for the geometric step")
+	}
+	start, end := pts[0].X, pts[len(pts)-1].X
+	level := GeometricStep(start, edges)
+	step := plotter.XYs{{X: start, Y: level}}
+	for _, edge := range edges {
+		if edge <= start || edge >= end {
+			continue
+		}
+		step = append(step, plotter.XY{X: edge, Y: level})
+		level = GeometricStep(edge, edges)
+		step = append(step, plotter.XY{X: edge, Y: level})
+	}
+	step = append(step, plotter.XY{X: end, Y: level})
+
+	line, err := plotter.NewLine(step)
+	if err != nil {
+		return nil, err
+	}
+	line.Color = color.RGBA{R: 128, G: 128, B: 128, A: 255} // gray
+	line.Width = vg.Points(0.75)
+	return line, nil
+}
+
+// PairEdges cleans a list of edges found along a path (in increasing order, alternately
+// disappearance and reappearance) and returns a list with an even number of edges. Two consecutive
+// edges closer than minSeparation bound a spurious zero-width segment (for example the gap between
+// a satellite touching the main body), so both are removed and counted in merged. If an edge is
+// then left unpaired the path ends inside the shadow, and pathEnd is added to close it (unpaired is
+// set so that the caller can warn). edges, minSeparation and pathEnd must be in the same units.
+func PairEdges(edges []float64, minSeparation, pathEnd float64) (paired []float64, merged int, unpaired bool) {
+	for _, edge := range edges {
+		if n := len(paired); n > 0 && edge-paired[n-1] < minSeparation {
+			paired = paired[:n-1]
+			merged++
+			continue
+		}
+		paired = append(paired, edge)
+	}
+	if len(paired)%2 == 1 {
+		paired = append(paired, math.Max(pathEnd, paired[len(paired)-1]))
+		unpaired = true
+	}
+	return paired, merged, unpaired
+}
+
+// ResidualPlot returns a plot of the light curve pts minus the geometric step at edges (both in
+// km), which leaves only the diffraction contribution. It is meant to be drawn under the light
+// curve plot with DrawStackedPlots.
+func ResidualPlot(pts plotter.XYs, edges []float64, xTicks plot.Ticker) (*plot.Plot, error) {
+	p := plot.New()
+
+	p.X.Label.TextStyle.Font.Typeface = "Liberation"
+	p.X.Label.TextStyle.Font.Variant = "Sans"
+	p.X.Label.TextStyle.Font.Size = vg.Points(12)
+
+	p.Y.Label.TextStyle.Font.Typeface = "Liberation"
+	p.Y.Label.TextStyle.Font.Variant = "Sans"
+	p.Y.Label.TextStyle.Font.Size = vg.Points(12)
+
+	p.X.Tick.Label.Font.Typeface = "Liberation"
+	p.X.Tick.Label.Font.Variant = "Sans"
+	p.X.Tick.Label.Font.Size = vg.Points(10)
+
+	p.Y.Tick.Label.Font.Typeface = "Liberation"
+	p.Y.Tick.Label.Font.Variant = "Sans"
+	p.Y.Tick.Label.Font.Size = vg.Points(10)
+
+	p.Y.Label.Text = "minus step"
+	p.X.Tick.Marker = xTicks
+	p.Add(plotter.NewGrid())
+
+	residual := make(plotter.XYs, len(pts))
+	for i, pt := range pts {
+		residual[i].X = pt.X
+		residual[i].Y = pt.Y - GeometricStep(pt.X, edges)
+	}
+	line, err := plotter.NewLine(residual)
+	if err != nil {
+		return nil, err
+	}
+	line.Color = color.RGBA{R: 0, G: 0, B: 255, A: 255} // blue
+	p.Add(line)
+
+	if len(pts) > 0 {
+		zero, err := plotter.NewLine(plotter.XYs{{X: pts[0].X, Y: 0.0}, {X: pts[len(pts)-1].X, Y: 0.0}})
+		if err != nil {
+			return nil, err
+		}
+		zero.Dashes = []vg.Length{vg.Points(6), vg.Points(4)}
+		zero.Color = color.RGBA{R: 0, G: 0, B: 0, A: 255} // black
+		p.Add(zero)
+	}
+
+	// Keep the zero line in the middle and leave room for the ringing on both sides
+	limit := 0.4
+	for _, pt := range residual {
+		if pt.Y > limit || -pt.Y > limit {
+			limit = max(pt.Y, -pt.Y)
+		}
+	}
+	p.Y.Min = -limit * 1.1
+	p.Y.Max = limit * 1.1
+	// The panel is short, so keep to about five ticks
+	p.Y.Tick.Marker = StepTicks{Step: 0.2 * math.Ceil(limit/0.5), Format: "%.1f"}
+	return p, nil
+}
+
+// DrawStackedPlots draws top above bottom on c, with bottom taking bottomFraction of the height.
+// The two plots are given the same x range and their data areas are lined up, so they share the
+// x axis, and the x axis label of top is moved to bottom.
+func DrawStackedPlots(c draw.Canvas, top, bottom *plot.Plot, bottomFraction float64) {
+	bottom.X.Label.Text = top.X.Label.Text
+	top.X.Label.Text = ""
+
+	xMin := min(top.X.Min, bottom.X.Min)
+	xMax := max(top.X.Max, bottom.X.Max)
+	top.X.Min, bottom.X.Min = xMin, xMin
+	top.X.Max, bottom.X.Max = xMax, xMax
+
+	height := c.Max.Y - c.Min.Y
+	split := height * vg.Length(bottomFraction)
+	topCanvas := draw.Crop(c, 0, 0, split, 0)
+	bottomCanvas := draw.Crop(c, 0, 0, 0, split-height)
+
+	// Indent each canvas by the difference between the space its axes take up and the widest axes
+	topData := top.DataCanvas(topCanvas)
+	bottomData := bottom.DataCanvas(bottomCanvas)
+	topLeft := topData.Min.X - topCanvas.Min.X
+	bottomLeft := bottomData.Min.X - bottomCanvas.Min.X
+	topRight := topCanvas.Max.X - topData.Max.X
+	bottomRight := bottomCanvas.Max.X - bottomData.Max.X
+	left := max(topLeft, bottomLeft)
+	right := max(topRight, bottomRight)
+	topCanvas = draw.Crop(topCanvas, left-topLeft, topRight-right, 0, 0)
+	bottomCanvas = draw.Crop(bottomCanvas, left-bottomLeft, bottomRight-right, 0, 0)
+
+	top.Draw(topCanvas)
+	bottom.Draw(bottomCanvas)
+}
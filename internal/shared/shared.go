@@ -0,0 +1,136 @@
+// Package shared holds helpers used by both the main IOTAdiffraction application
+// and the lightcurve package, so that the two cannot drift apart.
+package shared
+
+import (
+	"fmt"
+	"math"
+
+	"gonum.org/v1/plot"
+)
+
+// Interpolate performs bilinear interpolation on a 2D matrix at the given (x, y) coordinates.
+// x is the column (fractional pixel) and y is the row. Coordinates outside the matrix are
+// clamped to its edges.
+func Interpolate(matrix [][]float64, x, y float64) float64 {
+	rows := len(matrix)
+	if rows == 0 || len(matrix[0]) == 0 {
+		return 0
+	}
+	cols := len(matrix[0])
+
+	// Clamp to valid range (that is, at the edges of matrix). x indexes columns and y indexes rows.
+	x0, x1, xFrac := clampCoordinate(x, cols)
+	y0, y1, yFrac := clampCoordinate(y, rows)
+
+	// Four surrounding values
+	v00 := matrix[y0][x0]
+	v01 := matrix[y0][x1]
+	v10 := matrix[y1][x0]
+	v11 := matrix[y1][x1]
+
+	// Bilinear interpolation
+	v0 := v00*(1-xFrac) + v01*xFrac
+	v1 := v10*(1-xFrac) + v11*xFrac
+
+	return v0*(1-yFrac) + v1*yFrac
+}
+
+// clampCoordinate clamps the coordinate v to [0, n-1] and returns the indices of the two samples
+// that bracket it and the fractional distance from the first. When n is 1 both indices are 0.
+func clampCoordinate(v float64, n int) (i0, i1 int, frac float64) {
+	if n <= 1 {
+		return 0, 0, 0
+	}
+	if v < 0 {
+		v = 0
+	}
+	if v >= float64(n-1) {
+		v = float64(n-1) - 1e-9
+	}
+	i0 = int(v)
+	return i0, i0 + 1, v - float64(i0)
+}
+
+// InterpolateBicubic performs bicubic (Catmull-Rom cubic convolution) interpolation on a 2D matrix
+// at the given (x, y) coordinates. It passes through the matrix values at whole pixels but rounds
+// sharp peaks less than Interpolate. Coordinates are clamped exactly as in Interpolate; the 4x4
+// neighborhood used near an edge repeats the edge values.
+func InterpolateBicubic(matrix [][]float64, x, y float64) float64 {
+	rows := len(matrix)
+	if rows == 0 || len(matrix[0]) == 0 {
+		return 0
+	}
+	cols := len(matrix[0])
+
+	// Clamp to valid range (that is, at the edges of matrix). x indexes columns and y indexes rows.
+	x0, _, xFrac := clampCoordinate(x, cols)
+	y0, _, yFrac := clampCoordinate(y, rows)
+
+	clampIndex := func(i, n int) int {
+		if i < 0 {
+			return 0
+		}
+		if i > n-1 {
+			return n - 1
+		}
+		return i
+	}
+
+	var values [4]float64
+	for j := -1; j <= 2; j++ {
+		row := matrix[clampIndex(y0+j, rows)]
+		values[j+1] = cubicConvolution(row[clampIndex(x0-1, cols)], row[clampIndex(x0, cols)],
+			row[clampIndex(x0+1, cols)], row[clampIndex(x0+2, cols)], xFrac)
+	}
+	return cubicConvolution(values[0], values[1], values[2], values[3], yFrac)
+}
+
+// cubicConvolution interpolates between p1 and p2 (t in [0, 1)) using the Catmull-Rom spline
+// through the four equally spaced values p0..p3.
+func cubicConvolution(p0, p1, p2, p3, t float64) float64 {
+	return p1 + 0.5*t*(p2-p0+t*(2*p0-5*p1+4*p2-p3+t*(3*(p1-p2)+p3-p0)))
+}
+
+// StepTicks is a custom tick marker for plots with fixed step intervals.
+type StepTicks struct {
+	Step   float64
+	Format string
+}
+
+// DefaultTickFormat is the tick label format of the light curve plots.
+const DefaultTickFormat = "%.2f"
+
+// AxisTicks returns the StepTicks of a light curve plot axis: step and format as given, with
+// defaultStep for a step that is not set (<= 0) and DefaultTickFormat for an empty format.
+func AxisTicks(step float64, format string, defaultStep float64) StepTicks {
+	if step <= 0.0 {
+		step = defaultStep
+	}
+	if format == "" {
+		format = DefaultTickFormat
+	}
+	return StepTicks{Step: step, Format: format}
+}
+
+// maxStepTicks limits the number of ticks StepTicks returns. A step too small for the range (for
+// example from a zero length path) would otherwise give millions of ticks, or never finish when
+// adding the step no longer changes the tick value.
+const maxStepTicks = 1000
+
+// Ticks returns a tick at every multiple of Step that lies within [min, max]. No ticks are
+// returned for a step that is not positive and finite or that gives more than maxStepTicks ticks.
+func (t StepTicks) Ticks(min, max float64) []plot.Tick {
+	var ticks []plot.Tick
+	if !(t.Step > 0) || math.IsInf(t.Step, 1) || !((max-min)/t.Step <= maxStepTicks) {
+		return ticks
+	}
+	start := math.Ceil(min/t.Step) * t.Step
+	for v := start; v <= max; v += t.Step {
+		ticks = append(ticks, plot.Tick{
+			Value: v,
+			Label: fmt.Sprintf(t.Format, v),
+		})
+	}
+	return ticks
+}
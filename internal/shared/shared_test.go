@@ -0,0 +1,202 @@
+package shared
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"gonum.org/v1/plot/plotter"
+)
+
+// planeMatrix returns a rows x cols matrix holding the plane 2*col + 3*row, which bilinear
+// interpolation reproduces exactly.
+func planeMatrix(rows, cols int) [][]float64 {
+	m := make([][]float64, rows)
+	for row := range m {
+		m[row] = make([]float64, cols)
+		for col := range m[row] {
+			m[row][col] = 2*float64(col) + 3*float64(row)
+		}
+	}
+	return m
+}
+
+func TestInterpolateRectangularEdges(t *testing.T) {
+	for _, size := range []struct{ rows, cols int }{{3, 7}, {7, 3}, {1, 4}, {4, 1}} {
+		m := planeMatrix(size.rows, size.cols)
+		maxX := float64(size.cols - 1)
+		maxY := float64(size.rows - 1)
+		tests := []struct {
+			name string
+			x, y float64
+		}{
+			{"top left corner", 0, 0},
+			{"top right corner", maxX, 0},
+			{"bottom left corner", 0, maxY},
+			{"bottom right corner", maxX, maxY},
+			{"just inside left edge", 0.25, maxY / 2},
+			{"just inside right edge", maxX - 0.25, maxY / 2},
+			{"just inside top edge", maxX / 2, 0.25},
+			{"just inside bottom edge", maxX / 2, maxY - 0.25},
+			{"beyond bottom right corner", maxX + 5, maxY + 5},
+			{"beyond top left corner", -5, -5},
+		}
+		for _, tc := range tests {
+			// The expected value is the plane at the coordinates clamped to the matrix
+			wantX := math.Min(math.Max(tc.x, 0), maxX)
+			wantY := math.Min(math.Max(tc.y, 0), maxY)
+			want := 2*wantX + 3*wantY
+
+			if got := Interpolate(m, tc.x, tc.y); math.Abs(got-want) > 1e-6 {
+				t.Errorf("%dx%d bilinear %s: got %g, want %g", size.rows, size.cols, tc.name, got, want)
+			}
+
+			// Bicubic repeats the edge values, so it only reproduces the plane exactly at whole pixels;
+			// elsewhere near an edge it must simply stay in bounds (not panic).
+			got := InterpolateBicubic(m, tc.x, tc.y)
+			if wantX == math.Trunc(wantX) && wantY == math.Trunc(wantY) && math.Abs(got-want) > 1e-6 {
+				t.Errorf("%dx%d bicubic %s: got %g, want %g", size.rows, size.cols, tc.name, got, want)
+			}
+		}
+	}
+}
+
+func TestInterpolateEmptyMatrix(t *testing.T) {
+	if got := Interpolate(nil, 1, 1); got != 0 {
+		t.Errorf("Interpolate(nil) = %g, want 0", got)
+	}
+	if got := InterpolateBicubic([][]float64{{}}, 1, 1); got != 0 {
+		t.Errorf("InterpolateBicubic of an empty row = %g, want 0", got)
+	}
+}
+
+func TestGeometricStep(t *testing.T) {
+	tests := []struct {
+		distance float64
+		edges    []float64
+		want     float64
+	}{
+		{1.0, nil, 1},
+		{1.0, []float64{2, 4}, 1},
+		{2.0, []float64{2, 4}, 0},
+		{3.9, []float64{2, 4}, 0},
+		{4.0, []float64{2, 4}, 1},
+		{5.0, []float64{2, 4, 6}, 1},
+		{7.0, []float64{2, 4, 6}, 0}, // An odd final edge: the curve ends in the shadow
+	}
+	for _, tc := range tests {
+		if got := GeometricStep(tc.distance, tc.edges); got != tc.want {
+			t.Errorf("GeometricStep(%g, %v) = %g, want %g", tc.distance, tc.edges, got, tc.want)
+		}
+	}
+}
+
+func TestStepTicksDegenerateStep(t *testing.T) {
+	for _, step := range []float64{0, -0.5, math.NaN(), math.Inf(1), 1e-300} {
+		if ticks := (StepTicks{Step: step, Format: "%.2f"}).Ticks(0, 10); len(ticks) != 0 {
+			t.Errorf("step %g: got %d ticks, want none", step, len(ticks))
+		}
+	}
+	// A tiny step at a large value used to loop forever because v += step did not change v
+	if ticks := (StepTicks{Step: 1e-12, Format: "%.2f"}).Ticks(1e6, 1e6+1); len(ticks) != 0 {
+		t.Errorf("tiny step: got %d ticks, want none", len(ticks))
+	}
+	if ticks := (StepTicks{Step: 2, Format: "%.0f"}).Ticks(-3, 4); len(ticks) != 4 {
+		t.Errorf("step 2 over [-3, 4]: got %d ticks, want 4", len(ticks))
+	}
+}
+
+func TestAxisTicks(t *testing.T) {
+	if got := AxisTicks(0, "", 0.2); got != (StepTicks{Step: 0.2, Format: "%.2f"}) {
+		t.Errorf("unset step and format gave %+v, want the defaults", got)
+	}
+	if got := AxisTicks(0.05, "%.3f", 0.2); got != (StepTicks{Step: 0.05, Format: "%.3f"}) {
+		t.Errorf("step 0.05, format %%.3f gave %+v", got)
+	}
+	if got := AxisTicks(-1, "%.1f", 2); got != (StepTicks{Step: 2, Format: "%.1f"}) {
+		t.Errorf("a negative step should keep the default: %+v", got)
+	}
+}
+
+func TestGeometricStepLine(t *testing.T) {
+	pts := plotter.XYs{{X: 0, Y: 1}, {X: 5, Y: 0.5}, {X: 10, Y: 1}}
+	tests := []struct {
+		edges []float64
+		want  plotter.XYs
+	}{
+		{[]float64{3, 6}, plotter.XYs{{X: 0, Y: 1}, {X: 3, Y: 1}, {X: 3, Y: 0}, {X: 6, Y: 0}, {X: 6, Y: 1}, {X: 10, Y: 1}}},
+		{[]float64{4}, plotter.XYs{{X: 0, Y: 1}, {X: 4, Y: 1}, {X: 4, Y: 0}, {X: 10, Y: 0}}},     // Ends in the shadow
+		{[]float64{-2, 7}, plotter.XYs{{X: 0, Y: 0}, {X: 7, Y: 0}, {X: 7, Y: 1}, {X: 10, Y: 1}}}, // Starts in the shadow
+		{nil, plotter.XYs{{X: 0, Y: 1}, {X: 10, Y: 1}}},
+	}
+	for _, tc := range tests {
+		line, err := GeometricStepLine(pts, tc.edges)
+		if err != nil {
+			t.Fatalf("edges %v: unexpected error: %v", tc.edges, err)
+		}
+		if !reflect.DeepEqual(line.XYs, tc.want) {
+			t.Errorf("edges %v: step %v, want %v", tc.edges, line.XYs, tc.want)
+		}
+	}
+	if _, err := GeometricStepLine(nil, []float64{1}); err == nil {
+		t.Error("no points should give an error")
+	}
+}
+
+func TestPairEdges(t *testing.T) {
+	tests := []struct {
+		name     string
+		edges    []float64
+		want     []float64
+		merged   int
+		unpaired bool
+	}{
+		{"clean", []float64{10, 50}, []float64{10, 50}, 0, false},
+		{"touching shapes", []float64{10, 50, 51, 90}, []float64{10, 90}, 1, false},
+		{"sliver", []float64{10, 11, 40, 60}, []float64{40, 60}, 1, false},
+		{"ends in shadow", []float64{10, 50, 80}, []float64{10, 50, 80, 100}, 0, true},
+		{"touching and ends in shadow", []float64{10, 50, 51}, []float64{10, 100}, 1, true},
+	}
+	for _, tc := range tests {
+		got, merged, unpaired := PairEdges(tc.edges, 1.5, 100)
+		if !reflect.DeepEqual(got, tc.want) || merged != tc.merged || unpaired != tc.unpaired {
+			t.Errorf("%s: PairEdges(%v) = %v, %d, %v; want %v, %d, %v",
+				tc.name, tc.edges, got, merged, unpaired, tc.want, tc.merged, tc.unpaired)
+		}
+	}
+}
+
+func TestPathThroughCorner(t *testing.T) {
+	// This offset puts the path exactly through the corner (3.5, 3.5) of a 7 km square. Rounding put
+	// the crossing just outside both sides that meet there, so the path used to be rejected.
+	const w = 7.0
+	theta := 38 * math.Pi / 180
+	p1, p2, _, _, err := PathSquareIntersections(w, theta, 0.60322247398372353)
+	if err != nil {
+		t.Fatalf("path through a corner rejected: %v", err)
+	}
+	atCorner := func(p AnnotatedPoint) bool { return math.Hypot(p.X-w/2, p.Y-w/2) < 1e-9 }
+	if !atCorner(p1) && !atCorner(p2) {
+		t.Errorf("path ends %v and %v, want one of them at the corner (3.5, 3.5)", p1, p2)
+	}
+
+	// Every path entering the square through a corner has a chord; one that only touches it has none.
+	// Paths along the sides (multiples of 90 degrees) are neither.
+	for _, width := range []float64{1, 7, 13.7, 40, 63, 100} {
+		for deg := 1.0; deg < 360; deg++ {
+			theta := deg * math.Pi / 180
+			dx, dy := math.Sin(theta), math.Cos(theta)
+			d := width/2*dy - width/2*dx // the line through (width/2, width/2)
+			p1, p2, _, _, err := PathSquareIntersections(width, theta, d)
+			if math.Mod(deg, 90) == 0 {
+				continue
+			}
+			if dx*dy > 0 && (err != nil || math.Hypot(p1.X-p2.X, p1.Y-p2.Y) < 1e-6) {
+				t.Errorf("width %g, %g degrees: path through the corner rejected (%v)", width, deg, err)
+			}
+			if dx*dy < 0 && err == nil {
+				t.Errorf("width %g, %g degrees: a path touching only the corner gave %v to %v", width, deg, p1, p2)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package shared
+
+import (
+	"errors"
+	"math"
+)
+
+// AnnotatedPoint is a point of a path with the side of the square (top, bottom, left or right) or
+// the end of the path (start or end) it lies on.
+type AnnotatedPoint struct {
+	X, Y     float64
+	Position string
+}
+
+// ErrNoIntersection is returned by PathSquareIntersections when the line misses the square (or
+// only touches one corner).
+var ErrNoIntersection = errors.New("line does not intersect square")
+
+// PathSquareIntersections finds where a line intersects a square centered at origin.
+// w: square width
+// theta: angle of line measured CCW from y-axis (radians)
+// d: perpendicular distance from the origin to the line
+// Returns the two intersection points, dx and dy, and error
+func PathSquareIntersections(w, theta, d float64) (AnnotatedPoint, AnnotatedPoint, float64, float64, error) {
+	halfW := w / 2.0
+
+	// Direction vector of the line (perpendicular to the normal)
+	// If theta is CCW from y-axis, the line direction is (sin(theta), cos(theta))
+	dx := math.Sin(theta)
+	dy := math.Cos(theta)
+
+	// Normal vector pointing in the direction of offset (perpendicular to line, rotated 90° CW)
+	nx := dy  // cos(theta)
+	ny := -dx // -sin(theta)
+
+	// A point on the line: offset from the origin by distance d along the normal
+	x0 := d * nx
+	y0 := d * ny
+
+	// Line parametric form: x = x0 + t*dx, y = y0 + t*dy
+	// Find intersections with the four sides of the square
+
+	// A path through a corner meets two sides there, but rounding can put the crossing a hair
+	// outside both, which would lose the corner (and reject a legitimate grazing chord). Crossings
+	// within edgeTol of a side are accepted and clamped onto the square.
+	edgeTol := 1e-9 * math.Max(halfW, 1.0)
+	onSide := func(v float64) (float64, bool) {
+		if v < -halfW-edgeTol || v > halfW+edgeTol {
+			return v, false
+		}
+		return math.Max(-halfW, math.Min(halfW, v)), true
+	}
+
+	var intersections []AnnotatedPoint
+
+	// Right edge: x = halfW
+	if math.Abs(dx) > 1e-12 {
+		t := (halfW - x0) / dx
+		y := y0 + t*dy
+		if y, ok := onSide(y); ok {
+			intersections = append(intersections, AnnotatedPoint{halfW, y, "right"})
+		}
+	}
+
+	// Left edge: x = -halfW
+	if math.Abs(dx) > 1e-12 {
+		t := (-halfW - x0) / dx
+		y := y0 + t*dy
+		if y, ok := onSide(y); ok {
+			intersections = append(intersections, AnnotatedPoint{-halfW, y, "left"})
+		}
+	}
+
+	// Bottom edge: y = halfW
+	if math.Abs(dy) > 1e-12 {
+		t := (halfW - y0) / dy
+		x := x0 + t*dx
+		if x, ok := onSide(x); ok {
+			intersections = append(intersections, AnnotatedPoint{x, halfW, "bottom"})
+		}
+	}
+
+	// Top edge: y = halfW
+	if math.Abs(dy) > 1e-12 {
+		t := (-halfW - y0) / dy
+		x := x0 + t*dx
+		if x, ok := onSide(x); ok {
+			intersections = append(intersections, AnnotatedPoint{x, -halfW, "top"})
+		}
+	}
+
+	// Remove duplicate corner intersections
+	intersections = removeDuplicates(intersections, 1e-9)
+
+	if len(intersections) < 2 {
+		return AnnotatedPoint{}, AnnotatedPoint{}, dx, dy, ErrNoIntersection
+	}
+	return intersections[0], intersections[1], dx, dy, nil
+}
+
+func removeDuplicates(pts []AnnotatedPoint, tol float64) []AnnotatedPoint {
+	var result []AnnotatedPoint
+	for _, p := range pts {
+		duplicate := false
+		for _, r := range result {
+			if math.Abs(p.X-r.X) < tol && math.Abs(p.Y-r.Y) < tol {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			result = append(result, p)
+		}
+	}
+	return result
+}
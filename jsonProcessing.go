@@ -1,6 +1,141 @@
 package main
 
-import json "github.com/KevinWang15/go-json5"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	json "github.com/KevinWang15/go-json5"
+)
+
+// LoadEventFromJSON parses a JSON5 (or JSON) parameter file holding a single event and validates
+// it, returning the filled-in event or a descriptive error. It is the entry point for any code that
+// wants an OccultationEvent without the os.Exit error handling of the command line program.
+// Batch files (an array of events or of path offsets) are not accepted; see expandBatchTables.
+func LoadEventFromJSON(data []byte) (OccultationEvent, error) {
+	var jsonTable map[string]interface{}
+	err := json.Unmarshal(data, &jsonTable)
+	if err != nil {
+		return OccultationEvent{}, fmt.Errorf("format error: %w", err)
+	}
+	return eventFromTable(jsonTable)
+}
+
+// eventFromTable validates an already parsed parameter table and returns the event it describes.
+func eventFromTable(jsonTable map[string]interface{}) (OccultationEvent, error) {
+	var event OccultationEvent
+	msg, ok := validateJsonFileAndFillEvent(jsonTable, &event)
+	if !ok {
+		return OccultationEvent{}, errors.New(msg)
+	}
+	return event, nil
+}
+
+// resolveIncludes applies the include key of the parameter table in parsed (or of each event of a
+// batch array). include names a base JSON5 file, relative to the folder of filename (the file
+// parsed came from) unless it is an absolute path. The keys of the base file are loaded first and
+// then overridden by those of the including file; objects such as main_body are merged key by key.
+// A base file can itself use include, and include cycles are reported as errors.
+func resolveIncludes(parsed interface{}, filename string) (interface{}, error) {
+	switch v := parsed.(type) {
+	case map[string]interface{}:
+		return includeTable(v, filename, nil)
+	case []interface{}:
+		for i, element := range v {
+			table, ok := element.(map[string]interface{})
+			if !ok {
+				continue // expandBatchTables reports this
+			}
+			resolved, err := includeTable(table, filename, nil)
+			if err != nil {
+				return nil, fmt.Errorf("event %d: %w", i+1, err)
+			}
+			v[i] = resolved
+		}
+	}
+	return parsed, nil
+}
+
+// includeTable returns table with its include key (if any) replaced by the contents of the base file.
+// chain holds the absolute paths of the files that led to this one, for cycle detection.
+func includeTable(table map[string]interface{}, filename string, chain []string) (map[string]interface{}, error) {
+	value, ok := table["include"]
+	if !ok {
+		return table, nil
+	}
+	basePath, ok := value.(string)
+	if !ok {
+		return nil, errors.New("include: is not a string")
+	}
+	if !filepath.IsAbs(basePath) {
+		basePath = filepath.Join(filepath.Dir(filename), basePath)
+	}
+
+	self, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	chain = append(chain, self)
+	base, err := filepath.Abs(basePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, seen := range chain {
+		if seen == base {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), base)
+		}
+	}
+
+	data, err := os.ReadFile(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("include: %w", err)
+	}
+	var baseTable map[string]interface{}
+	if err := json.Unmarshal(data, &baseTable); err != nil {
+		return nil, fmt.Errorf("include: format error in file %q: %w", basePath, err)
+	}
+	baseTable, err = includeTable(baseTable, basePath, chain)
+	if err != nil {
+		return nil, err
+	}
+	return mergeTables(baseTable, table), nil
+}
+
+// mergeTables returns a copy of base with the keys of override (except include) set over it.
+// Where both hold an object under the same key, the objects are merged in the same way.
+func mergeTables(base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		if k == "include" {
+			continue
+		}
+		baseObject, baseIsObject := merged[k].(map[string]interface{})
+		overrideObject, overrideIsObject := v.(map[string]interface{})
+		if baseIsObject && overrideIsObject {
+			merged[k] = mergeTables(baseObject, overrideObject)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// bandWavelengthNm gives the central wavelength used for each photometric band name accepted by the
+// band key: Johnson-Cousins U, B, V, R and I, and the Gaia G band.
+var bandWavelengthNm = map[string]float64{
+	"U": 365,
+	"B": 445,
+	"V": 551,
+	"R": 658,
+	"I": 806,
+	"G": 673,
+}
 
 func parseArrayFormat(data []byte) ([][2]float64, error) {
 	var pairs [][2]float64
@@ -37,17 +172,242 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 		}
 	}
 
-	//rotationFlag, ok := getLeafValue(jsonTable, "rotate_ground_shadow_to_90_degree_pa_bool")
-	//if !ok {
-	//	event.RotateGroundShadowTo90pa = true // Default: rotate ground shadow to a standard 90 degree PA
-	//} else {
-	//	flagValue, ok := rotationFlag.(bool)
-	//	if !ok {
-	//		msg = "rotate_ground_shadow_to_90_degree_pa_bool: is not a bool"
-	//		return msg, false
-	//	}
-	//	event.RotateGroundShadowTo90pa = flagValue
-	//}
+	saveEField, ok := getLeafValue(jsonTable, "save_efield_bool")
+	if !ok {
+		event.SaveEField = false // default to false if this field is missing
+	} else {
+		event.SaveEField, ok = saveEField.(bool)
+		if !ok {
+			msg = "save_efield_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	cabillosPhase, ok := getLeafValue(jsonTable, "cabillos_phase_term_bool")
+	if !ok {
+		event.CabillosPhaseTerm = false // default to false if this field is missing
+	} else {
+		event.CabillosPhaseTerm, ok = cabillosPhase.(bool)
+		if !ok {
+			msg = "cabillos_phase_term_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	saveGeometricShadow, ok := getLeafValue(jsonTable, "save_geometric_shadow_bool")
+	if !ok {
+		event.SaveGeometricShadow = true // default to true if this field is missing
+	} else {
+		event.SaveGeometricShadow, ok = saveGeometricShadow.(bool)
+		if !ok {
+			msg = "save_geometric_shadow_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	saveSatelliteDifference, ok := getLeafValue(jsonTable, "save_satellite_difference_bool")
+	if !ok {
+		event.SaveSatelliteDifference = false // default to false if this field is missing
+	} else {
+		event.SaveSatelliteDifference, ok = saveSatelliteDifference.(bool)
+		if !ok {
+			msg = "save_satellite_difference_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	saveAperture, ok := getLeafValue(jsonTable, "save_aperture_intensity_bool")
+	if !ok {
+		event.SaveApertureIntensity = false // default to false if this field is missing
+	} else {
+		event.SaveApertureIntensity, ok = saveAperture.(bool)
+		if !ok {
+			msg = "save_aperture_intensity_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	savePerWavelength, ok := getLeafValue(jsonTable, "save_per_wavelength_bool")
+	if !ok {
+		event.SavePerWavelength = false // default to false if this field is missing
+	} else {
+		event.SavePerWavelength, ok = savePerWavelength.(bool)
+		if !ok {
+			msg = "save_per_wavelength_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	savePowerSpectrum, ok := getLeafValue(jsonTable, "save_power_spectrum_bool")
+	if !ok {
+		event.SavePowerSpectrum = false // default to false if this field is missing
+	} else {
+		event.SavePowerSpectrum, ok = savePowerSpectrum.(bool)
+		if !ok {
+			msg = "save_power_spectrum_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	saveMatrixGz, ok := getLeafValue(jsonTable, "save_intensity_matrix_gz_bool")
+	if !ok {
+		event.SaveIntensityMatrixGz = false // default to false if this field is missing
+	} else {
+		event.SaveIntensityMatrixGz, ok = saveMatrixGz.(bool)
+		if !ok {
+			msg = "save_intensity_matrix_gz_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	rotationFlag, ok := getLeafValue(jsonTable, "rotate_ground_shadow_to_90_degree_pa_bool")
+	if !ok {
+		event.RotateGroundShadowTo90pa = false // Default: leave the ground shadow in its natural orientation
+	} else {
+		flagValue, ok := rotationFlag.(bool)
+		if !ok {
+			msg = "rotate_ground_shadow_to_90_degree_pa_bool: is not a bool"
+			return msg, false
+		}
+		event.RotateGroundShadowTo90pa = flagValue
+	}
+
+	sourcePlaneRotation, ok := getLeafValue(jsonTable, "source_plane_rotation_degrees")
+	if ok {
+		event.SourcePlaneRotationDegrees, ok = sourcePlaneRotation.(float64)
+		if !ok {
+			msg = "source_plane_rotation_degrees: is not a float64"
+			return msg, false
+		}
+	}
+
+	residual, ok := getLeafValue(jsonTable, "plot_residual_bool")
+	if ok {
+		event.PlotResidual, ok = residual.(bool)
+		if !ok {
+			msg = "plot_residual_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	halfLight, ok := getLeafValue(jsonTable, "plot_half_light_edges_bool")
+	if ok {
+		event.PlotHalfLightEdges, ok = halfLight.(bool)
+		if !ok {
+			msg = "plot_half_light_edges_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	asymmetry, ok := getLeafValue(jsonTable, "report_asymmetry_bool")
+	if ok {
+		event.ReportAsymmetry, ok = asymmetry.(bool)
+		if !ok {
+			msg = "report_asymmetry_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	writeLog, ok := getLeafValue(jsonTable, "write_log_bool")
+	if ok {
+		event.WriteLog, ok = writeLog.(bool)
+		if !ok {
+			msg = "write_log_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	geometricStep, ok := getLeafValue(jsonTable, "plot_geometric_step_bool")
+	if ok {
+		event.PlotGeometricStep, ok = geometricStep.(bool)
+		if !ok {
+			msg = "plot_geometric_step_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	xTickStep, ok := getLeafValue(jsonTable, "plot_x_tick_step_km")
+	if ok { // 0 keeps the default step
+		event.PlotXTickStepKm, ok = xTickStep.(float64)
+		if !ok {
+			msg = "plot_x_tick_step_km: is not a float64"
+			return msg, false
+		}
+		if event.PlotXTickStepKm < 0.0 {
+			msg = "plot_x_tick_step_km: must not be negative"
+			return msg, false
+		}
+	}
+
+	yTickStep, ok := getLeafValue(jsonTable, "plot_y_tick_step")
+	if ok { // 0 keeps the default step
+		event.PlotYTickStep, ok = yTickStep.(float64)
+		if !ok {
+			msg = "plot_y_tick_step: is not a float64"
+			return msg, false
+		}
+		if event.PlotYTickStep < 0.0 {
+			msg = "plot_y_tick_step: must not be negative"
+			return msg, false
+		}
+	}
+
+	xTickFormat, ok := getLeafValue(jsonTable, "plot_x_tick_format")
+	if ok {
+		event.PlotXTickFormat, ok = xTickFormat.(string)
+		if !ok {
+			msg = "plot_x_tick_format: is not a string"
+			return msg, false
+		}
+		if label := fmt.Sprintf(event.PlotXTickFormat, 1.5); strings.Contains(label, "%!") {
+			msg = fmt.Sprintf("plot_x_tick_format: %q is not a format for one number (it gives %q)", event.PlotXTickFormat, label)
+			return msg, false
+		}
+	}
+
+	yTickFormat, ok := getLeafValue(jsonTable, "plot_y_tick_format")
+	if ok {
+		event.PlotYTickFormat, ok = yTickFormat.(string)
+		if !ok {
+			msg = "plot_y_tick_format: is not a string"
+			return msg, false
+		}
+		if label := fmt.Sprintf(event.PlotYTickFormat, 1.5); strings.Contains(label, "%!") {
+			msg = fmt.Sprintf("plot_y_tick_format: %q is not a format for one number (it gives %q)", event.PlotYTickFormat, label)
+			return msg, false
+		}
+	}
+
+	noise, ok := getLeafValue(jsonTable, "noise_level")
+	if ok {
+		event.NoiseLevel, ok = noise.(float64)
+		if !ok {
+			msg = "noise_level: is not a float64"
+			return msg, false
+		}
+		if event.NoiseLevel < 0 {
+			msg = "noise_level: must not be negative"
+			return msg, false
+		}
+	}
+
+	flipH, ok := getLeafValue(jsonTable, "flip_horizontal_bool")
+	if ok {
+		event.FlipHorizontal, ok = flipH.(bool)
+		if !ok {
+			msg = "flip_horizontal_bool: is not a bool"
+			return msg, false
+		}
+	}
+
+	flipV, ok := getLeafValue(jsonTable, "flip_vertical_bool")
+	if ok {
+		event.FlipVertical, ok = flipV.(bool)
+		if !ok {
+			msg = "flip_vertical_bool: is not a bool"
+			return msg, false
+		}
+	}
 
 	windowSize, ok := getLeafValue(jsonTable, "window_size_pixels")
 	if !ok {
@@ -81,6 +441,21 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 		}
 	}
 
+	units, ok := getLeafValue(jsonTable, "qe_wavelength_units")
+	if !ok {
+		event.QEWavelengthUnits = "nm" // Default
+	} else {
+		event.QEWavelengthUnits, ok = units.(string)
+		if !ok {
+			msg = "qe_wavelength_units: is not a string"
+			return msg, false
+		}
+		if event.QEWavelengthUnits != "nm" && event.QEWavelengthUnits != "um" {
+			msg = fmt.Sprintf("qe_wavelength_units: %q must be \"nm\" or \"um\"", event.QEWavelengthUnits)
+			return msg, false
+		}
+	}
+
 	mainBodyRequired := true
 	filePath, ok = getLeafValue(jsonTable, "path_to_external_image")
 	if ok {
@@ -92,6 +467,53 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 		mainBodyRequired = false
 	}
 
+	filePath, ok = getLeafValue(jsonTable, "path_to_source_plane_npy")
+	if ok {
+		event.PathToSourcePlaneNPY, ok = filePath.(string)
+		if !ok {
+			msg = "path_to_source_plane_npy: is not a string"
+			return msg, false
+		}
+		if event.PathToExternalImage != "" {
+			msg = "path_to_source_plane_npy: cannot be used together with path_to_external_image"
+			return msg, false
+		}
+		mainBodyRequired = false
+	}
+
+	filePath, ok = getLeafValue(jsonTable, "path_to_complex_source_plane_npy")
+	if ok {
+		event.PathToComplexSourcePlaneNPY, ok = filePath.(string)
+		if !ok {
+			msg = "path_to_complex_source_plane_npy: is not a string"
+			return msg, false
+		}
+		if event.PathToExternalImage != "" || event.PathToSourcePlaneNPY != "" {
+			msg = "path_to_complex_source_plane_npy: cannot be used together with path_to_external_image or path_to_source_plane_npy"
+			return msg, false
+		}
+		mainBodyRequired = false
+	}
+
+	filePath, ok = getLeafValue(jsonTable, "reuse_geometric_shadow_png")
+	if ok {
+		event.ReuseGeometricShadowPNG, ok = filePath.(string)
+		if !ok {
+			msg = "reuse_geometric_shadow_png: is not a string"
+			return msg, false
+		}
+		if event.PathToExternalImage != "" || event.PathToSourcePlaneNPY != "" || event.PathToComplexSourcePlaneNPY != "" {
+			msg = "reuse_geometric_shadow_png: cannot be used together with path_to_external_image or a source plane .npy file"
+			return msg, false
+		}
+		if event.SaveSatelliteDifference {
+			// The reused shadow still contains the satellite, so the rerun without it would be the same run
+			msg = "reuse_geometric_shadow_png: cannot be used together with save_satellite_difference_bool"
+			return msg, false
+		}
+		mainBodyRequired = false
+	}
+
 	extWidth, ok := getLeafValue(jsonTable, "external_image_width_km")
 	if ok {
 		event.ExternalImageWidthKm, ok = extWidth.(float64)
@@ -119,6 +541,37 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 		}
 	}
 
+	endpoints, ok := getLeafValue(jsonTable, "path_endpoints_pixels")
+	if ok {
+		values, isArray := endpoints.([]interface{})
+		if !isArray || len(values) != 4 {
+			msg = "path_endpoints_pixels: is not an array of 4 numbers [x0, y0, x1, y1]"
+			return msg, false
+		}
+		for i, value := range values {
+			event.PathEndpointsPixels[i], ok = value.(float64)
+			if !ok {
+				msg = "path_endpoints_pixels: is not an array of 4 numbers [x0, y0, x1, y1]"
+				return msg, false
+			}
+		}
+		event.PathEndpointsGiven = true
+	}
+
+	pathSamples, ok := getLeafValue(jsonTable, "path_num_samples")
+	if ok { // 0 keeps one sample per pixel of path length
+		samples, ok := pathSamples.(float64)
+		if !ok {
+			msg = "path_num_samples: is not a float64"
+			return msg, false
+		}
+		if samples != math.Trunc(samples) || samples < 0.0 || samples == 1.0 {
+			msg = fmt.Sprintf("path_num_samples: %g must be 0 or a whole number of at least 2", samples)
+			return msg, false
+		}
+		event.PathNumSamples = int(samples)
+	}
+
 	skyWidth, ok := getLeafValue(jsonTable, "fundamental_plane_width_km")
 	if !ok {
 		msg = "fundamental_plane_width_km: not found"
@@ -142,16 +595,14 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 	}
 	event.FundamentalPlaneWidthPoints = int(numberOfPoints)
 
-	//expSecs, ok := getLeafValue(jsonTable, "camera_exposure_secs")
-	//if !ok {
-	//	msg = "camera_exposure_secs: not found"
-	//	return msg, false
-	//}
-	//event.CameraExposureSecs, ok = expSecs.(float64)
-	//if !ok {
-	//	msg = "camera_exposure_secs: is not a float64"
-	//	return msg, false
-	//}
+	expSecs, ok := getLeafValue(jsonTable, "camera_exposure_secs")
+	if ok { // We allow this field to be missing - if missing, no exposure smear is applied
+		event.CameraExposureSecs, ok = expSecs.(float64)
+		if !ok {
+			msg = "camera_exposure_secs: is not a float64"
+			return msg, false
+		}
+	}
 
 	magDropPercent, ok := getLeafValue(jsonTable, "percent_mag_drop")
 	if ok {
@@ -162,15 +613,251 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 		}
 	}
 
-	wavelength, ok := getLeafValue(jsonTable, "observation_wavelength_nm")
+	mode, ok := getLeafValue(jsonTable, "mode")
 	if !ok {
-		msg = "observation_wavelength_nm: not found"
-		return msg, false
+		event.Mode = "occulter" // Default: an occultation
+	} else {
+		event.Mode, ok = mode.(string)
+		if !ok {
+			msg = "mode: is not a string"
+			return msg, false
+		}
+		if event.Mode != "occulter" && event.Mode != "aperture" {
+			msg = fmt.Sprintf("mode: %q must be \"occulter\" or \"aperture\"", event.Mode)
+			return msg, false
+		}
 	}
-	event.ObservationWavelengthNm, ok = wavelength.(float64)
+
+	incidentAmplitude, ok := getLeafValue(jsonTable, "incident_wave_amplitude")
 	if !ok {
-		msg = "observation_wavelength_nm: is not a float64"
-		return msg, false
+		event.IncidentWaveAmplitude = 1.0 // Default: the unit plane wave of Babinet's principle
+	} else {
+		event.IncidentWaveAmplitude, ok = incidentAmplitude.(float64)
+		if !ok {
+			msg = "incident_wave_amplitude: is not a float64"
+			return msg, false
+		}
+		if event.IncidentWaveAmplitude <= 0.0 {
+			msg = fmt.Sprintf("incident_wave_amplitude: %g must be greater than 0", event.IncidentWaveAmplitude)
+			return msg, false
+		}
+	}
+
+	incidentPhase, ok := getLeafValue(jsonTable, "incident_wave_phase_degrees")
+	if ok {
+		event.IncidentWavePhaseDegrees, ok = incidentPhase.(float64)
+		if !ok {
+			msg = "incident_wave_phase_degrees: is not a float64"
+			return msg, false
+		}
+	}
+	if event.Mode == "aperture" && (event.IncidentWaveAmplitude != 1.0 || event.IncidentWavePhaseDegrees != 0.0) {
+		logWarn("incident_wave_amplitude and incident_wave_phase_degrees are ignored in aperture mode (no Babinet step)\n")
+	}
+
+	psfConvMode, ok := getLeafValue(jsonTable, "psf_conv_mode")
+	if !ok {
+		event.PsfConvMode = "same" // Default: the star convolution keeps the size of the fundamental plane
+	} else {
+		event.PsfConvMode, ok = psfConvMode.(string)
+		if !ok {
+			msg = "psf_conv_mode: is not a string"
+			return msg, false
+		}
+		if _, err := parseConvMode(event.PsfConvMode); err != nil || event.PsfConvMode == "" {
+			msg = fmt.Sprintf("psf_conv_mode: %q must be \"same\", \"full\" or \"valid\"", event.PsfConvMode)
+			return msg, false
+		}
+	}
+
+	scaleHeight, ok := getLeafValue(jsonTable, "atmosphere_scale_height_km")
+	if ok {
+		event.AtmosphereScaleHeightKm, ok = scaleHeight.(float64)
+		if !ok {
+			msg = "atmosphere_scale_height_km: is not a float64"
+			return msg, false
+		}
+	}
+
+	apodization, ok := getLeafValue(jsonTable, "edge_apodization")
+	if ok {
+		event.EdgeApodization, ok = apodization.(float64)
+		if !ok {
+			msg = "edge_apodization: is not a float64"
+			return msg, false
+		}
+		if event.EdgeApodization < 0.0 || event.EdgeApodization > 0.25 {
+			msg = "edge_apodization: must be in the range 0 to 0.25"
+			return msg, false
+		}
+	}
+
+	floor, ok := getLeafValue(jsonTable, "target_image_floor")
+	if ok {
+		event.TargetImageFloor, ok = floor.(float64)
+		if !ok {
+			msg = "target_image_floor: is not a float64"
+			return msg, false
+		}
+		if event.TargetImageFloor < 0.0 || event.TargetImageFloor > 65535/4000.0 {
+			msg = "target_image_floor: must be in the range 0 to 16.38"
+			return msg, false
+		}
+	}
+
+	minSamples, ok := getLeafValue(jsonTable, "min_samples_per_fresnel")
+	if ok {
+		event.MinSamplesPerFresnel, ok = minSamples.(float64)
+		if !ok {
+			msg = "min_samples_per_fresnel: is not a float64"
+			return msg, false
+		}
+		if event.MinSamplesPerFresnel < 0.0 {
+			msg = "min_samples_per_fresnel: must not be negative"
+			return msg, false
+		}
+	}
+
+	minEdgeSeparation, ok := getLeafValue(jsonTable, "min_edge_separation_km")
+	if ok {
+		event.MinEdgeSeparationKm, ok = minEdgeSeparation.(float64)
+		if !ok {
+			msg = "min_edge_separation_km: is not a float64"
+			return msg, false
+		}
+		if event.MinEdgeSeparationKm < 0.0 {
+			msg = "min_edge_separation_km: must not be negative"
+			return msg, false
+		}
+	}
+
+	markers, ok := getLeafValue(jsonTable, "path_markers")
+	if ok {
+		event.PathMarkers, ok = markers.(string)
+		if !ok {
+			msg = "path_markers: is not a string"
+			return msg, false
+		}
+		if event.PathMarkers != "default" && event.PathMarkers != "colorblind" {
+			msg = "path_markers: must be \"default\" or \"colorblind\""
+			return msg, false
+		}
+	}
+
+	bitDepth, ok := getLeafValue(jsonTable, "display_bit_depth")
+	if ok {
+		depth, ok := bitDepth.(float64)
+		if !ok {
+			msg = "display_bit_depth: is not a float64"
+			return msg, false
+		}
+		if depth != 8 && depth != 16 {
+			msg = "display_bit_depth: must be 8 or 16"
+			return msg, false
+		}
+		event.DisplayBitDepth = int(depth)
+	}
+
+	displayOffset, ok := getLeafValue(jsonTable, "display_offset")
+	if ok {
+		event.DisplayOffset, ok = displayOffset.(float64)
+		if !ok {
+			msg = "display_offset: is not a float64"
+			return msg, false
+		}
+		if event.DisplayOffset < 0.0 {
+			msg = "display_offset: must not be negative"
+			return msg, false
+		}
+	}
+
+	gridSpacing, ok := getLeafValue(jsonTable, "km_grid_spacing_km")
+	if ok {
+		event.KmGridSpacingKm, ok = gridSpacing.(float64)
+		if !ok {
+			msg = "km_grid_spacing_km: is not a float64"
+			return msg, false
+		}
+		if event.KmGridSpacingKm < 0.0 {
+			msg = "km_grid_spacing_km: must not be negative"
+			return msg, false
+		}
+	}
+
+	dispersion, ok := getLeafValue(jsonTable, "chromatic_dispersion_coeff")
+	if ok {
+		event.ChromaticDispersionCoeff, ok = dispersion.(float64)
+		if !ok {
+			msg = "chromatic_dispersion_coeff: is not a float64"
+			return msg, false
+		}
+	}
+
+	starDiamChromatic, ok := getLeafValue(jsonTable, "star_diam_chromatic_coeff")
+	if ok {
+		event.StarDiamChromaticCoeff, ok = starDiamChromatic.(float64)
+		if !ok {
+			msg = "star_diam_chromatic_coeff: is not a float64"
+			return msg, false
+		}
+	}
+
+	starField, ok := getLeafValue(jsonTable, "star_field")
+	if ok {
+		sources, isArray := starField.([]interface{})
+		if !isArray {
+			msg = "star_field: is not an array of [x_offset_km, y_offset_km, brightness] entries"
+			return msg, false
+		}
+		event.StarField = nil
+		for _, source := range sources {
+			values, isArray := source.([]interface{})
+			if !isArray || len(values) != 3 {
+				msg = "star_field: is not an array of [x_offset_km, y_offset_km, brightness] entries"
+				return msg, false
+			}
+			var triple [3]float64
+			for i, value := range values {
+				triple[i], ok = value.(float64)
+				if !ok {
+					msg = "star_field: is not an array of [x_offset_km, y_offset_km, brightness] entries"
+					return msg, false
+				}
+			}
+			if triple[2] <= 0.0 {
+				msg = "star_field: each brightness must be greater than 0"
+				return msg, false
+			}
+			event.StarField = append(event.StarField,
+				StarFieldSource{XOffsetKm: triple[0], YOffsetKm: triple[1], Brightness: triple[2]})
+		}
+	}
+
+	wavelength, ok := getLeafValue(jsonTable, "observation_wavelength_nm")
+	if ok {
+		event.ObservationWavelengthNm, ok = wavelength.(float64)
+		if !ok {
+			msg = "observation_wavelength_nm: is not a float64"
+			return msg, false
+		}
+	} else {
+		// A photometric band name can stand in for the wavelength
+		band, ok := getLeafValue(jsonTable, "band")
+		if !ok {
+			msg = "observation_wavelength_nm: not found (and no band was given)"
+			return msg, false
+		}
+		event.Band, ok = band.(string)
+		if !ok {
+			msg = "band: is not a string"
+			return msg, false
+		}
+		event.Band = strings.ToUpper(event.Band)
+		event.ObservationWavelengthNm, ok = bandWavelengthNm[event.Band]
+		if !ok {
+			msg = fmt.Sprintf("band: %q is not one of U, B, V, R, I or G", event.Band)
+			return msg, false
+		}
 	}
 
 	dX, ok := getLeafValue(jsonTable, "dX_km_per_sec")
@@ -233,7 +920,7 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 		}
 	}
 
-	needAdistanceMeasure := true
+	// The distance can be given as a parallax, a light travel time or in au: resolveDistance picks one
 	parallax, ok := getLeafValue(jsonTable, "parallax_arcsec")
 	if ok {
 		event.ParallaxArcsec, ok = parallax.(float64)
@@ -241,16 +928,19 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 			msg = "parallax_arcsec: is not a float64"
 			return msg, false
 		}
-		needAdistanceMeasure = false // Now we don't need distance_au'
 	}
 
-	distanceAU, ok := getLeafValue(jsonTable, "distance_au")
-	if !ok {
-		if needAdistanceMeasure {
-			msg = "distance_au: not found"
+	lightTime, ok := getLeafValue(jsonTable, "light_time_secs")
+	if ok {
+		event.LightTimeSecs, ok = lightTime.(float64)
+		if !ok {
+			msg = "light_time_secs: is not a float64"
 			return msg, false
 		}
-	} else {
+	}
+
+	distanceAU, ok := getLeafValue(jsonTable, "distance_au")
+	if ok {
 		event.DistanceAu, ok = distanceAU.(float64)
 		if !ok {
 			msg = "distance_au: is not a float64"
@@ -258,6 +948,11 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 		}
 	}
 
+	if err := resolveDistance(event); err != nil {
+		msg = err.Error()
+		return msg, false
+	}
+
 	// Check to see if a main_body group is present. Required if no external image is supplied.
 	_, ok = getLeafValue(jsonTable, "main_body")
 	event.MainBodyGiven = ok
@@ -337,6 +1032,24 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 			msg = "main_body.major_axis_pa_degrees: not found"
 			return msg, false
 		}
+
+		// Validate the optional main_body.opacity entry (default 1: opaque)
+		v, ok = getLeafValue(jsonTable, "main_body", "opacity")
+		if ok {
+			value, ok := v.(float64)
+			if !ok {
+				msg = "main_body.opacity: is not a float64"
+				return msg, false
+			}
+			if value <= 0.0 || value > 1.0 {
+				msg = fmt.Sprintf("main_body.opacity: %g must be greater than 0 and at most 1", value)
+				return msg, false
+			}
+			event.MainbodyOpacity = value
+		} else {
+			event.MainbodyOpacity = 1.0
+		}
+		warnIfAxesSwapped("main_body", event.MainbodyMajorAxisKm, event.MainbodyMinorAxisKm, event.MainbodyMajorAxisPaDegrees)
 	} else {
 		if mainBodyRequired {
 			msg = "main_body group not found and is required."
@@ -423,7 +1136,36 @@ func validateJsonFileAndFillEvent(jsonTable map[string]interface{}, event *Occul
 			msg = "satellite.major_axis_pa_degrees: not found"
 			return msg, false
 		}
+
+		// Validate the optional satellite.opacity entry (default 1: opaque)
+		v, ok = getLeafValue(jsonTable, "satellite", "opacity")
+		if ok {
+			value, ok := v.(float64)
+			if !ok {
+				msg = "satellite.opacity: is not a float64"
+				return msg, false
+			}
+			if value <= 0.0 || value > 1.0 {
+				msg = fmt.Sprintf("satellite.opacity: %g must be greater than 0 and at most 1", value)
+				return msg, false
+			}
+			event.SatelliteOpacity = value
+		} else {
+			event.SatelliteOpacity = 1.0
+		}
+		warnIfAxesSwapped("satellite", event.SatelliteMajorAxisKm, event.SatelliteMinorAxisKm, event.SatelliteMajorAxisPaDegrees)
 	}
 
 	return msg, true
 }
+
+// warnIfAxesSwapped warns when the minor axis of an ellipse is given larger than its major axis,
+// usually a data entry error. The ellipse is still drawn as given, which puts its long axis at
+// major_axis_pa_degrees + 90, so the warning says so.
+func warnIfAxesSwapped(group string, majorKm, minorKm, paDegrees float64) {
+	if minorKm > majorKm {
+		logWarn("%s: minor_axis_km (%g) is larger than major_axis_km (%g), so the long axis of the ellipse "+
+			"is at PA %g degrees rather than major_axis_pa_degrees (%g). Swap them if that is not intended.\n",
+			group, minorKm, majorKm, math.Mod(paDegrees+90.0, 360.0), paDegrees)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	json "github.com/KevinWang15/go-json5"
+)
+
+func TestLoadEventFromJSON(t *testing.T) {
+	valid := `{
+		fundamental_plane_width_km : 40,
+		fundamental_plane_width_num_points : 300,
+		distance_au : 2.33,
+		observation_wavelength_nm : 500,
+		dX_km_per_sec : 5.074,  // JSON5 comments and trailing commas are allowed
+		main_body : { x_center_km : 5.8, y_center_km : 0.6, major_axis_km : 17.6, minor_axis_km : 8.0,
+			major_axis_pa_degrees : 98.3, },
+	}`
+	event, err := LoadEventFromJSON([]byte(valid))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event.FundamentalPlaneWidthPoints != 300 || event.DxKmPerSec != 5.074 || !event.MainBodyGiven {
+		t.Errorf("event not filled in: %+v", event)
+	}
+
+	// A band name stands in for a missing observation_wavelength_nm, but never overrides it
+	withBand := strings.Replace(valid, "observation_wavelength_nm : 500,", `band : "v",`, 1)
+	event, err = LoadEventFromJSON([]byte(withBand))
+	if err != nil {
+		t.Fatalf("unexpected error with a band: %v", err)
+	}
+	if event.ObservationWavelengthNm != 551 || event.Band != "V" {
+		t.Errorf("band v gave %g nm (band %q), want 551 nm", event.ObservationWavelengthNm, event.Band)
+	}
+	event, err = LoadEventFromJSON([]byte(strings.Replace(valid, "distance_au", `band : "I", distance_au`, 1)))
+	if err != nil || event.ObservationWavelengthNm != 500 {
+		t.Errorf("observation_wavelength_nm should win over band: %g nm, err %v", event.ObservationWavelengthNm, err)
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"not json", `{ fundamental_plane_width_km : `, "format error"},
+		{"batch array", `[ {}, {} ]`, "format error"},
+		{"missing required key", strings.Replace(valid, "distance_au : 2.33,", "", 1), "distance_au"},
+		{"wrong type", strings.Replace(valid, "500", `"500"`, 1), "observation_wavelength_nm"},
+		{"unknown band", strings.Replace(valid, "observation_wavelength_nm : 500,", `band : "K",`, 1), "band"},
+		{"star field entry", strings.Replace(valid, "distance_au", `star_field : [[1, 2]], distance_au`, 1), "star_field"},
+		{"tick step", strings.Replace(valid, "distance_au", `plot_y_tick_step : -0.1, distance_au`, 1), "plot_y_tick_step"},
+		{"tick format", strings.Replace(valid, "distance_au", `plot_x_tick_format : "%d km", distance_au`, 1), "plot_x_tick_format"},
+		{"star field brightness", strings.Replace(valid, "distance_au", `star_field : [[1, 2, 0]], distance_au`, 1), "star_field"},
+		{"reused shadow difference", strings.Replace(valid, "distance_au",
+			`reuse_geometric_shadow_png : "geometricShadow.png", save_satellite_difference_bool : true, distance_au`, 1),
+			"save_satellite_difference_bool"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadEventFromJSON([]byte(tc.data))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error = %v, want one mentioning %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveIncludes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// The base file is found relative to the including file, not the working directory
+	write("lib/base.json5", `{
+		fundamental_plane_width_km : 40,
+		fundamental_plane_width_num_points : 300,
+		distance_au : 2.33,
+		observation_wavelength_nm : 500,
+		main_body : { x_center_km : 5.8, y_center_km : 0.6, major_axis_km : 17.6, minor_axis_km : 8.0,
+			major_axis_pa_degrees : 98.3 },
+	}`)
+	run := write("run.json5", `{
+		include : "lib/base.json5",
+		observation_wavelength_nm : 650,
+		main_body : { x_center_km : -2.0 },
+	}`)
+
+	event := loadTestParameterFile(t, run)
+	if event.ObservationWavelengthNm != 650 {
+		t.Errorf("observation_wavelength_nm = %g, want the override 650", event.ObservationWavelengthNm)
+	}
+	if event.DistanceAu != 2.33 || event.FundamentalPlaneWidthPoints != 300 {
+		t.Errorf("keys of the base file were not loaded: %+v", event)
+	}
+	if event.MainBodyXCenterKm != -2.0 || event.MainbodyMajorAxisKm != 17.6 {
+		t.Errorf("main_body was not merged: x %g (want -2), major axis %g (want 17.6)",
+			event.MainBodyXCenterKm, event.MainbodyMajorAxisKm)
+	}
+
+	write("a.json5", `{ include : "b.json5", distance_au : 1 }`)
+	write("b.json5", `{ include : "a.json5" }`)
+	top := map[string]interface{}{"include": "a.json5"}
+	if _, err := resolveIncludes(top, filepath.Join(dir, "top.json5")); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("got error %v, want an include cycle", err)
+	}
+}
+
+// loadTestParameterFile reads filename the way main does, including any include.
+func loadTestParameterFile(t *testing.T, filename string) OccultationEvent {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed interface{}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err = resolveIncludes(parsed, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := eventFromTable(parsed.(map[string]interface{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestDistanceInputs(t *testing.T) {
+	base := `{
+		fundamental_plane_width_km : 40,
+		fundamental_plane_width_num_points : 300,
+		observation_wavelength_nm : 500,
+		DISTANCE
+		main_body : { x_center_km : 5.8, y_center_km : 0.6, major_axis_km : 17.6, minor_axis_km : 8.0,
+			major_axis_pa_degrees : 98.3, },
+	}`
+	tests := []struct {
+		distance   string
+		wantAu     float64
+		wantSource string
+	}{
+		{"distance_au : 2.33,", 2.33, "distance_au"},
+		{"parallax_arcsec : 3.7711,", 8.79414 / 3.7711, "parallax_arcsec"},
+		{"light_time_secs : 998.009568,", 2.0, "light_time_secs"},
+
+		// Precedence: parallax, then light time, then au
+		{"parallax_arcsec : 4.39707, light_time_secs : 1500, distance_au : 9,", 2.0, "parallax_arcsec"},
+		{"light_time_secs : 1497.014352, distance_au : 9,", 3.0, "light_time_secs"},
+
+		// An input of 0 counts as not given
+		{"parallax_arcsec : 0, distance_au : 2.33,", 2.33, "distance_au"},
+	}
+	for _, tc := range tests {
+		event, err := LoadEventFromJSON([]byte(strings.Replace(base, "DISTANCE", tc.distance, 1)))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.distance, err)
+			continue
+		}
+		if math.Abs(event.DistanceAu-tc.wantAu) > 1e-9 || event.DistanceSource != tc.wantSource {
+			t.Errorf("%s: %g au from %s, want %g au from %s", tc.distance, event.DistanceAu, event.DistanceSource,
+				tc.wantAu, tc.wantSource)
+		}
+	}
+
+	for _, distance := range []string{"", "distance_au : -1,", "light_time_secs : 0,"} {
+		_, err := LoadEventFromJSON([]byte(strings.Replace(base, "DISTANCE", distance, 1)))
+		if err == nil || !strings.Contains(err.Error(), "no distance given") {
+			t.Errorf("%q: error = %v, want no distance given", distance, err)
+		}
+	}
+
+	// An event built in code is resolved the same way when it is checked
+	event := OccultationEvent{FundamentalPlaneWidthKm: 10, LightTimeSecs: 499.004784}
+	if err := checkEventDistances(&event); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(event.DistanceAu-1) > 1e-12 || event.DistanceSource != "light_time_secs" {
+		t.Errorf("checkEventDistances: %g au from %s, want 1 au from light_time_secs", event.DistanceAu, event.DistanceSource)
+	}
+}
@@ -66,7 +66,9 @@ func main() {
 	// Compute sample points along the path
 	path.ComputeSamplePoints()
 	fmt.Printf("\nGenerated %d sample points along the observation path\n", len(path.SamplePoints))
-	fmt.Printf("Path length: %.1f pixels\n", path.SamplePoints[len(path.SamplePoints)-1].DistanceFromStart)
+	if len(path.SamplePoints) > 0 {
+		fmt.Printf("Path length: %.1f pixels\n", path.SamplePoints[len(path.SamplePoints)-1].DistanceFromStart)
+	}
 
 	// Try to load the 16-bit diffraction image
 	intensityFile := filepath.Join(imageDir, "targetImage16bit.png")
@@ -80,7 +82,10 @@ func main() {
 	}
 
 	// Extract the light curve from the intensity matrix
-	lightCurveData := lightcurve.ExtractLightCurve(intensityMatrix, path)
+	lightCurveData, err := lightcurve.ExtractLightCurve(intensityMatrix, path)
+	if err != nil {
+		log.Fatalf("Failed to extract light curve: %v", err)
+	}
 	fmt.Printf("Extracted %d light curve points\n", len(lightCurveData))
 
 	// Print the first few and last few points
@@ -132,8 +137,8 @@ func main() {
 		fmt.Printf("\nNote: Could not load %s: %v\n", displayFile, err)
 		fmt.Println("Skipping annotated image generation.")
 	} else {
-		// Draw the observation path on the image
-		annotatedImage, err := lightcurve.DrawObservationLineOnImage(displayImage, path)
+		// Draw the observation path on the image, with a tick mark every second of shadow motion
+		annotatedImage, err := lightcurve.DrawObservationLineOnImageWithTicks(displayImage, path, 1.0)
 		if err != nil {
 			log.Printf("Could not draw observation line: %v\n", err)
 		} else {
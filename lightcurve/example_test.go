@@ -64,7 +64,10 @@ func ExtractAndPlotLightCurve(
 	}
 
 	// Extract the light curve from the intensity matrix
-	lightCurveData := lightcurve.ExtractLightCurve(intensityMatrix, path)
+	lightCurveData, err := lightcurve.ExtractLightCurve(intensityMatrix, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to extract light curve: %w", err)
+	}
 	fmt.Printf("Extracted %d light curve points\n", len(lightCurveData))
 
 	// Load the geometric shadow image and detect edges
@@ -3,21 +3,34 @@
 package lightcurve
 
 import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/png"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/bob-anderson-ok/IOTAdiffraction/internal/shared"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
 	"gonum.org/v1/plot"
+	vgfont "gonum.org/v1/plot/font"
 	_ "gonum.org/v1/plot/font/liberation"
+	"gonum.org/v1/plot/palette/moreland"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
 	vgdraw "gonum.org/v1/plot/vg/draw"
 	"gonum.org/v1/plot/vg/vgimg"
+	"gonum.org/v1/plot/vg/vgpdf"
+	"gonum.org/v1/plot/vg/vgsvg"
 )
 
 // PathPoint represents a point along the observation path with x, y coordinates
@@ -34,6 +47,22 @@ type Point struct {
 	Intensity float64 // Normalized intensity value
 }
 
+// DetailedPoint is the full record of one light curve sample: where it was taken in the image
+// and what was measured there.
+type DetailedPoint struct {
+	X          float64 // X coordinate in image pixels (column)
+	Y          float64 // Y coordinate in image pixels (row)
+	DistanceKm float64 // Distance from path start (km)
+	TimeSec    float64 // Time since the shadow was at the path start (seconds); 0 if the shadow is not moving
+	Intensity  float64 // Normalized intensity value
+}
+
+// TimePoint represents a single point on a light curve sampled in equal time steps.
+type TimePoint struct {
+	TimeSec   float64 // Time since the shadow was at the path start (seconds)
+	Intensity float64 // Normalized intensity value
+}
+
 // ObservationPath defines the path along which the light curve is extracted.
 type ObservationPath struct {
 	// Input parameters (from parameter file)
@@ -53,16 +82,37 @@ type ObservationPath struct {
 	PathAngleDegrees    float64     // Path angle in degrees
 	Direction           string      // Path direction description
 	SamplePoints        []PathPoint // Computed sample points along the path
+
+	// Interpolation selects the kernel used by ExtractLightCurve (Bilinear if not set)
+	Interpolation InterpolationMethod
 }
 
+// InterpolationMethod selects how the intensity matrix is sampled between pixel centers.
+type InterpolationMethod int
+
+const (
+	// Bilinear interpolation (the default). It slightly rounds sharp fringe peaks.
+	Bilinear InterpolationMethod = iota
+	// Bicubic (Catmull-Rom) interpolation. It follows sharp fringe peaks more closely.
+	Bicubic
+)
+
 // annotatedPoint is used internally for path intersection calculations.
-type annotatedPoint struct {
-	X, Y     float64
-	Position string // "top", "bottom", "left", or "right"
-}
+type annotatedPoint = shared.AnnotatedPoint
 
 // ErrNoIntersection is returned when the path does not intersect the image boundaries.
-var ErrNoIntersection = errors.New("line does not intersect square")
+var ErrNoIntersection = shared.ErrNoIntersection
+
+// ErrPathTooShort is returned when the observation path only grazes a corner of the image and
+// so has fewer than two sample points (too short to extract or plot a light curve).
+var ErrPathTooShort = errors.New("observation path is too short (it barely clips the image)")
+
+// ErrNoOccultation is returned when there are no edges, so there is no occulted interval.
+var ErrNoOccultation = errors.New("no edges were found: the path does not cross the geometric shadow")
+
+// ErrFlatEdge is returned by EdgeTimingUncertainty when the light curve is flat at the edge, so the
+// edge cannot be timed at all.
+var ErrFlatEdge = errors.New("the light curve is flat at the edge")
 
 // ComputePathFromVelocity computes the observation path start and end points
 // from the velocity components (DxKmPerSec, DyKmPerSec) and path offset.
@@ -89,7 +139,7 @@ func (p *ObservationPath) ComputePathFromVelocity() error {
 	d := (p.PathOffsetFromCenterKm / p.FundamentalPlaneWidthKm) * float64(Npts)
 
 	// Find where the path intersects the image boundaries
-	p1, p2, dx, dy, err := pathSquareIntersections(w, theta, d)
+	p1, p2, dx, dy, err := shared.PathSquareIntersections(w, theta, d)
 	if err != nil {
 		return fmt.Errorf("path does not intersect image: %w", err)
 	}
@@ -142,6 +192,51 @@ func (p *ObservationPath) ComputePathFromVelocity() error {
 	return nil
 }
 
+// SetPathEndpoints defines the path directly by its start (x0, y0) and end (x1, y1) in image pixels
+// (x is the column, y is the row) instead of from the velocity and offset, which is handy when
+// reproducing a specific observed chord. PathAngleDegrees and Direction are derived from the two
+// points. The endpoints do not determine the speed, so ShadowSpeedKmPerSec is taken from
+// DxKmPerSec and DyKmPerSec (0 if they are not set, which leaves the light curve without a time
+// scale); DxKmPerSec and DyKmPerSec are then replaced by the equivalent components along the new
+// path. PathOffsetFromCenterKm is not used. Any previously computed sample points are discarded.
+func (p *ObservationPath) SetPathEndpoints(x0, y0, x1, y1 float64) error {
+	ix := x1 - x0
+	iy := y1 - y0
+	length := math.Sqrt(ix*ix + iy*iy)
+	if length == 0 {
+		return errors.New("the path start and end points are the same")
+	}
+
+	p.StartX = x0
+	p.StartY = y0
+	p.EndX = x1
+	p.EndY = y1
+	p.SamplePoints = nil
+
+	// ComputePathFromVelocity runs the path through the image (column, row) in the direction of
+	// (DxKmPerSec, DyKmPerSec), so the path angle atan2(-Dx, -Dy) is atan2(-ix, -iy).
+	p.PathAngleDegrees = math.Atan2(-ix, -iy) * 180.0 / math.Pi
+	if p.PathAngleDegrees < 0.0 {
+		p.PathAngleDegrees += 360.0
+	}
+
+	p.ShadowSpeedKmPerSec = math.Sqrt(p.DxKmPerSec*p.DxKmPerSec + p.DyKmPerSec*p.DyKmPerSec)
+	p.DxKmPerSec = p.ShadowSpeedKmPerSec * ix / length
+	p.DyKmPerSec = p.ShadowSpeedKmPerSec * iy / length
+
+	switch {
+	case math.Abs(iy) > math.Abs(ix) && iy > 0:
+		p.Direction = "top to bottom"
+	case math.Abs(iy) > math.Abs(ix):
+		p.Direction = "bottom to top"
+	case ix > 0:
+		p.Direction = "left to right"
+	default:
+		p.Direction = "right to left"
+	}
+	return nil
+}
+
 func (p *ObservationPath) setStartEnd(pStart, pEnd annotatedPoint) {
 	p.StartX = pStart.X
 	p.StartY = pStart.Y
@@ -149,104 +244,53 @@ func (p *ObservationPath) setStartEnd(pStart, pEnd annotatedPoint) {
 	p.EndY = pEnd.Y
 }
 
-// pathSquareIntersections finds where a line intersects a square centered at origin.
-// w: square width
-// theta: angle of line measured CCW from y-axis (radians)
-// d: perpendicular distance from origin to the line
-// Returns the two intersection points, direction vector (dx, dy), and error.
-func pathSquareIntersections(w, theta, d float64) (annotatedPoint, annotatedPoint, float64, float64, error) {
-	halfW := w / 2.0
-
-	// Direction vector of the line (perpendicular to the normal)
-	dx := math.Sin(theta)
-	dy := math.Cos(theta)
-
-	// Normal vector pointing in the direction of offset (perpendicular to line, rotated 90° CW)
-	nx := dy  // cos(theta)
-	ny := -dx // -sin(theta)
-
-	// A point on the line: offset from origin by distance d along the normal
-	x0 := d * nx
-	y0 := d * ny
-
-	// Line parametric form: x = x0 + t*dx, y = y0 + t*dy
-	// Find intersections with the four sides of the square
-	var intersections []annotatedPoint
-
-	// Right edge: x = halfW
-	if math.Abs(dx) > 1e-12 {
-		t := (halfW - x0) / dx
-		y := y0 + t*dy
-		if y >= -halfW && y <= halfW {
-			intersections = append(intersections, annotatedPoint{halfW, y, "right"})
-		}
-	}
-
-	// Left edge: x = -halfW
-	if math.Abs(dx) > 1e-12 {
-		t := (-halfW - x0) / dx
-		y := y0 + t*dy
-		if y >= -halfW && y <= halfW {
-			intersections = append(intersections, annotatedPoint{-halfW, y, "left"})
-		}
-	}
+// ComputeSamplePoints generates sample points along the observation path.
+// Points are sampled at 1-pixel intervals along the path.
+func (p *ObservationPath) ComputeSamplePoints() {
+	p.ComputeSamplePointsOversampled(1)
+}
 
-	// Bottom edge: y = halfW
-	if math.Abs(dy) > 1e-12 {
-		t := (halfW - y0) / dy
-		x := x0 + t*dx
-		if x >= -halfW && x <= halfW {
-			intersections = append(intersections, annotatedPoint{x, halfW, "bottom"})
-		}
+// ComputeSamplePointsN generates n sample points along the observation path, whatever its length:
+// the path is divided into n-1 equal segments, so the first point is the path start and the last
+// point the path end. DistanceFromStart is still expressed in pixels. Values of n < 2 give the
+// 1-pixel sampling of ComputeSamplePoints.
+func (p *ObservationPath) ComputeSamplePointsN(n int) {
+	if n < 2 {
+		p.ComputeSamplePoints()
+		return
 	}
+	xLength := p.EndX - p.StartX
+	yLength := p.EndY - p.StartY
+	pathLength := math.Sqrt(xLength*xLength + yLength*yLength)
 
-	// Top edge: y = -halfW
-	if math.Abs(dy) > 1e-12 {
-		t := (-halfW - y0) / dy
-		x := x0 + t*dx
-		if x >= -halfW && x <= halfW {
-			intersections = append(intersections, annotatedPoint{x, -halfW, "top"})
+	p.SamplePoints = make([]PathPoint, n)
+	for i := range p.SamplePoints {
+		fraction := float64(i) / float64(n-1)
+		p.SamplePoints[i] = PathPoint{
+			X:                 p.StartX + fraction*xLength,
+			Y:                 p.StartY + fraction*yLength,
+			DistanceFromStart: fraction * pathLength,
 		}
 	}
-
-	// Remove duplicate corner intersections
-	intersections = removeDuplicatePoints(intersections, 1e-9)
-
-	if len(intersections) < 2 {
-		return annotatedPoint{}, annotatedPoint{}, dx, dy, ErrNoIntersection
-	}
-	return intersections[0], intersections[1], dx, dy, nil
 }
 
-func removeDuplicatePoints(pts []annotatedPoint, tol float64) []annotatedPoint {
-	var result []annotatedPoint
-	for _, p := range pts {
-		duplicate := false
-		for _, r := range result {
-			if math.Abs(p.X-r.X) < tol && math.Abs(p.Y-r.Y) < tol {
-				duplicate = true
-				break
-			}
-		}
-		if !duplicate {
-			result = append(result, p)
-		}
+// ComputeSamplePointsOversampled generates sample points along the observation path
+// at samplesPerPixel points per pixel of path length (1/samplesPerPixel pixel spacing).
+// DistanceFromStart is still expressed in pixels. Values of samplesPerPixel < 1 are treated as 1.
+func (p *ObservationPath) ComputeSamplePointsOversampled(samplesPerPixel int) {
+	if samplesPerPixel < 1 {
+		samplesPerPixel = 1
 	}
-	return result
-}
-
-// ComputeSamplePoints generates sample points along the observation path.
-// Points are sampled at 1-pixel intervals along the path.
-func (p *ObservationPath) ComputeSamplePoints() {
 	xLength := p.EndX - p.StartX
 	yLength := p.EndY - p.StartY
 	pathLength := math.Sqrt(xLength*xLength + yLength*yLength)
 
-	dYPerStep := yLength / pathLength
-	dXPerStep := xLength / pathLength
+	stepLength := 1.0 / float64(samplesPerPixel)
+	dYPerStep := stepLength * yLength / pathLength
+	dXPerStep := stepLength * xLength / pathLength
 
 	p.SamplePoints = nil
-	for i := 0; i < int(math.Round(pathLength)); i++ {
+	for i := 0; i < int(math.Round(pathLength*float64(samplesPerPixel))); i++ {
 		k := float64(i)
 		xVal := p.StartX + k*dXPerStep
 		yVal := p.StartY + k*dYPerStep
@@ -259,48 +303,17 @@ func (p *ObservationPath) ComputeSamplePoints() {
 	}
 }
 
-// interpolate performs bilinear interpolation on a 2D matrix at the given (x, y) coordinates.
-func interpolate(matrix [][]float64, x, y float64) float64 {
-	n := len(matrix)
-	if n == 0 {
-		return 0
-	}
-
-	// Clamp to valid range
-	if x < 0 {
-		x = 0
-	}
-	if y < 0 {
-		y = 0
-	}
-	if x >= float64(n-1) {
-		x = float64(n-1) - 1e-9
-	}
-	if y >= float64(n-1) {
-		y = float64(n-1) - 1e-9
-	}
-
-	// Integer indices
-	x0 := int(x)
-	y0 := int(y)
-	x1 := x0 + 1
-	y1 := y0 + 1
-
-	// Fractional parts
-	xFrac := x - float64(x0)
-	yFrac := y - float64(y0)
-
-	// Four surrounding values
-	v00 := matrix[y0][x0]
-	v01 := matrix[y0][x1]
-	v10 := matrix[y1][x0]
-	v11 := matrix[y1][x1]
-
-	// Bilinear interpolation
-	v0 := v00*(1-xFrac) + v01*xFrac
-	v1 := v10*(1-xFrac) + v11*xFrac
+// InterpolatedIntensity returns the bilinearly interpolated value of matrix at the fractional
+// pixel position (x, y), where x is the column and y is the row. Positions outside the matrix
+// are clamped to its edges. This is convenient for querying the intensity under a mouse pointer.
+func InterpolatedIntensity(matrix [][]float64, x, y float64) float64 {
+	return shared.Interpolate(matrix, x, y)
+}
 
-	return v0*(1-yFrac) + v1*yFrac
+// BicubicIntensity returns the bicubic (Catmull-Rom) interpolated value of matrix at the fractional
+// pixel position (x, y). Edge clamping matches InterpolatedIntensity.
+func BicubicIntensity(matrix [][]float64, x, y float64) float64 {
+	return shared.InterpolateBicubic(matrix, x, y)
 }
 
 // LoadGray16PNG loads a 16-bit grayscale PNG image and returns it as a 2D float64 matrix.
@@ -385,30 +398,125 @@ func LoadGray8PNG(filename string) (matrix [][]float64, err error) {
 	return matrix, nil
 }
 
-// ExtractLightCurve extracts intensity values along the observation path from the intensity matrix.
-// Returns a slice of LightCurvePoints with distance and intensity values.
-func ExtractLightCurve(intensityMatrix [][]float64, path *ObservationPath) []Point {
+// ExtractLightCurve extracts intensity values along the observation path from the intensity matrix,
+// using the interpolation selected by path.Interpolation. Returns a slice of LightCurvePoints with distance and intensity values,
+// or ErrPathTooShort if the path has fewer than two sample points.
+func ExtractLightCurve(intensityMatrix [][]float64, path *ObservationPath) ([]Point, error) {
 	if len(path.SamplePoints) == 0 {
 		path.ComputeSamplePoints()
 	}
+	if len(path.SamplePoints) < 2 {
+		return nil, ErrPathTooShort
+	}
 
 	distancePerPoint := path.FundamentalPlaneWidthKm / float64(path.FundamentalPlaneWidthPts)
 
 	lightCurve := make([]Point, len(path.SamplePoints))
 	for i, pt := range path.SamplePoints {
-		intensity := interpolate(intensityMatrix, pt.X, pt.Y)
+		var intensity float64
+		if path.Interpolation == Bicubic {
+			intensity = BicubicIntensity(intensityMatrix, pt.X, pt.Y)
+		} else {
+			intensity = InterpolatedIntensity(intensityMatrix, pt.X, pt.Y)
+		}
 		lightCurve[i] = Point{
 			Distance:  pt.DistanceFromStart * distancePerPoint,
 			Intensity: intensity,
 		}
 	}
 
-	return lightCurve
+	return lightCurve, nil
+}
+
+// ExtractLightCurveDetailed is like ExtractLightCurve but keeps the image coordinates of every
+// sample and adds its time, which makes it easy to check where the path actually runs.
+func ExtractLightCurveDetailed(intensityMatrix [][]float64, path *ObservationPath) ([]DetailedPoint, error) {
+	lightCurve, err := ExtractLightCurve(intensityMatrix, path)
+	if err != nil {
+		return nil, err
+	}
+
+	detailed := make([]DetailedPoint, len(lightCurve))
+	for i, pt := range path.SamplePoints {
+		timeSec := 0.0
+		if path.ShadowSpeedKmPerSec > 0.0 {
+			timeSec = lightCurve[i].Distance / path.ShadowSpeedKmPerSec
+		}
+		detailed[i] = DetailedPoint{
+			X:          pt.X,
+			Y:          pt.Y,
+			DistanceKm: lightCurve[i].Distance,
+			TimeSec:    timeSec,
+			Intensity:  lightCurve[i].Intensity,
+		}
+	}
+
+	return detailed, nil
+}
+
+// ExtractLightCurveOversampled extracts intensity values along the observation path with
+// samplesPerPixel samples per pixel of path length. Oversampling captures sharp fringe peaks
+// that 1-pixel steps can miss on diagonal paths. The path's SamplePoints are recomputed at
+// the requested density, so later calls using the same path (e.g. FindEdgesInGeometricShadow)
+// see the oversampled points too.
+func ExtractLightCurveOversampled(intensityMatrix [][]float64, path *ObservationPath, samplesPerPixel int) ([]Point, error) {
+	path.ComputeSamplePointsOversampled(samplesPerPixel)
+	return ExtractLightCurve(intensityMatrix, path)
+}
+
+// ExtractLightCurveTimeSampled extracts intensity values along the observation path at equal time
+// steps of dtSec, as a camera would record them, starting at the path start and continuing for
+// totalSec seconds (or to the end of the path if totalSec <= 0 or the path ends first). The path
+// position for each time is interpolated from the shadow speed. For now the speed is taken to be
+// constant, so the samples are equally spaced along the path, but callers should not rely on that.
+// ComputePathFromVelocity must have been called first.
+func ExtractLightCurveTimeSampled(intensityMatrix [][]float64, path *ObservationPath, dtSec, totalSec float64) ([]TimePoint, error) {
+	if dtSec <= 0.0 {
+		return nil, fmt.Errorf("time step must be positive (got %g seconds)", dtSec)
+	}
+	if path.ShadowSpeedKmPerSec <= 0.0 || path.FundamentalPlaneWidthPts <= 0 {
+		return nil, errors.New("time sampling needs a moving shadow and a valid fundamental plane width")
+	}
+
+	xLength := path.EndX - path.StartX
+	yLength := path.EndY - path.StartY
+	pathLength := math.Sqrt(xLength*xLength + yLength*yLength)
+	if pathLength < 1.0 {
+		return nil, ErrPathTooShort
+	}
+
+	kmPerPixel := path.FundamentalPlaneWidthKm / float64(path.FundamentalPlaneWidthPts)
+	pathDurationSec := pathLength * kmPerPixel / path.ShadowSpeedKmPerSec
+	if totalSec <= 0.0 || totalSec > pathDurationSec {
+		totalSec = pathDurationSec
+	}
+
+	numSamples := int(math.Floor(totalSec/dtSec)) + 1
+	lightCurve := make([]TimePoint, 0, numSamples)
+	for i := 0; i < numSamples; i++ {
+		t := float64(i) * dtSec
+		// Distance along the path (pixels) at time t (constant speed for now)
+		d := t * path.ShadowSpeedKmPerSec / kmPerPixel
+		x := path.StartX + d*xLength/pathLength
+		y := path.StartY + d*yLength/pathLength
+
+		var intensity float64
+		if path.Interpolation == Bicubic {
+			intensity = BicubicIntensity(intensityMatrix, x, y)
+		} else {
+			intensity = InterpolatedIntensity(intensityMatrix, x, y)
+		}
+		lightCurve = append(lightCurve, TimePoint{TimeSec: t, Intensity: intensity})
+	}
+
+	return lightCurve, nil
 }
 
 // FindEdgesInGeometricShadow detects edge transitions in the geometric shadow image
 // along the observation path. Returns the distances (from path start) where edges occur.
-// An edge is detected when the interpolated value transitions between 0 and 1.
+// An edge is detected when the interpolated value transitions between 0 and 1. If the path ends
+// inside the shadow an edge is added at the path end, so the result always has pairs of edges.
+// Use PairEdges to also remove the narrow segments made where two shapes touch.
 func FindEdgesInGeometricShadow(geometricMatrix [][]float64, path *ObservationPath) []float64 {
 	if len(path.SamplePoints) == 0 {
 		path.ComputeSamplePoints()
@@ -418,7 +526,7 @@ func FindEdgesInGeometricShadow(geometricMatrix [][]float64, path *ObservationPa
 	colorAtNextEdge := 1.0
 
 	for _, pt := range path.SamplePoints {
-		pixelValue := interpolate(geometricMatrix, pt.X, pt.Y)
+		pixelValue := InterpolatedIntensity(geometricMatrix, pt.X, pt.Y)
 		if pixelValue > 0.0 {
 			pixelValue = 1.0
 		}
@@ -427,31 +535,465 @@ func FindEdgesInGeometricShadow(geometricMatrix [][]float64, path *ObservationPa
 			colorAtNextEdge = 1.0 - colorAtNextEdge // Toggle
 		}
 	}
+	if len(edges) == 0 {
+		return edges
+	}
 
+	pathEnd := path.SamplePoints[len(path.SamplePoints)-1].DistanceFromStart
+	edges, _, _ = shared.PairEdges(edges, 0.0, pathEnd)
 	return edges
 }
 
-// StepTicks is a custom tick marker for plots with fixed step intervals.
-type StepTicks struct {
-	Step   float64
-	Format string
-}
-
-func (t StepTicks) Ticks(min, max float64) []plot.Tick {
-	var ticks []plot.Tick
-	start := math.Ceil(min/t.Step) * t.Step
-	for v := start; v <= max; v += t.Step {
-		ticks = append(ticks, plot.Tick{
-			Value: v,
-			Label: fmt.Sprintf(t.Format, v),
-		})
+// PairEdges removes each pair of consecutive edges closer than minSeparation (a spurious segment,
+// for example where a satellite touches the main body) from edges, and adds pathEnd if an edge is
+// then left unpaired. merged is the number of pairs removed. All values are in the same units
+// (pixels from the path start for the edges of FindEdgesInGeometricShadow).
+func PairEdges(edges []float64, minSeparation, pathEnd float64) (paired []float64, merged int, unpaired bool) {
+	return shared.PairEdges(edges, minSeparation, pathEnd)
+}
+
+// IntegratedDrop returns the mean normalized intensity over the occulted part of lightCurve and the
+// equivalent magnitude drop, -2.5 log10(mean). This is the single number an observer measures
+// when the whole event is integrated. edges are in pixels from the path start, as returned by
+// FindEdgesInGeometricShadow; consecutive pairs of edges (disappearance, reappearance) bound the
+// occulted intervals, and an odd final edge means the path ends inside the shadow. lightCurve may
+// come from any of the Extract functions that return []Point. The magnitude drop is +Inf for a
+// mean intensity of zero or less.
+func IntegratedDrop(lightCurve []Point, edges []float64, path *ObservationPath) (meanIntensity, magDrop float64, err error) {
+	if len(edges) == 0 {
+		return 0, 0, ErrNoOccultation
+	}
+	if path.FundamentalPlaneWidthPts <= 0 {
+		return 0, 0, errors.New("the fundamental plane width must be given to convert the edges to km")
+	}
+	distancePerPoint := path.FundamentalPlaneWidthKm / float64(path.FundamentalPlaneWidthPts)
+
+	edgesKm := make([]float64, len(edges))
+	for i, edge := range edges {
+		edgesKm[i] = edge * distancePerPoint
+	}
+
+	sum := 0.0
+	count := 0
+	for _, pt := range lightCurve {
+		if shared.GeometricStep(pt.Distance, edgesKm) == 0.0 {
+			sum += pt.Intensity
+			count++
+		}
 	}
-	return ticks
+	if count == 0 {
+		return 0, 0, errors.New("no light curve samples lie inside the occulted interval")
+	}
+
+	meanIntensity = sum / float64(count)
+	if meanIntensity <= 0.0 {
+		return meanIntensity, math.Inf(1), nil
+	}
+	return meanIntensity, -2.5 * math.Log10(meanIntensity), nil
+}
+
+// AnalyzeFringes measures the diffraction fringes just outside the geometric shadow of lightCurve.
+// The edge is taken as the first place the curve crosses the level halfway between its minimum and
+// the unocculted baseline of 1 (or, if the curve starts in the shadow, the first place it rises
+// through that level). Moving away from the shadow, peakAmplitude is the height above the baseline
+// of the first bright fringe and spacingKm is the distance between the first two bright fringes.
+// Both are 0 if the curve has no edge or fewer than two fringes; peakAmplitude is still given
+// when only one fringe is found.
+func AnalyzeFringes(lc []Point) (spacingKm, peakAmplitude float64) {
+	if len(lc) < 3 {
+		return 0, 0
+	}
+	minIntensity := lc[0].Intensity
+	for _, pt := range lc {
+		minIntensity = math.Min(minIntensity, pt.Intensity)
+	}
+	level := (1.0 + minIntensity) / 2.0
+	startsInShadow := lc[0].Intensity < level
+	for i := 0; i+1 < len(lc); i++ {
+		if startsInShadow && lc[i+1].Intensity >= level {
+			return analyzeFringesAt(lc, i+1)
+		}
+		if !startsInShadow && lc[i+1].Intensity < level {
+			return analyzeFringesAt(lc, i)
+		}
+	}
+	return 0, 0
+}
+
+// AnalyzeFringesFromEdge is AnalyzeFringes with the edge given as a distance along the curve (km),
+// for example an edge from FindEdgesInGeometricShadow multiplied by the km per pixel.
+func AnalyzeFringesFromEdge(lc []Point, edgeKm float64) (spacingKm, peakAmplitude float64) {
+	if len(lc) < 3 {
+		return 0, 0
+	}
+	nearest := 0
+	for i, pt := range lc {
+		if math.Abs(pt.Distance-edgeKm) < math.Abs(lc[nearest].Distance-edgeKm) {
+			nearest = i
+		}
+	}
+	return analyzeFringesAt(lc, nearest)
+}
+
+// analyzeFringesAt walks away from the shadow, starting at the edge sample lc[edge], and measures the
+// first two bright fringes (strict local maxima, so flat stretches are not fringes). The side of the
+// edge with the brighter neighbour is taken as the outside of the shadow.
+func analyzeFringesAt(lc []Point, edge int) (spacingKm, peakAmplitude float64) {
+	step := 1
+	switch {
+	case edge == len(lc)-1:
+		step = -1
+	case edge > 0 && lc[edge-1].Intensity > lc[edge+1].Intensity:
+		step = -1
+	}
+
+	var peaks []int
+	for i := edge + step; i-step >= 0 && i+step >= 0 && i+step < len(lc) && len(peaks) < 2; i += step {
+		if lc[i].Intensity > lc[i-step].Intensity && lc[i].Intensity > lc[i+step].Intensity {
+			peaks = append(peaks, i)
+		}
+	}
+	if len(peaks) == 0 {
+		return 0, 0
+	}
+	peakAmplitude = lc[peaks[0]].Intensity - 1.0
+	if len(peaks) < 2 {
+		return 0, peakAmplitude
+	}
+	return math.Abs(lc[peaks[1]].Distance - lc[peaks[0]].Distance), peakAmplitude
+}
+
+// RefinedEdge is an edge found in the geometric shadow together with the diffraction (half-light)
+// position of the same edge. Both are distances along the light curve in km.
+type RefinedEdge struct {
+	GeometricKm   float64
+	DiffractionKm float64 // Equal to GeometricKm if no half-light crossing was found
+	Found         bool    // True if a half-light crossing was found
+}
+
+// RefineEdges moves each geometric edge (km along lightCurve, for example an edge from
+// FindEdgesInGeometricShadow multiplied by the km per pixel) to the nearest place where the light
+// curve, smoothed with a running mean smoothKm wide, crosses the half-light level halfway between
+// its minimum and the unocculted baseline of 1. This is where an observer would time the edge from
+// real data. The crossing is interpolated between samples. A smoothKm of 0 (or less than the sample
+// spacing) means no smoothing.
+func RefineEdges(lightCurve []Point, edgesKm []float64, smoothKm float64) []RefinedEdge {
+	refined := make([]RefinedEdge, len(edgesKm))
+	for i, edge := range edgesKm {
+		refined[i] = RefinedEdge{GeometricKm: edge, DiffractionKm: edge}
+	}
+	if len(lightCurve) < 2 {
+		return refined
+	}
+
+	smoothed := smoothLightCurve(lightCurve, smoothKm)
+	minIntensity := smoothed[0]
+	for _, v := range smoothed {
+		minIntensity = math.Min(minIntensity, v)
+	}
+	if minIntensity >= 1.0 {
+		return refined // No shadow to find the half-light level of
+	}
+	level := (1.0 + minIntensity) / 2.0
+
+	for i, edge := range edgesKm {
+		best := math.Inf(1)
+		for j := 0; j+1 < len(smoothed); j++ {
+			a, b := smoothed[j]-level, smoothed[j+1]-level
+			var crossing float64
+			switch {
+			case a == 0:
+				crossing = lightCurve[j].Distance
+			case (a < 0) != (b < 0):
+				// Linear interpolation of the crossing between samples j and j+1
+				f := a / (a - b)
+				crossing = lightCurve[j].Distance + f*(lightCurve[j+1].Distance-lightCurve[j].Distance)
+			default:
+				continue
+			}
+			if math.Abs(crossing-edge) < best {
+				best = math.Abs(crossing - edge)
+				refined[i].DiffractionKm = crossing
+				refined[i].Found = true
+			}
+		}
+	}
+	return refined
+}
+
+// EdgeTimingUncertainty estimates how precisely the edge at edgeKm (for example a RefinedEdge's
+// DiffractionKm) can be located in lightCurve when each sample has Gaussian noise with standard
+// deviation noise (in the normalized intensity units of the curve). The noise is converted to a
+// position error through the slope of the curve at the edge: sigmaKm = noise / |dI/dx|, and
+// sigmaSec = sigmaKm / speedKmPerSec. sigmaSec is 0 if speedKmPerSec is not positive (no time
+// scale). The slope is the central difference at the sample nearest the edge, so a steep, sharp
+// edge gives a small uncertainty.
+func EdgeTimingUncertainty(lightCurve []Point, edgeKm, noise, speedKmPerSec float64) (sigmaKm, sigmaSec float64, err error) {
+	if len(lightCurve) < 3 {
+		return 0, 0, ErrPathTooShort
+	}
+	nearest := 1
+	for i := 1; i < len(lightCurve)-1; i++ {
+		if math.Abs(lightCurve[i].Distance-edgeKm) < math.Abs(lightCurve[nearest].Distance-edgeKm) {
+			nearest = i
+		}
+	}
+	before, after := lightCurve[nearest-1], lightCurve[nearest+1]
+	slope := (after.Intensity - before.Intensity) / (after.Distance - before.Distance)
+	if slope == 0 || math.IsNaN(slope) {
+		return 0, 0, ErrFlatEdge
+	}
+	sigmaKm = noise / math.Abs(slope)
+	if speedKmPerSec > 0 {
+		sigmaSec = sigmaKm / speedKmPerSec
+	}
+	return sigmaKm, sigmaSec, nil
+}
+
+// DoubleStar describes the companion of a resolved double star being occulted. Each component casts
+// its own copy of the diffraction shadow, displaced by the separation of the pair projected onto the
+// fundamental plane.
+type DoubleStar struct {
+	SeparationKm      float64 // Separation of the components projected onto the fundamental plane (km); see MasToKm
+	PADegrees         float64 // Position angle of the companion, counter-clockwise from North (image up), as for the ellipses
+	CompanionFraction float64 // Fraction (0 to 1) of the total light that comes from the companion
+}
+
+// DoubleStarCurves holds the light curves of the two components of a double star along the same
+// observation, each normalized to its own unocculted level, and their flux-weighted sum.
+type DoubleStarCurves struct {
+	Primary       []Point
+	Companion     []Point
+	Combined      []Point
+	CompanionPath *ObservationPath // The parallel path along which the companion's curve was sampled
+}
+
+// MasToKm converts an angle in milliarcseconds (a double star separation, for example) to the
+// distance it spans at the asteroid, distanceAu away.
+func MasToKm(mas, distanceAu float64) float64 {
+	return 1.496e8 * distanceAu * mas / (1000.0 * 206265)
+}
+
+// ExtractDoubleStarLightCurves extracts the light curves of both components of a double star from
+// the intensity matrix of a single star. The primary is sampled along path. The companion's shadow is
+// displaced from the primary's by the separation, opposite to the PA, so seen from the observer it is
+// the same pattern sampled along a parallel path moved by the separation towards the PA. Samples of
+// that path that fall outside the matrix take the value at its nearest edge. Combined is
+// (1 - CompanionFraction) * Primary + CompanionFraction * Companion.
+func ExtractDoubleStarLightCurves(intensityMatrix [][]float64, path *ObservationPath, star DoubleStar) (DoubleStarCurves, error) {
+	if star.CompanionFraction < 0.0 || star.CompanionFraction > 1.0 {
+		return DoubleStarCurves{}, fmt.Errorf("the companion fraction must be between 0 and 1 (got %g)", star.CompanionFraction)
+	}
+	if path.FundamentalPlaneWidthKm <= 0.0 || path.FundamentalPlaneWidthPts <= 0 {
+		return DoubleStarCurves{}, errors.New("the fundamental plane width must be given to convert the separation to pixels")
+	}
+	primary, err := ExtractLightCurve(intensityMatrix, path)
+	if err != nil {
+		return DoubleStarCurves{}, err
+	}
+
+	// Image rows increase downwards, so North (PA 0) is -y and East (PA 90) is -x
+	separationPx := star.SeparationKm * float64(path.FundamentalPlaneWidthPts) / path.FundamentalPlaneWidthKm
+	pa := star.PADegrees * math.Pi / 180.0
+	dx := -separationPx * math.Sin(pa)
+	dy := -separationPx * math.Cos(pa)
+
+	companionPath := shiftedPath(path, dx, dy)
+	companion, err := ExtractLightCurve(intensityMatrix, &companionPath)
+	if err != nil {
+		return DoubleStarCurves{}, err
+	}
+
+	combined := make([]Point, len(primary))
+	for i := range primary {
+		combined[i] = Point{
+			Distance:  primary[i].Distance,
+			Intensity: (1.0-star.CompanionFraction)*primary[i].Intensity + star.CompanionFraction*companion[i].Intensity,
+		}
+	}
+	return DoubleStarCurves{Primary: primary, Companion: companion, Combined: combined, CompanionPath: &companionPath}, nil
+}
+
+// shiftedPath returns a copy of path moved by (dx, dy) pixels, sample points included, so that the
+// samples keep their distances from the start.
+func shiftedPath(path *ObservationPath, dx, dy float64) ObservationPath {
+	shifted := *path
+	shifted.StartX += dx
+	shifted.StartY += dy
+	shifted.EndX += dx
+	shifted.EndY += dy
+	shifted.SamplePoints = make([]PathPoint, len(path.SamplePoints))
+	for i, pt := range path.SamplePoints {
+		shifted.SamplePoints[i] = PathPoint{X: pt.X + dx, Y: pt.Y + dy, DistanceFromStart: pt.DistanceFromStart}
+	}
+	return shifted
+}
+
+// ExtractLightCurveFan extracts one light curve for each of offsetsKm along a path parallel to
+// basePath and moved sideways by that offset (a positive offset moves it as a larger
+// PathOffsetFromCenterKm would). Only the path changes, so a whole fan costs no more diffraction
+// than a single curve. Each path is the sample points of basePath shifted, so all the curves share
+// the distance axis of basePath: row i of the result is the curve at offsetsKm[i], and column j is
+// the same distance along every path, which makes the result a map of offset against distance.
+// Samples that fall outside the matrix take the value at its nearest edge.
+func ExtractLightCurveFan(intensityMatrix [][]float64, basePath *ObservationPath, offsetsKm []float64) ([][]Point, error) {
+	if basePath.FundamentalPlaneWidthKm <= 0.0 || basePath.FundamentalPlaneWidthPts <= 0 {
+		return nil, errors.New("the fundamental plane width must be given to convert the offsets to pixels")
+	}
+	if len(basePath.SamplePoints) == 0 {
+		basePath.ComputeSamplePoints()
+	}
+	dx := basePath.EndX - basePath.StartX
+	dy := basePath.EndY - basePath.StartY
+	length := math.Hypot(dx, dy)
+	if length == 0.0 {
+		return nil, ErrPathTooShort
+	}
+	// Perpendicular to the direction of travel, on the side a larger PathOffsetFromCenterKm moves to
+	nx, ny := -dy/length, dx/length
+	pixelsPerKm := float64(basePath.FundamentalPlaneWidthPts) / basePath.FundamentalPlaneWidthKm
+
+	fan := make([][]Point, len(offsetsKm))
+	for i, offsetKm := range offsetsKm {
+		path := shiftedPath(basePath, offsetKm*pixelsPerKm*nx, offsetKm*pixelsPerKm*ny)
+		curve, err := ExtractLightCurve(intensityMatrix, &path)
+		if err != nil {
+			return nil, fmt.Errorf("offset %g km: %w", offsetKm, err)
+		}
+		fan[i] = curve
+	}
+	return fan, nil
+}
+
+// RadialProfile returns the azimuthal average of m about the center (cx, cy) (x is the column, y
+// the row, in pixels): the mean of the pixels in each 1 pixel wide ring, against the radius in
+// pixels. If cx or cy is NaN the plane center is used, as for the observation paths. Rings that
+// reach past the nearest edge of m only average the azimuths inside it. NaN and Inf pixels are
+// skipped, and empty rings are left out. Use RadialProfileKm for the radius in km.
+func RadialProfile(m [][]float64, cx, cy float64) []Point {
+	if len(m) == 0 || len(m[0]) == 0 {
+		return nil
+	}
+	if math.IsNaN(cx) || math.IsNaN(cy) {
+		cx = float64(len(m[0])) / 2.0
+		cy = float64(len(m)) / 2.0
+	}
+
+	var sums []float64
+	var counts []int
+	for y, row := range m {
+		for x, v := range row {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			ring := int(math.Round(math.Hypot(float64(x)-cx, float64(y)-cy)))
+			for ring >= len(sums) {
+				sums = append(sums, 0)
+				counts = append(counts, 0)
+			}
+			sums[ring] += v
+			counts[ring]++
+		}
+	}
+
+	profile := make([]Point, 0, len(sums))
+	for ring := range sums {
+		if counts[ring] > 0 {
+			profile = append(profile, Point{Distance: float64(ring), Intensity: sums[ring] / float64(counts[ring])})
+		}
+	}
+	return profile
+}
+
+// RadialProfileKm is RadialProfile with the radius converted to km, for kmPerPixel km per pixel
+// (FundamentalPlaneWidthKm / FundamentalPlaneWidthPts).
+func RadialProfileKm(m [][]float64, cx, cy, kmPerPixel float64) []Point {
+	profile := RadialProfile(m, cx, cy)
+	for i := range profile {
+		profile[i].Distance *= kmPerPixel
+	}
+	return profile
+}
+
+// smoothLightCurve returns the intensities of lc smoothed with a running mean widthKm wide
+// (centered, and shortened at the ends of the curve).
+func smoothLightCurve(lc []Point, widthKm float64) []float64 {
+	smoothed := make([]float64, len(lc))
+	spacing := math.Abs(lc[len(lc)-1].Distance-lc[0].Distance) / float64(len(lc)-1)
+	half := 0
+	if spacing > 0 && widthKm > spacing {
+		half = int(math.Round(widthKm / spacing / 2.0))
+	}
+	for i := range lc {
+		lo, hi := max(0, i-half), min(len(lc)-1, i+half)
+		sum := 0.0
+		for j := lo; j <= hi; j++ {
+			sum += lc[j].Intensity
+		}
+		smoothed[i] = sum / float64(hi-lo+1)
+	}
+	return smoothed
+}
+
+// StepTicks is a custom tick marker for plots with fixed step intervals.
+// It is shared with the main IOTAdiffraction application.
+type StepTicks = shared.StepTicks
+
+// DefaultPlotTitle is the light curve plot title used when PlotOptions.Title is empty.
+const DefaultPlotTitle = "Light curve along observation path"
+
+// PlotOptions holds the optional settings of a light curve plot.
+type PlotOptions struct {
+	Title          string // Plot title. If empty, DefaultPlotTitle is used.
+	Residual       bool   // Add the lower panel of PlotLightCurveWithResidual
+	HalfLightEdges bool   // Also mark the half-light position of each edge found by RefineEdges
+	GeometricStep  bool   // Draw the geometric (no diffraction) 0/1 step at the edges as a thin gray line
+
+	// Tick steps and label formats of the axes. A step of 0 keeps the default (a twentieth of the
+	// path length for x, 0.2 for y) and an empty format keeps "%.2f".
+	XTickStepKm float64
+	YTickStep   float64
+	XTickFormat string
+	YTickFormat string
 }
 
 // PlotLightCurve creates a plot of the light curve with optional edge markers.
 // Returns the plot as an image.Image.
 func PlotLightCurve(lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64) (image.Image, error) {
+	return plotLightCurve(lightCurve, edges, path, wPx, hPx, PlotOptions{})
+}
+
+// PlotLightCurveWithResidual is PlotLightCurve with a lower panel showing the light curve minus the
+// geometric (0/1 step at the edges) curve, which leaves only the diffraction ringing. The two
+// panels share the x axis and together fill wPx by hPx.
+func PlotLightCurveWithResidual(lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64) (image.Image, error) {
+	return plotLightCurve(lightCurve, edges, path, wPx, hPx, PlotOptions{Residual: true})
+}
+
+// PlotLightCurveWithOptions is PlotLightCurve with the title, residual panel and ticks set by opts.
+func PlotLightCurveWithOptions(lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64, opts PlotOptions) (image.Image, error) {
+	return plotLightCurve(lightCurve, edges, path, wPx, hPx, opts)
+}
+
+func plotLightCurve(lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64, opts PlotOptions) (image.Image, error) {
+	const dpi = 96
+	width := vg.Length(wPx) * vg.Inch / dpi
+	height := vg.Length(hPx) * vg.Inch / dpi
+
+	c := vgimg.New(width, height)
+	if err := drawLightCurvePlot(c, lightCurve, edges, path, opts); err != nil {
+		return nil, err
+	}
+	return c.Image(), nil
+}
+
+// drawLightCurvePlot draws the light curve plot (with the residual panel if asked) on c, which can
+// be any vg backend.
+func drawLightCurvePlot(c vg.CanvasSizer, lightCurve []Point, edges []float64, path *ObservationPath, opts PlotOptions) error {
+	if len(path.SamplePoints) < 2 || len(lightCurve) < 2 {
+		return ErrPathTooShort
+	}
+
 	p := plot.New()
 
 	p.Y.Min = -0.2
@@ -478,14 +1020,27 @@ func PlotLightCurve(lightCurve []Point, edges []float64, path *ObservationPath,
 	p.Y.Tick.Label.Font.Variant = "Sans"
 	p.Y.Tick.Label.Font.Size = vg.Points(10)
 
+	p.Legend.TextStyle.Font.Typeface = "Liberation"
+	p.Legend.TextStyle.Font.Variant = "Sans"
+	p.Legend.TextStyle.Font.Size = vg.Points(10)
+	p.Legend.Top = true
+
 	distancePerPoint := path.FundamentalPlaneWidthKm / float64(path.FundamentalPlaneWidthPts)
 	pointSpan := path.SamplePoints[len(path.SamplePoints)-1].DistanceFromStart
 
-	p.Title.Text = "Light curve along observation path"
-	p.X.Label.Text = fmt.Sprintf("km (divide by shadow speed of %.3f km/s for time)", path.ShadowSpeedKmPerSec)
+	p.Title.Text = opts.Title
+	if p.Title.Text == "" {
+		p.Title.Text = DefaultPlotTitle
+	}
+	if path.ShadowSpeedKmPerSec > 0.0 {
+		p.X.Label.Text = fmt.Sprintf("km (divide by shadow speed of %.3f km/s for time)", path.ShadowSpeedKmPerSec)
+	} else {
+		// No shadow motion, so there is no time axis: distance only
+		p.X.Label.Text = "km along the path (shadow speed is zero, so no time scale)"
+	}
 	p.Y.Label.Text = "normalized intensity"
-	p.X.Tick.Marker = StepTicks{Step: pointSpan * distancePerPoint / 20, Format: "%.2f"}
-	p.Y.Tick.Marker = StepTicks{Step: 0.2, Format: "%.2f"}
+	p.X.Tick.Marker = shared.AxisTicks(opts.XTickStepKm, opts.XTickFormat, pointSpan*distancePerPoint/20)
+	p.Y.Tick.Marker = shared.AxisTicks(opts.YTickStep, opts.YTickFormat, 0.2)
 	p.Add(plotter.NewGrid())
 
 	// Plot the light curve data
@@ -496,15 +1051,30 @@ func PlotLightCurve(lightCurve []Point, edges []float64, path *ObservationPath,
 		pts[i].Y = lightCurve[i].Intensity
 	}
 
+	// The geometric step goes under the light curve
+	if opts.GeometricStep {
+		edgesKm := make([]float64, len(edges))
+		for i, edge := range edges {
+			edgesKm[i] = edge * distancePerPoint
+		}
+		stepLine, err := shared.GeometricStepLine(pts, edgesKm)
+		if err != nil {
+			return err
+		}
+		p.Add(stepLine)
+		p.Legend.Add("geometric step", stepLine)
+	}
+
 	line, err := plotter.NewLine(pts)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	line.Color = color.RGBA{R: 0, G: 0, B: 255, A: 255}
 	p.Add(line)
+	p.Legend.Add("light curve", line)
 
 	// Add edge markers as red dashed vertical lines
-	for _, edge := range edges {
+	for i, edge := range edges {
 		vpts := plotter.XYs{
 			{X: edge * distancePerPoint, Y: -0.1},
 			{X: edge * distancePerPoint, Y: 1.3},
@@ -512,11 +1082,39 @@ func PlotLightCurve(lightCurve []Point, edges []float64, path *ObservationPath,
 
 		vline, err := plotter.NewLine(vpts)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		vline.Dashes = []vg.Length{vg.Points(6), vg.Points(4)}
 		vline.Color = color.RGBA{R: 255, G: 0, B: 0, A: 255}
 		p.Add(vline)
+		if i == 0 {
+			p.Legend.Add("geometric edge", vline)
+		}
+	}
+
+	// Add the half-light (diffraction) edges as green dashed vertical lines
+	if opts.HalfLightEdges {
+		edgesKm := make([]float64, len(edges))
+		for i, edge := range edges {
+			edgesKm[i] = edge * distancePerPoint
+		}
+		first := true
+		for _, edge := range RefineEdges(lightCurve, edgesKm, 3*distancePerPoint) {
+			if !edge.Found {
+				continue
+			}
+			vline, err := plotter.NewLine(plotter.XYs{{X: edge.DiffractionKm, Y: -0.1}, {X: edge.DiffractionKm, Y: 1.3}})
+			if err != nil {
+				return err
+			}
+			vline.Dashes = []vg.Length{vg.Points(2), vg.Points(2)}
+			vline.Color = color.RGBA{R: 0, G: 160, B: 0, A: 255}
+			p.Add(vline)
+			if first {
+				p.Legend.Add("half-light edge", vline)
+				first = false
+			}
+		}
 	}
 
 	// Add a zero line
@@ -526,27 +1124,42 @@ func PlotLightCurve(lightCurve []Point, edges []float64, path *ObservationPath,
 	}
 	hline, err := plotter.NewLine(hpts)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	hline.Dashes = []vg.Length{vg.Points(6), vg.Points(4)}
 	hline.Color = color.RGBA{R: 0, G: 0, B: 0, A: 255}
 	p.Add(hline)
 
-	// Render to image
-	const dpi = 96
-	width := vg.Length(wPx) * vg.Inch / dpi
-	height := vg.Length(hPx) * vg.Inch / dpi
-
-	c := vgimg.New(width, height)
 	dc := vgdraw.New(c)
-	p.Draw(dc)
+	if opts.Residual {
+		edgesKm := make([]float64, len(edges))
+		for i, edge := range edges {
+			edgesKm[i] = edge * distancePerPoint
+		}
+		lower, err := shared.ResidualPlot(pts, edgesKm, p.X.Tick.Marker)
+		if err != nil {
+			return err
+		}
+		shared.DrawStackedPlots(dc, p, lower, 0.35)
+	} else {
+		p.Draw(dc)
+	}
 
-	return c.Image(), nil
+	return nil
 }
 
 // SaveLightCurvePlot creates and saves a light curve plot to a PNG file.
 func SaveLightCurvePlot(filename string, lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64) (err error) {
-	img, err := PlotLightCurve(lightCurve, edges, path, wPx, hPx)
+	return saveLightCurvePlot(filename, lightCurve, edges, path, wPx, hPx, PlotOptions{})
+}
+
+// SaveLightCurvePlotWithResidual saves the plot made by PlotLightCurveWithResidual to a PNG file.
+func SaveLightCurvePlotWithResidual(filename string, lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64) (err error) {
+	return saveLightCurvePlot(filename, lightCurve, edges, path, wPx, hPx, PlotOptions{Residual: true})
+}
+
+func saveLightCurvePlot(filename string, lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64, opts PlotOptions) (err error) {
+	img, err := plotLightCurve(lightCurve, edges, path, wPx, hPx, opts)
 	if err != nil {
 		return err
 	}
@@ -564,10 +1177,145 @@ func SaveLightCurvePlot(filename string, lightCurve []Point, edges []float64, pa
 	return png.Encode(f, img)
 }
 
+// SaveLightCurvePlotVector saves the plot made by PlotLightCurve in the format given by the
+// extension of filename: .svg or .pdf (vector, for publication) or .png. wPx and hPx are at 96 dpi,
+// as for PlotLightCurve, so the vector plot has the same layout as the PNG.
+func SaveLightCurvePlotVector(filename string, lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64) (err error) {
+	return saveLightCurvePlotVector(filename, lightCurve, edges, path, wPx, hPx, PlotOptions{})
+}
+
+// SaveLightCurvePlotVectorWithResidual is SaveLightCurvePlotVector for the plot made by
+// PlotLightCurveWithResidual.
+func SaveLightCurvePlotVectorWithResidual(filename string, lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64) (err error) {
+	return saveLightCurvePlotVector(filename, lightCurve, edges, path, wPx, hPx, PlotOptions{Residual: true})
+}
+
+// SaveLightCurvePlotWithOptions saves the plot made by PlotLightCurveWithOptions in the format given
+// by the extension of filename, as SaveLightCurvePlotVector does.
+func SaveLightCurvePlotWithOptions(filename string, lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64, opts PlotOptions) (err error) {
+	return saveLightCurvePlotVector(filename, lightCurve, edges, path, wPx, hPx, opts)
+}
+
+func saveLightCurvePlotVector(filename string, lightCurve []Point, edges []float64, path *ObservationPath, wPx, hPx float64, opts PlotOptions) (err error) {
+	const dpi = 96
+	width := vg.Length(wPx) * vg.Inch / dpi
+	height := vg.Length(hPx) * vg.Inch / dpi
+
+	var c vg.CanvasWriterTo
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".svg":
+		c = vgsvg.New(width, height)
+	case ".pdf":
+		c = vgpdf.New(width, height)
+	case ".png":
+		c = vgimg.PngCanvas{Canvas: vgimg.New(width, height)}
+	default:
+		return fmt.Errorf("%q: unsupported plot format %q (use .svg, .pdf or .png)", filename, filepath.Ext(filename))
+	}
+	if err := drawLightCurvePlot(c, lightCurve, edges, path, opts); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	_, err = c.WriteTo(f)
+	return err
+}
+
+// MarkerShape selects the shape of the markers at the ends of a drawn observation path.
+type MarkerShape int
+
+const (
+	// MarkerCircle is a filled circle (the default).
+	MarkerCircle MarkerShape = iota
+	// MarkerSquare is a filled square.
+	MarkerSquare
+	// MarkerDiamond is a filled square standing on a corner.
+	MarkerDiamond
+)
+
+// PathStyle sets how an observation path is drawn: the line color and the color, shape and size of
+// the start and end markers. Fields left at their zero value take the DefaultPathStyle value, so
+// PathStyle{EndShape: MarkerSquare}, for example, only changes the end marker shape.
+type PathStyle struct {
+	LineColor    color.Color
+	StartColor   color.Color
+	EndColor     color.Color
+	StartShape   MarkerShape
+	EndShape     MarkerShape
+	MarkerRadius int // In image pixels
+}
+
+// DefaultPathStyle returns the traditional style: a red line, a red dot at the start and a green
+// dot at the end, each of radius 5.
+func DefaultPathStyle() PathStyle {
+	return PathStyle{
+		LineColor:    color.RGBA{R: 255, A: 255},
+		StartColor:   color.RGBA{R: 255, A: 255},
+		EndColor:     color.RGBA{G: 255, A: 255},
+		MarkerRadius: 5,
+	}
+}
+
+// ColorblindPathStyle returns a style that does not rely on telling red from green: a vermillion
+// line, a blue circle at the start and a yellow square at the end (colors from the Okabe-Ito palette).
+func ColorblindPathStyle() PathStyle {
+	return PathStyle{
+		LineColor:    color.RGBA{R: 213, G: 94, A: 255},
+		StartColor:   color.RGBA{G: 114, B: 178, A: 255},
+		EndColor:     color.RGBA{R: 240, G: 228, B: 66, A: 255},
+		StartShape:   MarkerCircle,
+		EndShape:     MarkerSquare,
+		MarkerRadius: 5,
+	}
+}
+
+// withDefaults returns s with its unset fields filled in from DefaultPathStyle.
+func (s PathStyle) withDefaults() PathStyle {
+	d := DefaultPathStyle()
+	if s.LineColor == nil {
+		s.LineColor = d.LineColor
+	}
+	if s.StartColor == nil {
+		s.StartColor = d.StartColor
+	}
+	if s.EndColor == nil {
+		s.EndColor = d.EndColor
+	}
+	if s.MarkerRadius <= 0 {
+		s.MarkerRadius = d.MarkerRadius
+	}
+	return s
+}
+
 // DrawObservationLineOnImage draws the observation path on an 8-bit image.
 // The path is drawn as a red line with a red dot at the start and a green dot at the end.
 // Returns a new RGBA image with the line drawn on it.
 func DrawObservationLineOnImage(sourceImage image.Image, path *ObservationPath) (*image.RGBA, error) {
+	return DrawObservationLineOnImageWithTicks(sourceImage, path, 0.0)
+}
+
+// DrawObservationLineOnImageWithTicks draws the observation path as DrawObservationLineOnImage does and,
+// if tickIntervalSecs > 0, adds a short yellow dash across the path every tickIntervalSecs seconds
+// of shadow motion (measured from the start of the path), so that the chord itself shows the timing.
+// ComputePathFromVelocity must have been called so that ShadowSpeedKmPerSec is set.
+func DrawObservationLineOnImageWithTicks(sourceImage image.Image, path *ObservationPath, tickIntervalSecs float64) (*image.RGBA, error) {
+	return DrawObservationLineOnImageStyled(sourceImage, path, tickIntervalSecs, DefaultPathStyle())
+}
+
+// DrawObservationLineOnImageStyled is DrawObservationLineOnImageWithTicks with the line and the
+// start and end markers drawn in the given style.
+func DrawObservationLineOnImageStyled(sourceImage image.Image, path *ObservationPath, tickIntervalSecs float64,
+	style PathStyle) (*image.RGBA, error) {
+	style = style.withDefaults()
 	bounds := sourceImage.Bounds()
 
 	// Create a new RGBA image to draw on
@@ -575,13 +1323,40 @@ func DrawObservationLineOnImage(sourceImage image.Image, path *ObservationPath)
 	draw.Draw(result, bounds, sourceImage, bounds.Min, draw.Src)
 
 	// Draw the observation line
-	drawLine(result, path.StartX, path.StartY, path.EndX, path.EndY, color.RGBA{R: 255, A: 255})
+	drawLine(result, path.StartX, path.StartY, path.EndX, path.EndY, style.LineColor)
 
-	// Draw the start dot (red)
-	drawDot(result, path.StartX, path.StartY, 5, color.RGBA{R: 255, A: 255})
+	if tickIntervalSecs > 0.0 {
+		if path.ShadowSpeedKmPerSec <= 0.0 || path.FundamentalPlaneWidthPts <= 0 {
+			return nil, errors.New("tick marks need a moving shadow and a valid fundamental plane width")
+		}
+		xLength := path.EndX - path.StartX
+		yLength := path.EndY - path.StartY
+		pathLength := math.Sqrt(xLength*xLength + yLength*yLength)
+		if pathLength > 0 {
+			// Unit vectors along and across the path
+			ux := xLength / pathLength
+			uy := yLength / pathLength
+			px := -uy
+			py := ux
+
+			kmPerPixel := path.FundamentalPlaneWidthKm / float64(path.FundamentalPlaneWidthPts)
+			tickSpacingPixels := tickIntervalSecs * path.ShadowSpeedKmPerSec / kmPerPixel
+			if tickSpacingPixels < 2.0 {
+				return nil, fmt.Errorf("tick marks every %g seconds would be only %0.2f pixels apart",
+					tickIntervalSecs, tickSpacingPixels)
+			}
+			halfLength := 6.0
+			for d := tickSpacingPixels; d < pathLength; d += tickSpacingPixels {
+				cx := path.StartX + d*ux
+				cy := path.StartY + d*uy
+				drawLine(result, cx-halfLength*px, cy-halfLength*py, cx+halfLength*px, cy+halfLength*py,
+					color.RGBA{R: 255, G: 255, A: 255})
+			}
+		}
+	}
 
-	// Draw the end dot (green)
-	drawDot(result, path.EndX, path.EndY, 5, color.RGBA{G: 255, A: 255})
+	DrawMarker(result, path.StartX, path.StartY, style.MarkerRadius, style.StartShape, style.StartColor)
+	DrawMarker(result, path.EndX, path.EndY, style.MarkerRadius, style.EndShape, style.EndColor)
 
 	return result, nil
 }
@@ -627,11 +1402,19 @@ func drawLine(img *image.RGBA, x1, y1, x2, y2 float64, col color.Color) {
 	}
 }
 
-// drawDot draws a filled circle on the image.
-func drawDot(img *image.RGBA, cx, cy float64, radius int, col color.Color) {
+// DrawMarker draws a filled marker of the given shape and radius (half its width, in pixels) centered
+// on (cx, cy). Parts outside the image are clipped.
+func DrawMarker(img *image.RGBA, cx, cy float64, radius int, shape MarkerShape, col color.Color) {
 	for y := -radius; y <= radius; y++ {
 		for x := -radius; x <= radius; x++ {
-			if x*x+y*y <= radius*radius {
+			inside := x*x+y*y <= radius*radius
+			switch shape {
+			case MarkerSquare:
+				inside = true
+			case MarkerDiamond:
+				inside = math.Abs(float64(x))+math.Abs(float64(y)) <= float64(radius)
+			}
+			if inside {
 				px := int(cx) + x
 				py := int(cy) + y
 				if px >= 0 && px < img.Bounds().Dx() && py >= 0 && py < img.Bounds().Dy() {
@@ -642,6 +1425,271 @@ func drawDot(img *image.RGBA, cx, cy float64, radius int, col color.Color) {
 	}
 }
 
+// DrawKmGrid draws grid lines every spacingKm over img, each labelled with its position in km.
+// The origin is the fundamental plane center used by AddEllipses (pixel (N-1)/2 in both
+// directions), x increases to the right and y increases upward, so the labels read directly
+// as the x_center_km and y_center_km values of an ellipse at that position.
+// Nothing is drawn if the grid lines would be less than 2 pixels apart.
+func DrawKmGrid(img *image.RGBA, kmPerPixel, spacingKm float64) {
+	DrawKmGridMirrored(img, kmPerPixel, spacingKm, false, false)
+}
+
+// DrawKmGridMirrored draws the grid as DrawKmGrid does on an image that has been mirrored left to
+// right (mirrorX) and/or top to bottom (mirrorY), so that the labels still give the plane coordinates.
+func DrawKmGridMirrored(img *image.RGBA, kmPerPixel, spacingKm float64, mirrorX, mirrorY bool) {
+	if kmPerPixel <= 0.0 || spacingKm <= 0.0 {
+		return
+	}
+	spacingPixels := spacingKm / kmPerPixel
+	if spacingPixels < 2.0 {
+		return
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	centerX := float64(width-1) / 2.0
+	centerY := float64(height-1) / 2.0
+
+	gridColor := color.RGBA{R: 0, G: 160, B: 255, A: 255}
+	labelColor := image.NewUniform(color.RGBA{R: 255, G: 255, A: 255})
+
+	fnt := vgfont.DefaultCache.Lookup(vgfont.Font{Typeface: "Liberation", Variant: "Sans"}, vg.Points(10))
+	drawer := &font.Drawer{Dst: img, Src: labelColor, Face: fnt.FontFace(72)}
+	labelHeight := drawer.Face.Metrics().Ascent.Ceil()
+
+	// Round away the floating point noise of k*spacingKm so that the labels read 0.3, not 0.30000000000000004
+	label := func(k int, mirrored bool) string {
+		if mirrored {
+			k = -k
+		}
+		return fmt.Sprintf("%g", math.Round(float64(k)*spacingKm*1e6)/1e6)
+	}
+
+	kMax := int(math.Ceil(math.Max(centerX, centerY) / spacingPixels))
+	for k := -kMax; k <= kMax; k++ {
+		x := int(math.Round(centerX + float64(k)*spacingPixels))
+		if x >= 0 && x < width {
+			for y := 0; y < height; y++ {
+				img.Set(bounds.Min.X+x, bounds.Min.Y+y, gridColor)
+			}
+			// x labels run along the bottom edge, just right of their line
+			drawer.Dot = fixed.P(bounds.Min.X+x+3, bounds.Max.Y-3)
+			drawer.DrawString(label(k, mirrorX))
+		}
+
+		y := int(math.Round(centerY - float64(k)*spacingPixels))
+		if y >= 0 && y < height {
+			for x := 0; x < width; x++ {
+				img.Set(bounds.Min.X+x, bounds.Min.Y+y, gridColor)
+			}
+			// y labels run along the left edge, just below their line
+			drawer.Dot = fixed.P(bounds.Min.X+3, bounds.Min.Y+y+labelHeight+2)
+			drawer.DrawString(label(k, mirrorY))
+		}
+	}
+}
+
+// MatrixToColorView maps m to a color image with the perceptually uniform extended black body color
+// map (black, through red and yellow, to white): lo and below are black and hi and above are white.
+// If lo >= hi the minimum and maximum of the finite values of m are used. Non-finite values are
+// drawn in mid gray. Row 0 of m is the top row of the image.
+func MatrixToColorView(m [][]float64, lo, hi float64) (*image.RGBA, error) {
+	if len(m) == 0 || len(m[0]) == 0 {
+		return nil, errors.New("empty matrix")
+	}
+	if lo >= hi {
+		lo, hi = math.Inf(1), math.Inf(-1)
+		for _, row := range m {
+			for _, v := range row {
+				if !math.IsNaN(v) && !math.IsInf(v, 0) {
+					lo = math.Min(lo, v)
+					hi = math.Max(hi, v)
+				}
+			}
+		}
+		if lo > hi {
+			return nil, errors.New("the matrix has no finite values")
+		}
+		if lo == hi {
+			hi = lo + 1.0 // A flat matrix is drawn black
+		}
+	}
+
+	colorMap := moreland.ExtendedBlackBody()
+	colorMap.SetMin(0.0)
+	colorMap.SetMax(1.0)
+	img := image.NewRGBA(image.Rect(0, 0, len(m[0]), len(m)))
+	for y, row := range m {
+		for x, v := range row {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				img.Set(x, y, color.Gray{Y: 128})
+				continue
+			}
+			c, err := colorMap.At(math.Max(0.0, math.Min(1.0, (v-lo)/(hi-lo))))
+			if err != nil {
+				return nil, err
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// PlotLightCurveFan draws the fan of light curves made by ExtractLightCurveFan as a heat map, with the
+// distance along the path (km) across and the path offset (km) up, so that one picture shows how the
+// light curve changes from chord to chord. The colors run from black (no light) to white at the
+// largest intensity of the fan (see MatrixToColorView). offsetsKm must be evenly spaced and
+// increasing, with at least two offsets.
+func PlotLightCurveFan(fan [][]Point, offsetsKm []float64, wPx, hPx float64) (image.Image, error) {
+	if len(fan) != len(offsetsKm) {
+		return nil, fmt.Errorf("there are %d light curves for %d offsets", len(fan), len(offsetsKm))
+	}
+	if len(offsetsKm) < 2 {
+		return nil, errors.New("a fan plot needs at least two offsets")
+	}
+	offsetStep := (offsetsKm[len(offsetsKm)-1] - offsetsKm[0]) / float64(len(offsetsKm)-1)
+	for i := range offsetsKm {
+		if offsetStep <= 0.0 || math.Abs(offsetsKm[i]-(offsetsKm[0]+float64(i)*offsetStep)) > 1e-6*offsetStep {
+			return nil, errors.New("the offsets must be evenly spaced and increasing")
+		}
+	}
+	n := len(fan[0])
+	if n < 2 {
+		return nil, ErrPathTooShort
+	}
+
+	// The top row of the image is the largest offset
+	m := make([][]float64, len(fan))
+	for i, curve := range fan {
+		if len(curve) != n {
+			return nil, fmt.Errorf("light curve %d has %d points, but light curve 0 has %d", i, len(curve), n)
+		}
+		row := make([]float64, n)
+		for j, pt := range curve {
+			row[j] = pt.Intensity
+		}
+		m[len(fan)-1-i] = row
+	}
+	heat, err := MatrixToColorView(m, 0.0, 0.0)
+	if err != nil {
+		return nil, err
+	}
+
+	p := plot.New()
+	p.Title.TextStyle.Font.Typeface = "Liberation"
+	p.Title.TextStyle.Font.Variant = "Sans"
+	p.Title.TextStyle.Font.Size = vg.Points(12)
+	for _, axis := range []*plot.Axis{&p.X, &p.Y} {
+		axis.Label.TextStyle.Font.Typeface = "Liberation"
+		axis.Label.TextStyle.Font.Variant = "Sans"
+		axis.Label.TextStyle.Font.Size = vg.Points(12)
+		axis.Tick.Label.Font.Typeface = "Liberation"
+		axis.Tick.Label.Font.Variant = "Sans"
+		axis.Tick.Label.Font.Size = vg.Points(10)
+	}
+	p.Title.Text = "Light curves across the shadow (black: no light, white: brightest)"
+	p.X.Label.Text = "Distance along path (km)"
+	p.Y.Label.Text = "Path offset (km)"
+
+	// Each pixel is centered on its sample, so the image reaches half a step past the first and last
+	distanceStep := (fan[0][n-1].Distance - fan[0][0].Distance) / float64(n-1)
+	p.Add(plotter.NewImage(heat,
+		fan[0][0].Distance-distanceStep/2, offsetsKm[0]-offsetStep/2,
+		fan[0][n-1].Distance+distanceStep/2, offsetsKm[len(offsetsKm)-1]+offsetStep/2))
+
+	const dpi = 96
+	c := vgimg.New(vg.Length(wPx)*vg.Inch/dpi, vg.Length(hPx)*vg.Inch/dpi)
+	p.Draw(vgdraw.New(c))
+	return c.Image(), nil
+}
+
+// SaveLightCurveFanPlot saves the heat map made by PlotLightCurveFan to a PNG file.
+func SaveLightCurveFanPlot(filename string, fan [][]Point, offsetsKm []float64, wPx, hPx float64) error {
+	img, err := PlotLightCurveFan(fan, offsetsKm, wPx, hPx)
+	if err != nil {
+		return err
+	}
+	return SaveImageToFile(filename, img)
+}
+
+// montageGap is the space in pixels around and between the images of a montage.
+const montageGap = 8
+
+// MontageImages composites images, which must all be the same size, into a grid with the given
+// number of columns (filled row by row) on a white background. Each image has its caption drawn
+// above it in the Liberation font. captions may be nil for no captions; otherwise it must have
+// one entry per image.
+func MontageImages(images []image.Image, captions []string, columns int) (*image.RGBA, error) {
+	if len(images) == 0 {
+		return nil, errors.New("no images to make a montage of")
+	}
+	if columns < 1 {
+		return nil, fmt.Errorf("the number of columns must be at least 1 (got %d)", columns)
+	}
+	if captions != nil && len(captions) != len(images) {
+		return nil, fmt.Errorf("there are %d captions for %d images", len(captions), len(images))
+	}
+	size := images[0].Bounds().Size()
+	for i, img := range images {
+		if img.Bounds().Size() != size {
+			return nil, fmt.Errorf("image %d is %dx%d pixels, but image 0 is %dx%d", i,
+				img.Bounds().Dx(), img.Bounds().Dy(), size.X, size.Y)
+		}
+	}
+	columns = min(columns, len(images))
+	rows := (len(images) + columns - 1) / columns
+
+	fnt := vgfont.DefaultCache.Lookup(vgfont.Font{Typeface: "Liberation", Variant: "Sans"}, vg.Points(14))
+	face := fnt.FontFace(72)
+	captionHeight := 0
+	if captions != nil {
+		captionHeight = face.Metrics().Height.Ceil() + montageGap/2
+	}
+	cellWidth := size.X + montageGap
+	cellHeight := size.Y + captionHeight + montageGap
+
+	out := image.NewRGBA(image.Rect(0, 0, columns*cellWidth+montageGap, rows*cellHeight+montageGap))
+	draw.Draw(out, out.Bounds(), image.White, image.Point{}, draw.Src)
+	drawer := &font.Drawer{Dst: out, Src: image.Black, Face: face}
+
+	for i, img := range images {
+		x := montageGap + (i%columns)*cellWidth
+		y := montageGap + (i/columns)*cellHeight
+		if captions != nil {
+			drawer.Dot = fixed.P(x, y+face.Metrics().Ascent.Ceil())
+			drawer.DrawString(captions[i])
+		}
+		r := image.Rect(x, y+captionHeight, x+size.X, y+captionHeight+size.Y)
+		draw.Draw(out, r, img, img.Bounds().Min, draw.Src)
+	}
+	return out, nil
+}
+
+// SaveMontage loads the PNG files imageFiles, arranges them with MontageImages and saves the
+// montage to filename. If captions is nil, each image is captioned with its file name.
+func SaveMontage(filename string, imageFiles []string, captions []string, columns int) error {
+	images := make([]image.Image, len(imageFiles))
+	for i, name := range imageFiles {
+		img, err := LoadImageFromFile(name)
+		if err != nil {
+			return err
+		}
+		images[i] = img
+	}
+	if captions == nil {
+		captions = make([]string, len(imageFiles))
+		for i, name := range imageFiles {
+			captions[i] = filepath.Base(name)
+		}
+	}
+	montage, err := MontageImages(images, captions, columns)
+	if err != nil {
+		return err
+	}
+	return SaveImageToFile(filename, montage)
+}
+
 // LoadImageFromFile loads any PNG image file.
 func LoadImageFromFile(filename string) (img image.Image, err error) {
 	f, err := os.Open(filename)
@@ -676,3 +1724,135 @@ func SaveImageToFile(filename string, img image.Image) (err error) {
 
 	return png.Encode(f, img)
 }
+
+// matrixGzMagic starts every matrix written by SaveMatrixGz (inside the gzip stream).
+var matrixGzMagic = [8]byte{'I', 'O', 'T', 'A', 'M', 'A', 'T', '1'}
+
+// maxMatrixGzElements guards ReadMatrixGz against allocating from a corrupt header.
+const maxMatrixGzElements = 1 << 30
+
+// MatrixGzHeader is the header of a matrix written by SaveMatrixGz.
+type MatrixGzHeader struct {
+	Rows       int
+	Cols       int
+	KmPerPixel float64 // Size of one matrix element on the observation plane (0 when unknown)
+}
+
+// WriteMatrixGz writes m to w as a gzip stream holding the 8 byte magic "IOTAMAT1", the number of
+// rows and columns (little-endian uint32), kmPerPixel (float64) and then the elements row by row as
+// little-endian float64, so that the matrix is read back bit for bit. m must be rectangular.
+func WriteMatrixGz(w io.Writer, m [][]float64, kmPerPixel float64) error {
+	if len(m) == 0 || len(m[0]) == 0 {
+		return errors.New("the matrix is empty")
+	}
+	rows, cols := len(m), len(m[0])
+	for row := range m {
+		if len(m[row]) != cols {
+			return fmt.Errorf("row %d has %d columns but row 0 has %d", row, len(m[row]), cols)
+		}
+	}
+	if rows > math.MaxUint32 || cols > math.MaxUint32 {
+		return fmt.Errorf("the matrix (%d x %d) is too large", rows, cols)
+	}
+
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+	var header [24]byte
+	copy(header[:8], matrixGzMagic[:])
+	binary.LittleEndian.PutUint32(header[8:], uint32(rows))
+	binary.LittleEndian.PutUint32(header[12:], uint32(cols))
+	binary.LittleEndian.PutUint64(header[16:], math.Float64bits(kmPerPixel))
+	if _, err := bw.Write(header[:]); err != nil {
+		return err
+	}
+	var buf [8]byte
+	for _, row := range m {
+		for _, v := range row {
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+			if _, err := bw.Write(buf[:]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadMatrixGz reads a matrix written by WriteMatrixGz.
+func ReadMatrixGz(r io.Reader) ([][]float64, MatrixGzHeader, error) {
+	var hdr MatrixGzHeader
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, hdr, err
+	}
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+
+	var header [24]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, hdr, fmt.Errorf("reading the header: %w", err)
+	}
+	if [8]byte(header[:8]) != matrixGzMagic {
+		return nil, hdr, errors.New("not a matrix written by SaveMatrixGz (bad magic)")
+	}
+	hdr.Rows = int(binary.LittleEndian.Uint32(header[8:]))
+	hdr.Cols = int(binary.LittleEndian.Uint32(header[12:]))
+	hdr.KmPerPixel = math.Float64frombits(binary.LittleEndian.Uint64(header[16:]))
+	if hdr.Rows == 0 || hdr.Cols == 0 || hdr.Rows*hdr.Cols > maxMatrixGzElements {
+		return nil, hdr, fmt.Errorf("invalid matrix size %d x %d", hdr.Rows, hdr.Cols)
+	}
+
+	m := make([][]float64, hdr.Rows)
+	rowBytes := make([]byte, 8*hdr.Cols)
+	for row := range m {
+		if _, err := io.ReadFull(br, rowBytes); err != nil {
+			return nil, hdr, fmt.Errorf("reading row %d: %w", row, err)
+		}
+		m[row] = make([]float64, hdr.Cols)
+		for col := range m[row] {
+			m[row][col] = math.Float64frombits(binary.LittleEndian.Uint64(rowBytes[8*col:]))
+		}
+	}
+	return m, hdr, nil
+}
+
+// SaveMatrixGz saves m losslessly (as float64) to a gzip-compressed file with WriteMatrixGz. The
+// plane scale is recorded as unknown; use SaveMatrixGzWithScale to record it.
+func SaveMatrixGz(filename string, m [][]float64) error {
+	return SaveMatrixGzWithScale(filename, m, 0.0)
+}
+
+// SaveMatrixGzWithScale is SaveMatrixGz recording kmPerPixel in the header.
+func SaveMatrixGzWithScale(filename string, m [][]float64, kmPerPixel float64) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filename, err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	if err = WriteMatrixGz(f, m, kmPerPixel); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	return nil
+}
+
+// LoadMatrixGz loads a matrix saved by SaveMatrixGz and returns it with its header.
+func LoadMatrixGz(filename string) ([][]float64, MatrixGzHeader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, MatrixGzHeader{}, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	m, hdr, err := ReadMatrixGz(f)
+	if err != nil {
+		return nil, hdr, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	return m, hdr, nil
+}
@@ -0,0 +1,826 @@
+package lightcurve_test
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bob-anderson-ok/IOTAdiffraction/internal/shared"
+	"github.com/bob-anderson-ok/IOTAdiffraction/lightcurve"
+)
+
+// rampMatrix returns an n x n matrix whose values vary along both axes, so that
+// any difference in interpolation would show up in the sampled values.
+func rampMatrix(n int) [][]float64 {
+	m := make([][]float64, n)
+	for y := 0; y < n; y++ {
+		m[y] = make([]float64, n)
+		for x := 0; x < n; x++ {
+			m[y][x] = float64(x*x) + 0.5*float64(y)
+		}
+	}
+	return m
+}
+
+// TestSharedInterpolationMatchesMainApp confirms that the light curve extracted by the
+// lightcurve package matches what the main application computes for the same path
+// (the main application samples with shared.Interpolate directly).
+func TestSharedInterpolationMatchesMainApp(t *testing.T) {
+	matrix := rampMatrix(50)
+	path := &lightcurve.ObservationPath{
+		DxKmPerSec:               5.074,
+		DyKmPerSec:               -0.904,
+		PathOffsetFromCenterKm:   -1.18,
+		FundamentalPlaneWidthKm:  40.0,
+		FundamentalPlaneWidthPts: 50,
+	}
+	if err := path.ComputePathFromVelocity(); err != nil {
+		t.Fatalf("ComputePathFromVelocity failed: %v", err)
+	}
+
+	lc, err := lightcurve.ExtractLightCurve(matrix, path)
+	if err != nil {
+		t.Fatalf("ExtractLightCurve failed: %v", err)
+	}
+	if len(lc) != len(path.SamplePoints) {
+		t.Fatalf("got %d light curve points for %d sample points", len(lc), len(path.SamplePoints))
+	}
+	for i, pt := range path.SamplePoints {
+		want := shared.Interpolate(matrix, pt.X, pt.Y)
+		if lc[i].Intensity != want {
+			t.Errorf("point %d: lightcurve gives %g, main app gives %g", i, lc[i].Intensity, want)
+		}
+		if got := lightcurve.InterpolatedIntensity(matrix, pt.X, pt.Y); got != want {
+			t.Errorf("point %d: InterpolatedIntensity gives %g, want %g", i, got, want)
+		}
+	}
+
+	// Out-of-range coordinates are clamped identically.
+	for _, xy := range [][2]float64{{-3, -3}, {60, 2}, {2, 60}, {49, 49}} {
+		want := shared.Interpolate(matrix, xy[0], xy[1])
+		if got := lightcurve.InterpolatedIntensity(matrix, xy[0], xy[1]); got != want {
+			t.Errorf("(%g, %g): InterpolatedIntensity gives %g, want %g", xy[0], xy[1], got, want)
+		}
+	}
+}
+
+func TestStepTicks(t *testing.T) {
+	// lightcurve.StepTicks is the shared.StepTicks the main application plots with
+	ticks := lightcurve.StepTicks{Step: 0.2, Format: "%.2f"}.Ticks(-0.3, 1.5)
+	wantLabels := []string{"-0.20", "0.00", "0.20", "0.40", "0.60", "0.80", "1.00", "1.20", "1.40"}
+	if len(ticks) != len(wantLabels) {
+		t.Fatalf("got %d ticks (%+v), want %d", len(ticks), ticks, len(wantLabels))
+	}
+	for i, tick := range ticks {
+		wantValue := -0.2 + 0.2*float64(i)
+		if math.Abs(tick.Value-wantValue) > 1e-9 || tick.Label != wantLabels[i] {
+			t.Errorf("tick %d is %g %q, want %g %q", i, tick.Value, tick.Label, wantValue, wantLabels[i])
+		}
+	}
+
+	// A range that starts and ends on a step includes both ends
+	ticks = lightcurve.StepTicks{Step: 25, Format: "%.0f"}.Ticks(0, 100)
+	if len(ticks) != 5 || ticks[0].Label != "0" || ticks[4].Value != 100 || ticks[4].Label != "100" {
+		t.Errorf("0 to 100 in steps of 25 gave %+v, want 0, 25, 50, 75 and 100", ticks)
+	}
+}
+
+func TestIntegratedDrop(t *testing.T) {
+	path := &lightcurve.ObservationPath{FundamentalPlaneWidthKm: 10, FundamentalPlaneWidthPts: 100}
+
+	// 0.1 km per pixel: the shadow runs from 2.0 km to 4.0 km, where the intensity is 0.1 and 0.3
+	var curve []lightcurve.Point
+	for i := 0; i < 60; i++ {
+		intensity := 1.0
+		if i >= 20 && i < 30 {
+			intensity = 0.1
+		} else if i >= 30 && i < 40 {
+			intensity = 0.3
+		}
+		curve = append(curve, lightcurve.Point{Distance: float64(i) * 0.1, Intensity: intensity})
+	}
+
+	mean, drop, err := lightcurve.IntegratedDrop(curve, []float64{20, 40}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(mean-0.2) > 1e-9 {
+		t.Errorf("mean intensity = %g, want 0.2", mean)
+	}
+	if want := -2.5 * math.Log10(0.2); math.Abs(drop-want) > 1e-9 {
+		t.Errorf("magnitude drop = %g, want %g", drop, want)
+	}
+
+	if _, _, err := lightcurve.IntegratedDrop(curve, nil, path); err != lightcurve.ErrNoOccultation {
+		t.Errorf("expected ErrNoOccultation without edges, got %v", err)
+	}
+}
+
+// TestSetPathEndpointsMatchesVelocityPath checks that a path given by the endpoints that
+// ComputePathFromVelocity finds is described (angle, speed, direction) the same way.
+// fringeCurve returns a curve sampled every 0.01 km with bright fringes (triangular peaks) at 8.8 km
+// (height 1.37) and 7.5 km (height 1.2), a drop to 0 between 9.5 km and 10 km and shadow beyond.
+func fringeCurve() []lightcurve.Point {
+	peak := func(d, center, height float64) float64 {
+		return math.Max(0, (height-1)*(1-math.Abs(d-center)/0.3))
+	}
+	var curve []lightcurve.Point
+	for i := 0; i <= 1200; i++ {
+		d := float64(i) * 0.01
+		intensity := 1 + peak(d, 8.8, 1.37) + peak(d, 7.5, 1.2)
+		if d >= 10 {
+			intensity = 0
+		} else if d > 9.5 {
+			intensity = (10 - d) / 0.5
+		}
+		curve = append(curve, lightcurve.Point{Distance: d, Intensity: intensity})
+	}
+	return curve
+}
+
+func TestAnalyzeFringes(t *testing.T) {
+	curve := fringeCurve()
+	check := func(name string, spacing, amplitude float64) {
+		t.Helper()
+		if math.Abs(spacing-1.3) > 1e-6 || math.Abs(amplitude-0.37) > 1e-6 {
+			t.Errorf("%s: spacing %g km, amplitude %g; want 1.3 km and 0.37", name, spacing, amplitude)
+		}
+	}
+
+	spacing, amplitude := lightcurve.AnalyzeFringes(curve)
+	check("disappearance", spacing, amplitude)
+
+	spacing, amplitude = lightcurve.AnalyzeFringesFromEdge(curve, 9.9)
+	check("seeded edge", spacing, amplitude)
+
+	// Reversed, the curve starts in the shadow and the fringes follow the reappearance
+	reversed := make([]lightcurve.Point, len(curve))
+	for i, pt := range curve {
+		reversed[len(curve)-1-i] = lightcurve.Point{Distance: 12 - pt.Distance, Intensity: pt.Intensity}
+	}
+	spacing, amplitude = lightcurve.AnalyzeFringes(reversed)
+	check("reappearance", spacing, amplitude)
+
+	flat := []lightcurve.Point{{Distance: 0, Intensity: 1}, {Distance: 1, Intensity: 1}, {Distance: 2, Intensity: 1}}
+	if spacing, amplitude := lightcurve.AnalyzeFringes(flat); spacing != 0 || amplitude != 0 {
+		t.Errorf("a flat curve gave spacing %g and amplitude %g, want 0 and 0", spacing, amplitude)
+	}
+}
+
+func TestSetPathEndpointsMatchesVelocityPath(t *testing.T) {
+	for _, v := range []struct{ dx, dy float64 }{{-5, 0}, {5, 0}, {0, -5}, {3, 4}, {-2, 1}} {
+		fromVelocity := lightcurve.ObservationPath{
+			DxKmPerSec: v.dx, DyKmPerSec: v.dy, PathOffsetFromCenterKm: 1.5,
+			FundamentalPlaneWidthKm: 20, FundamentalPlaneWidthPts: 200,
+		}
+		if err := fromVelocity.ComputePathFromVelocity(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the speed carries over from the velocity
+		fromEndpoints := lightcurve.ObservationPath{
+			DxKmPerSec: fromVelocity.ShadowSpeedKmPerSec, FundamentalPlaneWidthKm: 20, FundamentalPlaneWidthPts: 200,
+		}
+		if err := fromEndpoints.SetPathEndpoints(fromVelocity.StartX, fromVelocity.StartY,
+			fromVelocity.EndX, fromVelocity.EndY); err != nil {
+			t.Fatal(err)
+		}
+
+		if math.Abs(fromEndpoints.PathAngleDegrees-fromVelocity.PathAngleDegrees) > 1e-9 {
+			t.Errorf("velocity (%g, %g): angle = %g, want %g", v.dx, v.dy,
+				fromEndpoints.PathAngleDegrees, fromVelocity.PathAngleDegrees)
+		}
+		if math.Abs(fromEndpoints.DxKmPerSec-v.dx) > 1e-9 || math.Abs(fromEndpoints.DyKmPerSec-v.dy) > 1e-9 {
+			t.Errorf("velocity (%g, %g): derived velocity (%g, %g)", v.dx, v.dy,
+				fromEndpoints.DxKmPerSec, fromEndpoints.DyKmPerSec)
+		}
+		if fromEndpoints.Direction != fromVelocity.Direction {
+			t.Errorf("velocity (%g, %g): direction %q, want %q", v.dx, v.dy,
+				fromEndpoints.Direction, fromVelocity.Direction)
+		}
+	}
+
+	var p lightcurve.ObservationPath
+	if err := p.SetPathEndpoints(3, 4, 3, 4); err == nil {
+		t.Error("expected an error for coincident endpoints")
+	}
+}
+
+func TestComputePathFromVelocityThroughCorner(t *testing.T) {
+	// Every path entering the plane through a corner has a chord, although rounding can put the
+	// crossing just outside both sides that meet there. Paths along the sides (multiples of 90
+	// degrees) and paths that only touch the corner (dx*dy < 0) are left out.
+	const widthKm = 10.0
+	for _, npts := range []int{8, 14, 64, 101, 400} {
+		half := float64(npts-1) / 2
+		for deg := 1.0; deg < 360; deg++ {
+			theta := deg * math.Pi / 180
+			dx, dy := math.Sin(theta), math.Cos(theta)
+			if math.Mod(deg, 90) == 0 || dx*dy < 0 {
+				continue
+			}
+			path := lightcurve.ObservationPath{
+				DxKmPerSec: -dx, DyKmPerSec: -dy,
+				PathOffsetFromCenterKm:  (half*dy - half*dx) * widthKm / float64(npts), // the line through a corner
+				FundamentalPlaneWidthKm: widthKm, FundamentalPlaneWidthPts: npts,
+			}
+			if err := path.ComputePathFromVelocity(); err != nil {
+				t.Errorf("%d points, %g degrees: path through the corner rejected: %v", npts, deg, err)
+			}
+		}
+	}
+}
+
+func TestDrawKmGridCenteredOnPlane(t *testing.T) {
+	// 101 pixels of 0.2 km: the plane center is pixel 50 and a 2 km grid has lines every 10 pixels
+	img := image.NewRGBA(image.Rect(0, 0, 101, 101))
+	lightcurve.DrawKmGrid(img, 0.2, 2.0)
+
+	black := color.RGBA{}
+	for _, x := range []int{0, 10, 50, 90, 100} {
+		if img.RGBAAt(x, 30) == black {
+			t.Errorf("expected a vertical grid line at x = %d", x)
+		}
+	}
+	for _, y := range []int{10, 50, 90} {
+		if img.RGBAAt(70, y) == black {
+			t.Errorf("expected a horizontal grid line at y = %d", y)
+		}
+	}
+	if img.RGBAAt(55, 55) != black {
+		t.Error("pixel (55, 55) lies between grid lines but was drawn on")
+	}
+
+	// A grid finer than 2 pixels is not drawn at all
+	img = image.NewRGBA(image.Rect(0, 0, 101, 101))
+	lightcurve.DrawKmGrid(img, 0.2, 0.3)
+	for i, v := range img.Pix {
+		if v != 0 {
+			t.Fatalf("a 1.5 pixel grid was drawn (byte %d is %d)", i, v)
+		}
+	}
+}
+
+func TestSaveLightCurvePlotVectorFormats(t *testing.T) {
+	path := &lightcurve.ObservationPath{
+		DxKmPerSec: 5, FundamentalPlaneWidthKm: 20, FundamentalPlaneWidthPts: 200,
+	}
+	if err := path.ComputePathFromVelocity(); err != nil {
+		t.Fatal(err)
+	}
+	path.ComputeSamplePoints()
+	curve, err := lightcurve.ExtractLightCurve(rampMatrix(200), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for ext, magic := range map[string]string{".svg": "<?xml", ".pdf": "%PDF", ".png": "\x89PNG"} {
+		filename := filepath.Join(dir, "plot"+ext)
+		if err := lightcurve.SaveLightCurvePlotVector(filename, curve, []float64{50, 120}, path, 600, 300); err != nil {
+			t.Fatalf("%s: %v", ext, err)
+		}
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), magic) {
+			t.Errorf("%s file starts with %q, want %q", ext, data[:min(len(data), 8)], magic)
+		}
+	}
+
+	if err := lightcurve.SaveLightCurvePlotVector(filepath.Join(dir, "plot.jpg"), curve, nil, path, 600, 300); err == nil {
+		t.Error("expected an error for an unsupported extension")
+	}
+}
+
+func TestRefineEdges(t *testing.T) {
+	// The curve falls linearly from 1 at 9.5 km to 0 at 10 km, so half light is at 9.75 km
+	for _, smoothKm := range []float64{0, 0.05} {
+		refined := lightcurve.RefineEdges(fringeCurve(), []float64{10.0}, smoothKm)
+		if len(refined) != 1 || !refined[0].Found {
+			t.Fatalf("smoothKm %g: got %+v, want one refined edge", smoothKm, refined)
+		}
+		if refined[0].GeometricKm != 10.0 || math.Abs(refined[0].DiffractionKm-9.75) > 1e-6 {
+			t.Errorf("smoothKm %g: got %+v, want geometric 10 and diffraction 9.75", smoothKm, refined[0])
+		}
+	}
+
+	flat := []lightcurve.Point{{Distance: 0, Intensity: 1}, {Distance: 1, Intensity: 1}, {Distance: 2, Intensity: 1}}
+	refined := lightcurve.RefineEdges(flat, []float64{1.0}, 0)
+	if refined[0].Found || refined[0].DiffractionKm != 1.0 {
+		t.Errorf("unocculted curve: got %+v, want the geometric edge back, not found", refined[0])
+	}
+}
+
+func TestEdgeTimingUncertainty(t *testing.T) {
+	// The fringeCurve edge falls by 1 over 0.5 km, a slope of 2 per km
+	sigmaKm, sigmaSec, err := lightcurve.EdgeTimingUncertainty(fringeCurve(), 9.75, 0.05, 5.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(sigmaKm-0.025) > 1e-9 || math.Abs(sigmaSec-0.005) > 1e-9 {
+		t.Errorf("got sigma %g km, %g s; want 0.025 km, 0.005 s", sigmaKm, sigmaSec)
+	}
+
+	if _, sigmaSec, _ := lightcurve.EdgeTimingUncertainty(fringeCurve(), 9.75, 0.05, 0); sigmaSec != 0 {
+		t.Errorf("without a shadow speed sigmaSec = %g, want 0", sigmaSec)
+	}
+	if _, _, err := lightcurve.EdgeTimingUncertainty(fringeCurve(), 11.0, 0.05, 5.0); err != lightcurve.ErrFlatEdge {
+		t.Errorf("edge in the flat shadow: got error %v, want ErrFlatEdge", err)
+	}
+}
+
+func TestExtractDoubleStarLightCurves(t *testing.T) {
+	// The value of each pixel is its column, so a shift of the path to the East (left) by k pixels
+	// lowers every companion sample by k
+	const n = 100
+	matrix := make([][]float64, n)
+	for y := range matrix {
+		matrix[y] = make([]float64, n)
+		for x := range matrix[y] {
+			matrix[y][x] = float64(x)
+		}
+	}
+	path := &lightcurve.ObservationPath{
+		FundamentalPlaneWidthKm:  50.0,
+		FundamentalPlaneWidthPts: n,
+	}
+	if err := path.SetPathEndpoints(50, 10, 50, 90); err != nil {
+		t.Fatal(err)
+	}
+
+	star := lightcurve.DoubleStar{SeparationKm: 5.0, PADegrees: 90, CompanionFraction: 0.25}
+	curves, err := lightcurve.ExtractDoubleStarLightCurves(matrix, path, star)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(curves.Companion) != len(curves.Primary) || len(curves.Combined) != len(curves.Primary) {
+		t.Fatalf("curve lengths differ: %d, %d, %d", len(curves.Primary), len(curves.Companion), len(curves.Combined))
+	}
+	for i := range curves.Primary {
+		if math.Abs(curves.Primary[i].Intensity-50) > 1e-9 || math.Abs(curves.Companion[i].Intensity-40) > 1e-9 {
+			t.Fatalf("sample %d: primary %g and companion %g, want 50 and 40 (10 pixels to the East)",
+				i, curves.Primary[i].Intensity, curves.Companion[i].Intensity)
+		}
+		if math.Abs(curves.Combined[i].Intensity-47.5) > 1e-9 {
+			t.Fatalf("sample %d: combined %g, want 0.75 * 50 + 0.25 * 40", i, curves.Combined[i].Intensity)
+		}
+	}
+	if curves.CompanionPath.StartX != 40 {
+		t.Errorf("the companion path starts at x = %g, want 40", curves.CompanionPath.StartX)
+	}
+
+	star.CompanionFraction = 1.5
+	if _, err := lightcurve.ExtractDoubleStarLightCurves(matrix, path, star); err == nil {
+		t.Error("a companion fraction of 1.5 gave no error")
+	}
+}
+
+func TestRadialProfile(t *testing.T) {
+	// A radially symmetric matrix (value = squared distance from the plane center) gives back each
+	// ring's mean squared radius, which is close to the ring radius squared
+	const n = 64
+	m := make([][]float64, n)
+	for y := range m {
+		m[y] = make([]float64, n)
+		for x := range m[y] {
+			dx, dy := float64(x-n/2), float64(y-n/2)
+			m[y][x] = dx*dx + dy*dy
+		}
+	}
+	m[0][0] = math.NaN()
+
+	profile := lightcurve.RadialProfile(m, math.NaN(), math.NaN())
+	if len(profile) == 0 || profile[0].Distance != 0 || profile[0].Intensity != 0 {
+		t.Fatalf("the profile should start with the center pixel at radius 0, got %v", profile[:1])
+	}
+	for _, pt := range profile[1:] {
+		if pt.Distance > n/2 {
+			break
+		}
+		if math.Abs(pt.Intensity-pt.Distance*pt.Distance) > pt.Distance+0.5 {
+			t.Errorf("ring %g has mean %g, want about %g", pt.Distance, pt.Intensity, pt.Distance*pt.Distance)
+		}
+	}
+
+	km := lightcurve.RadialProfileKm(m, n/2, n/2, 0.25)
+	if len(km) != len(profile) || km[8].Distance != 0.25*profile[8].Distance || km[8].Intensity != profile[8].Intensity {
+		t.Errorf("RadialProfileKm does not scale the radius of RadialProfile by the km per pixel")
+	}
+}
+
+func TestDrawObservationLineOnImageWithTicks(t *testing.T) {
+	// An 80 pixel horizontal path on a plane of 1 km per pixel, the shadow moving at 5 km/sec
+	src := image.NewGray(image.Rect(0, 0, 100, 100))
+	path := &lightcurve.ObservationPath{FundamentalPlaneWidthKm: 100, FundamentalPlaneWidthPts: 100}
+	if err := path.SetPathEndpoints(10, 50, 90, 50); err != nil {
+		t.Fatal(err)
+	}
+	path.ShadowSpeedKmPerSec = 5
+	img, err := lightcurve.DrawObservationLineOnImageWithTicks(src, path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tick every 2 sec is one every 10 km, or 10 pixels, from the path start (not at the start
+	// itself). Each dash is 3 pixels wide and crosses row 44, away from the line.
+	yellow := color.RGBA{R: 255, G: 255, A: 255}
+	var centers []int
+	for x := 0; x < 100; x++ {
+		if img.RGBAAt(x, 44) == yellow && img.RGBAAt(x-1, 44) != yellow {
+			centers = append(centers, x+1)
+		}
+	}
+	want := []int{20, 30, 40, 50, 60, 70, 80}
+	if len(centers) != len(want) {
+		t.Fatalf("tick marks at x = %v, want %v", centers, want)
+	}
+	for i := range want {
+		if centers[i] != want[i] {
+			t.Errorf("tick %d at x = %d, want %d (%g sec from the start)", i+1, centers[i], want[i], 2*float64(i+1))
+		}
+	}
+
+	// Ticks closer than 2 pixels, or without a moving shadow, are refused
+	if _, err := lightcurve.DrawObservationLineOnImageWithTicks(src, path, 0.3); err == nil {
+		t.Error("ticks 1.5 pixels apart gave no error")
+	}
+	path.ShadowSpeedKmPerSec = 0
+	if _, err := lightcurve.DrawObservationLineOnImageWithTicks(src, path, 2); err == nil {
+		t.Error("ticks for a shadow that is not moving gave no error")
+	}
+}
+
+func TestDrawObservationLineOnImageStyled(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 60, 60))
+	path := &lightcurve.ObservationPath{FundamentalPlaneWidthKm: 60, FundamentalPlaneWidthPts: 60}
+	if err := path.SetPathEndpoints(10, 30, 50, 30); err != nil {
+		t.Fatal(err)
+	}
+	style := lightcurve.PathStyle{EndColor: color.RGBA{B: 255, A: 255}, EndShape: lightcurve.MarkerSquare, MarkerRadius: 4}
+	img, err := lightcurve.DrawObservationLineOnImageStyled(src, path, 0, style)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The unset colors default to red, and the square end marker fills its corners where a
+	// circle would not
+	if got := img.RGBAAt(10, 30); got != (color.RGBA{R: 255, A: 255}) {
+		t.Errorf("start marker color %v, want the default red", got)
+	}
+	if got := img.RGBAAt(54, 34); got != (color.RGBA{B: 255, A: 255}) {
+		t.Errorf("corner of the square end marker is %v, want blue", got)
+	}
+
+	diamond := image.NewRGBA(image.Rect(0, 0, 11, 11))
+	lightcurve.DrawMarker(diamond, 5, 5, 5, lightcurve.MarkerDiamond, color.White)
+	if diamond.RGBAAt(5, 0).A == 0 || diamond.RGBAAt(1, 1).A != 0 {
+		t.Errorf("the diamond marker should reach the top center but not the corners")
+	}
+}
+
+func TestMontageImages(t *testing.T) {
+	solid := func(c color.Gray) image.Image {
+		img := image.NewGray(image.Rect(0, 0, 20, 10))
+		for i := range img.Pix {
+			img.Pix[i] = c.Y
+		}
+		return img
+	}
+	images := []image.Image{solid(color.Gray{Y: 0}), solid(color.Gray{Y: 100}), solid(color.Gray{Y: 200})}
+
+	// Without captions, three images in two columns make two rows of 8 pixel gaps and 20x10 cells
+	m, err := lightcurve.MontageImages(images, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Bounds().Size(); got != image.Pt(2*28+8, 2*18+8) {
+		t.Errorf("the montage is %v pixels, want (64,44)", got)
+	}
+	for _, tc := range []struct {
+		x, y int
+		want uint8
+	}{{8, 8, 0}, {36, 8, 100}, {8, 26, 200}, {36, 26, 255}, {4, 4, 255}} {
+		if r, _, _, _ := m.At(tc.x, tc.y).RGBA(); uint8(r>>8) != tc.want {
+			t.Errorf("montage pixel (%d, %d) is %d, want %d", tc.x, tc.y, r>>8, tc.want)
+		}
+	}
+
+	// A caption band above each image pushes it down and holds some dark text
+	captioned, err := lightcurve.MontageImages(images, []string{"a", "b", "c"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captionHeight := captioned.Bounds().Dy() - 18 - 8
+	if captionHeight <= 0 {
+		t.Fatalf("the captioned montage is only %d pixels high", captioned.Bounds().Dy())
+	}
+	ink := false
+	for y := 8; y < 8+captionHeight; y++ {
+		for x := 8; x < 28; x++ {
+			if r, _, _, _ := captioned.At(x, y).RGBA(); r < 0x8000 {
+				ink = true
+			}
+		}
+	}
+	if !ink {
+		t.Errorf("no caption was drawn above the first image")
+	}
+
+	if _, err := lightcurve.MontageImages(images, []string{"a"}, 2); err == nil {
+		t.Errorf("one caption for three images should be an error")
+	}
+	if _, err := lightcurve.MontageImages(append(images, image.NewGray(image.Rect(0, 0, 5, 5))), nil, 2); err == nil {
+		t.Errorf("images of different sizes should be an error")
+	}
+}
+
+func TestExtractLightCurveFan(t *testing.T) {
+	const n = 60
+	m := rampMatrix(n)
+	base := lightcurve.ObservationPath{DxKmPerSec: -3, DyKmPerSec: -4, FundamentalPlaneWidthKm: 30,
+		FundamentalPlaneWidthPts: n}
+	if err := base.ComputePathFromVelocity(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := lightcurve.ExtractLightCurve(m, &base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offsets := []float64{-2, 0, 1.5}
+	fan, err := lightcurve.ExtractLightCurveFan(m, &base, offsets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fan) != len(offsets) {
+		t.Fatalf("got %d curves for %d offsets", len(fan), len(offsets))
+	}
+	for i := range fan {
+		if len(fan[i]) != len(want) {
+			t.Fatalf("curve %d has %d points, want %d (the distance axis of the base path)", i, len(fan[i]), len(want))
+		}
+	}
+	for j := range want {
+		if fan[1][j] != want[j] {
+			t.Fatalf("the zero offset curve differs from the base curve at point %d", j)
+		}
+	}
+
+	// An offset curve samples the same points as a path computed with that PathOffsetFromCenterKm.
+	// Their starts differ (each runs edge to edge), so compare at the middle of the plane.
+	moved := base
+	moved.PathOffsetFromCenterKm = offsets[2]
+	moved.SamplePoints = nil
+	if err := moved.ComputePathFromVelocity(); err != nil {
+		t.Fatal(err)
+	}
+	movedCurve, err := lightcurve.ExtractLightCurve(m, &moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kmPerPixel := base.FundamentalPlaneWidthKm / n
+	centerAlong := func(p lightcurve.ObservationPath) float64 { // Distance (km) from the start to the plane center
+		dx, dy := p.EndX-p.StartX, p.EndY-p.StartY
+		return ((n/2-p.StartX)*dx + (n/2-p.StartY)*dy) / math.Hypot(dx, dy) * kmPerPixel
+	}
+	atDistance := func(curve []lightcurve.Point, d float64) float64 {
+		for k := 1; k < len(curve); k++ {
+			if curve[k].Distance >= d {
+				f := (d - curve[k-1].Distance) / (curve[k].Distance - curve[k-1].Distance)
+				return curve[k-1].Intensity + f*(curve[k].Intensity-curve[k-1].Intensity)
+			}
+		}
+		return math.NaN()
+	}
+	got := atDistance(fan[2], centerAlong(base))
+	wantMid := atDistance(movedCurve, centerAlong(moved))
+	// The ramp is quadratic in x, so sampling at other points along the line leaves a small
+	// interpolation difference; a wrong offset would change the value by over 100.
+	if math.Abs(got-wantMid) > 0.1 {
+		t.Errorf("at the plane center the offset curve is %g, but the path with that offset gives %g", got, wantMid)
+	}
+
+	if _, err := lightcurve.ExtractLightCurveFan(m, &lightcurve.ObservationPath{}, offsets); err == nil {
+		t.Errorf("a path without a fundamental plane width should be an error")
+	}
+}
+
+func TestMatrixToColorView(t *testing.T) {
+	m := [][]float64{{0, 0.5, 1}, {2, math.NaN(), -1}}
+	img, err := lightcurve.MatrixToColorView(m, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray := func(x, y int) (r, g, b uint8) {
+		c := img.RGBAAt(x, y)
+		return c.R, c.G, c.B
+	}
+	if r, g, b := gray(0, 0); r > 5 || g > 5 || b > 5 {
+		t.Errorf("lo is (%d, %d, %d), want black", r, g, b)
+	}
+	if r, g, b := gray(2, 0); r < 250 || g < 250 || b < 250 {
+		t.Errorf("hi is (%d, %d, %d), want white", r, g, b)
+	}
+	if img.RGBAAt(0, 1) != img.RGBAAt(2, 0) || img.RGBAAt(2, 1) != img.RGBAAt(0, 0) {
+		t.Errorf("values beyond lo and hi should be clamped")
+	}
+	if r, g, b := gray(1, 1); r != 128 || g != 128 || b != 128 {
+		t.Errorf("NaN is (%d, %d, %d), want mid gray", r, g, b)
+	}
+
+	// With lo >= hi the range of the data is used: -1 is black and 2 is white
+	auto, err := lightcurve.MatrixToColorView(m, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auto.RGBAAt(2, 1) != img.RGBAAt(0, 0) || auto.RGBAAt(0, 1) != img.RGBAAt(2, 0) {
+		t.Errorf("the automatic range should run from the minimum (-1) to the maximum (2)")
+	}
+}
+
+func TestPlotLightCurveFan(t *testing.T) {
+	const n = 80
+	m := make([][]float64, n) // A dark disk of radius 15 pixels on a bright sky
+	for y := range m {
+		m[y] = make([]float64, n)
+		for x := range m[y] {
+			if math.Hypot(float64(x)-40, float64(y)-40) > 15 {
+				m[y][x] = 1
+			}
+		}
+	}
+	base := lightcurve.ObservationPath{DxKmPerSec: 5, FundamentalPlaneWidthKm: 40, FundamentalPlaneWidthPts: n}
+	if err := base.ComputePathFromVelocity(); err != nil {
+		t.Fatal(err)
+	}
+	offsets := []float64{-10, -5, 0, 5, 10}
+	fan, err := lightcurve.ExtractLightCurveFan(m, &base, offsets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := lightcurve.PlotLightCurveFan(fan, offsets, 600, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds().Size(); got != image.Pt(600, 400) {
+		t.Errorf("the fan plot is %v pixels, want 600x400", got)
+	}
+
+	if _, err := lightcurve.PlotLightCurveFan(fan, []float64{-10, -5, 0, 5, 11}, 600, 400); err == nil {
+		t.Errorf("unevenly spaced offsets should be an error")
+	}
+	if _, err := lightcurve.PlotLightCurveFan(fan[:1], offsets[:1], 600, 400); err == nil {
+		t.Errorf("a single offset should be an error")
+	}
+}
+
+func TestSaveMatrixGzRoundTrip(t *testing.T) {
+	m := [][]float64{
+		{0.0, 1.0 / 3.0, math.Pi, -2.5e-300},
+		{math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(1), math.Copysign(0, -1)},
+		{1e-17, 123456.789, math.NaN(), 0.9999999999999999},
+	}
+	filename := filepath.Join(t.TempDir(), "m.f64.gz")
+	if err := lightcurve.SaveMatrixGzWithScale(filename, m, 0.0125); err != nil {
+		t.Fatal(err)
+	}
+	got, hdr, err := lightcurve.LoadMatrixGz(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Rows != 3 || hdr.Cols != 4 || hdr.KmPerPixel != 0.0125 {
+		t.Errorf("header = %+v, want 3 x 4 at 0.0125 km per pixel", hdr)
+	}
+	for y := range m {
+		for x := range m[y] {
+			if math.Float64bits(got[y][x]) != math.Float64bits(m[y][x]) {
+				t.Errorf("element (%d, %d) = %v, want %v bit for bit", y, x, got[y][x], m[y][x])
+			}
+		}
+	}
+
+	if err := lightcurve.SaveMatrixGz(filename, [][]float64{{1, 2}, {3}}); err == nil {
+		t.Error("ragged matrix accepted")
+	}
+	notMatrix := filepath.Join(t.TempDir(), "x.png")
+	if err := lightcurve.SaveImageToFile(notMatrix, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lightcurve.LoadMatrixGz(notMatrix); err == nil {
+		t.Error("a PNG file was loaded as a matrix")
+	}
+}
+
+func TestExtractLightCurveTimeSampled(t *testing.T) {
+	// A 50 pixel path on a plane of 1 km per pixel, crossed at 5 km/sec in 10 seconds. The matrix
+	// is linear in x and y, so the interpolated intensity is exactly x + 2y.
+	m := make([][]float64, 100)
+	for y := range m {
+		m[y] = make([]float64, 100)
+		for x := range m[y] {
+			m[y][x] = float64(x) + 2*float64(y)
+		}
+	}
+	path := &lightcurve.ObservationPath{StartX: 10, StartY: 20, EndX: 40, EndY: 60,
+		FundamentalPlaneWidthKm: 100, FundamentalPlaneWidthPts: 100, ShadowSpeedKmPerSec: 5}
+
+	curve, err := lightcurve.ExtractLightCurveTimeSampled(m, path, 0.5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(curve) != 21 {
+		t.Fatalf("got %d samples, want 21 (0 to 10 sec every 0.5 sec)", len(curve))
+	}
+	for i, pt := range curve {
+		// At 0.5 sec per sample the shadow moves 2.5 pixels: 1.5 in x and 2 in y
+		wantTime := 0.5 * float64(i)
+		wantIntensity := (10 + 1.5*float64(i)) + 2*(20+2*float64(i))
+		if math.Abs(pt.TimeSec-wantTime) > 1e-12 || math.Abs(pt.Intensity-wantIntensity) > 1e-9 {
+			t.Errorf("sample %d is %+v, want %g sec and intensity %g", i, pt, wantTime, wantIntensity)
+		}
+	}
+
+	// totalSec shortens the curve; it cannot run past the path end
+	if curve, err := lightcurve.ExtractLightCurveTimeSampled(m, path, 0.3, 2); err != nil || len(curve) != 7 {
+		t.Errorf("2 sec every 0.3 sec gave %d samples (%v), want 7", len(curve), err)
+	}
+	if curve, err := lightcurve.ExtractLightCurveTimeSampled(m, path, 1, 60); err != nil || len(curve) != 11 {
+		t.Errorf("60 sec on a 10 sec path gave %d samples (%v), want 11", len(curve), err)
+	}
+
+	if _, err := lightcurve.ExtractLightCurveTimeSampled(m, path, 0, 0); err == nil {
+		t.Error("a time step of 0 gave no error")
+	}
+	path.ShadowSpeedKmPerSec = 0
+	if _, err := lightcurve.ExtractLightCurveTimeSampled(m, path, 0.5, 0); err == nil {
+		t.Error("a shadow that is not moving gave no error")
+	}
+}
+
+func TestComputeSamplePointsOversampled(t *testing.T) {
+	// A 50 pixel path sampled 4 times per pixel, on a plane of 1 km per pixel
+	path := &lightcurve.ObservationPath{StartX: 10, StartY: 20, EndX: 40, EndY: 60,
+		FundamentalPlaneWidthKm: 100, FundamentalPlaneWidthPts: 100}
+	m := rampMatrix(100)
+	curve, err := lightcurve.ExtractLightCurveOversampled(m, path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(path.SamplePoints) != 200 || len(curve) != 200 {
+		t.Fatalf("got %d sample points and %d curve points, want 200", len(path.SamplePoints), len(curve))
+	}
+	for i, pt := range path.SamplePoints {
+		wantDistance := 0.25 * float64(i)
+		if math.Abs(pt.DistanceFromStart-wantDistance) > 1e-9 ||
+			math.Abs(math.Hypot(pt.X-10, pt.Y-20)-wantDistance) > 1e-9 {
+			t.Fatalf("point %d at (%g, %g), %g from the start, want %g pixels along the path", i, pt.X, pt.Y,
+				pt.DistanceFromStart, wantDistance)
+		}
+		if math.Abs(curve[i].Distance-wantDistance) > 1e-9 || curve[i].Intensity != shared.Interpolate(m, pt.X, pt.Y) {
+			t.Fatalf("curve point %d is %+v, want %g km and the interpolated value at (%g, %g)", i, curve[i],
+				wantDistance, pt.X, pt.Y)
+		}
+	}
+
+	// Values below 1 give the 1-pixel sampling
+	path.ComputeSamplePointsOversampled(0)
+	if len(path.SamplePoints) != 50 || path.SamplePoints[49].DistanceFromStart != 49 {
+		t.Errorf("samplesPerPixel 0 gave %d points, want the 50 of ComputeSamplePoints", len(path.SamplePoints))
+	}
+}
+
+func TestComputeSamplePointsN(t *testing.T) {
+	// A 50 pixel path in 10 equal segments
+	path := &lightcurve.ObservationPath{StartX: 10, StartY: 20, EndX: 40, EndY: 60}
+	path.ComputeSamplePointsN(11)
+	if len(path.SamplePoints) != 11 {
+		t.Fatalf("got %d sample points, want 11", len(path.SamplePoints))
+	}
+	for i, pt := range path.SamplePoints {
+		wantDistance := 5.0 * float64(i)
+		if math.Abs(pt.DistanceFromStart-wantDistance) > 1e-12 ||
+			math.Abs(math.Hypot(pt.X-10, pt.Y-20)-wantDistance) > 1e-12 {
+			t.Errorf("point %d at (%g, %g), %g from the start, want %g along the path", i, pt.X, pt.Y,
+				pt.DistanceFromStart, wantDistance)
+		}
+	}
+
+	// The last point is the path end, so its distance is the path length
+	last := path.SamplePoints[len(path.SamplePoints)-1]
+	if last.X != 40 || last.Y != 60 || last.DistanceFromStart != 50 {
+		t.Errorf("the last point is (%g, %g), %g from the start, want the path end (40, 60) 50 from the start",
+			last.X, last.Y, last.DistanceFromStart)
+	}
+
+	// Fewer than 2 samples keeps the 1-pixel sampling
+	path.ComputeSamplePointsN(0)
+	if len(path.SamplePoints) != 50 || path.SamplePoints[49].DistanceFromStart != 49 {
+		t.Errorf("n = 0 gave %d points, want the 50 of ComputeSamplePoints", len(path.SamplePoints))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Console messages are written at one of the log/slog levels (debug, info, warn, error) and are
+// printed only if their level is at least verbosity. The default shows everything except debug
+// messages; -verbosity warn, for example, keeps warnings and errors but drops the progress and
+// timing messages, which is useful for batch runs.
+var verbosity = slog.LevelInfo
+
+// console is where all console text goes: stdout, or stdout and the run log once startRunLog has
+// been called.
+var console io.Writer = os.Stdout
+
+// runLogFilename is the file written by -log (or write_log_bool), next to the images.
+const runLogFilename = "run.log"
+
+// runLog is the open run log (nil until startRunLog is called).
+var runLog *os.File
+
+// startRunLog creates filename and from then on copies all console text to it. Calling it again
+// does nothing. The file is not buffered, so nothing is lost when the program exits through os.Exit.
+func startRunLog(filename string) error {
+	if runLog != nil {
+		return nil
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	runLog = f
+	console = io.MultiWriter(os.Stdout, f)
+	return nil
+}
+
+func logAt(level slog.Level, format string, args ...any) {
+	if level >= verbosity {
+		fmt.Fprintf(console, format, args...)
+	}
+}
+
+// logDebug prints detailed diagnostics (path intersections, per-wavelength progress ...).
+func logDebug(format string, args ...any) { logAt(slog.LevelDebug, format, args...) }
+
+// logInfo prints normal progress, timing and result messages.
+func logInfo(format string, args ...any) { logAt(slog.LevelInfo, format, args...) }
+
+// logWarn prints problems that the program has worked around.
+func logWarn(format string, args ...any) { logAt(slog.LevelWarn, format, args...) }
+
+// quietLevel is the verbosity set by -quiet: only errors (and the run summary) are printed.
+const quietLevel = slog.LevelError
+
+// logError prints err on a line of its own. Errors are never suppressed.
+func logError(err error) { fmt.Fprintln(console, err) }
+
+// exitError is an error that ends the command line program with a particular exit code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// exitWith returns err with the exit code that the command line program ends with because of it.
+func exitWith(code int, err error) error { return &exitError{code: code, err: err} }
+
+// exitOnError does nothing if err is nil. Otherwise it prints err and ends the program with the
+// exit code given by exitWith (1 for any other error).
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+	logError(err)
+	code := 1
+	var exit *exitError
+	if errors.As(err, &exit) {
+		code = exit.code
+	}
+	os.Exit(code)
+}
+
+// stripVerbosityFlag removes a -verbosity=<level> (or -verbosity <level>) flag from args, sets
+// verbosity from it and returns the remaining arguments.
+func stripVerbosityFlag(args []string) ([]string, error) {
+	remaining, value, err := stripValueFlag(args, "verbosity")
+	if err != nil {
+		return nil, fmt.Errorf("-verbosity needs a value: debug, info, warn or error")
+	}
+	if value == "" {
+		return remaining, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return nil, fmt.Errorf("-verbosity %q is not one of debug, info, warn or error", value)
+	}
+	verbosity = level
+	return remaining, nil
+}
+
+// runSummary returns the one-line, key=value summary of a completed run of event that is printed
+// for scripts (whatever the verbosity): the shadow speed (km/sec), the path angle (degrees), the
+// number of shadow edges on the path, the total occulted chord length (km) and the run time (sec).
+// label, when not empty, is put first (event=3 in a batch).
+func runSummary(event *OccultationEvent, label string, runtime time.Duration) string {
+	nEdges, chordKm := 0, 0.0
+	if event.PathDefined && event.GeometricMatrix != nil {
+		edges, _, _ := findEdgePairs(*event)
+		nEdges = len(edges)
+		kmPerPixel := event.FundamentalPlaneWidthKm / float64(event.FundamentalPlaneWidthPoints)
+		for i := 0; i+1 < len(edges); i += 2 {
+			chordKm += (edges[i+1] - edges[i]) * kmPerPixel
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString("summary")
+	if label != "" {
+		sb.WriteString(" " + label)
+	}
+	fmt.Fprintf(&sb, " shadow_speed=%g path_angle=%g n_edges=%d chord_km=%.4f runtime_s=%.3f",
+		event.ShadowSpeedKmPerSec, event.PathAngleDegrees, nEdges, chordKm, runtime.Seconds())
+	return sb.String()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStartRunLog(t *testing.T) {
+	defer func(w io.Writer, v slog.Level) { console, runLog, verbosity = w, nil, v }(console, verbosity)
+	verbosity = slog.LevelInfo
+
+	filename := filepath.Join(t.TempDir(), "run.log")
+	if err := startRunLog(filename); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer runLog.Close()
+	logInfo("Fresnel scale is %0.3f km\n", 0.123)
+	logDebug("not shown\n")
+	logError(os.ErrNotExist)
+
+	// A second start (the flag and the parameter file both asking) keeps the same log
+	if err := startRunLog(filepath.Join(t.TempDir(), "other.log")); err != nil {
+		t.Fatalf("unexpected error on a second start: %v", err)
+	}
+	logWarn("still logged\n")
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Fresnel scale is 0.123 km\nfile does not exist\nstill logged\n"
+	if string(data) != want {
+		t.Errorf("run log holds %q, want %q", data, want)
+	}
+}
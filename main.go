@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/color"
-	"image/png"
 	"math"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -15,6 +16,7 @@ import (
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
 	json "github.com/KevinWang15/go-json5"
+	"github.com/bob-anderson-ok/IOTAdiffraction/lightcurve"
 )
 
 // !!!!! This MUST match the app name given in the run configuration !!!!!
@@ -27,22 +29,41 @@ type OccultationEvent struct {
 	IntensityMatrix                 [][]float64
 	GeometricMatrix                 [][]float64
 	ShowInput                       bool
+	SaveEField                      bool
+	CabillosPhaseTerm               bool // Include exp(i k Z) in the saved e-field (no effect on intensity)
+	RotateGroundShadowTo90pa        bool
+	SourcePlaneRotationDegrees      float64 // Counter-clockwise (as displayed) rotation of the source plane
+	SaveSatelliteDifference         bool
+	SaveGeometricShadow             bool // Write geometricShadow.png (edge detection uses GeometricMatrix)
+	SavePowerSpectrum               bool
+	SaveIntensityMatrixGz           bool // Also write the intensity matrix losslessly (float64, gzip)
+	SavePerWavelength               bool
+	SaveApertureIntensity           bool
 	PathSamplePoints                [][3]float64
+	PathEndpointsPixels             [4]float64 // [x0,y0,x1,y1] from path_endpoints_pixels (if PathEndpointsGiven)
+	PathEndpointsGiven              bool
+	PathDefined                     bool       // Set when there is an observation path (moving shadow or endpoints given)
 	PathStart                       [2]float64 // [x,y] fractional pixel coordinates of path start point
 	PathEnd                         [2]float64 // [x,y] fractional pixel coordinates of path end point
 	PathDirection                   string
 	WindowSizePixels                int
 	PathForGroundShadowOutputFolder string
 	PathToExternalImage             string
+	ReuseGeometricShadowPNG         string // geometricShadow.png of an earlier run, used instead of building the plane
 	ExternalImageWidthKm            float64
+	PathToSourcePlaneNPY            string // numpy .npy file with the occulter opacity (0 sky to 1 solid) of each pixel
+	PathToComplexSourcePlaneNPY     string // numpy .npy file with the complex source plane, used unchanged
 	PathToQEtable                   string
+	QEWavelengthUnits               string // "nm" or "um" (micrometers) for the wavelengths in the QE table file
 	QEtable                         [][2]float64
 	Title                           string
 	FundamentalPlaneWidthKm         float64
 	FundamentalPlaneWidthPoints     int
 	ObservationWavelengthNm         float64
+	Band                            string // Photometric band that set ObservationWavelengthNm (empty if the wavelength was given)
 	DxKmPerSec                      float64
 	DyKmPerSec                      float64
+	UnrotatedVelocity               [2]float64 // dX, dY (km/sec) before rotateGroundShadowTo90pa turned them to a 90 degree PA
 	ShadowSpeedKmPerSec             float64
 	PathAngleDegrees                float64
 	PathOffsetFromCenterKm          float64
@@ -52,507 +73,282 @@ type OccultationEvent struct {
 	LimbDarkeningCoeff              float64
 	StarClass                       string
 	PercentMagDrop                  float64
+	IncidentWaveAmplitude           float64 // Amplitude of the Babinet incident wave (0, when not set, means 1)
+	IncidentWavePhaseDegrees        float64 // Phase of the Babinet incident wave
+	Mode                            string  // "occulter" (Babinet: the shapes block the light) or "aperture" (the shapes let it through)
+	CameraExposureSecs              float64
+	EdgeApodization                 float64
+	AtmosphereScaleHeightKm         float64
+	ChromaticDispersionCoeff        float64
+	StarDiamChromaticCoeff          float64 // Relative change of the star diameter per relative change of wavelength
+	TargetImageFloor                float64
+	PathMarkers                     string  // "default" or "colorblind": the style of the path and its end markers
+	DisplayBitDepth                 int     // 8, or 16 to also write the stretched display image at 16 bits
+	DisplayOffset                   float64 // Subtracted (clamped at 0) from the intensity before the display stretch only
+	KmGridSpacingKm                 float64
+	PlotResidual                    bool    // Add a panel with the light curve minus the geometric step
+	PlotHalfLightEdges              bool    // Also mark the half-light (diffraction) position of each edge
+	PlotGeometricStep               bool    // Draw the geometric 0/1 step under the light curve
+	WriteLog                        bool    // Copy the console output to run.log (as the -log flag does)
+	ReportAsymmetry                 bool    // Print how far the intensity is from point symmetry about the shadow center
+	PathNumSamples                  int     // Number of equal steps the path is sampled at (0: one per pixel of length)
+	PlotXTickStepKm                 float64 // Light curve plot tick steps and label formats (0 and "" keep the defaults)
+	PlotYTickStep                   float64
+	PlotXTickFormat                 string
+	PlotYTickFormat                 string
+	MinSamplesPerFresnel            float64 // Stop (or with -autosize add points) below this many samples per Fresnel scale
+	NoiseLevel                      float64 // Noise (standard deviation) of the light curve samples, for edge timing
+	MinEdgeSeparationKm             float64 // Closer edges along the path bound a spurious segment and are removed (0: off)
+	FlipHorizontal                  bool    // Mirror the saved and displayed images left to right (E-W)
+	FlipVertical                    bool    // Mirror the saved and displayed images top to bottom (N-S)
+	PsfConvMode                     string  // Star convolution mode: same, full or valid (extra images of the full extent)
+	GradedSourcePlane               bool    // Set when the geometric shadow has gray levels (atmosphere, opacity or transparent image)
 	ParallaxArcsec                  float64
-	DistanceAu                      float64
+	LightTimeSecs                   float64 // One-way light travel time to the asteroid
+	DistanceAu                      float64 // Set by resolveDistance from the parallax, light time or distance_au
+	DistanceSource                  string  // The parameter DistanceAu was taken from
 	MainBodyGiven                   bool
 	MainBodyXCenterKm               float64
 	MainBodyYCenterKm               float64
 	MainbodyMajorAxisKm             float64
 	MainbodyMinorAxisKm             float64
 	MainbodyMajorAxisPaDegrees      float64
+	MainbodyOpacity                 float64 // 0 < opacity <= 1 (0, when not set, means opaque)
 	SatelliteGiven                  bool
 	SatelliteXCenterKm              float64
 	SatelliteYCenterKm              float64
 	SatelliteMajorAxisKm            float64
 	SatelliteMinorAxisKm            float64
 	SatelliteMajorAxisPaDegrees     float64
-}
+	SatelliteOpacity                float64 // 0 < opacity <= 1 (0, when not set, means opaque)
 
-func main() {
+	// Other point sources near the target star, each adding its own shifted diffraction pattern
+	StarField []StarFieldSource
 
-	programStart := time.Now()
+	// Resolution and Fresnel sampling as last reported by printResolution (see DerivedQuantities)
+	Sampling PlaneSampling
+}
 
-	var p1 AnnotatedPoint
-	var p2 AnnotatedPoint
+// StarFieldSource is a point source near the target star. Its diffraction pattern is the target's
+// pattern moved by the offset (in fundamental plane km), weighted by its brightness relative to the target.
+type StarFieldSource struct {
+	XOffsetKm  float64
+	YOffsetKm  float64
+	Brightness float64
+}
 
-	// We supply an ID (hopefully unique) because we may need to use the preferences API
-	myApp := app.NewWithID("com.gmail.ok.anderson.bob")
-	w := myApp.NewWindow("OccultDiffractionApp - user friendly diffraction image (8 bit grayscale png)")
-	w.Resize(fyne.Size{Height: 800, Width: 1200})
+func main() {
 
-	args := os.Args
+	programStart := time.Now()
 
-	if len(args) < 2 || len(args) > 3 {
-		fmt.Println("\n\tWrong number of arguments.\n\tUsage: OccultDiffractionApp <parameter-file> [true|false]")
+	// -verbosity=<debug|info|warn|error> may appear anywhere on the command line
+	args, err := stripVerbosityFlag(os.Args)
+	if err != nil {
+		logError(fmt.Errorf("\n\t%w\n", err))
 		os.Exit(1)
 	}
 
-	path := args[1]
+	// -quiet prints only errors and the one-line run summary, for scripts
+	args, quiet := stripFlag(args, "quiet")
+	if quiet {
+		verbosity = quietLevel
+	}
 
-	showPlots := true
-	if len(args) == 3 {
-		var err error
-		showPlots, err = strconv.ParseBool(args[2])
-		if err != nil {
-			fmt.Println("\n\tSecond argument must be true or false.")
-			os.Exit(1)
+	// -autosize replaces the fundamental plane width and number of points by the suggested values
+	args, autosize := stripFlag(args, "autosize")
+
+	// -log copies everything printed to run.log (write_log_bool does the same from the parameter file)
+	args, writeLog := stripFlag(args, "log")
+	if writeLog {
+		if err := startRunLog(runLogFilename); err != nil {
+			logError(fmt.Errorf("\n\tThe run log could not be created: %w\n", err))
+			os.Exit(27)
 		}
 	}
 
-	// Read the Json5 (or Json) parameter file
-	data, err := os.ReadFile(path)
+	// -cpuprofile=<file> and -memprofile=<file> write pprof profiles of the computation
+	args, cpuProfilePath, err := stripValueFlag(args, "cpuprofile")
 	if err != nil {
-		fmt.Println(fmt.Errorf("\n\tAttempt to read input file %q failed: %w\n", path, err))
-		os.Exit(2)
+		logError(fmt.Errorf("\n\t%w\n", err))
+		os.Exit(1)
 	}
-
-	// Parse json(5) data into a generic container
-	var jsonTable map[string]interface{}
-	err = json.Unmarshal(data, &jsonTable)
+	args, memProfilePath, err := stripValueFlag(args, "memprofile")
 	if err != nil {
-		fmt.Println(fmt.Errorf("\n\tFormat error in file %q: %w\n", path, err))
-		os.Exit(3)
-	}
-
-	var event OccultationEvent
-	msg, ok := validateJsonFileAndFillEvent(jsonTable, &event)
-	if !ok {
-		fmt.Println(msg)
-		os.Exit(4)
+		logError(fmt.Errorf("\n\t%w\n", err))
+		os.Exit(1)
 	}
 
-	// Check for user wanting printout of complete jsonTable
-	if event.ShowInput {
-		fmt.Printf("%s", "\nPrintout of  complete jsonTable contents...\n")
-		fmt.Println(string(data))
+	// -version prints the version and build information (for bug reports) and exits.
+	if len(args) == 2 && (args[1] == "-version" || args[1] == "--version") {
+		fmt.Println(versionInfo())
+		return
 	}
 
-	// If a path to a camera response json file was given, read it
-	if event.PathToQEtable != "" {
-		// Read the Json5 (or Json) parameter file
-		data, err := os.ReadFile(event.PathToQEtable)
-		if err != nil {
-			fmt.Println(fmt.Errorf("\n\tAttempt to read file %q failed: %w\n", path, err))
-			os.Exit(13)
-		}
-		var qeTable [][2]float64
-		qeTable, err = parseArrayFormat(data)
+	// The replot subcommand regenerates the light curve products from the PNGs of a previous
+	// run, so it is handled before any window is created.
+	if len(args) == 3 && args[1] == "replot" {
+		err := runReplot(args[2])
 		if err != nil {
-			fmt.Println(fmt.Errorf("\n\tError reading camera response file %q: %w\n", event.PathToQEtable, err))
-			os.Exit(15)
+			logError(fmt.Errorf("\n\treplot failed: %w\n", err))
+			os.Exit(19)
 		}
-		event.QEtable = qeTable
-		//fmt.Println("Got the camera table", len(qeTable), "entries")
-		if len(qeTable) < 1 {
-			fmt.Println(fmt.Errorf("\n\tThe camera response file %q is empty.", event.PathToQEtable))
-			os.Exit(14)
-		}
-		var cumWeights = 0.0
-		for i := 0; i < len(qeTable); i++ {
-			cumWeights += qeTable[i][1]
-		}
-		for i := 0; i < len(qeTable); i++ {
-			qeTable[i][1] /= cumWeights
-		}
-		MakeCameraResponsePlot(qeTable, event.PathToQEtable)
-	}
-
-	// Sanity check on number of points in a fundamental plane
-	if event.FundamentalPlaneWidthPoints < 10 {
-		fmt.Println(fmt.Errorf("\n\tThe fundamental plane width must be at least 10 points."))
-		os.Exit(16)
+		return
 	}
 
-	Npts := event.FundamentalPlaneWidthPoints // Just a shorthand version
-
-	fmt.Printf("\nVersion %s\n\n", version)
-
-	// Calculate resolution in fundamental plane
-	resolution := event.FundamentalPlaneWidthKm / float64(Npts)
-	fmt.Printf("Resolution in fundamental plane is %0.3f km/pixel\n", resolution)
-	fresnelScale := FresnelScale(event.ObservationWavelengthNm, event.DistanceAu)
-	fmt.Printf("Fresnel scale is %0.3f km\n", fresnelScale)
-	samplesPerFresnelScale := int(fresnelScale / resolution)
-	fmt.Printf("Samples per Fresnel scale is %d  (To see diffraction effects, this number should be at least 5)\n\n", samplesPerFresnelScale)
-
-	start := time.Now() // Time generation of geometric shadow
-
-	// Deal with external image supplied by the user.
-	if event.PathToExternalImage != "" {
-		f, err := os.Open(event.PathToExternalImage)
+	// The compare subcommand reports the differences between two 16-bit intensity images.
+	if len(args) == 4 && args[1] == "compare" {
+		err := runCompare(args[2], args[3])
 		if err != nil {
-			fmt.Println(fmt.Errorf("\n\tAttempt to read external image %q failed: %w\n", event.PathToExternalImage, err))
-			os.Exit(5)
+			logError(fmt.Errorf("\n\tcompare failed: %w\n", err))
+			os.Exit(20)
 		}
-		//defer f.Close()
-		defer func() {
-			if cerr := f.Close(); cerr != nil && err == nil {
-				err = cerr
-			}
-		}()
+		return
+	}
 
-		img, err := png.Decode(f)
+	// The sweep subcommand runs the parameter file over a range of values of one key and animates
+	// the light curve plots.
+	if len(args) == 7 && args[1] == "sweep" {
+		var limits [3]float64
+		for i := range limits {
+			limits[i], err = strconv.ParseFloat(args[4+i], 64)
+			if err != nil {
+				logError(fmt.Errorf("\n\tsweep: %q is not a number\n", args[4+i]))
+				os.Exit(1)
+			}
+		}
+		err := runSweep(args[2], args[3], limits[0], limits[1], limits[2], "sweep.gif")
 		if err != nil {
-			fmt.Println(fmt.Errorf("\n\tAttempt to decode external image %q failed: %w\n", event.PathToExternalImage, err))
-			os.Exit(6)
+			logError(fmt.Errorf("\n\tsweep failed: %w\n", err))
+			os.Exit(22)
 		}
+		return
+	}
 
-		if img.Bounds().Dx() != img.Bounds().Dy() {
-			fmt.Println(fmt.Errorf("\n\tThe supplied external image %q is not square.", event.PathToExternalImage))
-			os.Exit(7)
+	// The montage subcommand places same-size PNG images side by side, captioned with their file names.
+	if len(args) >= 4 && args[1] == "montage" {
+		columns, err := strconv.Atoi(args[2])
+		if err != nil {
+			logError(fmt.Errorf("\n\tmontage: %q is not a whole number of columns\n", args[2]))
+			os.Exit(1)
 		}
-
-		// We require that an external image is in GRAY format (uint8) to match
-		// our internal use when we build the fundamental plane image ourselves. We do this
-		// so that we can add (overlay) any ellipses defined in the json file. We expect
-		// that external image files are used only to define odd or polygon shapes.
-		// If the image is RGB (32-bit), we convert it to Gray automatically.
-		var grayImg *image.Gray
-		if img.ColorModel() == color.GrayModel {
-			grayImg = img.(*image.Gray)
-		} else if img.ColorModel() == color.RGBAModel || img.ColorModel() == color.NRGBAModel {
-			fmt.Printf("\n\tThe supplied external image %q is %s. Converting to Gray.\n",
-				event.PathToExternalImage, ColorModelString(img.ColorModel()))
-			bounds := img.Bounds()
-			grayImg = image.NewGray(bounds)
-			skyRef := img.At(bounds.Min.X, bounds.Min.Y)
-			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-				for x := bounds.Min.X; x < bounds.Max.X; x++ {
-					if img.At(x, y) == skyRef {
-						grayImg.SetGray(x, y, color.Gray{Y: 255})
-					} else {
-						grayImg.SetGray(x, y, color.Gray{Y: 0})
-					}
-				}
-			}
-		} else {
-			fmt.Println(fmt.Errorf("\n\tThe supplied external image %q is not type GRAY (found: %s).",
-				event.PathToExternalImage, ColorModelString(img.ColorModel())))
-			os.Exit(8)
+		err = lightcurve.SaveMontage("montage.png", args[3:], nil, columns)
+		if err != nil {
+			logError(fmt.Errorf("\n\tmontage failed: %w\n", err))
+			os.Exit(24)
 		}
+		logInfo("Montage of %d images saved to montage.png\n", len(args)-3)
+		return
+	}
 
-		event.FplaneImage = grayImg
+	// We supply an ID (hopefully unique) because we may need to use the preferences API
+	myApp := app.NewWithID("com.gmail.ok.anderson.bob")
+	w := myApp.NewWindow("OccultDiffractionApp - user friendly diffraction image (8 bit grayscale png)")
+	w.Resize(fyne.Size{Height: 800, Width: 1200})
 
-		// Override the value (possibly) supplied in the fundamental_plane_width_num_points parameter
-		event.FundamentalPlaneWidthPoints = img.Bounds().Dx()
-		Npts = event.FundamentalPlaneWidthPoints // Shorthand
-		fmt.Printf("External image loaded. Color model in use: %s\n", ColorModelString(event.FplaneImage.ColorModel()))
-		fmt.Printf("external_image_width_km: %g\n", event.ExternalImageWidthKm)
-	} else { // No image supplied by user, so we start our own.
-		event.FplaneImage = image.NewGray(image.Rect(0, 0, Npts, Npts))
-		FillFplane(event.FplaneImage, true)
+	if len(args) < 2 || len(args) > 3 {
+		fmt.Println("\n\tWrong number of arguments.\n\tUsage: OccultDiffractionApp [-verbosity=<level>] [-quiet] [-autosize] [-log]" +
+			" [-cpuprofile=<file>] [-memprofile=<file>] <parameter-file> [true|false]" +
+			"\n\t       OccultDiffractionApp replot <parameter-file>" +
+			"\n\t       OccultDiffractionApp compare <16-bit-png> <16-bit-png>" +
+			"\n\t       OccultDiffractionApp sweep <parameter-file> <key> <start> <stop> <step>" +
+			"\n\t       OccultDiffractionApp montage <columns> <png> [<png> ...]" +
+			"\n\t       OccultDiffractionApp -version")
+		os.Exit(1)
 	}
 
-	AddEllipses(event, true)
-	err = SaveGrayPNG("geometricShadow.png", event.FplaneImage)
-	if err != nil {
-		fmt.Println(fmt.Errorf("\n\tFailed to write %q.", "geometricShadow.png"))
-		os.Exit(9)
-	}
+	path := args[1]
 
-	sourcePlane := ConvertSourcePlaneImageToComplex(event.FplaneImage)
-	event.GeometricMatrix = ConvertSourcePlaneImageToMatrix(event.FplaneImage)
-
-	elapsed := time.Since(start)
-	fmt.Printf("Generation of the geometric shadow took %s\n", elapsed)
-
-	// Here we figure out the proper value to use for the limb darkening coefficient based on
-	// the supplied parameters.
-	LimbValues := map[string]float64{
-		"O": 0.05,
-		"B": 0.2,
-		"A": 0.5,
-		"F": 0.6,
-		"G": 0.7,
-		"K": 0.7,
-		"M": 0.7,
-	}
-	if event.StarDiamMas > 0.0 {
-		if event.LimbDarkeningCoeff == 0.0 { // Limb darkening coefficient takes precedence over star class
-			if event.StarClass == "" {
-				// No star class or limb darkening coefficient given, so we use a default value of 0.7
-				event.LimbDarkeningCoeff = 0.7
-			} else {
-				v, ok := LimbValues[event.StarClass]
-				if !ok {
-					fmt.Println(fmt.Errorf(
-						"\n\tThe star class %q is not recognized. Default value of 0.7 will be used.\n",
-						event.StarClass),
-					)
-					event.LimbDarkeningCoeff = 0.7
-				} else {
-					event.LimbDarkeningCoeff = v // Use value from the table
-				}
-			}
+	showPlots := true
+	if len(args) == 3 {
+		showPlots, err = strconv.ParseBool(args[2])
+		if err != nil {
+			fmt.Println("\n\tSecond argument must be true or false.")
+			os.Exit(1)
 		}
 	}
 
-	fmt.Println("Limb darkening coefficient set to:", event.LimbDarkeningCoeff)
-
-	// If a user gave us distance in arcseconds, it is given priority, and
-	// we overwrite any value that may also have been given in AU.
-	if event.ParallaxArcsec > 0.0 {
-		event.DistanceAu = 8.79414 / event.ParallaxArcsec
+	stopProfiling, err := startProfiling(cpuProfilePath, memProfilePath)
+	if err != nil {
+		logError(fmt.Errorf("\n\t%w\n", err))
+		os.Exit(21)
 	}
 
-	auToKm := 1.495979e+8
-	nmToKm := 1e-9 * 1e-3
-
-	WavelengthKm := event.ObservationWavelengthNm * nmToKm
-	Lkm := event.FundamentalPlaneWidthKm
-	Zkm := event.DistanceAu * auToKm
-
-	// Some elementary checks to make sure that the user has not supplied bad parameters
-	if Lkm <= 0.0 {
-		fmt.Println(fmt.Errorf("\n\tFundamental plane width must be positive."))
-		os.Exit(10)
+	// Read the Json5 (or Json) parameter file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logError(fmt.Errorf("\n\tAttempt to read input file %q failed: %w\n", path, err))
+		os.Exit(2)
 	}
 
-	if Zkm <= 0.0 {
-		fmt.Println(fmt.Errorf("\n\tDistance given is invalid."))
-		os.Exit(10)
+	// Parse json(5) data into a generic container
+	var parsed interface{}
+	err = json.Unmarshal(data, &parsed)
+	if err != nil {
+		logError(fmt.Errorf("\n\tFormat error in file %q: %w\n", path, err))
+		os.Exit(3)
 	}
-
-	event.ShadowSpeedKmPerSec = math.Sqrt(event.DxKmPerSec*event.DxKmPerSec + event.DyKmPerSec*event.DyKmPerSec)
-	if event.ShadowSpeedKmPerSec > 0.0 {
-		event.PathAngleDegrees = math.Atan2(-event.DxKmPerSec, -event.DyKmPerSec) * 180.0 / math.Pi
-		if event.PathAngleDegrees < 0.0 {
-			event.PathAngleDegrees += 360.0
-		}
-		fmt.Printf("\nPath angle is %0.1f degrees\n", event.PathAngleDegrees)
-		fmt.Printf("Shadow speed is %0.3f km/sec\n\n", event.ShadowSpeedKmPerSec)
-
-		// The following function sets event.PathStart and event.PathEnd variables
-		p1, p2, event.PathDirection, err = processPathDirection(Npts, p1, p2, &event)
-		if err != nil {
-			fmt.Println(fmt.Errorf("\n\tProcessing of path direction failed: %w", err))
-			os.Exit(10)
-		}
-		fmt.Printf("Direction: %s\n", event.PathDirection)
-		computePathPoints(&event)
-
+	parsed, err = resolveIncludes(parsed, path)
+	if err != nil {
+		logError(fmt.Errorf("\n\tIn file %q: %w\n", path, err))
+		os.Exit(3)
 	}
 
-	event.StarDiamKm = 1.496e8 * event.DistanceAu * event.StarDiamMas / (1000.0 * 206265)
-
-	var eField []complex128
-	if len(event.QEtable) > 0 {
-		// Get the first scaled eField to use to accumulate all the rest
-		WavelengthKm = event.QEtable[0][0] * nmToKm
-		eField = FullObservationPlaneSincSolution(Lkm, Zkm, WavelengthKm, sourcePlane)
-		scaleComplex(eField, event.QEtable[0][1])
-
-		// Now do the rest
-		for i := 1; i < len(event.QEtable); i++ {
-			// Compute the effective wavelength at each wavelength bin
-			WavelengthKm = event.QEtable[i][0] * nmToKm
-			start = time.Now()
-			newField := FullObservationPlaneSincSolution(Lkm, Zkm, WavelengthKm, sourcePlane)
-			addScaledComplexInPlace(eField, newField, event.QEtable[i][1])
-			elapsed = time.Since(start)
-			fmt.Printf("Calculation of wavelength %0.1f e-field took %s\n", event.QEtable[i][0], elapsed)
-		}
-	} else {
-		start = time.Now()
-		eField = FullObservationPlaneSincSolution(Lkm, Zkm, WavelengthKm, sourcePlane)
-		elapsed = time.Since(start)
-		fmt.Printf("Calculation of the observation e-field took %s\n", elapsed)
+	// An array of events (or an array of path offsets) is run as a headless batch
+	tables, isBatch, err := expandBatchTables(parsed)
+	if err != nil {
+		logError(fmt.Errorf("\n\tFormat error in file %q: %w\n", path, err))
+		os.Exit(3)
 	}
-
-	start = time.Now()
-
-	// incidentWave is used to convert the aperture image to an occulter image using Babinet's formula
-	incidentWave := complex(1.0, 0.0)
-
-	intensity := make([]float64, len(eField))
-	for i := 0; i < len(eField); i++ {
-		intensity[i] = real(incidentWave-eField[i])*real(incidentWave-eField[i]) +
-			imag(incidentWave-eField[i])*imag(incidentWave-eField[i])
+	if isBatch {
+		logInfo("\nVersion %s\n", version)
+		exitOnError(runBatch(tables, autosize))
+		if err := stopProfiling(); err != nil {
+			logError(err)
+		}
+		logInfo("\nTotal program run time is %s\n", time.Since(programStart))
+		return
 	}
 
-	event.IntensityMatrix, err = Reshape1DTo2D(intensity, Npts, Npts)
+	event, err := eventFromTable(parsed.(map[string]interface{}))
 	if err != nil {
-		fmt.Println(fmt.Errorf("reshape of intensity vector failed: %w", err))
-		os.Exit(10)
+		logError(err)
+		os.Exit(4)
 	}
 
-	// Here we apply any necessary magDrop adjustments
-	if event.PercentMagDrop > 0 { // Check for value given and bonus: ignore negative values
-		if event.PercentMagDrop > 100 {
-			fmt.Println(fmt.Errorf("percentMagDrop of %0.1f is too large. Setting it to 100.0", event.PercentMagDrop))
-			event.PercentMagDrop = 100.0
-		}
-		scaleFactor := event.PercentMagDrop / 100.0
-		shiftUp := 1.0 - scaleFactor
-		for row := 0; row < len(event.IntensityMatrix); row++ {
-			for col := 0; col < len(event.IntensityMatrix[row]); col++ {
-				event.IntensityMatrix[row][col] *= scaleFactor
-				event.IntensityMatrix[row][col] += shiftUp
-			}
+	if event.WriteLog {
+		if err := startRunLog(runLogFilename); err != nil {
+			logError(fmt.Errorf("\n\tThe run log could not be created: %w\n", err))
+			os.Exit(27)
 		}
 	}
 
-	elapsed = time.Since(start)
-	fmt.Printf("Calculation of the observation intensity took %s\n", elapsed)
-
-	var newImage [][]float64
-	var imgForDisplay *image.Gray
-
-	if event.StarDiamKm > 0.0 {
-		fmt.Printf("\nStar diameter projected at the plane of the asteroid is %0.3f km\n\n", event.StarDiamKm)
-		starImage, sumOfWeights := BuildStarPsf(event.StarDiamKm, resolution, event.LimbDarkeningCoeff)
-
-		start := time.Now()
-		newImage, err = ConvolvePSFFFT(event.IntensityMatrix, starImage, sumOfWeights, ConvSame, PadReplicate, false)
-		if err != nil {
-			fmt.Println(fmt.Errorf("convolution of intensity matrix with star image failed: %w", err))
-			os.Exit(13)
-		}
-
-		event.IntensityMatrix = newImage
-
-		elapsed := time.Since(start)
-		fmt.Printf("Convolution of intensity matrix with star image took %s\n", elapsed)
-
-		imgForDisplay, err = MatrixToGrayViewPercentile(newImage, 0.0, 100)
-		// comment place here just to suppress dup lines warning
-		if err != nil {
-			fmt.Println(fmt.Errorf("creation of the display image failed: %w", err))
-			os.Exit(11)
-		}
-
-		err = SaveGrayPNG("diffractionImage8bit.png", imgForDisplay)
-		if err != nil {
-			fmt.Println(fmt.Errorf("writing of %q failed: %w", "diffractionImage8bit.png", err))
-			os.Exit(12)
-		}
-
-		// Make the scientific (well-defined scaling) version of the intensity matrix
-		occultImage, err := MatrixToGray16Data(newImage, 4000)
-		if err != nil {
-			fmt.Println(fmt.Errorf("creation of occultImage failed: %w", err))
-			os.Exit(13)
-		}
-
-		err = SaveGray16PNG("targetImage16bit.png", occultImage)
-		if err != nil {
-			fmt.Println(fmt.Errorf("writing of %q failed: %w", "targetImage16bit.png", err))
-			os.Exit(14)
-		}
-	} else {
-		// Make a user-friendly .png of the observation intensity matrix
-		imgForDisplay, err = MatrixToGrayViewPercentile(event.IntensityMatrix, 0.0, 100)
-		if err != nil {
-			fmt.Println(fmt.Errorf("creation of the display image failed: %w", err))
-			os.Exit(11)
-		}
+	// Check for user wanting printout of complete jsonTable
+	if event.ShowInput {
+		logInfo("%s", "\nPrintout of  complete jsonTable contents...\n")
+		logInfo("%s\n", string(data))
+	}
 
-		err = SaveGrayPNG("diffractionImage8bit.png", imgForDisplay)
-		if err != nil {
-			fmt.Println(fmt.Errorf("writing of %q failed: %w", "diffractionImage8bit.png", err))
-			os.Exit(12)
-		}
+	logInfo("\nVersion %s\n\n", version)
 
-		// Make the scientific (well-defined scaling) version of the intensity matrix
-		occultImage, err := MatrixToGray16Data(event.IntensityMatrix, 4000)
-		if err != nil {
-			fmt.Println(fmt.Errorf("creation of occultImage failed: %w", err))
-			os.Exit(13)
-		}
+	event, err = RunSimulationContext(context.Background(), event, SimulationOptions{
+		Autosize:           autosize,
+		SaveLightCurvePlot: !showPlots, // Save the plot as a PNG file instead of displaying it
+	})
+	exitOnError(err)
 
-		err = SaveGray16PNG("targetImage16bit.png", occultImage)
-		if err != nil {
-			fmt.Println(fmt.Errorf("writing of %q failed: %w", "targetImage16bit.png", err))
-			os.Exit(14)
-		}
+	// The computation is done: the rest is display
+	if err := stopProfiling(); err != nil {
+		logError(err)
 	}
 
-	// Save a diffraction image with an observation path overlay
-	if event.ShadowSpeedKmPerSec > 0.0 && imgForDisplay != nil {
-		annotated := DrawPathOnImage(imgForDisplay, p1.X, p1.Y, p2.X, p2.Y,
-			event.PathStart[0], event.PathStart[1], event.PathEnd[0], event.PathEnd[1])
-		err = SaveImagePNG("diffractionImageWithPath.png", annotated)
-		if err != nil {
-			fmt.Println(fmt.Errorf("writing of %q failed: %w", "diffractionImageWithPath.png", err))
-		} else {
-			fmt.Println("Diffraction image with observation path saved to diffractionImageWithPath.png")
-		}
-	}
+	elapsed := time.Since(programStart)
+	logInfo("\nTotal program run time is %s\n", elapsed)
+	fmt.Fprintln(console, runSummary(&event, "", elapsed))
 
-	//if event.StarDiamKm > 0.0 {
-	//	fmt.Printf("\nStar diameter projected at the plane of the asteroid is %0.3f km\n\n", event.StarDiamKm)
-	//	starImage, sumOfWeights := BuildStarPsf(event.StarDiamKm, resolution, event.LimbDarkeningCoeff)
-	//
-	//	start := time.Now()
-	//	newImage, err = ConvolvePSFFFT(event.IntensityMatrix, starImage, sumOfWeights, ConvSame, PadReplicate, false)
-	//	if err != nil {
-	//		fmt.Println(fmt.Errorf("convolution of intensity matrix with star image failed: %w", err))
-	//		os.Exit(13)
-	//	}
-	//
-	//	elapsed := time.Since(start)
-	//	fmt.Printf("Convolution of intensity matrix with star image took %s\n", elapsed)
-	//
-	//	imgForDisplay, err := MatrixToGrayViewPercentile(newImage, 0.0, 100)
-	//	// comment place here just to suppress dup lines warning
-	//	if err != nil {
-	//		fmt.Println(fmt.Errorf("creation of the display image failed: %w", err))
-	//		os.Exit(11)
-	//	}
-	//
-	//	err = SaveGrayPNG("diffractionImage8bit.png", imgForDisplay)
-	//	if err != nil {
-	//		fmt.Println(fmt.Errorf("writing of %q failed: %w", "diffractionImage8bit.png", err))
-	//		os.Exit(12)
-	//	}
-	//
-	//	// Make the scientific (well-defined scaling) version of the intensity matrix
-	//	occultImage, err := MatrixToGray16Data(newImage, 4000)
-	//	if err != nil {
-	//		fmt.Println(fmt.Errorf("creation of occultImage failed: %w", err))
-	//		os.Exit(13)
-	//	}
-	//
-	//	err = SaveGray16PNG("targetImage16bit.png", occultImage)
-	//	if err != nil {
-	//		fmt.Println(fmt.Errorf("writing of %q failed: %w", "targetImage16bit.png", err))
-	//		os.Exit(14)
-	//	}
-	//}
-
-	elapsed = time.Since(programStart)
-	fmt.Printf("\nTotal program run time is %s\n", elapsed)
-
-	if !showPlots {
-		// Save plots as PNG files instead of displaying them
-		if event.ShadowSpeedKmPerSec > 0.0 {
-			edges := FindEdgesInGeometricShadow(event)
-			plotImg, err := makePlotImage(event.PathDirection, 1200, 500, event, edges)
-			if err != nil {
-				fmt.Println(fmt.Errorf("creating light curve plot failed: %w", err))
-				os.Exit(15)
-			}
-			f, err := os.Create("lightCurvePlot.png")
-			if err != nil {
-				fmt.Println(fmt.Errorf("creating lightCurvePlot.png failed: %w", err))
-				os.Exit(16)
-			}
-			if err := png.Encode(f, plotImg); err != nil {
-				if cerr := f.Close(); cerr != nil {
-					fmt.Println(fmt.Errorf("closing lightCurvePlot.png failed: %w", cerr))
-				}
-				fmt.Println(fmt.Errorf("writing lightCurvePlot.png failed: %w", err))
-				os.Exit(17)
-			}
-			if err := f.Close(); err != nil {
-				fmt.Println(fmt.Errorf("closing lightCurvePlot.png failed: %w", err))
-				os.Exit(18)
-			}
-			fmt.Println("Light curve plot saved to lightCurvePlot.png")
-		}
-		// diffractionImage8bit.png and camera_response.png are already saved
-	} else if event.WindowSizePixels > 0 { // We have lots of displays to make!
+	// Without plots, lightCurvePlot.png, diffractionImage8bit.png and camera_response.png are already saved
+	if showPlots && event.WindowSizePixels > 0 { // We have lots of displays to make!
 		size := event.WindowSizePixels
+		Npts := event.FundamentalPlaneWidthPoints // Shorthand (an external image may have overridden it)
 
 		winTitle := event.Title
 		if len(event.QEtable) > 0 {
@@ -571,30 +367,31 @@ func main() {
 
 		w.SetContent(container.NewStack(img))
 
-		// Here we add a red line to show the star path with colored dots at the ends to show direction(red to green)
-		if event.ShadowSpeedKmPerSec > 0.0 {
-			line := canvas.NewLine(color.RGBA{R: 255, A: 255})
+		// Here we add a line to show the star path with markers at the ends to show direction (by default a red
+		// line with red to green dots)
+		if event.PathDefined {
+			style := pathStyle(&event)
+			line := canvas.NewLine(style.LineColor)
+			// The displayed image may be flipped, so the path is flipped to match
+			startX, startY := outputPoint(&event, event.PathStart[0], event.PathStart[1])
+			endX, endY := outputPoint(&event, event.PathEnd[0], event.PathEnd[1])
+
 			// Convert row, col values to window coordinates
-			scaledY1 := float32(p1.Y) / float32(Npts) * float32(size)
-			scaledX1 := float32(p1.X) / float32(Npts) * float32(size)
+			scaledStartX := float32(startX) / float32(Npts) * float32(size)
+			scaledStartY := float32(startY) / float32(Npts) * float32(size)
 
-			scaledY2 := float32(p2.Y) / float32(Npts) * float32(size)
-			scaledX2 := float32(p2.X) / float32(Npts) * float32(size)
+			scaledEndX := float32(endX) / float32(Npts) * float32(size)
+			scaledEndY := float32(endY) / float32(Npts) * float32(size)
 
-			line.Position1 = fyne.NewPos(scaledX1, scaledY1)
-			line.Position2 = fyne.NewPos(scaledX2, scaledY2)
+			line.Position1 = fyne.NewPos(scaledStartX, scaledStartY)
+			line.Position2 = fyne.NewPos(scaledEndX, scaledEndY)
 			line.StrokeWidth = 2
 
-			// Here we use PathStart and PathEnd to place red and green dots at the start and end of the real path
+			// The markers go at the start and end of the path (PathStart and PathEnd)
 
 			dotSize := float32(10)
-			scaledDotX := float32(event.PathStart[0]) / float32(Npts) * float32(size)
-			scaledDotY := float32(event.PathStart[1]) / float32(Npts) * float32(size)
-			startDot := placeDotAt(scaledDotX, scaledDotY, dotSize, color.RGBA{R: 255, A: 255})
-
-			scaledDotX = float32(event.PathEnd[0]) / float32(Npts) * float32(size)
-			scaledDotY = float32(event.PathEnd[1]) / float32(Npts) * float32(size)
-			endDot := placeDotAt(scaledDotX, scaledDotY, dotSize, color.RGBA{G: 255, A: 255})
+			startDot := placeMarkerAt(scaledStartX, scaledStartY, dotSize, style.StartShape, style.StartColor)
+			endDot := placeMarkerAt(scaledEndX, scaledEndY, dotSize, style.EndShape, style.EndColor)
 
 			content := container.NewWithoutLayout(img, line, startDot, endDot)
 			w.SetContent(content)
@@ -605,12 +402,13 @@ func main() {
 
 		var img2 image.Image
 		gotCurveToPlot := false
-		if event.ShadowSpeedKmPerSec > 0.0 {
+		if event.PathDefined {
 			gotCurveToPlot = true
 			edges := FindEdgesInGeometricShadow(event)
 			img2, err = makePlotImage(event.PathDirection, 1200, 500, event, edges)
 			if err != nil {
-				panic(err)
+				logError(fmt.Errorf("creating light curve plot failed: %w", err))
+				gotCurveToPlot = false
 			}
 		}
 
@@ -648,18 +446,105 @@ func FresnelScale(wavelengthNm, ZAu float64) float64 {
 	return math.Sqrt(wavelengthKm * ZKm / 2)
 }
 
-func placeDotAt(x, y, diameter float32, col color.Color) *canvas.Circle {
-	dot := canvas.NewCircle(col)
-	dot.Resize(fyne.NewSize(diameter, diameter))
-	dot.Move(fyne.NewPos(x-diameter/2, y-diameter/2))
-	return dot
+// FresnelNumber returns a^2 / (lambda Z) for an occulter of radius radiusKm. Values much greater than 1
+// mean a nearly geometric shadow, values near 1 mean strong diffraction, and values much less than 1
+// mean the far field, where the shadow no longer resembles the occulter.
+func FresnelNumber(radiusKm, wavelengthNm, ZAu float64) float64 {
+	auToKm := 1.495979e+8 // Convert distance expressed in AU to km
+	nmToKm := 1e-9 * 1e-3 // Convert nm to km
+	return radiusKm * radiusKm / (wavelengthNm * nmToKm * ZAu * auToKm)
+}
+
+// The plane size suggested by SuggestPlaneSize leaves this many Fresnel scales of margin around the
+// objects and samples each Fresnel scale at least this many times.
+const (
+	autosizeMarginFresnelScales    = 10.0
+	autosizeSamplesPerFresnelScale = 5.0
+)
+
+// SuggestPlaneSize returns a fundamental plane width (km) that holds objects reaching out to
+// halfExtentKm from the plane center plus a margin of autosizeMarginFresnelScales Fresnel scales on
+// each side, and the (even) number of points that samples each Fresnel scale at least
+// autosizeSamplesPerFresnelScale times.
+func SuggestPlaneSize(halfExtentKm, fresnelScaleKm float64) (widthKm float64, numPoints int) {
+	widthKm = 2.0 * (halfExtentKm + autosizeMarginFresnelScales*fresnelScaleKm)
+	numPoints = int(math.Ceil(widthKm * autosizeSamplesPerFresnelScale / fresnelScaleKm))
+	if numPoints%2 != 0 {
+		numPoints++
+	}
+	return widthKm, numPoints
+}
+
+// stripValueFlag removes every occurrence of the flag -name=<value> or -name <value> (also with --)
+// from args and returns the (last) value, or "" if the flag is absent.
+func stripValueFlag(args []string, name string) ([]string, string, error) {
+	var remaining []string
+	value := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-"+name || arg == "--"+name:
+			if i+1 >= len(args) {
+				return nil, "", fmt.Errorf("-%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		case strings.HasPrefix(arg, "-"+name+"=") || strings.HasPrefix(arg, "--"+name+"="):
+			value = arg[strings.Index(arg, "=")+1:]
+		default:
+			remaining = append(remaining, arg)
+		}
+	}
+	return remaining, value, nil
+}
+
+// stripFlag removes every occurrence of the flag -name (or --name) from args and reports whether it was present.
+func stripFlag(args []string, name string) ([]string, bool) {
+	var remaining []string
+	found := false
+	for _, arg := range args {
+		if arg == "-"+name || arg == "--"+name {
+			found = true
+			continue
+		}
+		remaining = append(remaining, arg)
+	}
+	return remaining, found
+}
+
+// placeMarkerAt returns a marker of the given shape and color, diameter window units wide and
+// centered on (x, y). It is drawn with lightcurve.DrawMarker, so it matches the markers of the
+// saved images.
+func placeMarkerAt(x, y, diameter float32, shape lightcurve.MarkerShape, col color.Color) *canvas.Image {
+	radius := int(diameter / 2)
+	markerImage := image.NewRGBA(image.Rect(0, 0, 2*radius+1, 2*radius+1))
+	lightcurve.DrawMarker(markerImage, float64(radius), float64(radius), radius, shape, col)
+	marker := canvas.NewImageFromImage(markerImage)
+	marker.FillMode = canvas.ImageFillStretch
+	marker.Resize(fyne.NewSize(diameter, diameter))
+	marker.Move(fyne.NewPos(x-diameter/2, y-diameter/2))
+	return marker
 }
 
 func computePathPoints(e *OccultationEvent) {
 	xLengthPixels := e.PathEnd[0] - e.PathStart[0]
 	yLengthPixels := e.PathEnd[1] - e.PathStart[1]
 	pathLengthPixels := math.Sqrt(xLengthPixels*xLengthPixels + yLengthPixels*yLengthPixels)
-	fmt.Printf("Path length is %0.3f pixels\n", pathLengthPixels)
+	logInfo("Path length is %0.3f pixels\n", pathLengthPixels)
+
+	// path_num_samples asks for a number of points from the start to the end of the path instead of
+	// one per pixel of length: the library sampling is used so that replot samples the same points
+	if e.PathNumSamples >= 2 {
+		path := lightcurve.ObservationPath{StartX: e.PathStart[0], StartY: e.PathStart[1], EndX: e.PathEnd[0], EndY: e.PathEnd[1]}
+		path.ComputeSamplePointsN(e.PathNumSamples)
+		for _, pt := range path.SamplePoints {
+			e.PathSamplePoints = append(e.PathSamplePoints, [3]float64{pt.X, pt.Y, pt.DistanceFromStart})
+		}
+		logInfo("The path is sampled at %d points, %0.3f pixels apart\n", e.PathNumSamples,
+			pathLengthPixels/float64(e.PathNumSamples-1))
+		return
+	}
+
 	dYPerStep := yLengthPixels / pathLengthPixels
 	dXPerStep := xLengthPixels / pathLengthPixels
 	startX := e.PathStart[0]
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var npyMagic = []byte("\x93NUMPY")
+
+var (
+	npyDescrPattern   = regexp.MustCompile(`'descr'\s*:\s*'([^']*)'`)
+	npyFortranPattern = regexp.MustCompile(`'fortran_order'\s*:\s*(True|False)`)
+	npyShapePattern   = regexp.MustCompile(`'shape'\s*:\s*\(([^)]*)\)`)
+)
+
+// LoadMatrixNPY reads a numpy .npy file holding a 2D float64 array (as written by numpy.save) and
+// returns it as rows. Only little-endian float64 ('<f8') in C order is supported.
+func LoadMatrixNPY(filename string) ([][]float64, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseMatrixNPY(data)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", filename, err)
+	}
+	return m, nil
+}
+
+func parseMatrixNPY(data []byte) ([][]float64, error) {
+	descr, shape, body, err := parseNPY(data)
+	if err != nil {
+		return nil, err
+	}
+	if descr != "<f8" {
+		return nil, fmt.Errorf("unsupported dtype %q: only little-endian float64 ('<f8') is supported", descr)
+	}
+	if len(shape) != 2 {
+		return nil, fmt.Errorf("the array has %d dimensions (shape %v): a 2D array is required", len(shape), shape)
+	}
+
+	rows, cols := shape[0], shape[1]
+	m := make([][]float64, rows)
+	for row := range m {
+		m[row] = make([]float64, cols)
+		for col := range m[row] {
+			m[row][col] = npyFloat64(body, row*cols+col)
+		}
+	}
+	return m, nil
+}
+
+// LoadComplexMatrixNPY reads a numpy .npy file holding a 2D complex array and returns it as rows.
+// The array can be complex128 ('<c16') with shape (rows, cols), or float64 ('<f8') with shape
+// (rows, cols, 2) holding the real and imaginary parts. Only C order is supported.
+func LoadComplexMatrixNPY(filename string) ([][]complex128, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseComplexMatrixNPY(data)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", filename, err)
+	}
+	return m, nil
+}
+
+func parseComplexMatrixNPY(data []byte) ([][]complex128, error) {
+	descr, shape, body, err := parseNPY(data)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case descr == "<c16" && len(shape) == 2:
+	case descr == "<f8" && len(shape) == 3 && shape[2] == 2:
+	case descr == "<c16" || descr == "<f8":
+		return nil, fmt.Errorf("unsupported shape %v: a 2D complex128 array or a float64 array of shape (rows, cols, 2) is required", shape)
+	default:
+		return nil, fmt.Errorf("unsupported dtype %q: only complex128 ('<c16') or float64 ('<f8') real/imaginary pairs are supported", descr)
+	}
+
+	// Both layouts store each element as a real float64 followed by an imaginary float64
+	rows, cols := shape[0], shape[1]
+	m := make([][]complex128, rows)
+	for row := range m {
+		m[row] = make([]complex128, cols)
+		for col := range m[row] {
+			i := 2 * (row*cols + col)
+			m[row][col] = complex(npyFloat64(body, i), npyFloat64(body, i+1))
+		}
+	}
+	return m, nil
+}
+
+// parseNPY checks the header of a .npy file and returns the dtype, the shape and the array data.
+// For float64 and complex128 the data is checked to be the right size for the shape.
+func parseNPY(data []byte) (descr string, shape []int, body []byte, err error) {
+	if len(data) < 10 || !bytes.Equal(data[:6], npyMagic) {
+		return "", nil, nil, errors.New("not a numpy .npy file")
+	}
+
+	// Version 1 has a 2 byte header length, versions 2 and 3 a 4 byte one
+	var headerLen, headerStart int
+	switch data[6] {
+	case 1:
+		headerLen = int(binary.LittleEndian.Uint16(data[8:10]))
+		headerStart = 10
+	case 2, 3:
+		if len(data) < 12 {
+			return "", nil, nil, errors.New("truncated .npy header")
+		}
+		headerLen = int(binary.LittleEndian.Uint32(data[8:12]))
+		headerStart = 12
+	default:
+		return "", nil, nil, fmt.Errorf("unsupported .npy format version %d.%d", data[6], data[7])
+	}
+	if len(data) < headerStart+headerLen {
+		return "", nil, nil, errors.New("truncated .npy header")
+	}
+	header := string(data[headerStart : headerStart+headerLen])
+
+	descrMatch := npyDescrPattern.FindStringSubmatch(header)
+	if descrMatch == nil {
+		return "", nil, nil, errors.New("the .npy header has no 'descr'")
+	}
+	descr = descrMatch[1]
+	fortran := npyFortranPattern.FindStringSubmatch(header)
+	if fortran != nil && fortran[1] == "True" {
+		return "", nil, nil, errors.New("Fortran order arrays are not supported: save a C order array")
+	}
+	shapeMatch := npyShapePattern.FindStringSubmatch(header)
+	if shapeMatch == nil {
+		return "", nil, nil, errors.New("the .npy header has no 'shape'")
+	}
+	size := 1
+	for _, field := range strings.Split(shapeMatch[1], ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return "", nil, nil, fmt.Errorf("bad shape (%s) in the .npy header", shapeMatch[1])
+		}
+		shape = append(shape, n)
+		size *= n
+	}
+
+	// The size of other dtypes is not checked: the callers reject them
+	itemSize := 0
+	switch descr {
+	case "<f8":
+		itemSize = 8
+	case "<c16":
+		itemSize = 16
+	}
+	body = data[headerStart+headerLen:]
+	if itemSize > 0 && len(body) != size*itemSize {
+		return "", nil, nil, fmt.Errorf("the data is %d bytes but shape %v of %s needs %d", len(body), shape, descr, size*itemSize)
+	}
+	return descr, shape, body, nil
+}
+
+// npyFloat64 returns the i-th little-endian float64 of body.
+func npyFloat64(body []byte, i int) float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(body[8*i : 8*i+8]))
+}
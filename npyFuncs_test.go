@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// npyBytes builds a version 1.0 .npy file the way numpy.save does, with the header padded so that
+// the data starts on a 64 byte boundary.
+func npyBytes(header string, values []float64) []byte {
+	pad := 64 - (10+len(header)+1)%64
+	header += strings.Repeat(" ", pad%64) + "\n"
+	var buf bytes.Buffer
+	buf.Write(npyMagic)
+	buf.Write([]byte{1, 0})
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(len(header)))
+	buf.WriteString(header)
+	for _, v := range values {
+		_ = binary.Write(&buf, binary.LittleEndian, math.Float64bits(v))
+	}
+	return buf.Bytes()
+}
+
+func TestLoadMatrixNPY(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "plane.npy")
+	values := []float64{0, 0.25, 0.5, 1, 0.75, -1}
+	err := os.WriteFile(good, npyBytes("{'descr': '<f8', 'fortran_order': False, 'shape': (2, 3), }", values), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadMatrixNPY(good)
+	if err != nil {
+		t.Fatalf("LoadMatrixNPY: %v", err)
+	}
+	if len(m) != 2 || len(m[0]) != 3 {
+		t.Fatalf("got a %dx%d matrix, want 2x3", len(m), len(m[0]))
+	}
+	for row := range m {
+		for col := range m[row] {
+			if m[row][col] != values[row*3+col] {
+				t.Errorf("m[%d][%d] = %g, want %g (C order)", row, col, m[row][col], values[row*3+col])
+			}
+		}
+	}
+
+	bad := []struct {
+		name, header string
+		values       []float64
+		want         string
+	}{
+		{"float32", "{'descr': '<f4', 'fortran_order': False, 'shape': (1, 2), }", []float64{0}, "dtype"},
+		{"fortran", "{'descr': '<f8', 'fortran_order': True, 'shape': (1, 2), }", []float64{0, 1}, "Fortran"},
+		{"1d", "{'descr': '<f8', 'fortran_order': False, 'shape': (2,), }", []float64{0, 1}, "2D"},
+		{"short", "{'descr': '<f8', 'fortran_order': False, 'shape': (2, 2), }", []float64{0, 1}, "bytes"},
+	}
+	for _, tc := range bad {
+		path := filepath.Join(dir, tc.name+".npy")
+		if err := os.WriteFile(path, npyBytes(tc.header, tc.values), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadMatrixNPY(path)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want one mentioning %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestLoadComplexMatrixNPY(t *testing.T) {
+	dir := t.TempDir()
+	// The same 2x2 matrix as complex128 and as float64 real/imaginary pairs
+	pairs := []float64{1, 0, 0, 1, -0.5, 0.25, 0, 0}
+	want := [][]complex128{{1, 1i}, {-0.5 + 0.25i, 0}}
+	files := map[string]string{
+		"c16.npy":  "{'descr': '<c16', 'fortran_order': False, 'shape': (2, 2), }",
+		"pair.npy": "{'descr': '<f8', 'fortran_order': False, 'shape': (2, 2, 2), }",
+	}
+	for name, header := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, npyBytes(header, pairs), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := LoadComplexMatrixNPY(path)
+		if err != nil {
+			t.Fatalf("%s: LoadComplexMatrixNPY: %v", name, err)
+		}
+		for row := range want {
+			for col := range want[row] {
+				if m[row][col] != want[row][col] {
+					t.Errorf("%s: m[%d][%d] = %v, want %v", name, row, col, m[row][col], want[row][col])
+				}
+			}
+		}
+	}
+
+	path := filepath.Join(dir, "real.npy")
+	if err := os.WriteFile(path, npyBytes("{'descr': '<f8', 'fortran_order': False, 'shape': (2, 4), }", pairs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadComplexMatrixNPY(path); err == nil || !strings.Contains(err.Error(), "shape") {
+		t.Errorf("a 2D float64 array gave error %v, want one about the shape", err)
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"math"
+
+	"github.com/bob-anderson-ok/IOTAdiffraction/internal/shared"
 )
 
 func processPathDirection(Npts int, p1 AnnotatedPoint, p2 AnnotatedPoint,
@@ -17,11 +18,11 @@ func processPathDirection(Npts int, p1 AnnotatedPoint, p2 AnnotatedPoint,
 	d := (event.PathOffsetFromCenterKm / event.FundamentalPlaneWidthKm) * float64(event.FundamentalPlaneWidthPoints)
 	dx := 0.0
 	dy := 0.0
-	p1, p2, dx, dy, err := PathSquareIntersections(w, theta, d)
-	fmt.Printf("\nDirection vector of path in image coordinates: dx=%.4f dy=%.4f\n\n", dx, dy)
+	p1, p2, dx, dy, err := shared.PathSquareIntersections(w, theta, d)
+	logDebug("\nDirection vector of path in image coordinates: dx=%.4f dy=%.4f\n\n", dx, dy)
 
 	if err != nil {
-		fmt.Println("Error:", err)
+		logError(fmt.Errorf("Error: %w", err))
 	} else {
 		// Move the origin back to the upper left corner of the image
 		delta := float64(Npts) / 2.0
@@ -29,57 +30,44 @@ func processPathDirection(Npts int, p1 AnnotatedPoint, p2 AnnotatedPoint,
 		p1.Y += delta
 		p2.X += delta
 		p2.Y += delta
-		fmt.Printf("Intersection 1: (%.4f, %.4f)  %s\n", p1.X, p1.Y, p1.Position)
-		fmt.Printf("Intersection 2: (%.4f, %.4f)  %s\n", p2.X, p2.Y, p2.Position)
+		logDebug("Intersection 1: (%.4f, %.4f)  %s\n", p1.X, p1.Y, p1.Position)
+		logDebug("Intersection 2: (%.4f, %.4f)  %s\n", p2.X, p2.Y, p2.Position)
 
 		// Time to figure out the direction and fill start and end coordinates
-		useTopBottomLogic := (p1.Position == "top" || p1.Position == "bottom") &&
-			(p2.Position == "top" || p2.Position == "bottom")
-		if useTopBottomLogic {
-			if dy < 0 {
-				direction = "top to bottom"
-				if p1.Position == "top" {
-					setPathStartEnd(event, p1, p2)
-				} else {
-					setPathStartEnd(event, p2, p1)
-				}
-			} else {
-				direction = "bottom to top"
-				if p1.Position == "bottom" {
-					setPathStartEnd(event, p1, p2)
-				} else {
-					setPathStartEnd(event, p2, p1)
-				}
-			}
-		} else {
-			if dx < 0 {
-				direction = "left to right"
-				if p1.Position == "left" {
-					setPathStartEnd(event, p1, p2)
-				} else {
-					setPathStartEnd(event, p2, p1)
-				}
-			} else {
-				direction = "right to left"
-				if p1.Position == "right" {
-					setPathStartEnd(event, p1, p2)
-				} else {
-					setPathStartEnd(event, p2, p1)
-				}
-			}
-		}
-		fmt.Println("\nPath start:", event.PathStart)
-		fmt.Println("Path end:", event.PathEnd)
+		var pStart, pEnd AnnotatedPoint
+		pStart, pEnd, direction = orderPathEnds(p1, p2, dx, dy)
+		setPathStartEnd(event, pStart, pEnd)
+		logDebug("\nPath start: %v\n", event.PathStart)
+		logDebug("Path end: %v\n", event.PathEnd)
 	}
 	return p1, p2, direction, err
 }
 
+// FindEdgesInGeometricShadow returns the distances (in pixels from the path start) at which the
+// path enters or leaves the geometric shadow, in pairs. If e.MinEdgeSeparationKm is set,
+// consecutive edges closer than that bound a spurious segment, as where a satellite touches the
+// main body, and are removed. If the path ends inside the shadow, an edge is added at the path end.
+// Both cases are reported with a warning.
 func FindEdgesInGeometricShadow(e OccultationEvent) []float64 {
+	ans, merged, unpaired := findEdgePairs(e)
+	if merged > 0 {
+		logWarn("%d pair(s) of edges closer than %g km along the path (shapes touching?) were removed\n",
+			merged, e.MinEdgeSeparationKm)
+	}
+	if unpaired {
+		logWarn("The path ends inside the shadow: an edge was added at the path end\n")
+	}
+	return ans
+}
+
+// findEdgePairs is FindEdgesInGeometricShadow without the warnings: it also returns the number of
+// edge pairs removed as too close and whether an edge was added at the path end.
+func findEdgePairs(e OccultationEvent) (edges []float64, merged int, unpaired bool) {
 	var ans []float64
 	var colorAtNextEdge = 1.0
 
 	for i := range len(e.PathSamplePoints) {
-		pixelValue := interpolate(e.GeometricMatrix, e.PathSamplePoints[i][0], e.PathSamplePoints[i][1])
+		pixelValue := shared.Interpolate(e.GeometricMatrix, e.PathSamplePoints[i][0], e.PathSamplePoints[i][1])
 		if pixelValue > 0.0 {
 			pixelValue = 1.0
 		}
@@ -88,7 +76,41 @@ func FindEdgesInGeometricShadow(e OccultationEvent) []float64 {
 			colorAtNextEdge = 1.0 - colorAtNextEdge     // Toggle the color we treat as an edge
 		}
 	}
-	return ans
+	if len(ans) == 0 {
+		return ans, 0, false
+	}
+
+	minSeparation := e.MinEdgeSeparationKm * float64(e.FundamentalPlaneWidthPoints) / e.FundamentalPlaneWidthKm
+	pathEnd := e.PathSamplePoints[len(e.PathSamplePoints)-1][2]
+	return shared.PairEdges(ans, minSeparation, pathEnd)
+}
+
+// orderPathEnds returns the two intersections p1 and p2 of the path with the plane edges as (start,
+// end) in the direction of travel, with that direction as "left to right", "right to left", "top to
+// bottom" or "bottom to top". (dx, dy) is the direction vector returned by shared.PathSquareIntersections,
+// which points against the travel. A path that crosses the top and bottom edges is named by its
+// vertical direction, any other by its horizontal one. The start, where the start (red, by default)
+// marker is drawn, is the intersection reached first. This also holds for a path that cuts a corner
+// (crossing two adjacent edges), where neither intersection need be on the edge named first.
+func orderPathEnds(p1, p2 AnnotatedPoint, dx, dy float64) (start, end AnnotatedPoint, direction string) {
+	topBottom := (p1.Position == "top" || p1.Position == "bottom") &&
+		(p2.Position == "top" || p2.Position == "bottom")
+	switch {
+	case topBottom && dy < 0:
+		direction = "top to bottom"
+	case topBottom:
+		direction = "bottom to top"
+	case dx < 0:
+		direction = "left to right"
+	default:
+		direction = "right to left"
+	}
+
+	// The travel is along (-dx, -dy), so the start is the point further along (dx, dy)
+	if (p1.X-p2.X)*dx+(p1.Y-p2.Y)*dy >= 0 {
+		return p1, p2, direction
+	}
+	return p2, p1, direction
 }
 
 func setPathStartEnd(event *OccultationEvent, pStart AnnotatedPoint, pEnd AnnotatedPoint) {
@@ -98,97 +120,86 @@ func setPathStartEnd(event *OccultationEvent, pStart AnnotatedPoint, pEnd Annota
 	event.PathEnd[1] = pEnd.Y
 }
 
-type AnnotatedPoint struct {
-	X, Y     float64
-	Position string
+// AnnotatedPoint is a path point with the side of the plane (or the path end) it lies on.
+type AnnotatedPoint = shared.AnnotatedPoint
+
+// CentralFlash describes how the observation path passes the center of the main body's shadow,
+// where a central flash can appear behind a body with an atmosphere or a near-circular outline.
+type CentralFlash struct {
+	MissDistanceKm float64 // Perpendicular distance from the shadow center to the path
+	AlongPathKm    float64 // Distance along the path from its start to the point of closest approach
+	TimeSecs       float64 // AlongPathKm / shadow speed (NaN when the path is given by its endpoints)
+	OnPath         bool    // The point of closest approach lies between the path start and end
+	Expected       bool    // OnPath and MissDistanceKm is at most the flash zone half-width
 }
 
-var ErrNoIntersection = errors.New("line does not intersect square")
-
-// PathSquareIntersections finds where a line intersects a square centered at origin.
-// w: square width
-// theta: angle of line measured CCW from y-axis (radians)
-// d: perpendicular distance from point (px, py) to the line
-// Returns the two intersection points, dx and dy, and error
-func PathSquareIntersections(w, theta, d float64) (AnnotatedPoint, AnnotatedPoint, float64, float64, error) {
-	halfW := w / 2.0
-
-	// Direction vector of the line (perpendicular to the normal)
-	// If theta is CCW from y-axis, the line direction is (sin(theta), cos(theta))
-	dx := math.Sin(theta)
-	dy := math.Cos(theta)
-
-	// Normal vector pointing in the direction of offset (perpendicular to line, rotated 90° CW)
-	nx := dy  // cos(theta)
-	ny := -dx // -sin(theta)
-
-	// A point on the line: offset from (px, py) by distance d along the normal
-	x0 := d * nx
-	y0 := d * ny
-
-	// Line parametric form: x = x0 + t*dx, y = y0 + t*dy
-	// Find intersections with the four sides of the square
+// centralFlashGeometry returns where the observation path passes closest to the center of the main
+// body. A central flash is expected when the path passes within zoneKm of the center. ok is false
+// if there is no main body or no path. The path must be in the unrotated plane.
+func centralFlashGeometry(event OccultationEvent, zoneKm float64) (flash CentralFlash, ok bool) {
+	if !event.MainBodyGiven || !event.PathDefined || event.FundamentalPlaneWidthPoints < 2 {
+		return flash, false
+	}
+	kmPerPixel := event.FundamentalPlaneWidthKm / float64(event.FundamentalPlaneWidthPoints)
+	center := float64(event.FundamentalPlaneWidthPoints-1) / 2.0
+
+	// The shadow center in pixels (y_center_km is up, so it decreases the row)
+	cx := center + event.MainBodyXCenterKm/kmPerPixel
+	cy := center - event.MainBodyYCenterKm/kmPerPixel
+
+	dx := event.PathEnd[0] - event.PathStart[0]
+	dy := event.PathEnd[1] - event.PathStart[1]
+	lengthPixels := math.Hypot(dx, dy)
+	if lengthPixels == 0.0 {
+		return flash, false
+	}
+	ux, uy := dx/lengthPixels, dy/lengthPixels
 
-	var intersections []AnnotatedPoint
+	// Project the center onto the path: along is the distance from the start, miss the distance off it
+	along := (cx-event.PathStart[0])*ux + (cy-event.PathStart[1])*uy
+	miss := math.Abs((cx-event.PathStart[0])*uy - (cy-event.PathStart[1])*ux)
 
-	// Right edge: x = halfW
-	if math.Abs(dx) > 1e-12 {
-		t := (halfW - x0) / dx
-		y := y0 + t*dy
-		if y >= -halfW && y <= halfW {
-			intersections = append(intersections, AnnotatedPoint{halfW, y, "right"})
-		}
+	flash.MissDistanceKm = miss * kmPerPixel
+	flash.AlongPathKm = along * kmPerPixel
+	flash.TimeSecs = math.NaN()
+	if event.ShadowSpeedKmPerSec > 0.0 && !event.PathEndpointsGiven {
+		flash.TimeSecs = flash.AlongPathKm / event.ShadowSpeedKmPerSec
 	}
+	flash.OnPath = along >= 0.0 && along <= lengthPixels
+	flash.Expected = flash.OnPath && flash.MissDistanceKm <= zoneKm
+	return flash, true
+}
 
-	// Left edge: x = -halfW
-	if math.Abs(dx) > 1e-12 {
-		t := (-halfW - x0) / dx
-		y := y0 + t*dy
-		if y >= -halfW && y <= halfW {
-			intersections = append(intersections, AnnotatedPoint{-halfW, y, "left"})
-		}
+// reportCentralFlash logs, for a main body with an atmosphere or a near-circular outline, how close
+// the path passes to the shadow center. The flash zone half-width is taken as the larger of the
+// Fresnel scale and the projected star diameter. Call it after computePathGeometry and after
+// event.StarDiamKm has been set.
+func reportCentralFlash(event OccultationEvent) {
+	if !event.MainBodyGiven || event.MainbodyMajorAxisKm <= 0.0 {
+		return
 	}
-
-	// Bottom edge: y = halfW
-	if math.Abs(dy) > 1e-12 {
-		t := (halfW - y0) / dy
-		x := x0 + t*dx
-		if x >= -halfW && x <= halfW {
-			intersections = append(intersections, AnnotatedPoint{x, halfW, "bottom"})
-		}
+	nearCircular := event.MainbodyMinorAxisKm/event.MainbodyMajorAxisKm >= 0.9
+	if event.AtmosphereScaleHeightKm <= 0.0 && !nearCircular {
+		return
 	}
-
-	// Top edge: y = halfW
-	if math.Abs(dy) > 1e-12 {
-		t := (-halfW - y0) / dy
-		x := x0 + t*dx
-		if x >= -halfW && x <= halfW {
-			intersections = append(intersections, AnnotatedPoint{x, -halfW, "top"})
-		}
+	if event.RotateGroundShadowTo90pa || event.SourcePlaneRotationDegrees != 0.0 {
+		logDebug("The central flash position is not reported for a rotated source plane\n")
+		return
 	}
-
-	// Remove duplicate corner intersections
-	intersections = removeDuplicates(intersections, 1e-9)
-
-	if len(intersections) < 2 {
-		return AnnotatedPoint{}, AnnotatedPoint{}, dx, dy, ErrNoIntersection
+	zoneKm := math.Max(FresnelScale(event.ObservationWavelengthNm, event.DistanceAu), event.StarDiamKm)
+	flash, ok := centralFlashGeometry(event, zoneKm)
+	if !ok {
+		return
 	}
-	return intersections[0], intersections[1], dx, dy, nil
-}
-
-func removeDuplicates(pts []AnnotatedPoint, tol float64) []AnnotatedPoint {
-	var result []AnnotatedPoint
-	for _, p := range pts {
-		duplicate := false
-		for _, r := range result {
-			if math.Abs(p.X-r.X) < tol && math.Abs(p.Y-r.Y) < tol {
-				duplicate = true
-				break
-			}
-		}
-		if !duplicate {
-			result = append(result, p)
-		}
+	logInfo("The path passes %0.3f km from the shadow center, %0.3f km along the path", flash.MissDistanceKm, flash.AlongPathKm)
+	if !math.IsNaN(flash.TimeSecs) {
+		logInfo(" (%0.3f sec)", flash.TimeSecs)
+	}
+	logInfo("\n")
+	switch {
+	case flash.Expected:
+		logInfo("A central flash is expected: the path is within %0.3f km of the shadow center\n", zoneKm)
+	case !flash.OnPath:
+		logInfo("The point of closest approach to the shadow center is beyond the ends of the path\n")
 	}
-	return result
 }
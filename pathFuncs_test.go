@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCentralFlashGeometry(t *testing.T) {
+	const n = 201
+	for _, offsetKm := range []float64{-1.0, 1.0} {
+		event := OccultationEvent{
+			FundamentalPlaneWidthKm:     20,
+			FundamentalPlaneWidthPoints: n,
+			MainBodyGiven:               true,
+			MainBodyXCenterKm:           2,
+			MainBodyYCenterKm:           1,
+			MainbodyMajorAxisKm:         1,
+			MainbodyMinorAxisKm:         1,
+			DxKmPerSec:                  -5,
+			PathOffsetFromCenterKm:      offsetKm,
+			FplaneImage:                 image.NewGray(image.Rect(0, 0, n, n)),
+		}
+		if _, _, err := computePathGeometry(&event); err != nil {
+			t.Fatal(err)
+		}
+		FillFplane(event.FplaneImage, true)
+		AddEllipses(event, true)
+		geometric := ConvertSourcePlaneImageToMatrix(event.FplaneImage)
+
+		flash, ok := centralFlashGeometry(event, 0.2)
+		if !ok {
+			t.Fatalf("offset %g: no central flash geometry for a body and a path", offsetKm)
+		}
+		if !flash.OnPath {
+			t.Errorf("offset %g: the shadow center should be beside the path", offsetKm)
+		}
+		if math.Abs(flash.TimeSecs*5-flash.AlongPathKm) > 1e-9 {
+			t.Errorf("offset %g: %g sec at 5 km/sec does not match %g km", offsetKm, flash.TimeSecs, flash.AlongPathKm)
+		}
+
+		// One offset runs the path through the body center, the other 2 km from it
+		kmPerPixel := event.FundamentalPlaneWidthKm / n
+		dx, dy := event.PathEnd[0]-event.PathStart[0], event.PathEnd[1]-event.PathStart[1]
+		length := math.Hypot(dx, dy)
+		x := event.PathStart[0] + flash.AlongPathKm/kmPerPixel*dx/length
+		y := event.PathStart[1] + flash.AlongPathKm/kmPerPixel*dy/length
+		switch {
+		case flash.MissDistanceKm < 0.1:
+			if !flash.Expected {
+				t.Errorf("offset %g: a central flash should be expected %g km from the center", offsetKm, flash.MissDistanceKm)
+			}
+			if geometric[int(math.Round(y))][int(math.Round(x))] != 1.0 {
+				t.Errorf("offset %g: the closest approach (%0.1f, %0.1f) is not inside the body", offsetKm, x, y)
+			}
+		case math.Abs(flash.MissDistanceKm-2.0) < 0.1:
+			if flash.Expected {
+				t.Errorf("offset %g: no central flash should be expected 2 km from the center", offsetKm)
+			}
+		default:
+			t.Errorf("offset %g: the path misses the center by %g km, want 0 or 2", offsetKm, flash.MissDistanceKm)
+		}
+	}
+}
+
+func TestOrderPathEnds(t *testing.T) {
+	left := AnnotatedPoint{X: 0.5, Y: 40, Position: "left"}
+	right := AnnotatedPoint{X: 99.5, Y: 60, Position: "right"}
+	top := AnnotatedPoint{X: 45, Y: 0.5, Position: "top"}
+	bottom := AnnotatedPoint{X: 55, Y: 99.5, Position: "bottom"}
+
+	// (dx, dy) points against the travel, as returned by PathSquareIntersections
+	cases := []struct {
+		a, b          AnnotatedPoint
+		dx, dy        float64
+		wantDirection string
+		wantStart     string
+	}{
+		{left, right, -0.98, -0.2, "left to right", "left"},
+		{left, right, 0.98, 0.2, "right to left", "right"},
+		{top, bottom, -0.1, -0.99, "top to bottom", "top"},
+		{top, bottom, 0.1, 0.99, "bottom to top", "bottom"},
+
+		// Paths that cut a corner, where neither end is on the edge named first
+		{top, left, 0.7, -0.7, "right to left", "top"},
+		{bottom, right, -0.7, 0.7, "left to right", "bottom"},
+		{top, right, -0.7, -0.7, "left to right", "top"},
+	}
+	for _, c := range cases {
+		for _, swap := range []bool{false, true} {
+			p1, p2 := c.a, c.b
+			if swap {
+				p1, p2 = p2, p1
+			}
+			start, end, direction := orderPathEnds(p1, p2, c.dx, c.dy)
+			if direction != c.wantDirection || start.Position != c.wantStart {
+				t.Errorf("%s/%s with (dx, dy) = (%g, %g): %q starting on the %s edge, want %q starting on the %s edge",
+					p1.Position, p2.Position, c.dx, c.dy, direction, start.Position, c.wantDirection, c.wantStart)
+			}
+			if start == end {
+				t.Errorf("%s/%s: start and end are the same point", p1.Position, p2.Position)
+			}
+		}
+	}
+}
+
+func TestProcessPathDirectionStartsAtIngress(t *testing.T) {
+	const n = 100
+	for _, v := range [][2]float64{{5, 0}, {-5, 0}, {0, 5}, {0, -5}, {5, 1}, {-5, -1}, {-3, 4}, {3, -4}, {-4, -4}} {
+		for _, offsetKm := range []float64{0, -4, 4} {
+			event := OccultationEvent{
+				DxKmPerSec:                  v[0],
+				DyKmPerSec:                  v[1],
+				PathOffsetFromCenterKm:      offsetKm,
+				FundamentalPlaneWidthKm:     10,
+				FundamentalPlaneWidthPoints: n,
+				PathAngleDegrees:            math.Atan2(-v[0], -v[1]) * 180.0 / math.Pi,
+			}
+			_, _, direction, err := processPathDirection(n, AnnotatedPoint{}, AnnotatedPoint{}, &event)
+			if err != nil {
+				t.Fatalf("velocity %v, offset %g: %v", v, offsetKm, err)
+			}
+
+			// The shadow moves along (dX, dY) in image pixels (y down), so the end must lie ahead of the start
+			travelX, travelY := event.PathEnd[0]-event.PathStart[0], event.PathEnd[1]-event.PathStart[1]
+			if travelX*v[0]+travelY*v[1] <= 0 {
+				t.Errorf("velocity %v, offset %g (%s): start %v and end %v are swapped",
+					v, offsetKm, direction, event.PathStart, event.PathEnd)
+			}
+			wantDirection := map[bool]string{true: "left to right", false: "right to left"}[travelX > 0]
+			if direction == "top to bottom" || direction == "bottom to top" {
+				wantDirection = map[bool]string{true: "top to bottom", false: "bottom to top"}[travelY > 0]
+			}
+			if direction != wantDirection {
+				t.Errorf("velocity %v, offset %g: direction %q, want %q", v, offsetKm, direction, wantDirection)
+			}
+		}
+	}
+}
+
+func TestComputePathPointsNumSamples(t *testing.T) {
+	// A 50 pixel path, sampled at each pixel and at 9 points (8 equal steps) from start to end
+	for _, tc := range []struct {
+		numSamples int
+		wantPoints int
+		wantStep   float64
+	}{{0, 50, 1}, {9, 9, 6.25}} {
+		event := OccultationEvent{PathStart: [2]float64{10, 20}, PathEnd: [2]float64{40, 60}, PathNumSamples: tc.numSamples}
+		computePathPoints(&event)
+		if len(event.PathSamplePoints) != tc.wantPoints {
+			t.Fatalf("path_num_samples %d: got %d points, want %d", tc.numSamples, len(event.PathSamplePoints), tc.wantPoints)
+		}
+		last := event.PathSamplePoints[tc.wantPoints-1]
+		wantDistance := tc.wantStep * float64(tc.wantPoints-1)
+		if math.Abs(last[2]-wantDistance) > 1e-9 || math.Abs(math.Hypot(last[0]-10, last[1]-20)-wantDistance) > 1e-9 {
+			t.Errorf("path_num_samples %d: last point %v, want %g pixels from the start", tc.numSamples, last, wantDistance)
+		}
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	const n = 201
+	event := OccultationEvent{
+		FundamentalPlaneWidthKm:     20,
+		FundamentalPlaneWidthPoints: n,
+		MainBodyGiven:               true,
+		MainbodyMajorAxisKm:         6,
+		MainbodyMinorAxisKm:         6,
+		DxKmPerSec:                  -5,
+		FplaneImage:                 image.NewGray(image.Rect(0, 0, n, n)),
+	}
+	if _, _, err := computePathGeometry(&event); err != nil {
+		t.Fatal(err)
+	}
+	FillFplane(event.FplaneImage, true)
+	AddEllipses(event, true)
+	event.GeometricMatrix = ConvertSourcePlaneImageToMatrix(event.FplaneImage)
+
+	var speed, angle, chord, runtime float64
+	var edges int
+	line := runSummary(&event, "event=2", 1500*time.Millisecond)
+	_, err := fmt.Sscanf(line, "summary event=2 shadow_speed=%g path_angle=%g n_edges=%d chord_km=%g runtime_s=%g",
+		&speed, &angle, &edges, &chord, &runtime)
+	if err != nil {
+		t.Fatalf("%q does not parse: %v", line, err)
+	}
+	if speed != 5 || angle != 90 || edges != 2 || runtime != 1.5 {
+		t.Errorf("%q: want a speed of 5, an angle of 90, 2 edges and 1.5 sec", line)
+	}
+	// The path runs through the center of a 6 km circle
+	if math.Abs(chord-6) > 0.2 {
+		t.Errorf("chord_km = %g, want about 6", chord)
+	}
+}
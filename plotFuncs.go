@@ -6,9 +6,10 @@ import (
 	"image"
 	"image/color"
 	"log"
-	"math"
 	//"strconv"
 
+	"github.com/bob-anderson-ok/IOTAdiffraction/internal/shared"
+	"github.com/bob-anderson-ok/IOTAdiffraction/lightcurve"
 	"gonum.org/v1/plot"
 
 	// Liberation fonts register automatically on import
@@ -52,18 +53,36 @@ func makePlotImage(direction string, wPx, hPx float64, e OccultationEvent, edges
 	p.Y.Tick.Label.Font.Variant = "Sans"
 	p.Y.Tick.Label.Font.Size = vg.Points(10)
 
-	timePerPixel := e.FundamentalPlaneWidthKm / e.ShadowSpeedKmPerSec / float64(e.FundamentalPlaneWidthPoints)
+	p.Legend.TextStyle.Font.Typeface = "Liberation"
+	p.Legend.TextStyle.Font.Variant = "Sans"
+	p.Legend.TextStyle.Font.Size = vg.Points(10)
+	p.Legend.Top = true
+
+	if len(e.PathSamplePoints) < 2 {
+		return nil, lightcurve.ErrPathTooShort
+	}
+
 	pointSpan := e.PathSamplePoints[len(e.PathSamplePoints)-1][D]
 	distancePerPoint := e.FundamentalPlaneWidthKm / float64(e.FundamentalPlaneWidthPoints)
-	timeSpan := timePerPixel * pointSpan
-	fmt.Printf("Time span is %0.3f seconds\n", timeSpan)
 
-	p.Title.Text = "Light curve along observation path"
-	p.X.Label.Text = fmt.Sprintf("km (divide by the shadow speed of %0.3f km/second to get time)", e.ShadowSpeedKmPerSec)
+	// The event title (if any) names the plot, as it does the image window
+	p.Title.Text = e.Title
+	if p.Title.Text == "" {
+		p.Title.Text = "Light curve along observation path"
+	}
+	if e.ShadowSpeedKmPerSec > 0.0 {
+		timePerPixel := e.FundamentalPlaneWidthKm / e.ShadowSpeedKmPerSec / float64(e.FundamentalPlaneWidthPoints)
+		timeSpan := timePerPixel * pointSpan
+		logInfo("Time span is %0.3f seconds\n", timeSpan)
+		p.X.Label.Text = fmt.Sprintf("km (divide by the shadow speed of %0.3f km/second to get time)", e.ShadowSpeedKmPerSec)
+	} else {
+		// No shadow motion, so there is no time axis: distance only
+		p.X.Label.Text = "km along the path (shadow speed is zero, so no time scale)"
+	}
 	p.Y.Label.Text = "normalized intensity"
-	p.X.Tick.Marker = StepTicks{Step: pointSpan * distancePerPoint / 20, Format: "%.2f"}
+	p.X.Tick.Marker = shared.AxisTicks(e.PlotXTickStepKm, e.PlotXTickFormat, pointSpan*distancePerPoint/20)
 
-	p.Y.Tick.Marker = StepTicks{Step: 0.2, Format: "%.2f"}
+	p.Y.Tick.Marker = shared.AxisTicks(e.PlotYTickStep, e.PlotYTickFormat, 0.2)
 	p.Add(plotter.NewGrid()) // grid + ticks
 
 	//var reverse float64
@@ -88,11 +107,25 @@ func makePlotImage(direction string, wPx, hPx float64, e OccultationEvent, edges
 	for i := 0; i < n; i++ {
 		x := e.PathSamplePoints[i][X]
 		y := e.PathSamplePoints[i][Y]
-		intensity := interpolate(e.IntensityMatrix, x, y)
+		intensity := shared.Interpolate(e.IntensityMatrix, x, y)
 		pts[i].X = e.PathSamplePoints[i][D] * distancePerPoint
 		pts[i].Y = intensity
 	}
 
+	// Optionally show the geometric (no diffraction) step under the light curve
+	if e.PlotGeometricStep {
+		edgesKm := make([]float64, len(edges))
+		for i, edge := range edges {
+			edgesKm[i] = edge * distancePerPoint
+		}
+		stepLine, err := shared.GeometricStepLine(pts, edgesKm)
+		if err != nil {
+			return nil, err
+		}
+		p.Add(stepLine)
+		p.Legend.Add("geometric step", stepLine)
+	}
+
 	line, err := plotter.NewLine(pts)
 	if err != nil {
 		return nil, err
@@ -100,9 +133,10 @@ func makePlotImage(direction string, wPx, hPx float64, e OccultationEvent, edges
 	line.Color = color.RGBA{R: 0, G: 0, B: 255, A: 255} // blue
 
 	p.Add(line)
+	p.Legend.Add("light curve", line)
 
 	if len(edges) > 0 {
-		for _, edge := range edges {
+		for i, edge := range edges {
 			vpts := plotter.XYs{
 				{X: edge * distancePerPoint, Y: -0.1},
 				{X: edge * distancePerPoint, Y: 1.3},
@@ -121,6 +155,48 @@ func makePlotImage(direction string, wPx, hPx float64, e OccultationEvent, edges
 				vg.Points(4), // gap length
 			}
 			vline.Color = color.RGBA{R: 255, G: 0, B: 0, A: 255} // red
+			if i == 0 {
+				p.Legend.Add("geometric edge", vline)
+			}
+		}
+	}
+
+	// Optionally mark where each edge would be timed from the diffraction curve (half light) and
+	// estimate how precisely that can be done for the given noise level
+	if (e.PlotHalfLightEdges || e.NoiseLevel > 0) && len(edges) > 0 {
+		curve := make([]lightcurve.Point, len(pts))
+		for i, pt := range pts {
+			curve[i] = lightcurve.Point{Distance: pt.X, Intensity: pt.Y}
+		}
+		edgesKm := make([]float64, len(edges))
+		for i, edge := range edges {
+			edgesKm[i] = edge * distancePerPoint
+		}
+		first := true
+		for _, edge := range lightcurve.RefineEdges(curve, edgesKm, 3*distancePerPoint) {
+			if e.NoiseLevel > 0 {
+				reportEdgeTiming(curve, edge, e.NoiseLevel, e.ShadowSpeedKmPerSec)
+			}
+			if !e.PlotHalfLightEdges {
+				continue
+			}
+			if !edge.Found {
+				logInfo("Edge at %0.3f km: no half-light crossing found\n", edge.GeometricKm)
+				continue
+			}
+			logInfo("Edge at %0.3f km: half light at %0.3f km (%+0.3f km)\n",
+				edge.GeometricKm, edge.DiffractionKm, edge.DiffractionKm-edge.GeometricKm)
+			vline, err := plotter.NewLine(plotter.XYs{{X: edge.DiffractionKm, Y: -0.1}, {X: edge.DiffractionKm, Y: 1.3}})
+			if err != nil {
+				return nil, err
+			}
+			vline.Dashes = []vg.Length{vg.Points(2), vg.Points(2)}
+			vline.Color = color.RGBA{R: 0, G: 160, B: 0, A: 255} // green
+			p.Add(vline)
+			if first {
+				p.Legend.Add("half-light edge", vline)
+				first = false
+			}
 		}
 	}
 
@@ -150,26 +226,39 @@ func makePlotImage(direction string, wPx, hPx float64, e OccultationEvent, edges
 
 	c := vgimg.New(width, height)
 	dc := draw.New(c)
-	p.Draw(dc)
+	if e.PlotResidual {
+		// A lower panel with the diffraction curve minus the geometric 0/1 step
+		edgesKm := make([]float64, len(edges))
+		for i, edge := range edges {
+			edgesKm[i] = edge * distancePerPoint
+		}
+		lower, err := shared.ResidualPlot(pts, edgesKm, p.X.Tick.Marker)
+		if err != nil {
+			return nil, err
+		}
+		shared.DrawStackedPlots(dc, p, lower, 0.35)
+	} else {
+		p.Draw(dc)
+	}
 
 	return c.Image(), nil
 }
 
-type StepTicks struct {
-	Step   float64
-	Format string
-}
-
-func (t StepTicks) Ticks(min, max float64) []plot.Tick {
-	var ticks []plot.Tick
-	start := math.Ceil(min/t.Step) * t.Step
-	for v := start; v <= max; v += t.Step {
-		ticks = append(ticks, plot.Tick{
-			Value: v,
-			Label: fmt.Sprintf(t.Format, v),
-		})
+// reportEdgeTiming prints the timing uncertainty of edge (at its half-light position if one was
+// found) for light curve samples with noise standard deviation noise.
+func reportEdgeTiming(curve []lightcurve.Point, edge lightcurve.RefinedEdge, noise, speedKmPerSec float64) {
+	sigmaKm, sigmaSec, err := lightcurve.EdgeTimingUncertainty(curve, edge.DiffractionKm, noise, speedKmPerSec)
+	if err != nil {
+		logWarn("Edge at %0.3f km: timing uncertainty not available: %v\n", edge.GeometricKm, err)
+		return
+	}
+	if speedKmPerSec > 0 {
+		logInfo("Edge at %0.3f km: with noise %g it can be timed to +/- %0.1f ms (+/- %0.3f km)\n",
+			edge.GeometricKm, noise, sigmaSec*1000, sigmaKm)
+	} else {
+		logInfo("Edge at %0.3f km: with noise %g it can be located to +/- %0.3f km\n",
+			edge.GeometricKm, noise, sigmaKm)
 	}
-	return ticks
 }
 
 func MakeCameraResponsePlot(data [][2]float64, filename string) {
@@ -196,9 +285,9 @@ func MakeCameraResponsePlot(data [][2]float64, filename string) {
 	p.X.Label.Text = "Wavelength (nm)"
 	p.Y.Label.Text = "Relative response"
 
-	p.X.Tick.Marker = StepTicks{Step: 25.0, Format: "%.0f"}
+	p.X.Tick.Marker = shared.StepTicks{Step: 25.0, Format: "%.0f"}
 
-	p.Y.Tick.Marker = StepTicks{Step: 0.1, Format: "%.2f"}
+	p.Y.Tick.Marker = shared.StepTicks{Step: 0.1, Format: "%.2f"}
 	p.Add(plotter.NewGrid()) // grid + ticks
 
 	p.Y.Min = 0.0
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bob-anderson-ok/IOTAdiffraction/lightcurve"
+)
+
+func TestMakePlotImageCornerClippingPath(t *testing.T) {
+	// The corner of a 101 point plane is 50*sqrt(2) = 70.71 pixels from the center. A diagonal path
+	// 70.60 pixels (6.99 km) from the center clips it with a chord of about 0.2 pixel.
+	event := OccultationEvent{
+		FundamentalPlaneWidthKm:     10,
+		FundamentalPlaneWidthPoints: 101,
+		DxKmPerSec:                  5,
+		DyKmPerSec:                  -5,
+		PathOffsetFromCenterKm:      6.99,
+	}
+	if _, _, err := computePathGeometry(&event); err != nil {
+		t.Fatal(err)
+	}
+	if !event.PathDefined || len(event.PathSamplePoints) >= 2 {
+		t.Fatalf("the path has %d sample points, want fewer than 2", len(event.PathSamplePoints))
+	}
+
+	_, err := makePlotImage(event.PathDirection, 1200, 500, event, FindEdgesInGeometricShadow(event))
+	if !errors.Is(err, lightcurve.ErrPathTooShort) {
+		t.Errorf("makePlotImage gave %v, want %v", err, lightcurve.ErrPathTooShort)
+	}
+}
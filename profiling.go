@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling starts writing a CPU profile to cpuProfilePath (if it is not empty) and returns a
+// function that stops it and writes a heap profile to memProfilePath (if it is not empty). The files
+// are read with go tool pprof. The returned function must be called once the computation is done.
+func startProfiling(cpuProfilePath, memProfilePath string) (stop func() error, err error) {
+	var cpuFile *os.File
+	if cpuProfilePath != "" {
+		cpuFile, err = os.Create(cpuProfilePath)
+		if err != nil {
+			return nil, fmt.Errorf("creating the CPU profile failed: %w", err)
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			_ = cpuFile.Close()
+			return nil, fmt.Errorf("starting the CPU profile failed: %w", err)
+		}
+	}
+
+	stop = func() error {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			if err := cpuFile.Close(); err != nil {
+				return fmt.Errorf("closing the CPU profile failed: %w", err)
+			}
+			logInfo("CPU profile written to %s\n", cpuProfilePath)
+		}
+		if memProfilePath != "" {
+			f, err := os.Create(memProfilePath)
+			if err != nil {
+				return fmt.Errorf("creating the memory profile failed: %w", err)
+			}
+			runtime.GC() // Bring the heap statistics up to date
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				_ = f.Close()
+				return fmt.Errorf("writing the memory profile failed: %w", err)
+			}
+			if err := f.Close(); err != nil {
+				return fmt.Errorf("closing the memory profile failed: %w", err)
+			}
+			logInfo("Memory profile written to %s\n", memProfilePath)
+		}
+		return nil
+	}
+	return stop, nil
+}
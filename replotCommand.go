@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	json "github.com/KevinWang15/go-json5"
+	"github.com/bob-anderson-ok/IOTAdiffraction/lightcurve"
+)
+
+// runReplot regenerates the light curve plot and the annotated diffraction image from the
+// PNG files written by a previous full run (targetImage16bit.png, geometricShadow.png and
+// diffractionImage8bit.png in the current folder). The observation path is taken from the
+// dX/dY/offset values in the given parameter file, so the path can be changed and re-plotted
+// without repeating the (expensive) diffraction calculation.
+func runReplot(paramPath string) error {
+	data, err := os.ReadFile(paramPath)
+	if err != nil {
+		return fmt.Errorf("attempt to read input file %q failed: %w", paramPath, err)
+	}
+
+	var jsonTable map[string]interface{}
+	if err := json.Unmarshal(data, &jsonTable); err != nil {
+		return fmt.Errorf("format error in file %q: %w", paramPath, err)
+	}
+	jsonTable, err = includeTable(jsonTable, paramPath, nil)
+	if err != nil {
+		return fmt.Errorf("in file %q: %w", paramPath, err)
+	}
+	event, err := eventFromTable(jsonTable)
+	if err != nil {
+		return fmt.Errorf("in file %q: %w", paramPath, err)
+	}
+
+	// The scale factor of 4000 matches what the main application uses to write targetImage16bit.png
+	intensityMatrix, err := lightcurve.LoadGray16PNG("targetImage16bit.png", 4000.0)
+	if err != nil {
+		return err
+	}
+
+	geometricMatrix, err := lightcurve.LoadGray8PNG("geometricShadow.png")
+	if err != nil {
+		if !event.SaveGeometricShadow {
+			return fmt.Errorf("%w (save_geometric_shadow_bool is false, so the full run did not write it)", err)
+		}
+		return err
+	}
+	// geometricShadow.png is a black occulter on white, so LoadGray8PNG gives 1 for sky. The edge
+	// finder expects the occulter to be 1 (as in the main application's GeometricMatrix), so invert it.
+	for _, row := range geometricMatrix {
+		for x := range row {
+			row[x] = 1.0 - row[x]
+		}
+	}
+
+	if len(intensityMatrix) != len(geometricMatrix) {
+		return fmt.Errorf("targetImage16bit.png (%d pixels) and geometricShadow.png (%d pixels) are not the same size",
+			len(intensityMatrix), len(geometricMatrix))
+	}
+
+	// The saved images were flipped as the parameter file asks, but the path is defined in the
+	// unflipped orientation, so undo the flip (flipping twice restores the original).
+	intensityMatrix = FlipMatrix(intensityMatrix, event.FlipHorizontal, event.FlipVertical)
+	geometricMatrix = FlipMatrix(geometricMatrix, event.FlipHorizontal, event.FlipVertical)
+
+	// The saved images of a rotated run have the path at a 90 degree PA, so turn the velocity to match
+	if event.RotateGroundShadowTo90pa {
+		velocityTo90pa(&event)
+	}
+
+	// The saved images define the number of points (an external image may have overridden
+	// fundamental_plane_width_num_points in the original run).
+	path := &lightcurve.ObservationPath{
+		DxKmPerSec:               event.DxKmPerSec,
+		DyKmPerSec:               event.DyKmPerSec,
+		PathOffsetFromCenterKm:   event.PathOffsetFromCenterKm,
+		FundamentalPlaneWidthKm:  event.FundamentalPlaneWidthKm,
+		FundamentalPlaneWidthPts: len(intensityMatrix),
+	}
+
+	if event.PathEndpointsGiven {
+		err = path.SetPathEndpoints(event.PathEndpointsPixels[0], event.PathEndpointsPixels[1],
+			event.PathEndpointsPixels[2], event.PathEndpointsPixels[3])
+	} else {
+		err = path.ComputePathFromVelocity()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compute path: %w", err)
+	}
+	logInfo("Path angle is %0.1f degrees\n", path.PathAngleDegrees)
+	logInfo("Shadow speed is %0.3f km/sec\n", path.ShadowSpeedKmPerSec)
+	logInfo("Direction: %s\n", path.Direction)
+
+	path.ComputeSamplePointsN(event.PathNumSamples)
+	lightCurveData, err := lightcurve.ExtractLightCurve(intensityMatrix, path)
+	if err != nil {
+		return err
+	}
+	edges := lightcurve.FindEdgesInGeometricShadow(geometricMatrix, path)
+	if event.MinEdgeSeparationKm > 0.0 && len(edges) > 0 {
+		minSeparation := event.MinEdgeSeparationKm * float64(len(intensityMatrix)) / event.FundamentalPlaneWidthKm
+		pathEnd := path.SamplePoints[len(path.SamplePoints)-1].DistanceFromStart
+		edges, _, _ = lightcurve.PairEdges(edges, minSeparation, pathEnd)
+	}
+
+	opts := lightcurve.PlotOptions{Title: event.Title, Residual: event.PlotResidual, HalfLightEdges: event.PlotHalfLightEdges,
+		GeometricStep: event.PlotGeometricStep, XTickStepKm: event.PlotXTickStepKm, YTickStep: event.PlotYTickStep,
+		XTickFormat: event.PlotXTickFormat, YTickFormat: event.PlotYTickFormat}
+	err = lightcurve.SaveLightCurvePlotWithOptions("lightCurvePlot.png", lightCurveData, edges, path, 1200, 500, opts)
+	if err != nil {
+		return fmt.Errorf("writing of %q failed: %w", "lightCurvePlot.png", err)
+	}
+	logInfo("Light curve plot saved to lightCurvePlot.png\n")
+
+	displayImage, err := lightcurve.LoadImageFromFile("diffractionImage8bit.png")
+	if err != nil {
+		return err
+	}
+	// diffractionImage8bit.png is still flipped, so the drawn path is flipped to match
+	drawnPath := *path
+	n := len(intensityMatrix)
+	drawnPath.StartX, drawnPath.StartY = FlipOverlayPoint(path.StartX, path.StartY, n, event.FlipHorizontal, event.FlipVertical)
+	drawnPath.EndX, drawnPath.EndY = FlipOverlayPoint(path.EndX, path.EndY, n, event.FlipHorizontal, event.FlipVertical)
+	annotated, err := lightcurve.DrawObservationLineOnImageStyled(displayImage, &drawnPath, 0.0, pathStyle(&event))
+	if err != nil {
+		return err
+	}
+	if event.KmGridSpacingKm > 0.0 {
+		lightcurve.DrawKmGridMirrored(annotated, event.FundamentalPlaneWidthKm/float64(n), event.KmGridSpacingKm,
+			event.FlipHorizontal, event.FlipVertical)
+	}
+	err = lightcurve.SaveImageToFile("diffractionImageWithPath.png", annotated)
+	if err != nil {
+		return fmt.Errorf("writing of %q failed: %w", "diffractionImageWithPath.png", err)
+	}
+	logInfo("Diffraction image with observation path saved to diffractionImageWithPath.png\n")
+
+	return nil
+}
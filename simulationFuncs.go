@@ -0,0 +1,1732 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"math/cmplx"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/bob-anderson-ok/IOTAdiffraction/lightcurve"
+)
+
+// The functions in this file are the stages of a diffraction run. They return their errors (with
+// the exit code of the command line, see exitWith). computeDiffraction and runSimulation put them
+// together for the normal (single event) run of RunSimulationContext, the batch run in batchRun.go
+// and the sweep in sweepCommand.go.
+
+// loadQEtable reads, normalizes and plots the camera response table named in event.PathToQEtable
+// (if any) and stores it in event.QEtable.
+func loadQEtable(event *OccultationEvent) error {
+	if event.PathToQEtable == "" {
+		return nil
+	}
+	// Read the Json5 (or Json) parameter file
+	data, err := os.ReadFile(event.PathToQEtable)
+	if err != nil {
+		return exitWith(13, fmt.Errorf("\n\tAttempt to read file %q failed: %w\n", event.PathToQEtable, err))
+	}
+	var qeTable [][2]float64
+	qeTable, err = parseArrayFormat(data)
+	if err != nil {
+		return exitWith(15, fmt.Errorf("\n\tError reading camera response file %q: %w\n", event.PathToQEtable, err))
+	}
+	event.QEtable = qeTable
+	//fmt.Println("Got the camera table", len(qeTable), "entries")
+	if len(qeTable) < 1 {
+		return exitWith(14, fmt.Errorf("\n\tThe camera response file %q is empty.", event.PathToQEtable))
+	}
+	if event.QEWavelengthUnits == "um" {
+		for i := range qeTable {
+			qeTable[i][0] *= 1000.0 // micrometers to nm
+		}
+		logInfo("Camera response wavelengths converted from micrometers to nm\n")
+	} else {
+		// Visible and near infrared wavelengths are hundreds of nm, so values this small are almost
+		// certainly micrometers
+		allSmall := true
+		for i := range qeTable {
+			if qeTable[i][0] >= 10.0 {
+				allSmall = false
+				break
+			}
+		}
+		if allSmall {
+			logWarn("\n\tWARNING: all wavelengths in %q are below 10 nm. If they are in micrometers, add\n"+
+				"\tqe_wavelength_units : \"um\" to the parameter file.\n\n", event.PathToQEtable)
+		}
+	}
+	normalizeQEtable(qeTable)
+	logInfo("Effective wavelength of the camera response is %0.1f nm\n", effectiveWavelengthNm(qeTable))
+	MakeCameraResponsePlot(qeTable, event.PathToQEtable)
+	return nil
+}
+
+// normalizeQEtable scales the weights (second column) of qeTable in place so that they sum to 1.
+// The e-fields of the wavelength bins are then summed with these weights.
+func normalizeQEtable(qeTable [][2]float64) {
+	var cumWeights = 0.0
+	for i := 0; i < len(qeTable); i++ {
+		cumWeights += qeTable[i][1]
+	}
+	for i := 0; i < len(qeTable); i++ {
+		qeTable[i][1] /= cumWeights
+	}
+}
+
+// effectiveWavelengthNm returns the weighted mean wavelength of a normalized qeTable.
+func effectiveWavelengthNm(qeTable [][2]float64) float64 {
+	effective := 0.0
+	for i := 0; i < len(qeTable); i++ {
+		effective += qeTable[i][0] * qeTable[i][1]
+	}
+	return effective
+}
+
+// PlaneSampling holds the quantities derived from the fundamental plane, wavelength and distance
+// of an event that describe how finely the diffraction is sampled.
+type PlaneSampling struct {
+	KmPerPixel             float64 // Resolution in the fundamental plane
+	FresnelScaleKm         float64
+	SamplesPerFresnelScale float64
+}
+
+// DerivedQuantities returns the resolution and Fresnel sampling of the current fundamental plane,
+// wavelength and distance of e. printResolution stores them in e.Sampling each time it reports
+// them, so e.Sampling holds the values of the last report.
+func (e *OccultationEvent) DerivedQuantities() PlaneSampling {
+	kmPerPixel := e.FundamentalPlaneWidthKm / float64(e.FundamentalPlaneWidthPoints)
+	fresnelScale := FresnelScale(e.ObservationWavelengthNm, e.DistanceAu)
+	return PlaneSampling{
+		KmPerPixel:             kmPerPixel,
+		FresnelScaleKm:         fresnelScale,
+		SamplesPerFresnelScale: fresnelScale / kmPerPixel,
+	}
+}
+
+// printResolution prints the resolution, Fresnel scale and samples per Fresnel scale for the
+// event, stores them in event.Sampling and returns the resolution (km/pixel) in the fundamental plane.
+func printResolution(event *OccultationEvent) float64 {
+	event.Sampling = event.DerivedQuantities()
+	resolution := event.Sampling.KmPerPixel
+	logInfo("Resolution in fundamental plane is %0.3f km/pixel\n", resolution)
+	if event.Band != "" {
+		logInfo("Band %s: observation wavelength is %g nm\n", event.Band, event.ObservationWavelengthNm)
+	}
+	logInfo("Fresnel scale is %0.3f km\n", event.Sampling.FresnelScaleKm)
+	samplesPerFresnelScale := int(event.Sampling.SamplesPerFresnelScale)
+	logInfo("Samples per Fresnel scale is %d  (To see diffraction effects, this number should be at least 5)\n", samplesPerFresnelScale)
+	if event.MainBodyGiven {
+		// The radius of the circle with the same area as the main body ellipse
+		radius := math.Sqrt(event.MainbodyMajorAxisKm*event.MainbodyMinorAxisKm) / 2.0
+		fresnelNumber := FresnelNumber(radius, event.ObservationWavelengthNm, event.DistanceAu)
+		var regime string
+		switch {
+		case fresnelNumber > 10.0:
+			regime = "near geometric: the shadow follows the outline of the body"
+		case fresnelNumber >= 0.1:
+			regime = "strong diffraction"
+		default:
+			regime = "far field: the shadow is a diffraction pattern that no longer resembles the body"
+		}
+		logInfo("Fresnel number of the main body is %0.3g  (%s)\n", fresnelNumber, regime)
+	}
+	logInfo("\n")
+	return resolution
+}
+
+// autosizePlane compares the fundamental plane of the event with the one SuggestPlaneSize gives for
+// its ellipses and the Fresnel scale. If the plane is too small or too coarse, the suggestion is
+// printed; with apply (the -autosize flag) the suggested values replace the given ones. Planes
+// defined by an external image are left alone because the image fixes them.
+func autosizePlane(event *OccultationEvent, apply bool) {
+	if !(event.MainBodyGiven || event.SatelliteGiven) {
+		return
+	}
+	if event.PathToExternalImage != "" || event.PathToSourcePlaneNPY != "" || event.PathToComplexSourcePlaneNPY != "" ||
+		event.ReuseGeometricShadowPNG != "" {
+		if apply {
+			logWarn("-autosize is ignored: the external image defines the fundamental plane\n")
+		}
+		return
+	}
+
+	// The farthest any ellipse reaches from the plane center (conservatively, along either axis)
+	halfExtentKm := 0.0
+	if event.MainBodyGiven {
+		halfExtentKm = math.Max(math.Abs(event.MainBodyXCenterKm), math.Abs(event.MainBodyYCenterKm)) +
+			math.Max(event.MainbodyMajorAxisKm, event.MainbodyMinorAxisKm)/2.0
+	}
+	if event.SatelliteGiven {
+		halfExtentKm = math.Max(halfExtentKm,
+			math.Max(math.Abs(event.SatelliteXCenterKm), math.Abs(event.SatelliteYCenterKm))+
+				math.Max(event.SatelliteMajorAxisKm, event.SatelliteMinorAxisKm)/2.0)
+	}
+
+	fresnelScale := FresnelScale(event.ObservationWavelengthNm, event.DistanceAu)
+	widthKm, numPoints := SuggestPlaneSize(halfExtentKm, fresnelScale)
+
+	if apply {
+		logInfo("Autosize: fundamental_plane_width_km %0.3f -> %0.3f, fundamental_plane_width_num_points %d -> %d\n",
+			event.FundamentalPlaneWidthKm, widthKm, event.FundamentalPlaneWidthPoints, numPoints)
+		event.FundamentalPlaneWidthKm = widthKm
+		event.FundamentalPlaneWidthPoints = numPoints
+		return
+	}
+
+	samplesPerFresnelScale := event.DerivedQuantities().SamplesPerFresnelScale
+	if event.FundamentalPlaneWidthKm < widthKm || samplesPerFresnelScale < autosizeSamplesPerFresnelScale {
+		logInfo("Suggested fundamental plane (%g Fresnel scales of margin, %g samples per Fresnel scale): "+
+			"fundamental_plane_width_km : %0.3f, fundamental_plane_width_num_points : %d  (or run with -autosize)\n",
+			autosizeMarginFresnelScales, autosizeSamplesPerFresnelScale, widthKm, numPoints)
+	}
+}
+
+// enforceMinSamplesPerFresnel makes sure the fundamental plane has at least
+// event.MinSamplesPerFresnel samples per Fresnel scale (no check when that is 0). With apply (the
+// -autosize flag) the number of points of an ellipse plane is increased to meet it; otherwise, or
+// for a plane defined by an external image, an error is returned. An external plane is
+// only checked once buildGeometricShadow has set its number of points, so call this both before and
+// after buildGeometricShadow.
+func enforceMinSamplesPerFresnel(event *OccultationEvent, apply bool) error {
+	if event.MinSamplesPerFresnel <= 0.0 {
+		return nil
+	}
+	external := event.PathToExternalImage != "" || event.PathToSourcePlaneNPY != "" || event.PathToComplexSourcePlaneNPY != "" ||
+		event.ReuseGeometricShadowPNG != ""
+	if external && event.FplaneImage == nil {
+		return nil
+	}
+
+	sampling := event.DerivedQuantities()
+	fresnelScale := sampling.FresnelScaleKm
+	samplesPerFresnelScale := sampling.SamplesPerFresnelScale
+	if samplesPerFresnelScale >= event.MinSamplesPerFresnel {
+		return nil
+	}
+	if apply && !external {
+		numPoints := int(math.Ceil(event.MinSamplesPerFresnel * event.FundamentalPlaneWidthKm / fresnelScale))
+		logInfo("Autosize: fundamental_plane_width_num_points %d -> %d to give %g samples per Fresnel scale\n",
+			event.FundamentalPlaneWidthPoints, numPoints, event.MinSamplesPerFresnel)
+		event.FundamentalPlaneWidthPoints = numPoints
+		return nil
+	}
+	return exitWith(23, fmt.Errorf("\n\tThe plane has %0.2f samples per Fresnel scale but min_samples_per_fresnel is %g: "+
+		"increase fundamental_plane_width_num_points (or run with -autosize)\n", samplesPerFresnelScale, event.MinSamplesPerFresnel))
+}
+
+// buildGeometricShadow fills event.FplaneImage (from the external image, if one was given, plus
+// any ellipses), writes it to shadowFilename (unless save_geometric_shadow_bool is false), fills
+// event.GeometricMatrix and returns the complex source plane. When an external image is used, event.FundamentalPlaneWidthPoints is overridden
+// by the image width (with a warning if that changes it), so callers must recompute the resolution.
+func buildGeometricShadow(event *OccultationEvent, shadowFilename string) ([][]complex128, error) {
+	Npts := event.FundamentalPlaneWidthPoints // Just a shorthand version
+	var npyPlane [][]complex128
+
+	// Deal with external image supplied by the user.
+	reused := event.ReuseGeometricShadowPNG != ""
+	if reused {
+		if err := loadGeometricShadow(event); err != nil {
+			return nil, err
+		}
+		if event.FundamentalPlaneWidthPoints != Npts {
+			logWarn("\n\tWARNING: fundamental_plane_width_num_points (%d) is ignored: the reused shadow is %d pixels wide.\n"+
+				"\tThe resolution in the fundamental plane is now:\n\n", Npts, event.FundamentalPlaneWidthPoints)
+			printResolution(event)
+		}
+	} else if event.PathToExternalImage != "" {
+		f, err := os.Open(event.PathToExternalImage)
+		if err != nil {
+			return nil, exitWith(5, fmt.Errorf("\n\tAttempt to read external image %q failed: %w\n", event.PathToExternalImage, err))
+		}
+		//defer f.Close()
+		defer func() {
+			if cerr := f.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+
+		img, err := png.Decode(f)
+		if err != nil {
+			return nil, exitWith(6, fmt.Errorf("\n\tAttempt to decode external image %q failed: %w\n", event.PathToExternalImage, err))
+		}
+
+		if img.Bounds().Dx() != img.Bounds().Dy() {
+			return nil, exitWith(7, fmt.Errorf("\n\tThe supplied external image %q is not square.", event.PathToExternalImage))
+		}
+
+		// We require that an external image is in GRAY format (uint8) to match
+		// our internal use when we build the fundamental plane image ourselves. We do this
+		// so that we can add (overlay) any ellipses defined in the json file. We expect
+		// that external image files are used only to define odd or polygon shapes.
+		// If the image is RGB (32-bit), we convert it to Gray automatically. An image with transparency
+		// defines a soft occulter: the pixel opacity becomes the graded aperture amplitude.
+		var grayImg *image.Gray
+		if img.ColorModel() == color.GrayModel {
+			grayImg = img.(*image.Gray)
+		} else if (img.ColorModel() == color.RGBAModel || img.ColorModel() == color.NRGBAModel) && hasTransparency(img) {
+			logInfo("\n\tThe supplied external image %q has transparency. Its opacity defines a soft occulter.\n",
+				event.PathToExternalImage)
+			grayImg = opacityToGray(img)
+			event.GradedSourcePlane = true
+		} else if img.ColorModel() == color.RGBAModel || img.ColorModel() == color.NRGBAModel {
+			logWarn("\n\tThe supplied external image %q is %s. Converting to Gray.\n",
+				event.PathToExternalImage, ColorModelString(img.ColorModel()))
+			bounds := img.Bounds()
+			grayImg = image.NewGray(bounds)
+			skyRef := img.At(bounds.Min.X, bounds.Min.Y)
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					if img.At(x, y) == skyRef {
+						grayImg.SetGray(x, y, color.Gray{Y: 255})
+					} else {
+						grayImg.SetGray(x, y, color.Gray{Y: 0})
+					}
+				}
+			}
+		} else {
+			return nil, exitWith(8, fmt.Errorf("\n\tThe supplied external image %q is not type GRAY (found: %s).",
+				event.PathToExternalImage, ColorModelString(img.ColorModel())))
+		}
+
+		event.FplaneImage = grayImg
+
+		// Override the value (possibly) supplied in the fundamental_plane_width_num_points parameter
+		event.FundamentalPlaneWidthPoints = img.Bounds().Dx()
+		logInfo("External image loaded. Color model in use: %s\n", ColorModelString(event.FplaneImage.ColorModel()))
+		logInfo("external_image_width_km: %g\n", event.ExternalImageWidthKm)
+		if event.FundamentalPlaneWidthPoints != Npts {
+			logWarn("\n\tWARNING: fundamental_plane_width_num_points (%d) is ignored: the external image is %d pixels wide.\n"+
+				"\tThe resolution in the fundamental plane is now:\n\n", Npts, event.FundamentalPlaneWidthPoints)
+			printResolution(event)
+		}
+	} else if event.PathToSourcePlaneNPY != "" || event.PathToComplexSourcePlaneNPY != "" {
+		path := event.PathToSourcePlaneNPY
+		var err error
+		if path != "" {
+			var opacity [][]float64
+			opacity, err = LoadMatrixNPY(path)
+			npyPlane = make([][]complex128, len(opacity))
+			for y, row := range opacity {
+				npyPlane[y] = make([]complex128, len(row))
+				for x, v := range row {
+					npyPlane[y][x] = complex(v, 0.0)
+				}
+			}
+		} else {
+			path = event.PathToComplexSourcePlaneNPY
+			npyPlane, err = LoadComplexMatrixNPY(path)
+		}
+		if err != nil {
+			return nil, exitWith(6, fmt.Errorf("\n\tAttempt to load source plane %q failed: %w\n", path, err))
+		}
+		if len(npyPlane) == 0 || len(npyPlane) != len(npyPlane[0]) {
+			return nil, exitWith(7, fmt.Errorf("\n\tThe supplied source plane %q is not square.", path))
+		}
+
+		// The gray image is only used for display, the ellipses and the geometric shadow. The source
+		// plane itself is built from the full precision (and, if complex, full phase) values below.
+		event.FplaneImage = opacityMatrixToGray(npyPlane)
+		event.GradedSourcePlane = true
+
+		event.FundamentalPlaneWidthPoints = len(npyPlane)
+		logInfo("Source plane loaded from %s\n", path)
+		if event.FundamentalPlaneWidthPoints != Npts {
+			logWarn("\n\tWARNING: fundamental_plane_width_num_points (%d) is ignored: the source plane is %d pixels wide.\n"+
+				"\tThe resolution in the fundamental plane is now:\n\n", Npts, event.FundamentalPlaneWidthPoints)
+			printResolution(event)
+		}
+	} else { // No image supplied by user, so we start our own.
+		event.FplaneImage = image.NewGray(image.Rect(0, 0, Npts, Npts))
+		FillFplane(event.FplaneImage, true)
+	}
+
+	if reused {
+		// The saved shadow already has its ellipses, atmosphere and rotations: only the shadow
+		// motion still has to be turned to a 90 degree PA
+		if event.RotateGroundShadowTo90pa {
+			velocityTo90pa(event)
+		}
+	} else {
+		drawOcculters(event, logInfo)
+	}
+	if err := checkSourcePlaneCoverage(event); err != nil {
+		return nil, err
+	}
+	if event.SaveGeometricShadow {
+		err := SaveGrayPNG(shadowFilename, outputGrayImage(event, event.FplaneImage))
+		if err != nil {
+			return nil, exitWith(9, fmt.Errorf("\n\tFailed to write %q.", shadowFilename))
+		}
+	}
+
+	var sourcePlane [][]complex128
+	if event.GradedSourcePlane {
+		sourcePlane = ConvertSourcePlaneImageToComplexGraded(event.FplaneImage)
+		// Restore the full precision (and phase) of a .npy source plane wherever an ellipse has not
+		// been drawn over it. A rotated plane no longer lines up with npyPlane, so it keeps the 8-bit
+		// magnitudes.
+		if npyPlane != nil && !event.RotateGroundShadowTo90pa && event.SourcePlaneRotationDegrees == 0.0 {
+			for y, row := range npyPlane {
+				for x, v := range row {
+					if event.FplaneImage.GrayAt(x, y).Y == opacityToGrayLevel(cmplx.Abs(v)) {
+						sourcePlane[y][x] = v
+					}
+				}
+			}
+		}
+	} else {
+		sourcePlane = ConvertSourcePlaneImageToComplex(event.FplaneImage)
+	}
+	event.GeometricMatrix = ConvertSourcePlaneImageToMatrix(event.FplaneImage)
+	return sourcePlane, nil
+}
+
+// drawOcculters draws the ellipses and the atmosphere of event on event.FplaneImage (already filled
+// with sky) and then applies the source plane rotations. Each step is reported through logf.
+func drawOcculters(event *OccultationEvent, logf func(format string, args ...any)) {
+	AddEllipses(*event, true)
+	if hasPartialOpacity(*event) {
+		event.GradedSourcePlane = true
+	}
+	if event.AtmosphereScaleHeightKm > 0.0 {
+		event.GradedSourcePlane = true
+		AddAtmosphere(*event)
+		logf("Main body atmosphere added with a scale height of %0.3f km\n", event.AtmosphereScaleHeightKm)
+	}
+	if event.SourcePlaneRotationDegrees != 0.0 {
+		// Hard edges stay two-level; the newly exposed corners are open sky
+		event.FplaneImage = RotateGrayImage(event.FplaneImage, event.SourcePlaneRotationDegrees, 255, !event.GradedSourcePlane)
+		logf("Source plane rotated by %g degrees (counter-clockwise)\n", event.SourcePlaneRotationDegrees)
+	}
+	if event.RotateGroundShadowTo90pa {
+		rotateGroundShadowTo90pa(event, logf)
+	}
+}
+
+// loadGeometricShadow sets event.FplaneImage from the geometricShadow.png of an earlier run (named by
+// reuse_geometric_shadow_png), so that the run uses exactly that geometry. The saved image was
+// flipped for output, so the flips are undone. Any gray level other than 0 and 255 (an atmosphere,
+// a partial occulter or a hand-edited soft edge) makes the source plane graded.
+func loadGeometricShadow(event *OccultationEvent) error {
+	img, err := lightcurve.LoadImageFromFile(event.ReuseGeometricShadowPNG)
+	if err != nil {
+		return exitWith(6, fmt.Errorf("\n\tAttempt to load the geometric shadow %q failed: %w\n", event.ReuseGeometricShadowPNG, err))
+	}
+	if img.Bounds().Dx() != img.Bounds().Dy() {
+		return exitWith(7, fmt.Errorf("\n\tThe geometric shadow %q is not square.", event.ReuseGeometricShadowPNG))
+	}
+
+	grayImg, ok := img.(*image.Gray)
+	if !ok || grayImg.Bounds().Min != (image.Point{}) {
+		logWarn("\n\tThe geometric shadow %q is %s. Converting to Gray.\n",
+			event.ReuseGeometricShadowPNG, ColorModelString(img.ColorModel()))
+		size := img.Bounds().Dx()
+		grayImg = image.NewGray(image.Rect(0, 0, size, size))
+		draw.Draw(grayImg, grayImg.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	if event.FlipHorizontal || event.FlipVertical {
+		grayImg = FlipGrayImage(grayImg, event.FlipHorizontal, event.FlipVertical)
+	}
+	for _, v := range grayImg.Pix {
+		if v != 0 && v != 255 {
+			event.GradedSourcePlane = true
+			break
+		}
+	}
+
+	event.FplaneImage = grayImg
+	event.FundamentalPlaneWidthPoints = grayImg.Bounds().Dx()
+	logInfo("Geometric shadow reused from %s (ellipses, atmosphere and rotations are not applied again)\n",
+		event.ReuseGeometricShadowPNG)
+	return nil
+}
+
+// checkSourcePlaneCoverage returns an error if no light at all gets through the fundamental plane (the
+// result would be an unexplained all-black image) and warns if the plane is uniform, which gives a
+// trivial result. In occulter mode the shapes block the light; in aperture mode they pass it.
+func checkSourcePlaneCoverage(event *OccultationEvent) error {
+	opaque, blocking, total := sourcePlaneCoverage(event.FplaneImage)
+	allCovered := opaque == total
+	noneCovered := blocking == 0
+	if event.Mode == "aperture" {
+		allCovered, noneCovered = noneCovered, allCovered
+		if allCovered {
+			return exitWith(25, fmt.Errorf("\n\tNo aperture was drawn in the fundamental plane, so no light gets through. Check that\n"+
+				"\tthe shapes are centered within the %g km plane.\n", event.FundamentalPlaneWidthKm))
+		}
+		if noneCovered {
+			logWarn("\n\tThe aperture fills the whole fundamental plane (is it larger than the %g km plane?),\n"+
+				"\tso only the edges of the plane diffract.\n\n", event.FundamentalPlaneWidthKm)
+		}
+		return nil
+	}
+	if allCovered {
+		return exitWith(25, fmt.Errorf("\n\tThe occulter covers the whole fundamental plane (%d of %d pixels are opaque), so no light\n"+
+			"\tgets through. Is the body larger than fundamental_plane_width_km (%g km)?\n",
+			opaque, total, event.FundamentalPlaneWidthKm))
+	}
+	if noneCovered {
+		logWarn("\n\tNothing in the fundamental plane blocks the light: check that the body centers are within\n"+
+			"\tthe %g km plane. The diffraction image will be uniform.\n\n", event.FundamentalPlaneWidthKm)
+	}
+	return nil
+}
+
+// outputGrayImage returns img mirrored as requested by flip_horizontal_bool and flip_vertical_bool.
+// Only the saved and displayed images are flipped: all calculations use the unflipped orientation.
+func outputGrayImage(event *OccultationEvent, img *image.Gray) *image.Gray {
+	if !event.FlipHorizontal && !event.FlipVertical {
+		return img
+	}
+	return FlipGrayImage(img, event.FlipHorizontal, event.FlipVertical)
+}
+
+// outputMatrix returns m mirrored in the same way as outputGrayImage.
+func outputMatrix(event *OccultationEvent, m [][]float64) [][]float64 {
+	if !event.FlipHorizontal && !event.FlipVertical {
+		return m
+	}
+	return FlipMatrix(m, event.FlipHorizontal, event.FlipVertical)
+}
+
+// outputPoint returns the position of the image point x,y in the flipped output images.
+func outputPoint(event *OccultationEvent, x, y float64) (float64, float64) {
+	return FlipOverlayPoint(x, y, event.FundamentalPlaneWidthPoints, event.FlipHorizontal, event.FlipVertical)
+}
+
+// rotateGroundShadowTo90pa rotates event.FplaneImage (bilinear resampling) so that the path runs at
+// the standard 90 degree PA, that is, horizontally along the image rows, and replaces the velocity
+// components by the equivalent ones for the rotated plane (the given ones are kept in
+// event.UnrotatedVelocity). The perpendicular path offset is unchanged because the rotation is about
+// the plane center. The rotation is reported through logf.
+func rotateGroundShadowTo90pa(event *OccultationEvent, logf func(format string, args ...any)) {
+	event.UnrotatedVelocity = [2]float64{event.DxKmPerSec, event.DyKmPerSec}
+	pathAngleDegrees, moving := velocityTo90pa(event)
+	if !moving {
+		logWarn("The shadow is not moving, so the ground shadow was not rotated.\n")
+		return
+	}
+
+	// Graded (atmosphere or transparent image) edges keep their gray levels; hard edges stay two-level
+	threshold := !event.GradedSourcePlane
+	event.FplaneImage = RotateGrayImage(event.FplaneImage, 90.0-pathAngleDegrees, 255, threshold)
+	logf("Ground shadow rotated by %0.1f degrees (counter-clockwise) to put the path at a 90 degree PA\n",
+		90.0-pathAngleDegrees)
+}
+
+// velocityTo90pa turns the shadow motion of event to a 90 degree PA, keeping its speed, and returns
+// the path angle it had. moving is false (and nothing is changed) for a stationary shadow.
+func velocityTo90pa(event *OccultationEvent) (pathAngleDegrees float64, moving bool) {
+	speed := math.Sqrt(event.DxKmPerSec*event.DxKmPerSec + event.DyKmPerSec*event.DyKmPerSec)
+	if speed == 0.0 {
+		return 0.0, false
+	}
+	pathAngleDegrees = math.Atan2(-event.DxKmPerSec, -event.DyKmPerSec) * 180.0 / math.Pi
+
+	// A path angle of 90 degrees means motion toward negative x (x is positive to the left)
+	event.DxKmPerSec = -speed
+	event.DyKmPerSec = 0.0
+	return pathAngleDegrees, true
+}
+
+// pathFromEndpoints sets up the observation path from event.PathEndpointsPixels (see
+// lightcurve.ObservationPath.SetPathEndpoints). This works with a stationary shadow too, in which
+// case the light curve is a spatial profile without a time scale.
+func pathFromEndpoints(event *OccultationEvent) (AnnotatedPoint, AnnotatedPoint, error) {
+	maxCoordinate := float64(event.FundamentalPlaneWidthPoints - 1)
+	for _, v := range event.PathEndpointsPixels {
+		if v < 0.0 || v > maxCoordinate {
+			return AnnotatedPoint{}, AnnotatedPoint{}, exitWith(10, fmt.Errorf("\n\tpath_endpoints_pixels %v must lie within the image (0 to %g)",
+				event.PathEndpointsPixels, maxCoordinate))
+		}
+	}
+	x0, y0 := event.PathEndpointsPixels[0], event.PathEndpointsPixels[1]
+	x1, y1 := event.PathEndpointsPixels[2], event.PathEndpointsPixels[3]
+
+	path := lightcurve.ObservationPath{
+		DxKmPerSec:               event.DxKmPerSec,
+		DyKmPerSec:               event.DyKmPerSec,
+		FundamentalPlaneWidthKm:  event.FundamentalPlaneWidthKm,
+		FundamentalPlaneWidthPts: event.FundamentalPlaneWidthPoints,
+	}
+	err := path.SetPathEndpoints(x0, y0, x1, y1)
+	if err != nil {
+		return AnnotatedPoint{}, AnnotatedPoint{}, exitWith(10, fmt.Errorf("\n\tpath_endpoints_pixels: %w", err))
+	}
+	event.DxKmPerSec = path.DxKmPerSec
+	event.DyKmPerSec = path.DyKmPerSec
+	event.ShadowSpeedKmPerSec = path.ShadowSpeedKmPerSec
+	event.PathAngleDegrees = path.PathAngleDegrees
+	event.PathDirection = path.Direction
+	event.PathStart = [2]float64{x0, y0}
+	event.PathEnd = [2]float64{x1, y1}
+	event.PathDefined = true
+
+	logInfo("\nPath given by its endpoints (%0.1f, %0.1f) to (%0.1f, %0.1f)\n", x0, y0, x1, y1)
+	logInfo("Path angle is %0.1f degrees\n", event.PathAngleDegrees)
+	logInfo("Shadow speed is %0.3f km/sec\n\n", event.ShadowSpeedKmPerSec)
+	logInfo("Direction: %s\n", event.PathDirection)
+	computePathPoints(event)
+	return AnnotatedPoint{X: x0, Y: y0, Position: "start"}, AnnotatedPoint{X: x1, Y: y1, Position: "end"}, nil
+}
+
+// setLimbDarkeningCoeff figures out the proper value to use for the limb darkening coefficient
+// based on the supplied parameters.
+func setLimbDarkeningCoeff(event *OccultationEvent) {
+	LimbValues := map[string]float64{
+		"O": 0.05,
+		"B": 0.2,
+		"A": 0.5,
+		"F": 0.6,
+		"G": 0.7,
+		"K": 0.7,
+		"M": 0.7,
+	}
+	if event.StarDiamMas > 0.0 {
+		if event.LimbDarkeningCoeff == 0.0 { // Limb darkening coefficient takes precedence over star class
+			if event.StarClass == "" {
+				// No star class or limb darkening coefficient given, so we use a default value of 0.7
+				event.LimbDarkeningCoeff = 0.7
+			} else {
+				v, ok := LimbValues[event.StarClass]
+				if !ok {
+					logError(fmt.Errorf(
+						"\n\tThe star class %q is not recognized. Default value of 0.7 will be used.\n",
+						event.StarClass),
+					)
+					event.LimbDarkeningCoeff = 0.7
+				} else {
+					event.LimbDarkeningCoeff = v // Use value from the table
+				}
+			}
+		}
+	}
+
+	logInfo("Limb darkening coefficient set to: %v\n", event.LimbDarkeningCoeff)
+}
+
+// Distance conversions: the solar (equatorial horizontal) parallax at 1 au and the light travel time over 1 au
+const (
+	parallaxArcsecAt1Au = 8.79414
+	lightSecsPer1Au     = 499.004784
+)
+
+// distanceFromInputs returns the distance in au from the first of its inputs that is given (greater
+// than 0), in the order parallax_arcsec, light_time_secs, distance_au, and the name of that input.
+// A parallax is converted with distance = 8.79414 / parallax, a light time with distance = light
+// time / 499.004784 seconds.
+func distanceFromInputs(parallaxArcsec, lightTimeSecs, distanceAu float64) (au float64, source string, err error) {
+	switch {
+	case parallaxArcsec > 0.0:
+		return parallaxArcsecAt1Au / parallaxArcsec, "parallax_arcsec", nil
+	case lightTimeSecs > 0.0:
+		return lightTimeSecs / lightSecsPer1Au, "light_time_secs", nil
+	case distanceAu > 0.0:
+		return distanceAu, "distance_au", nil
+	}
+	return 0.0, "", errors.New("no distance given: one of parallax_arcsec, light_time_secs or distance_au must be greater than 0")
+}
+
+// resolveDistance sets event.DistanceAu and event.DistanceSource from the distance inputs of event
+// (see distanceFromInputs). It is done when the parameters are read, so that everything from the
+// first Fresnel scale on uses the same distance, and again by checkEventDistances for events built
+// in code.
+func resolveDistance(event *OccultationEvent) error {
+	au, source, err := distanceFromInputs(event.ParallaxArcsec, event.LightTimeSecs, event.DistanceAu)
+	if err != nil {
+		return err
+	}
+	event.DistanceAu, event.DistanceSource = au, source
+	return nil
+}
+
+// checkEventDistances resolves the distance (see resolveDistance), prints the distance used and makes
+// some elementary checks to make sure that the user has not supplied bad parameters.
+func checkEventDistances(event *OccultationEvent) error {
+	if event.FundamentalPlaneWidthKm <= 0.0 {
+		return exitWith(10, fmt.Errorf("\n\tFundamental plane width must be positive."))
+	}
+
+	if err := resolveDistance(event); err != nil {
+		return exitWith(10, fmt.Errorf("\n\tDistance given is invalid: %w", err))
+	}
+	logInfo("Distance used: %0.6f AU (from %s)\n", event.DistanceAu, event.DistanceSource)
+	return nil
+}
+
+// computePathGeometry computes the shadow speed and path angle from the velocity components and,
+// if the shadow is moving, the path end points (p1, p2 are where the extended path crosses the
+// plane edges), direction and sample points.
+func computePathGeometry(event *OccultationEvent) (AnnotatedPoint, AnnotatedPoint, error) {
+	var p1 AnnotatedPoint
+	var p2 AnnotatedPoint
+	var err error
+
+	event.PathSamplePoints = nil
+	if event.PathEndpointsGiven {
+		return pathFromEndpoints(event)
+	}
+	event.ShadowSpeedKmPerSec = math.Sqrt(event.DxKmPerSec*event.DxKmPerSec + event.DyKmPerSec*event.DyKmPerSec)
+	event.PathDefined = event.ShadowSpeedKmPerSec > 0.0
+	if event.ShadowSpeedKmPerSec > 0.0 {
+		event.PathAngleDegrees = math.Atan2(-event.DxKmPerSec, -event.DyKmPerSec) * 180.0 / math.Pi
+		if event.PathAngleDegrees < 0.0 {
+			event.PathAngleDegrees += 360.0
+		}
+		logInfo("\nPath angle is %0.1f degrees\n", event.PathAngleDegrees)
+		logInfo("Shadow speed is %0.3f km/sec\n\n", event.ShadowSpeedKmPerSec)
+
+		// The following function sets event.PathStart and event.PathEnd variables
+		p1, p2, event.PathDirection, err = processPathDirection(event.FundamentalPlaneWidthPoints, p1, p2, event)
+		if err != nil {
+			return AnnotatedPoint{}, AnnotatedPoint{}, exitWith(10, fmt.Errorf("\n\tProcessing of path direction failed: %w", err))
+		}
+		logInfo("Direction: %s\n", event.PathDirection)
+		computePathPoints(event)
+	}
+	return p1, p2, nil
+}
+
+// occulterBody is the source plane of one body of a chromatic occulter and the center (in pixels)
+// it is scaled about.
+type occulterBody struct {
+	plane  [][]complex128
+	cx, cy float64
+}
+
+// occulterBodies splits the occulter of event into bodies that a chromatic occulter scales about
+// their own centers, so that a change of size does not move them. Ellipses are drawn again one at a
+// time (with the same atmosphere and rotations as sourcePlane) and each is scaled about the centroid
+// of its shadow. An occulter taken from an image cannot be taken apart: it is one body, scaled about
+// its centroid, so separate shapes in the image move apart or together as the scale changes.
+func occulterBodies(event *OccultationEvent, sourcePlane [][]complex128) []occulterBody {
+	external := event.PathToExternalImage != "" || event.PathToSourcePlaneNPY != "" || event.PathToComplexSourcePlaneNPY != "" ||
+		event.ReuseGeometricShadowPNG != ""
+	if external || !(event.MainBodyGiven || event.SatelliteGiven) {
+		plane := make([][]complex128, len(sourcePlane))
+		for row := range sourcePlane {
+			plane[row] = append([]complex128(nil), sourcePlane[row]...)
+		}
+		cx, cy := sourcePlaneCentroid(plane)
+		return []occulterBody{{plane, cx, cy}}
+	}
+
+	var bodies []occulterBody
+	for _, satellite := range []bool{false, true} {
+		body := *event
+		body.MainBodyGiven = event.MainBodyGiven && !satellite
+		body.SatelliteGiven = event.SatelliteGiven && satellite
+		if !(body.MainBodyGiven || body.SatelliteGiven) {
+			continue
+		}
+		if event.RotateGroundShadowTo90pa {
+			// The velocity of event has already been turned to a 90 degree PA
+			body.DxKmPerSec, body.DyKmPerSec = event.UnrotatedVelocity[0], event.UnrotatedVelocity[1]
+			body.RotateGroundShadowTo90pa = body.DxKmPerSec != 0.0 || body.DyKmPerSec != 0.0
+		}
+		n := event.FundamentalPlaneWidthPoints
+		body.FplaneImage = image.NewGray(image.Rect(0, 0, n, n))
+		FillFplane(body.FplaneImage, true)
+		drawOcculters(&body, logDebug)
+
+		var plane [][]complex128
+		if event.GradedSourcePlane {
+			plane = ConvertSourcePlaneImageToComplexGraded(body.FplaneImage)
+		} else {
+			plane = ConvertSourcePlaneImageToComplex(body.FplaneImage)
+		}
+		cx, cy := sourcePlaneCentroid(plane)
+		bodies = append(bodies, occulterBody{plane, cx, cy})
+	}
+	return bodies
+}
+
+// sourcePlaneCentroid returns the centroid (x is the column, y the row) of the magnitude of plane,
+// or the plane center if plane is empty.
+func sourcePlaneCentroid(plane [][]complex128) (cx, cy float64) {
+	var sum, sumX, sumY float64
+	for y, row := range plane {
+		for x, v := range row {
+			m := cmplx.Abs(v)
+			sum += m
+			sumX += m * float64(x)
+			sumY += m * float64(y)
+		}
+	}
+	if sum == 0.0 {
+		return float64(len(plane)-1) / 2.0, float64(len(plane)-1) / 2.0
+	}
+	return sumX / sum, sumY / sum
+}
+
+// scaleOcculterBodies returns the source plane with each of bodies magnified by scale about its own
+// center. Where bodies overlap, the larger magnitude is kept.
+func scaleOcculterBodies(bodies []occulterBody, scale float64) ([][]complex128, error) {
+	var plane [][]complex128
+	for _, body := range bodies {
+		scaled, err := ScaleSourcePlaneAbout(body.plane, scale, body.cx, body.cy)
+		if err != nil {
+			return nil, err
+		}
+		if plane == nil {
+			plane = scaled
+			continue
+		}
+		for y, row := range scaled {
+			for x, v := range row {
+				if cmplx.Abs(v) > cmplx.Abs(plane[y][x]) {
+					plane[y][x] = v
+				}
+			}
+		}
+	}
+	return plane, nil
+}
+
+// accumulateQEFields returns the QE weighted sum of the e-fields of the wavelength bins of qeTable
+// (wavelength in nm, weight). fieldAt computes the e-field of one wavelength; it is called with a
+// nil workspace for the first bin, whose field then holds the sum, and with one shared workspace for
+// the rest (each field is added to the sum before the next call overwrites it). binDone, if not
+// nil, is given each field, unweighted, before it is added. The first error of fieldAt or binDone is
+// returned.
+func accumulateQEFields(qeTable [][2]float64, fieldAt func(ws *SincWorkspace, wavelengthNm float64) ([]complex128, error),
+	binDone func(field []complex128, wavelengthNm, weight float64) error) ([]complex128, error) {
+	var sum []complex128
+	var workspace SincWorkspace
+	for i, bin := range qeTable {
+		start := time.Now()
+		ws := &workspace
+		if i == 0 {
+			ws = nil
+		}
+		field, err := fieldAt(ws, bin[0])
+		if err != nil {
+			return nil, err
+		}
+		if binDone != nil {
+			if err := binDone(field, bin[0], bin[1]); err != nil {
+				return nil, err
+			}
+		}
+		if i == 0 {
+			sum = field
+			scaleComplex(sum, bin[1])
+		} else {
+			addScaledComplexInPlace(sum, field, bin[1])
+		}
+		logDebug("Calculation of wavelength %0.1f e-field took %s\n", bin[0], time.Since(start))
+	}
+	return sum, nil
+}
+
+// computeIntensity runs the diffraction calculation (monochromatic, or a QE weighted composite)
+// on sourcePlane, applies Babinet's principle to get the occulter intensity, then applies the
+// magDrop adjustment and the finite star diameter. The result is left in event.IntensityMatrix.
+// If event.EdgeApodization is set, sourcePlane is tapered in place. outputName maps the name of
+// each optional output file (e-field, per-wavelength images) to the name actually written.
+func computeIntensity(event *OccultationEvent, sourcePlane [][]complex128, resolution float64,
+	outputName func(string) string) error {
+	return computeIntensityContext(context.Background(), event, sourcePlane, resolution, outputName)
+}
+
+// computeIntensityContext is computeIntensity checking ctx before each wavelength bin, between the
+// matrix multiplications of each bin and before the star convolution. It returns ctx.Err() if ctx
+// has been canceled; event.IntensityMatrix is then not valid (as it is after any other error).
+func computeIntensityContext(ctx context.Context, event *OccultationEvent, sourcePlane [][]complex128, resolution float64,
+	outputName func(string) string) error {
+	auToKm := 1.495979e+8
+	nmToKm := 1e-9 * 1e-3
+
+	Npts := event.FundamentalPlaneWidthPoints
+	WavelengthKm := event.ObservationWavelengthNm * nmToKm
+	Lkm := event.FundamentalPlaneWidthKm
+	Zkm := event.DistanceAu * auToKm
+
+	// With a chromatic occulter, each wavelength bin gets its own plane of scaled (untapered) bodies
+	var bodies []occulterBody
+	if event.ChromaticDispersionCoeff != 0.0 && len(event.QEtable) > 0 {
+		bodies = occulterBodies(event, sourcePlane)
+	}
+	planeAt := func(wavelengthNm float64) ([][]complex128, error) {
+		if bodies == nil {
+			return sourcePlane, nil
+		}
+		scale := 1.0 + event.ChromaticDispersionCoeff*(wavelengthNm-event.ObservationWavelengthNm)/event.ObservationWavelengthNm
+		plane, err := scaleOcculterBodies(bodies, scale)
+		if err != nil {
+			return nil, exitWith(10, fmt.Errorf("scaling the occulter for wavelength %0.1f nm failed: %w", wavelengthNm, err))
+		}
+		if event.EdgeApodization > 0.0 {
+			_ = ApodizeSourcePlane(plane, event.EdgeApodization) // The fraction has already been validated
+		}
+		logDebug("Occulter scaled by %0.5f for wavelength %0.1f nm\n", scale, wavelengthNm)
+		return plane, nil
+	}
+
+	// Optionally taper the plane margins so that an aperture cut off by the plane boundary does not ring
+	if event.EdgeApodization > 0.0 {
+		err := ApodizeSourcePlane(sourcePlane, event.EdgeApodization)
+		if err != nil {
+			return exitWith(10, fmt.Errorf("apodization of the source plane failed: %w", err))
+		}
+		logInfo("Source plane margins apodized (Tukey taper over %0.1f%% of the width at each edge)\n",
+			100*event.EdgeApodization)
+	}
+
+	// With a chromatic star diameter, each wavelength bin is convolved with its own star PSF, so the
+	// bins are combined as intensities (an incoherent sum) into chromaticStar instead of as e-fields
+	var chromaticStar [][]float64
+	if event.StarDiamChromaticCoeff != 0.0 && len(event.QEtable) > 0 && event.StarDiamKm > 0.0 {
+		if event.PsfConvMode != "" && event.PsfConvMode != "same" {
+			logWarn("psf_conv_mode %q is ignored with star_diam_chromatic_coeff: each bin is convolved in same mode\n",
+				event.PsfConvMode)
+		}
+		chromaticStar = make([][]float64, Npts)
+		for row := range chromaticStar {
+			chromaticStar[row] = make([]float64, Npts)
+		}
+	}
+	addChromaticStarBin := func(field []complex128, wavelengthNm, weight float64) error {
+		if chromaticStar == nil {
+			return nil
+		}
+		scale, err := starDiamScale(event, wavelengthNm)
+		if err != nil {
+			return err
+		}
+		starDiamKm := event.StarDiamKm * scale
+		binIntensity, err := convolvedBinIntensity(field, Npts, babinetIncidentWave(event), starDiamKm, resolution, event.LimbDarkeningCoeff)
+		if err != nil {
+			return err
+		}
+		for row := range chromaticStar {
+			for col := range chromaticStar[row] {
+				chromaticStar[row][col] += weight * binIntensity[row][col]
+			}
+		}
+		logDebug("Star diameter %0.4f km for wavelength %0.1f nm\n", starDiamKm, wavelengthNm)
+		return nil
+	}
+
+	var eField []complex128
+	if len(event.QEtable) > 0 {
+		fieldAt := func(ws *SincWorkspace, wavelengthNm float64) ([]complex128, error) {
+			plane, err := planeAt(wavelengthNm)
+			if err != nil {
+				return nil, err
+			}
+			return FullObservationPlaneSincSolutionContext(ctx, ws, Lkm, Zkm, wavelengthNm*nmToKm, plane)
+		}
+		binDone := func(field []complex128, wavelengthNm, weight float64) error {
+			if event.SavePerWavelength {
+				filename := outputName(fmt.Sprintf("diffraction_%gnm.png", wavelengthNm))
+				if err := saveWavelengthIntensity(field, Npts, filename, babinetIncidentWave(event)); err != nil {
+					return err
+				}
+			}
+			return addChromaticStarBin(field, wavelengthNm, weight)
+		}
+		var err error
+		eField, err = accumulateQEFields(event.QEtable, fieldAt, binDone)
+		if err != nil {
+			return err
+		}
+	} else {
+		start := time.Now()
+		var err error
+		eField, err = FullObservationPlaneSincSolutionContext(ctx, nil, Lkm, Zkm, WavelengthKm, sourcePlane)
+		if err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+		logInfo("Calculation of the observation e-field took %s\n", elapsed)
+	}
+
+	start := time.Now()
+
+	// incidentWave is used to convert the aperture image to an occulter image using Babinet's formula.
+	incidentWave := babinetIncidentWave(event)
+
+	intensity := make([]float64, len(eField))
+	for i := 0; i < len(eField); i++ {
+		intensity[i] = real(incidentWave-eField[i])*real(incidentWave-eField[i]) +
+			imag(incidentWave-eField[i])*imag(incidentWave-eField[i])
+	}
+
+	var err error
+	event.IntensityMatrix, err = Reshape1DTo2D(intensity, Npts, Npts)
+	if err != nil {
+		return exitWith(10, fmt.Errorf("reshape of intensity vector failed: %w", err))
+	}
+	if chromaticStar != nil {
+		event.IntensityMatrix = chromaticStar // Already convolved with the star, bin by bin
+		logInfo("Each wavelength bin was convolved with its own star diameter (star_diam_chromatic_coeff %g)\n",
+			event.StarDiamChromaticCoeff)
+	}
+	if err := sumStarField(event); err != nil {
+		return err
+	}
+
+	// Optionally save the aperture intensity (no Babinet step) so that it can be compared with the
+	// complementary occulter image
+	if event.SaveApertureIntensity {
+		err = saveApertureIntensity(eField, Npts, outputName("apertureImage8bit.png"), outputName("apertureImage16bit.png"))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Optionally save the complex e-field (after the Babinet step, if any) as amplitude and phase images.
+	// The Cabillos phase term multiplies the incident wave and the diffracted field alike, so it is
+	// applied to the saved field only: the intensity above is the same with or without it.
+	if event.CabillosPhaseTerm && (!event.SaveEField || len(event.QEtable) > 0) {
+		logWarn("cabillos_phase_term_bool is ignored: it only applies to the saved e-field of a single wavelength " +
+			"(save_efield_bool without a QE table)\n")
+	}
+	if event.SaveEField {
+		phaseFactor := complex(1.0, 0.0)
+		if event.CabillosPhaseTerm && len(event.QEtable) == 0 {
+			phaseFactor = CabillosPhaseFactor(Zkm, WavelengthKm)
+			logInfo("E-field includes the Cabillos phase term exp(i k Z) = %0.6f\n", phaseFactor)
+		}
+		occulterField := make([]complex128, len(eField))
+		for i := 0; i < len(eField); i++ {
+			occulterField[i] = phaseFactor * (incidentWave - eField[i])
+		}
+		amplitudeFilename := outputName("eFieldAmplitude16bit.png")
+		phaseFilename := outputName("eFieldPhase16bit.png")
+		err = SaveEFieldImages(occulterField, Npts, amplitudeFilename, phaseFilename)
+		if err != nil {
+			return exitWith(12, fmt.Errorf("saving the e-field images failed: %w", err))
+		}
+		logInfo("E-field saved to %s (amplitude * 4000) and %s ((phase + pi) * 65535 / 2pi)\n",
+			amplitudeFilename, phaseFilename)
+	}
+
+	elapsed := time.Since(start)
+	logInfo("Calculation of the observation intensity took %s\n", elapsed)
+
+	if event.StarDiamKm <= 0.0 && event.PsfConvMode != "" && event.PsfConvMode != "same" {
+		logWarn("psf_conv_mode %q is ignored: there is no star diameter to convolve with\n", event.PsfConvMode)
+	}
+	if event.StarDiamKm > 0.0 && chromaticStar == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		logInfo("\nStar diameter projected at the plane of the asteroid is %0.3f km\n\n", event.StarDiamKm)
+		starImage, sumOfWeights := BuildStarPsf(event.StarDiamKm, resolution, event.LimbDarkeningCoeff)
+
+		start := time.Now()
+		mode, _ := parseConvMode(event.PsfConvMode) // Already validated
+		newImage, err := ConvolvePSFFFT(event.IntensityMatrix, starImage, sumOfWeights, mode, PadReplicate, false)
+		if err != nil {
+			return exitWith(13, fmt.Errorf("convolution of intensity matrix with star image failed: %w", err))
+		}
+		if mode != ConvSame {
+			newImage, err = savePsfExtent(event, newImage, starImage, mode, sumOfWeights, outputName)
+			if err != nil {
+				return err
+			}
+		}
+
+		event.IntensityMatrix = newImage
+
+		elapsed := time.Since(start)
+		logInfo("Convolution of intensity matrix with star image took %s\n", elapsed)
+	}
+
+	// Here we apply any necessary magDrop adjustments, after the star smoothing so that the baseline is
+	// the one plotted. A magnitude drop only means something for an occultation (there is no unocculted
+	// baseline behind an aperture).
+	if event.Mode == "aperture" {
+		if event.PercentMagDrop > 0 && event.PercentMagDrop < 100 {
+			logWarn("percent_mag_drop is ignored in aperture mode\n")
+		}
+	} else if event.PercentMagDrop > 0 { // Check for value given and bonus: ignore negative values
+		applied := ApplyMagDrop(event.IntensityMatrix, event.PercentMagDrop)
+		if applied != event.PercentMagDrop {
+			logWarn("%v\n", fmt.Errorf("percentMagDrop of %0.1f is too large. Setting it to %0.1f", event.PercentMagDrop, applied))
+			event.PercentMagDrop = applied
+		}
+	}
+	return nil
+}
+
+// savePsfExtent writes the full or valid result of the star convolution, which is not the size of
+// the fundamental plane, to its own pair of images. The path geometry is in fundamental plane
+// pixels, so the plane-sized (same mode) result is returned for everything that follows: for full
+// mode it is the central crop, for valid mode the convolution is repeated in same mode.
+func savePsfExtent(event *OccultationEvent, extent, starImage [][]float64, mode ConvMode, sumOfWeights float64,
+	outputName func(string) string) ([][]float64, error) {
+	displayFilename := outputName(fmt.Sprintf("diffractionImagePsf%s8bit.png", convModeNames[mode]))
+	targetFilename := outputName(fmt.Sprintf("targetImagePsf%s16bit.png", convModeNames[mode]))
+	err := saveMatrixImages(outputMatrix(event, extent), "star convolution", displayFilename, targetFilename)
+	if err != nil {
+		return nil, err
+	}
+	logInfo("The %dx%d %s star convolution is saved to %s and %s\n", len(extent[0]), len(extent),
+		event.PsfConvMode, displayFilename, targetFilename)
+
+	Ph, Pw := len(starImage), len(starImage[0])
+	if mode == ConvFull {
+		// The same mode result is the block of the full result offset by half the psf size
+		n := len(event.IntensityMatrix)
+		plane := make([][]float64, n)
+		for y := range plane {
+			plane[y] = append([]float64(nil), extent[y+Ph/2][Pw/2:Pw/2+len(event.IntensityMatrix[0])]...)
+		}
+		return plane, nil
+	}
+
+	logWarn("psf_conv_mode valid: the light curve and path images use the same mode result, because the valid\n"+
+		"\tresult is %d pixels smaller than the fundamental plane and does not fit the path geometry\n", Ph-1)
+	plane, err := ConvolvePSFFFT(event.IntensityMatrix, starImage, sumOfWeights, ConvSame, PadReplicate, false)
+	if err != nil {
+		return nil, exitWith(13, fmt.Errorf("convolution of intensity matrix with star image failed: %w", err))
+	}
+	return plane, nil
+}
+
+// saveSatelliteDifference repeats the diffraction calculation with the satellite removed and writes
+// the difference (with satellite minus main body only) as a stretched 8-bit image, so that only the
+// diffraction signature of the satellite remains. event.IntensityMatrix must already be computed.
+func saveSatelliteDifference(event *OccultationEvent, resolution float64, shadowFilename, differenceFilename string) error {
+	if !event.SatelliteGiven {
+		logError(fmt.Errorf("save_satellite_difference_bool is set but no satellite was given: no difference image made"))
+		return nil
+	}
+
+	logInfo("\nRepeating the diffraction calculation without the satellite ...\n")
+	mainOnly := mainBodyOnlyEvent(event)
+	sourcePlane, err := buildGeometricShadow(&mainOnly, shadowFilename)
+	if err != nil {
+		return err
+	}
+	err = computeIntensity(&mainOnly, sourcePlane, resolution, func(name string) string { return name })
+	if err != nil {
+		return err
+	}
+
+	diff, err := SubtractMatrices(event.IntensityMatrix, mainOnly.IntensityMatrix)
+	if err != nil {
+		return exitWith(11, fmt.Errorf("subtraction of the main body only intensity failed: %w", err))
+	}
+	maxAbs, rmse, _ := CompareMatrices(event.IntensityMatrix, mainOnly.IntensityMatrix)
+	logInfo("Satellite contribution: maximum absolute difference %0.4g  RMS difference %0.4g\n", maxAbs, rmse)
+
+	diffImage, err := MatrixToGrayViewPercentile(outputMatrix(event, diff), 0.0, 100)
+	if err != nil {
+		return exitWith(11, fmt.Errorf("creation of the satellite difference image failed: %w", err))
+	}
+	err = SaveGrayPNG(differenceFilename, diffImage)
+	if err != nil {
+		return exitWith(12, fmt.Errorf("writing of %q failed: %w", differenceFilename, err))
+	}
+	logInfo("Satellite difference image saved to %s\n\n", differenceFilename)
+	return nil
+}
+
+// mainBodyOnlyEvent returns a copy of event with the satellite (and the extra output files) removed,
+// ready for buildGeometricShadow. A ground shadow rotated to a 90 degree PA has already turned the
+// velocity of event, so the copy gets the given velocity back and is rotated by the same angle.
+func mainBodyOnlyEvent(event *OccultationEvent) OccultationEvent {
+	mainOnly := *event
+	mainOnly.SatelliteGiven = false
+	mainOnly.SaveEField = false
+	mainOnly.SavePerWavelength = false
+	mainOnly.SaveApertureIntensity = false
+	mainOnly.PsfConvMode = "" // The full/valid extent images belong to the run with the satellite
+	if event.RotateGroundShadowTo90pa {
+		mainOnly.DxKmPerSec, mainOnly.DyKmPerSec = event.UnrotatedVelocity[0], event.UnrotatedVelocity[1]
+	}
+	return mainOnly
+}
+
+// poissonSpotTolerance is the largest departure from 1 of the Poisson spot intensity that is
+// reported as agreeing with theory.
+const poissonSpotTolerance = 0.1
+
+// PoissonSpotIntensity returns event.IntensityMatrix at the center of the main body's shadow,
+// interpolated between the four nearest pixels. For an opaque circular disk lit by a point source,
+// Fresnel diffraction puts a bright (Arago or Poisson) spot there with exactly the unocculted
+// intensity, 1.
+func PoissonSpotIntensity(event *OccultationEvent) float64 {
+	n := event.FundamentalPlaneWidthPoints
+	pixelsPerKm := float64(n-1) / event.FundamentalPlaneWidthKm
+	col := float64(n-1)/2 + event.MainBodyXCenterKm*pixelsPerKm
+	row := float64(n-1)/2 - event.MainBodyYCenterKm*pixelsPerKm
+	return BilinearSample(event.IntensityMatrix, row, col)
+}
+
+// reportPoissonSpot logs the intensity at the center of the shadow of a circular, opaque main body
+// and how far it is from the theoretical 1, as a one-number check of the resolution and of the
+// diffraction calculation. Nothing is reported unless the event is one the theory covers: a lone
+// circular disk inside the plane, one wavelength, a point source and no other changes to the
+// intensity. Call it after computeIntensity (and before any exposure smear).
+func reportPoissonSpot(event *OccultationEvent) {
+	if !event.MainBodyGiven || event.MainbodyMajorAxisKm <= 0.0 ||
+		math.Abs(event.MainbodyMinorAxisKm-event.MainbodyMajorAxisKm) > 1e-9*event.MainbodyMajorAxisKm {
+		return
+	}
+	var reason string
+	switch {
+	case event.SatelliteGiven || event.AtmosphereScaleHeightKm > 0.0 || event.GradedSourcePlane ||
+		event.PathToExternalImage != "" || event.PathToSourcePlaneNPY != "" ||
+		event.PathToComplexSourcePlaneNPY != "" || event.ReuseGeometricShadowPNG != "":
+		reason = "the occulter is not a lone opaque disk"
+	case event.Mode == "aperture" || babinetIncidentWave(event) != complex(1.0, 0.0):
+		reason = "the incident wave is not the unit plane wave"
+	case len(event.QEtable) > 0 || event.StarDiamKm > 0.0 || len(event.StarField) > 0 || event.PercentMagDrop > 0.0:
+		reason = "the source is not a single point at one wavelength"
+	case event.RotateGroundShadowTo90pa || event.SourcePlaneRotationDegrees != 0.0:
+		reason = "the source plane is rotated"
+	case math.Max(math.Abs(event.MainBodyXCenterKm), math.Abs(event.MainBodyYCenterKm))+event.MainbodyMajorAxisKm/2 >=
+		event.FundamentalPlaneWidthKm/2:
+		reason = "the disk is not inside the plane"
+	}
+	if reason != "" {
+		logDebug("The Poisson spot is not checked: %s\n", reason)
+		return
+	}
+	spot := PoissonSpotIntensity(event)
+	logInfo("Poisson spot intensity at the shadow center is %0.4f (theory 1 for a point source): deviation %+0.4f\n",
+		spot, spot-1.0)
+	if math.Abs(spot-1.0) > poissonSpotTolerance {
+		logWarn("The Poisson spot is off by more than %g: the plane may be too coarse "+
+			"(see samples per Fresnel scale) or too small\n", poissonSpotTolerance)
+	}
+}
+
+// reportAsymmetry logs how far the intensity is from point symmetry about the center of the main
+// body's shadow (the plane center if there is no main body), with the same measure for the
+// geometric shadow alongside: see Asymmetry. A lone ellipse has point symmetry, so a diffraction
+// asymmetry well above that of the geometric shadow (which only reflects the pixel grid) points
+// to a problem in the calculation. Call it after computeIntensity.
+func reportAsymmetry(event *OccultationEvent) {
+	if !event.ReportAsymmetry {
+		return
+	}
+	n := event.FundamentalPlaneWidthPoints
+	pixelsPerKm := float64(n-1) / event.FundamentalPlaneWidthKm
+	row, col := float64(n-1)/2, float64(n-1)/2
+	if event.MainBodyGiven {
+		col += event.MainBodyXCenterKm * pixelsPerKm
+		row -= event.MainBodyYCenterKm * pixelsPerKm
+	}
+	intensity, err := Asymmetry(event.IntensityMatrix, row, col)
+	if err != nil {
+		logWarn("The asymmetry could not be measured: %v\n", err)
+		return
+	}
+	logInfo("Asymmetry (RMS of the image minus its 180 degree rotation about the shadow center): intensity %0.5f",
+		intensity)
+	if geometric, err := Asymmetry(event.GeometricMatrix, row, col); err == nil {
+		logInfo(", geometric shadow %0.5f", geometric)
+	}
+	logInfo("\n")
+}
+
+// babinetIncidentWave returns the incident wave from which the aperture e-field is subtracted to get
+// the occulter e-field (Babinet's principle): by default the unit plane wave 1 + 0i, otherwise the
+// amplitude and phase given by incident_wave_amplitude and incident_wave_phase_degrees. In aperture
+// mode the light passing through the shapes is wanted, so there is no Babinet step and it is 0.
+func babinetIncidentWave(event *OccultationEvent) complex128 {
+	if event.Mode == "aperture" {
+		return complex(0.0, 0.0)
+	}
+	amplitude := event.IncidentWaveAmplitude
+	if amplitude == 0.0 {
+		amplitude = 1.0
+	}
+	return cmplx.Rect(amplitude, event.IncidentWavePhaseDegrees*math.Pi/180.0)
+}
+
+// starDiamScale returns the factor 1 + star_diam_chromatic_coeff * (wavelength - observation_wavelength_nm) /
+// observation_wavelength_nm by which the projected star diameter is scaled in the given wavelength bin.
+func starDiamScale(event *OccultationEvent, wavelengthNm float64) (float64, error) {
+	scale := 1.0 + event.StarDiamChromaticCoeff*(wavelengthNm-event.ObservationWavelengthNm)/event.ObservationWavelengthNm
+	if scale <= 0.0 {
+		return 0.0, exitWith(10, fmt.Errorf("\n\tstar_diam_chromatic_coeff %g gives a star diameter scale of %g at %0.1f nm: "+
+			"it must stay positive over the QE table\n", event.StarDiamChromaticCoeff, scale, wavelengthNm))
+	}
+	return scale, nil
+}
+
+// convolvedBinIntensity returns the occulter intensity (Babinet, with incidentWave) of the e-field of
+// one wavelength bin, convolved with the PSF of a star of diameter starDiamKm.
+func convolvedBinIntensity(eField []complex128, npts int, incidentWave complex128, starDiamKm, resolution,
+	limbDarkeningCoeff float64) ([][]float64, error) {
+	intensity := make([]float64, len(eField))
+	for i := range eField {
+		v := incidentWave - eField[i]
+		intensity[i] = real(v)*real(v) + imag(v)*imag(v)
+	}
+	matrix, err := Reshape1DTo2D(intensity, npts, npts)
+	if err != nil {
+		return nil, exitWith(10, fmt.Errorf("reshape of intensity vector failed: %w", err))
+	}
+	starImage, sumOfWeights := BuildStarPsf(starDiamKm, resolution, limbDarkeningCoeff)
+	convolved, err := ConvolvePSFFFT(matrix, starImage, sumOfWeights, ConvSame, PadReplicate, false)
+	if err != nil {
+		return nil, exitWith(13, fmt.Errorf("convolution of a wavelength bin with the star image failed: %w", err))
+	}
+	return convolved, nil
+}
+
+// sumStarField replaces event.IntensityMatrix with the brightness-weighted sum of the target star's
+// pattern and one shifted copy for each star_field source, normalized so that the unocculted level
+// is unchanged. A point source offset in the sky gives the same diffraction pattern moved by its
+// offset in the plane, so the patterns are shifted rather than computed again. Light from beyond
+// the plane edge is not known and is taken to be the edge value.
+func sumStarField(event *OccultationEvent) error {
+	if len(event.StarField) == 0 {
+		return nil
+	}
+	pixelsPerKm := float64(event.FundamentalPlaneWidthPoints-1) / event.FundamentalPlaneWidthKm
+	target := event.IntensityMatrix
+	sum := target
+	totalBrightness := 1.0
+	for _, source := range event.StarField {
+		// Plane y is up, image rows go down
+		shifted, err := ShiftMatrix(target, -source.YOffsetKm*pixelsPerKm, source.XOffsetKm*pixelsPerKm)
+		if err == nil {
+			sum, err = AddMatrices(sum, shifted, source.Brightness)
+		}
+		if err != nil {
+			return exitWith(10, fmt.Errorf("adding the star_field source at (%g, %g) km failed: %w",
+				source.XOffsetKm, source.YOffsetKm, err))
+		}
+		if math.Abs(source.XOffsetKm) >= event.FundamentalPlaneWidthKm/2 ||
+			math.Abs(source.YOffsetKm) >= event.FundamentalPlaneWidthKm/2 {
+			logWarn("star_field source at (%g, %g) km is shifted by half the plane or more: "+
+				"its shadow is mostly outside the plane\n", source.XOffsetKm, source.YOffsetKm)
+		}
+		totalBrightness += source.Brightness
+	}
+	for row := range sum {
+		for col := range sum[row] {
+			sum[row][col] /= totalBrightness
+		}
+	}
+	event.IntensityMatrix = sum
+	logInfo("Star field: %d other sources added (total brightness %g times the target star)\n",
+		len(event.StarField), totalBrightness)
+	return nil
+}
+
+// saveWavelengthIntensity writes the occulter intensity (Babinet, with incidentWave) of a single
+// wavelength e-field as a 16-bit image with the same scaling as targetImage16bit.png.
+func saveWavelengthIntensity(eField []complex128, npts int, filename string, incidentWave complex128) error {
+	intensity := make([]float64, len(eField))
+	for i := 0; i < len(eField); i++ {
+		intensity[i] = real(incidentWave-eField[i])*real(incidentWave-eField[i]) +
+			imag(incidentWave-eField[i])*imag(incidentWave-eField[i])
+	}
+	matrix, err := Reshape1DTo2D(intensity, npts, npts)
+	if err != nil {
+		return exitWith(10, fmt.Errorf("reshape of intensity vector failed: %w", err))
+	}
+	img, err := MatrixToGray16Data(matrix, 4000)
+	if err != nil {
+		return exitWith(13, fmt.Errorf("creation of %q failed: %w", filename, err))
+	}
+	err = SaveGray16PNG(filename, img)
+	if err != nil {
+		return exitWith(14, fmt.Errorf("writing of %q failed: %w", filename, err))
+	}
+	logDebug("Single wavelength intensity saved to %s\n", filename)
+	return nil
+}
+
+// saveApertureIntensity writes |eField|^2, the intensity behind an aperture shaped like the occulter,
+// as a stretched 8-bit image and as a 16-bit image with the same scaling as targetImage16bit.png.
+// By Babinet's principle it is the complement of the occulter pattern.
+func saveApertureIntensity(eField []complex128, npts int, displayFilename, targetFilename string) error {
+	intensity := make([]float64, len(eField))
+	for i := 0; i < len(eField); i++ {
+		intensity[i] = real(eField[i])*real(eField[i]) + imag(eField[i])*imag(eField[i])
+	}
+	matrix, err := Reshape1DTo2D(intensity, npts, npts)
+	if err != nil {
+		return exitWith(10, fmt.Errorf("reshape of aperture intensity vector failed: %w", err))
+	}
+
+	if err := saveMatrixImages(matrix, "aperture", displayFilename, targetFilename); err != nil {
+		return err
+	}
+	logInfo("Aperture intensity saved to %s and %s\n", displayFilename, targetFilename)
+	return nil
+}
+
+// saveMatrixImages writes matrix as a stretched 8-bit image and as a 16-bit image with the same
+// scaling as targetImage16bit.png. what names the matrix in error messages.
+func saveMatrixImages(matrix [][]float64, what, displayFilename, targetFilename string) error {
+	imgForDisplay, err := MatrixToGrayViewPercentile(matrix, 0.0, 100)
+	if err != nil {
+		return exitWith(11, fmt.Errorf("creation of the %s display image failed: %w", what, err))
+	}
+	err = SaveGrayPNG(displayFilename, imgForDisplay)
+	if err != nil {
+		return exitWith(12, fmt.Errorf("writing of %q failed: %w", displayFilename, err))
+	}
+
+	img, err := MatrixToGray16Data(matrix, 4000)
+	if err != nil {
+		return exitWith(13, fmt.Errorf("creation of %q failed: %w", targetFilename, err))
+	}
+	err = SaveGray16PNG(targetFilename, img)
+	if err != nil {
+		return exitWith(14, fmt.Errorf("writing of %q failed: %w", targetFilename, err))
+	}
+	return nil
+}
+
+// applyExposureSmear models a finite camera exposure by smearing event.IntensityMatrix along the
+// shadow motion direction. It depends on the path, so it is applied after computeIntensity.
+func applyExposureSmear(event *OccultationEvent, resolution float64) error {
+	if event.CameraExposureSecs > 0.0 && event.ShadowSpeedKmPerSec > 0.0 {
+		var err error
+		start := time.Now()
+		event.IntensityMatrix, err = ApplyExposureSmear(event.IntensityMatrix, event.CameraExposureSecs,
+			event.ShadowSpeedKmPerSec, resolution, event.PathAngleDegrees)
+		if err != nil {
+			return exitWith(13, fmt.Errorf("exposure smear of intensity matrix failed: %w", err))
+		}
+		elapsed := time.Since(start)
+		logInfo("Exposure smear of %0.3f seconds (%0.1f pixels) took %s\n", event.CameraExposureSecs,
+			event.CameraExposureSecs*event.ShadowSpeedKmPerSec/resolution, elapsed)
+	}
+	return nil
+}
+
+// saveIntensityImages writes the user-friendly 8-bit display image and the scientific 16-bit
+// image of event.IntensityMatrix (flipped as requested), and returns the display image. With a
+// display bit depth of 16, the display image is also written at 16 bits, to displayFilename with
+// "8bit" replaced by "16bit". With event.SaveIntensityMatrixGz, the scientific matrix is also written
+// losslessly to targetFilename with "16bit.png" replaced by ".f64.gz" (see lightcurve.SaveMatrixGz).
+func saveIntensityImages(event *OccultationEvent, displayFilename, targetFilename string) (*image.Gray, error) {
+	intensity := outputMatrix(event, event.IntensityMatrix)
+
+	// Make a user-friendly .png of the observation intensity matrix. A display offset (dark/bias
+	// level) only changes this image, not the scientific one.
+	displayMatrix := intensity
+	if event.DisplayOffset > 0.0 {
+		displayMatrix = SubtractOffsetClamped(intensity, event.DisplayOffset)
+	}
+	imgForDisplay, err := MatrixToGrayViewPercentile(displayMatrix, 0.0, 100)
+	if err != nil {
+		return nil, exitWith(11, fmt.Errorf("creation of the display image failed: %w", err))
+	}
+
+	err = SaveGrayPNG(displayFilename, imgForDisplay)
+	if err != nil {
+		return nil, exitWith(12, fmt.Errorf("writing of %q failed: %w", displayFilename, err))
+	}
+
+	// Optionally also write the display image with the same stretch at 16 bits
+	if event.DisplayBitDepth == 16 {
+		displayFilename16 := strings.Replace(displayFilename, "8bit", "16bit", 1)
+		img16, err := MatrixToGray16ViewPercentile(displayMatrix, 0.0, 100)
+		if err != nil {
+			return nil, exitWith(11, fmt.Errorf("creation of the 16 bit display image failed: %w", err))
+		}
+		err = SaveGray16PNG(displayFilename16, img16)
+		if err != nil {
+			return nil, exitWith(12, fmt.Errorf("writing of %q failed: %w", displayFilename16, err))
+		}
+		logInfo("16 bit display image saved to %s\n", displayFilename16)
+	}
+
+	// Make the scientific (well-defined scaling) version of the intensity matrix
+	occultImage, clamped, err := MatrixToGray16DataClamped(intensity, 4000, event.TargetImageFloor)
+	if err != nil {
+		return nil, exitWith(13, fmt.Errorf("creation of occultImage failed: %w", err))
+	}
+	if clamped.Total() > 0 {
+		logWarn("%s: %d pixels were clamped (%d below the floor of %g, %d above %g, %d NaN or Inf)\n",
+			targetFilename, clamped.Total(), clamped.Low, event.TargetImageFloor, clamped.High, 65535/4000.0, clamped.Invalid)
+	}
+
+	err = SaveGray16PNG(targetFilename, occultImage)
+	if err != nil {
+		return nil, exitWith(14, fmt.Errorf("writing of %q failed: %w", targetFilename, err))
+	}
+
+	if event.SaveIntensityMatrixGz {
+		gzFilename := strings.TrimSuffix(strings.Replace(targetFilename, "16bit", "", 1), ".png") + ".f64.gz"
+		kmPerPixel := event.FundamentalPlaneWidthKm / float64(event.FundamentalPlaneWidthPoints)
+		err = lightcurve.SaveMatrixGzWithScale(gzFilename, intensity, kmPerPixel)
+		if err != nil {
+			return nil, exitWith(14, fmt.Errorf("writing of %q failed: %w", gzFilename, err))
+		}
+		logInfo("Intensity matrix saved losslessly to %s\n", gzFilename)
+	}
+	return imgForDisplay, nil
+}
+
+// savePowerSpectrum writes the (DC centered) log-magnitude spectrum of event.IntensityMatrix as a
+// stretched 8-bit image. It is useful for seeing whether the fundamental plane is undersampled.
+func savePowerSpectrum(event *OccultationEvent, filename string) error {
+	start := time.Now()
+	spectrum, err := PowerSpectrum(event.IntensityMatrix)
+	if err != nil {
+		return exitWith(11, fmt.Errorf("calculation of the power spectrum failed: %w", err))
+	}
+	spectrumImage, err := MatrixToGrayViewPercentile(spectrum, 0.0, 100)
+	if err != nil {
+		return exitWith(11, fmt.Errorf("creation of the power spectrum image failed: %w", err))
+	}
+	err = SaveGrayPNG(filename, spectrumImage)
+	if err != nil {
+		return exitWith(12, fmt.Errorf("writing of %q failed: %w", filename, err))
+	}
+	logInfo("Power spectrum (log10(1 + |FFT|), DC at center) saved to %s in %s\n", filename, time.Since(start))
+	return nil
+}
+
+// savePathImage saves a diffraction image with an observation path overlay. imgForDisplay is the
+// (already flipped) image returned by saveIntensityImages, so the path is flipped to match.
+func savePathImage(event *OccultationEvent, imgForDisplay *image.Gray, p1, p2 AnnotatedPoint, filename string) {
+	if event.PathDefined && imgForDisplay != nil {
+		x1, y1 := outputPoint(event, p1.X, p1.Y)
+		x2, y2 := outputPoint(event, p2.X, p2.Y)
+		startX, startY := outputPoint(event, event.PathStart[0], event.PathStart[1])
+		endX, endY := outputPoint(event, event.PathEnd[0], event.PathEnd[1])
+		annotated := DrawPathOnImage(imgForDisplay, x1, y1, x2, y2, startX, startY, endX, endY, pathStyle(event))
+		if event.KmGridSpacingKm > 0.0 {
+			kmPerPixel := event.FundamentalPlaneWidthKm / float64(event.FundamentalPlaneWidthPoints)
+			lightcurve.DrawKmGridMirrored(annotated, kmPerPixel, event.KmGridSpacingKm,
+				event.FlipHorizontal, event.FlipVertical)
+		}
+		err := SaveImagePNG(filename, annotated)
+		if err != nil {
+			logError(fmt.Errorf("writing of %q failed: %w", filename, err))
+		} else {
+			logInfo("Diffraction image with observation path saved to %s\n", filename)
+		}
+	}
+}
+
+// saveLightCurvePlot saves the light curve plot (used when plots are not displayed).
+func saveLightCurvePlot(event *OccultationEvent, filename string) error {
+	if event.PathDefined {
+		edges := FindEdgesInGeometricShadow(*event)
+		plotImg, err := makePlotImage(event.PathDirection, 1200, 500, *event, edges)
+		if errors.Is(err, lightcurve.ErrPathTooShort) {
+			logWarn("\n\tWARNING: no light curve plot was made: the %v\n", err)
+			return nil
+		}
+		if err != nil {
+			return exitWith(15, fmt.Errorf("creating light curve plot failed: %w", err))
+		}
+		f, err := os.Create(filename)
+		if err != nil {
+			return exitWith(16, fmt.Errorf("creating %s failed: %w", filename, err))
+		}
+		if err := png.Encode(f, plotImg); err != nil {
+			if cerr := f.Close(); cerr != nil {
+				logError(fmt.Errorf("closing %s failed: %w", filename, cerr))
+			}
+			return exitWith(17, fmt.Errorf("writing %s failed: %w", filename, err))
+		}
+		if err := f.Close(); err != nil {
+			return exitWith(18, fmt.Errorf("closing %s failed: %w", filename, err))
+		}
+		logInfo("Light curve plot saved to %s\n", filename)
+	}
+	return nil
+}
+
+// SimulationOptions are the settings of a run that do not come from the parameter file.
+type SimulationOptions struct {
+	Autosize           bool // Use the fundamental plane suggested by autosizePlane (the -autosize flag)
+	SaveLightCurvePlot bool // Write lightCurvePlot.png (the command line displays the plot instead, if asked to)
+}
+
+// RunSimulationContext runs the whole simulation of event, writing the output files to the working
+// directory, and returns the completed event. It is the run of the command line, which only adds
+// the display. ctx is checked between the major stages (geometric shadow, each matrix
+// multiplication, each QE wavelength bin, star convolution, output images) and ctx.Err() is returned
+// as soon as a check finds it canceled. A stage that has started (in particular a matrix
+// multiplication) runs to its end. Any other error stops the run and is returned as well; the
+// command line ends with its exit code (see exitOnError).
+func RunSimulationContext(ctx context.Context, event OccultationEvent, opts SimulationOptions) (OccultationEvent, error) {
+	_, err := runSimulation(ctx, &event, opts, func(name string) string { return name }, nil)
+	return event, err
+}
+
+// diffractionRun is what computeDiffraction leaves for the rest of a run, and for the next event of
+// a batch or sweep, which reuses the calculation if its diffraction inputs are the same.
+type diffractionRun struct {
+	inputs     OccultationEvent // diffractionInputs of the event
+	computed   OccultationEvent // The event as computeDiffraction left it (before any exposure smear)
+	resolution float64          // km/pixel in the fundamental plane
+	p1, p2     AnnotatedPoint   // Where the extended path crosses the plane edges (see computePathGeometry)
+}
+
+// runSimulation runs computeDiffraction on event and then applies the exposure smear and writes the
+// intensity images, the power spectrum, the path image and (with opts.SaveLightCurvePlot) the light
+// curve plot. outputName maps the name of each output file to the name actually written. The
+// diffractionRun is returned for the next event of a batch.
+func runSimulation(ctx context.Context, event *OccultationEvent, opts SimulationOptions, outputName func(string) string,
+	previous *diffractionRun) (*diffractionRun, error) {
+	run, err := computeDiffraction(ctx, event, opts.Autosize, outputName, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	// Model a finite camera exposure by smearing the intensity along the shadow motion direction
+	if err := applyExposureSmear(event, run.resolution); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	imgForDisplay, err := saveIntensityImages(event, outputName("diffractionImage8bit.png"), outputName("targetImage16bit.png"))
+	if err != nil {
+		return nil, err
+	}
+	if event.SavePowerSpectrum {
+		if err := savePowerSpectrum(event, outputName("powerSpectrum8bit.png")); err != nil {
+			return nil, err
+		}
+	}
+
+	// Save a diffraction image with an observation path overlay
+	savePathImage(event, imgForDisplay, run.p1, run.p2, outputName("diffractionImageWithPath.png"))
+	if opts.SaveLightCurvePlot {
+		if err := saveLightCurvePlot(event, outputName("lightCurvePlot.png")); err != nil {
+			return nil, err
+		}
+	}
+	return run, nil
+}
+
+// computeDiffraction runs the stages of event up to its intensity before any exposure smear: the
+// plane size (autosize is passed on to autosizePlane), the geometric shadow, the path geometry, the
+// diffraction calculation with the reports on it and, if asked for, the satellite difference. If
+// previous (nil for the first event) has the same diffractionInputs, its calculation is reused and
+// only the path is computed again. outputName maps the name of each output file to the name written.
+func computeDiffraction(ctx context.Context, event *OccultationEvent, autosize bool, outputName func(string) string,
+	previous *diffractionRun) (*diffractionRun, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Sanity check on number of points in a fundamental plane
+	if event.FundamentalPlaneWidthPoints < 10 {
+		return nil, exitWith(16, fmt.Errorf("\n\tThe fundamental plane width must be at least 10 points."))
+	}
+
+	autosizePlane(event, autosize)
+	if err := enforceMinSamplesPerFresnel(event, autosize); err != nil {
+		return nil, err
+	}
+	run := &diffractionRun{inputs: diffractionInputs(*event)}
+
+	if previous != nil && reflect.DeepEqual(run.inputs, previous.inputs) {
+		logInfo("Same geometry as the previous event: reusing its diffraction calculation\n")
+		event.FplaneImage = previous.computed.FplaneImage
+		event.GeometricMatrix = previous.computed.GeometricMatrix
+		event.FundamentalPlaneWidthPoints = previous.computed.FundamentalPlaneWidthPoints
+		event.GradedSourcePlane = previous.computed.GradedSourcePlane
+		event.QEtable = previous.computed.QEtable
+		event.LimbDarkeningCoeff = previous.computed.LimbDarkeningCoeff
+		event.DistanceAu = previous.computed.DistanceAu
+		event.DistanceSource = previous.computed.DistanceSource
+		event.StarDiamKm = previous.computed.StarDiamKm
+		event.IntensityMatrix = previous.computed.IntensityMatrix
+		run.resolution = previous.resolution
+
+		if event.SaveGeometricShadow {
+			shadowFilename := outputName("geometricShadow.png")
+			if err := SaveGrayPNG(shadowFilename, outputGrayImage(event, event.FplaneImage)); err != nil {
+				return nil, exitWith(9, fmt.Errorf("\n\tFailed to write %q.", shadowFilename))
+			}
+		}
+		// The reused plane is already rotated: only the shadow motion still has to be turned
+		if event.RotateGroundShadowTo90pa {
+			velocityTo90pa(event)
+		}
+		var err error
+		run.p1, run.p2, err = computePathGeometry(event)
+		if err != nil {
+			return nil, err
+		}
+		reportCentralFlash(*event)
+		reportPoissonSpot(event)
+		reportAsymmetry(event)
+		run.computed = *event
+		return run, nil
+	}
+
+	// If a path to a camera response json file was given, read it
+	if err := loadQEtable(event); err != nil {
+		return nil, err
+	}
+	printResolution(event)
+
+	start := time.Now() // Time generation of geometric shadow
+	sourcePlane, err := buildGeometricShadow(event, outputName("geometricShadow.png"))
+	if err != nil {
+		return nil, err
+	}
+	if err := enforceMinSamplesPerFresnel(event, false); err != nil {
+		return nil, err
+	}
+	// An external image may have overridden the number of points
+	run.resolution = event.FundamentalPlaneWidthKm / float64(event.FundamentalPlaneWidthPoints)
+	logInfo("Generation of the geometric shadow took %s\n", time.Since(start))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	setLimbDarkeningCoeff(event)
+	if err := checkEventDistances(event); err != nil {
+		return nil, err
+	}
+	run.p1, run.p2, err = computePathGeometry(event)
+	if err != nil {
+		return nil, err
+	}
+	event.StarDiamKm = 1.496e8 * event.DistanceAu * event.StarDiamMas / (1000.0 * 206265)
+	reportCentralFlash(*event)
+
+	if err := computeIntensityContext(ctx, event, sourcePlane, run.resolution, outputName); err != nil {
+		return nil, err
+	}
+	reportPoissonSpot(event)
+	reportAsymmetry(event)
+
+	// Optionally show only the satellite's contribution to the diffraction image
+	if event.SaveSatelliteDifference {
+		err := saveSatelliteDifference(event, run.resolution, outputName("geometricShadowNoSatellite.png"),
+			outputName("satelliteDifference8bit.png"))
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	run.computed = *event
+	return run, nil
+}
+
+// pathStyle returns the style in which the observation path of event is drawn.
+func pathStyle(event *OccultationEvent) lightcurve.PathStyle {
+	if event.PathMarkers == "colorblind" {
+		return lightcurve.ColorblindPathStyle()
+	}
+	return lightcurve.DefaultPathStyle()
+}
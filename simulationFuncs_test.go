@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"math"
+	"math/cmplx"
+	"os"
+	"testing"
+)
+
+func TestNormalizeQEtable(t *testing.T) {
+	table := [][2]float64{{400, 0.2}, {450, 0.5}, {500, 0.9}, {550, 0.4}}
+	normalizeQEtable(table)
+	sum := 0.0
+	for _, entry := range table {
+		sum += entry[1]
+	}
+	if math.Abs(sum-1.0) > 1e-12 {
+		t.Errorf("normalized weights sum to %g, want 1", sum)
+	}
+	if math.Abs(table[2][1]-0.9/2.0) > 1e-12 {
+		t.Errorf("normalized weight at 500 nm is %g, want %g", table[2][1], 0.9/2.0)
+	}
+}
+
+func TestEffectiveWavelengthOfSymmetricTable(t *testing.T) {
+	table := [][2]float64{{400, 0.1}, {450, 0.6}, {500, 1.0}, {550, 0.6}, {600, 0.1}}
+	normalizeQEtable(table)
+	if got := effectiveWavelengthNm(table); math.Abs(got-500.0) > 1e-9 {
+		t.Errorf("effective wavelength is %g nm, want 500 nm", got)
+	}
+}
+
+// TestQEAccumulation checks the weighted sum of wavelength e-fields done in computeIntensity: a
+// single-entry table must give the monochromatic field, and two bins the weighted sum of theirs.
+func TestQEAccumulation(t *testing.T) {
+	const n = 32
+	const lKm = 4.0
+	zKm := 2.33 * 1.495979e8
+	nmToKm := 1e-9 * 1e-3
+
+	plane := make([][]complex128, n)
+	for row := range plane {
+		plane[row] = make([]complex128, n)
+		for col := range plane[row] {
+			if (row-15)*(row-15)+(col-17)*(col-17) < 36 {
+				plane[row][col] = complex(1.0, 0.0)
+			}
+		}
+	}
+
+	fieldAt := func(ws *SincWorkspace, wavelengthNm float64) ([]complex128, error) {
+		return FullObservationPlaneSincSolutionContext(context.Background(), ws, lKm, zKm, wavelengthNm*nmToKm, plane)
+	}
+
+	single := [][2]float64{{550, 0.37}}
+	normalizeQEtable(single)
+	mono := FullObservationPlaneSincSolution(lKm, zKm, 550*nmToKm, plane)
+	eField, err := accumulateQEFields(single, fieldAt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range mono {
+		if cmplx.Abs(eField[i]-mono[i]) > 1e-12 {
+			t.Fatalf("single-entry table, element %d: got %v, want the monochromatic %v", i, eField[i], mono[i])
+		}
+	}
+
+	// Three bins, so that the later ones share a workspace; each bin is seen unweighted
+	bins := [][2]float64{{450, 1.0}, {550, 2.0}, {650, 1.0}}
+	normalizeQEtable(bins)
+	var seen []float64
+	eField, err = accumulateQEFields(bins, fieldAt, func(field []complex128, wavelengthNm, weight float64) error {
+		seen = append(seen, wavelengthNm)
+		want := FullObservationPlaneSincSolution(lKm, zKm, wavelengthNm*nmToKm, plane)
+		if cmplx.Abs(field[40]-want[40]) > 1e-12 {
+			t.Errorf("%g nm: the bin field is %v, want the unweighted %v", wavelengthNm, field[40], want[40])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 3 {
+		t.Errorf("binDone saw %v, want the three bins", seen)
+	}
+	blue := FullObservationPlaneSincSolution(lKm, zKm, 450*nmToKm, plane)
+	green := FullObservationPlaneSincSolution(lKm, zKm, 550*nmToKm, plane)
+	red := FullObservationPlaneSincSolution(lKm, zKm, 650*nmToKm, plane)
+	for i := range eField {
+		want := 0.25*blue[i] + 0.5*green[i] + 0.25*red[i]
+		if cmplx.Abs(eField[i]-want) > 1e-12 {
+			t.Fatalf("three-entry table, element %d: got %v, want %v", i, eField[i], want)
+		}
+	}
+
+	wantErr := errors.New("bin failed")
+	_, err = accumulateQEFields(bins, func(ws *SincWorkspace, wavelengthNm float64) ([]complex128, error) {
+		if wavelengthNm == 550 {
+			return nil, wantErr
+		}
+		return fieldAt(ws, wavelengthNm)
+	}, nil)
+	if !errors.Is(err, wantErr) {
+		t.Errorf("error = %v, want %v", err, wantErr)
+	}
+	_, err = accumulateQEFields(bins, fieldAt, func(field []complex128, wavelengthNm, weight float64) error {
+		return wantErr
+	})
+	if !errors.Is(err, wantErr) {
+		t.Errorf("binDone error = %v, want %v", err, wantErr)
+	}
+}
+
+func TestRunSimulationContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	plane := [][]complex128{{0, 1}, {1, 0}}
+	if _, err := FullObservationPlaneSincSolutionContext(ctx, nil, 4.0, 3.5e8, 500e-12, plane); !errors.Is(err, context.Canceled) {
+		t.Errorf("FullObservationPlaneSincSolutionContext with a canceled context returned %v, want context.Canceled", err)
+	}
+
+	// Nothing may be written when the context is already canceled
+	t.Chdir(t.TempDir())
+	event := OccultationEvent{FundamentalPlaneWidthKm: 4.0, FundamentalPlaneWidthPoints: 64, DistanceAu: 2.33}
+	if _, err := RunSimulationContext(ctx, event, SimulationOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("RunSimulationContext with a canceled context returned %v, want context.Canceled", err)
+	}
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("a canceled run wrote %d files, want none", len(entries))
+	}
+}
+
+func TestRunSimulationContextReturnsStageErrors(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	// A body larger than the plane lets no light through: the run stops with the exit code 25 of the
+	// command line instead of ending the program
+	event := OccultationEvent{FundamentalPlaneWidthKm: 4.0, FundamentalPlaneWidthPoints: 64, DistanceAu: 2.33,
+		ObservationWavelengthNm: 500, MainBodyGiven: true, MainbodyMajorAxisKm: 20, MainbodyMinorAxisKm: 20}
+	_, err := RunSimulationContext(context.Background(), event, SimulationOptions{})
+	var exit *exitError
+	if !errors.As(err, &exit) || exit.code != 25 {
+		t.Errorf("RunSimulationContext of a covered plane returned %v, want an error with exit code 25", err)
+	}
+
+	event.FundamentalPlaneWidthPoints = 8
+	_, err = RunSimulationContext(context.Background(), event, SimulationOptions{})
+	if !errors.As(err, &exit) || exit.code != 16 {
+		t.Errorf("RunSimulationContext of an 8 point plane returned %v, want an error with exit code 16", err)
+	}
+}
+
+func TestEnforceMinSamplesPerFresnelAutosize(t *testing.T) {
+	event := OccultationEvent{FundamentalPlaneWidthKm: 40, FundamentalPlaneWidthPoints: 300,
+		ObservationWavelengthNm: 500, DistanceAu: 2.33, MinSamplesPerFresnel: 5}
+	if err := enforceMinSamplesPerFresnel(&event, true); err != nil {
+		t.Fatal(err)
+	}
+	fresnelScale := FresnelScale(event.ObservationWavelengthNm, event.DistanceAu)
+	samples := fresnelScale / (event.FundamentalPlaneWidthKm / float64(event.FundamentalPlaneWidthPoints))
+	if samples < 5 || samples > 5.05 {
+		t.Errorf("after autosize there are %0.3f samples per Fresnel scale (%d points), want just over 5",
+			samples, event.FundamentalPlaneWidthPoints)
+	}
+	if event.FundamentalPlaneWidthKm != 40 {
+		t.Errorf("the plane width was changed to %g km", event.FundamentalPlaneWidthKm)
+	}
+}
+
+func TestDerivedQuantities(t *testing.T) {
+	event := OccultationEvent{FundamentalPlaneWidthKm: 40, FundamentalPlaneWidthPoints: 400,
+		ObservationWavelengthNm: 500, DistanceAu: 2.33}
+	got := event.DerivedQuantities()
+	fresnelScale := FresnelScale(500, 2.33)
+	if got.KmPerPixel != 0.1 || got.FresnelScaleKm != fresnelScale ||
+		math.Abs(got.SamplesPerFresnelScale-fresnelScale/0.1) > 1e-9 {
+		t.Errorf("DerivedQuantities() = %+v, want 0.1 km/pixel and Fresnel scale %g km", got, fresnelScale)
+	}
+
+	// printResolution reports and stores them; a later change of the plane is picked up
+	if resolution := printResolution(&event); resolution != got.KmPerPixel || event.Sampling != got {
+		t.Errorf("printResolution returned %g and stored %+v, want %+v", resolution, event.Sampling, got)
+	}
+	event.FundamentalPlaneWidthPoints = 800
+	if kmPerPixel := event.DerivedQuantities().KmPerPixel; kmPerPixel != 0.05 {
+		t.Errorf("after doubling the points the resolution is %g km/pixel, want 0.05", kmPerPixel)
+	}
+}
+
+func TestSourcePlaneRotation(t *testing.T) {
+	shadow := func(paDegrees, rotationDegrees float64) *image.Gray {
+		event := OccultationEvent{FundamentalPlaneWidthKm: 20, FundamentalPlaneWidthPoints: 101,
+			MainBodyGiven: true, MainbodyMajorAxisKm: 12, MainbodyMinorAxisKm: 4, MainbodyMajorAxisPaDegrees: paDegrees,
+			SourcePlaneRotationDegrees: rotationDegrees}
+		if _, err := buildGeometricShadow(&event, ""); err != nil {
+			t.Fatal(err)
+		}
+		return event.FplaneImage
+	}
+
+	// Rotating the plane by 30 degrees turns the ellipse as a 30 degree larger position angle would,
+	// apart from resampling at the edge
+	rotated := shadow(20, 30)
+	drawn := shadow(50, 0)
+	differ, occulted := 0, 0
+	for i := range drawn.Pix {
+		if drawn.Pix[i] == 0 {
+			occulted++
+		}
+		if rotated.Pix[i] != drawn.Pix[i] {
+			differ++
+		}
+	}
+	if differ > occulted/20 {
+		t.Errorf("%d of %d occulted pixels differ between a rotated plane and a rotated ellipse", differ, occulted)
+	}
+	for _, v := range rotated.Pix {
+		if v != 0 && v != 255 {
+			t.Fatalf("the rotated hard-edged shadow has the gray level %d", v)
+		}
+	}
+	if rotated.Pix[0] != 255 {
+		t.Errorf("the exposed corner is %d, want the sky level 255", rotated.Pix[0])
+	}
+}
+
+func TestBabinetIncidentWave(t *testing.T) {
+	cases := []struct {
+		event OccultationEvent
+		want  complex128
+	}{
+		{OccultationEvent{}, 1},                         // Not set: the unit plane wave
+		{OccultationEvent{IncidentWaveAmplitude: 1}, 1}, // Default from the parameter file
+		{OccultationEvent{IncidentWaveAmplitude: 0.5, IncidentWavePhaseDegrees: 90}, 0.5i},
+		{OccultationEvent{IncidentWaveAmplitude: 2, IncidentWavePhaseDegrees: 180}, -2},
+		{OccultationEvent{Mode: "aperture", IncidentWaveAmplitude: 0.5}, 0},
+	}
+	for _, c := range cases {
+		if got := babinetIncidentWave(&c.event); cmplx.Abs(got-c.want) > 1e-12 {
+			t.Errorf("babinetIncidentWave(amplitude %g, phase %g, mode %q) = %v, want %v",
+				c.event.IncidentWaveAmplitude, c.event.IncidentWavePhaseDegrees, c.event.Mode, got, c.want)
+		}
+	}
+}
+
+func TestSumStarField(t *testing.T) {
+	// 17 points over 16 km: one pixel per km
+	target := occultationMatrix(17, 1.0)
+	event := OccultationEvent{FundamentalPlaneWidthKm: 16, FundamentalPlaneWidthPoints: 17, IntensityMatrix: target,
+		StarField: []StarFieldSource{{XOffsetKm: 2, Brightness: 1}, {YOffsetKm: 1, Brightness: 2}}}
+	if err := sumStarField(&event); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second source's shadow is one row up (plane y is up)
+	right, _ := ShiftMatrix(target, 0, 2)
+	up, _ := ShiftMatrix(target, -1, 0)
+	for row := range target {
+		for col := range target[row] {
+			want := (target[row][col] + right[row][col] + 2*up[row][col]) / 4
+			if math.Abs(event.IntensityMatrix[row][col]-want) > 1e-12 {
+				t.Fatalf("[%d][%d] = %g, want %g", row, col, event.IntensityMatrix[row][col], want)
+			}
+		}
+	}
+	if event.IntensityMatrix[0][0] != 1.0 {
+		t.Errorf("unocculted level = %g, want 1", event.IntensityMatrix[0][0])
+	}
+	if target[8][4] != 0.0 {
+		t.Error("the target pattern was changed")
+	}
+}
+
+func TestPoissonSpotIntensity(t *testing.T) {
+	// A 0.5 km disk off the plane center, at 30 pixels per km
+	event := OccultationEvent{FundamentalPlaneWidthKm: 10, FundamentalPlaneWidthPoints: 301, DistanceAu: 2.33,
+		ObservationWavelengthNm: 500, MainBodyGiven: true, MainBodyXCenterKm: 0.5, MainBodyYCenterKm: -0.3,
+		MainbodyMajorAxisKm: 0.5, MainbodyMinorAxisKm: 0.5}
+	plane, err := buildGeometricShadow(&event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := computeIntensity(&event, plane, 10.0/301, func(name string) string { return name }); err != nil {
+		t.Fatal(err)
+	}
+
+	spot := PoissonSpotIntensity(&event)
+	if math.Abs(spot-1.0) > poissonSpotTolerance {
+		t.Errorf("Poisson spot intensity is %g, want 1 within %g", spot, poissonSpotTolerance)
+	}
+
+	// Away from the center the shadow is dark
+	event.MainBodyXCenterKm += 0.15
+	if offCenter := PoissonSpotIntensity(&event); offCenter > 0.5 {
+		t.Errorf("intensity 0.15 km from the shadow center is %g, want a dark shadow", offCenter)
+	}
+}
+
+func TestDiffractionIsPointSymmetric(t *testing.T) {
+	// An ellipse at an angle, centered on a pixel away from the plane center (10 pixels per km)
+	asymmetry := func(satellite bool) float64 {
+		event := OccultationEvent{FundamentalPlaneWidthKm: 10, FundamentalPlaneWidthPoints: 101, DistanceAu: 2.33,
+			ObservationWavelengthNm: 500, MainBodyGiven: true, MainBodyXCenterKm: 0.8, MainBodyYCenterKm: -0.5,
+			MainbodyMajorAxisKm: 3, MainbodyMinorAxisKm: 1.6, MainbodyMajorAxisPaDegrees: 30,
+			SatelliteGiven: satellite, SatelliteXCenterKm: 2.5, SatelliteMajorAxisKm: 0.6, SatelliteMinorAxisKm: 0.6}
+		plane, err := buildGeometricShadow(&event, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := computeIntensity(&event, plane, 10.0/101, func(name string) string { return name }); err != nil {
+			t.Fatal(err)
+		}
+		a, err := Asymmetry(event.IntensityMatrix, 50+5, 50+8)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return a
+	}
+	if a := asymmetry(false); a > 1e-6 {
+		t.Errorf("the diffraction of a lone ellipse has asymmetry %g, want 0", a)
+	}
+	if a := asymmetry(true); a < 1e-3 {
+		t.Errorf("with a satellite the asymmetry is only %g", a)
+	}
+}
+
+func TestStarDiamChromaticCoeff(t *testing.T) {
+	const n = 32
+	intensity := func(qe [][2]float64, coeff float64) [][]float64 {
+		plane := make([][]complex128, n)
+		for row := range plane {
+			plane[row] = make([]complex128, n)
+			for col := range plane[row] {
+				if (row-15)*(row-15)+(col-17)*(col-17) < 36 {
+					plane[row][col] = complex(1.0, 0.0)
+				}
+			}
+		}
+		event := OccultationEvent{FundamentalPlaneWidthKm: 4, FundamentalPlaneWidthPoints: n, DistanceAu: 2.33,
+			ObservationWavelengthNm: 550, StarDiamKm: 0.5, QEtable: qe, StarDiamChromaticCoeff: coeff}
+		if err := computeIntensity(&event, plane, 4.0/n, func(name string) string { return name }); err != nil {
+			t.Fatal(err)
+		}
+		return event.IntensityMatrix
+	}
+
+	// A single bin at the observation wavelength has the unscaled star, whether combined as an
+	// e-field or (with the coefficient set) as an intensity
+	single := [][2]float64{{550, 1}}
+	plain, chromatic := intensity(single, 0), intensity(single, 0.4)
+	if maxAbs, _, _ := CompareMatrices(plain, chromatic); maxAbs > 1e-9 {
+		t.Errorf("a single bin at the observation wavelength changed by up to %g with the coefficient set", maxAbs)
+	}
+
+	// With two bins the sign of the coefficient decides which bin gets the larger star
+	pair := [][2]float64{{450, 0.5}, {650, 0.5}}
+	if maxAbs, _, _ := CompareMatrices(intensity(pair, 0.4), intensity(pair, -0.4)); maxAbs < 1e-6 {
+		t.Errorf("opposite coefficients give the same intensity (maximum difference %g)", maxAbs)
+	}
+	event := OccultationEvent{ObservationWavelengthNm: 550, StarDiamChromaticCoeff: -0.2}
+	blue, blueErr := starDiamScale(&event, 450)
+	red, redErr := starDiamScale(&event, 650)
+	if blueErr != nil || redErr != nil || blue <= 1 || red >= 1 {
+		t.Errorf("a negative coefficient scales the star by %g (%v) at 450 nm and %g (%v) at 650 nm", blue, blueErr, red, redErr)
+	}
+	if _, err := starDiamScale(&event, 550+550/0.2); err == nil {
+		t.Error("a star diameter scale of 0 was accepted")
+	}
+}
+
+func TestReuseGeometricShadow(t *testing.T) {
+	dir := t.TempDir()
+	for _, opacity := range []float64{1, 0.5} {
+		built := OccultationEvent{FundamentalPlaneWidthKm: 20, FundamentalPlaneWidthPoints: 101,
+			MainBodyGiven: true, MainbodyMajorAxisKm: 12, MainbodyMinorAxisKm: 4, MainbodyMajorAxisPaDegrees: 30,
+			MainBodyXCenterKm: 3, MainbodyOpacity: opacity, FlipHorizontal: true, SaveGeometricShadow: true}
+		shadowFile := dir + "/geometricShadow.png"
+		builtPlane, err := buildGeometricShadow(&built, shadowFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The ellipse is not given again: it comes from the saved (flipped) shadow
+		reused := OccultationEvent{FundamentalPlaneWidthKm: 20, FundamentalPlaneWidthPoints: 50,
+			FlipHorizontal: true, ReuseGeometricShadowPNG: shadowFile}
+		reusedPlane, err := buildGeometricShadow(&reused, dir+"/again.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reused.FundamentalPlaneWidthPoints != 101 {
+			t.Errorf("opacity %g: the reused plane has %d points, want the 101 of the image", opacity, reused.FundamentalPlaneWidthPoints)
+		}
+		if reused.GradedSourcePlane != built.GradedSourcePlane {
+			t.Errorf("opacity %g: graded is %v for the reused plane, %v for the built one", opacity,
+				reused.GradedSourcePlane, built.GradedSourcePlane)
+		}
+		for y := range builtPlane {
+			for x := range builtPlane[y] {
+				if reusedPlane[y][x] != builtPlane[y][x] {
+					t.Fatalf("opacity %g: source plane (%d, %d) is %v reused, %v built", opacity, x, y,
+						reusedPlane[y][x], builtPlane[y][x])
+				}
+			}
+		}
+	}
+}
+
+func TestMainBodyOnlyEventOfRotatedShadow(t *testing.T) {
+	withSatellite := OccultationEvent{FundamentalPlaneWidthKm: 20, FundamentalPlaneWidthPoints: 64,
+		DxKmPerSec: 3, DyKmPerSec: 4, RotateGroundShadowTo90pa: true,
+		MainBodyGiven: true, MainBodyXCenterKm: 2, MainbodyMajorAxisKm: 10, MainbodyMinorAxisKm: 4, MainbodyMajorAxisPaDegrees: 20,
+		SatelliteGiven: true, SatelliteXCenterKm: -5, SatelliteYCenterKm: 3, SatelliteMajorAxisKm: 2, SatelliteMinorAxisKm: 2}
+	mainOnly := withSatellite
+	mainOnly.SatelliteGiven = false
+	for _, event := range []*OccultationEvent{&withSatellite, &mainOnly} {
+		if _, err := buildGeometricShadow(event, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The rerun for the satellite difference must rotate its plane as the run with the satellite did
+	again := mainBodyOnlyEvent(&withSatellite)
+	if _, err := buildGeometricShadow(&again, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := range mainOnly.FplaneImage.Pix {
+		if again.FplaneImage.Pix[i] != mainOnly.FplaneImage.Pix[i] {
+			t.Fatalf("pixel %d of the rebuilt main body plane is %d, want %d", i, again.FplaneImage.Pix[i],
+				mainOnly.FplaneImage.Pix[i])
+		}
+	}
+	if again.DxKmPerSec != withSatellite.DxKmPerSec || again.DyKmPerSec != withSatellite.DyKmPerSec {
+		t.Errorf("the rebuilt event moves at (%g, %g), want (%g, %g)", again.DxKmPerSec, again.DyKmPerSec,
+			withSatellite.DxKmPerSec, withSatellite.DyKmPerSec)
+	}
+}
+
+func TestOcculterBodiesScaleAboutTheirCenters(t *testing.T) {
+	event := OccultationEvent{FundamentalPlaneWidthKm: 20, FundamentalPlaneWidthPoints: 101,
+		MainBodyGiven: true, MainBodyXCenterKm: 4, MainbodyMajorAxisKm: 6, MainbodyMinorAxisKm: 4, MainbodyMajorAxisPaDegrees: 30,
+		SatelliteGiven: true, SatelliteXCenterKm: -5, SatelliteYCenterKm: 2, SatelliteMajorAxisKm: 3, SatelliteMinorAxisKm: 3}
+	sourcePlane, err := buildGeometricShadow(&event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := occulterBodies(&event, sourcePlane)
+	if len(bodies) != 2 {
+		t.Fatalf("got %d bodies, want the main body and the satellite", len(bodies))
+	}
+
+	// The bodies lie on either side of column 50: each keeps its centroid and grows in area by scale^2
+	half := func(plane [][]complex128, right bool) (area, cx, cy float64) {
+		for y, row := range plane {
+			for x, v := range row {
+				if (x > 50) == right {
+					m := cmplx.Abs(v)
+					area += m
+					cx += m * float64(x)
+					cy += m * float64(y)
+				}
+			}
+		}
+		return area, cx / area, cy / area
+	}
+	const scale = 1.2
+	scaled, err := scaleOcculterBodies(bodies, scale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, right := range []bool{false, true} {
+		area, cx, cy := half(sourcePlane, right)
+		scaledArea, scaledCx, scaledCy := half(scaled, right)
+		if math.Hypot(scaledCx-cx, scaledCy-cy) > 0.05 {
+			t.Errorf("right half %v: the body moved from (%0.2f, %0.2f) to (%0.2f, %0.2f)", right, cx, cy, scaledCx, scaledCy)
+		}
+		if ratio := scaledArea / area; math.Abs(ratio-scale*scale) > 0.05 {
+			t.Errorf("right half %v: the area grew by %0.3f, want %0.3f", right, ratio, scale*scale)
+		}
+	}
+
+	// With a ground shadow rotated to a 90 degree PA, a scale of 1 gives back the plane of the run
+	event.DxKmPerSec, event.DyKmPerSec, event.RotateGroundShadowTo90pa = 3, 4, true
+	sourcePlane, err = buildGeometricShadow(&event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unscaled, err := scaleOcculterBodies(occulterBodies(&event, sourcePlane), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := range sourcePlane {
+		for x := range sourcePlane[y] {
+			if cmplx.Abs(unscaled[y][x]-sourcePlane[y][x]) > 1e-9 {
+				t.Fatalf("source plane (%d, %d) is %v rebuilt, %v in the run", x, y, unscaled[y][x], sourcePlane[y][x])
+			}
+		}
+	}
+}
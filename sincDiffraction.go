@@ -1,11 +1,51 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"math/cmplx"
+	"sync"
+	"time"
 )
 
+var (
+	blasCheckOnce sync.Once
+	blasCheckErr  error
+)
+
+// checkMatMul multiplies two 2x2 complex matrices with mul (which must set c = a @ b, all three
+// row-major) and compares the product with the known result.
+func checkMatMul(mul func(a, b, c []complex128)) error {
+	a := []complex128{1 + 1i, 2, 0, 3 - 1i}
+	b := []complex128{2, 1i, 1 - 1i, 1}
+	want := []complex128{4, 1 + 1i, 2 - 4i, 3 - 1i}
+	c := make([]complex128, 4)
+	mul(a, b, c)
+	for i := range want {
+		if cmplx.Abs(c[i]-want[i]) > 1e-12 {
+			return fmt.Errorf("element %d of a 2x2 test product is %v, want %v", i, c[i], want[i])
+		}
+	}
+	return nil
+}
+
+// requireBLAS checks, once per run and before the first (long) BLAS multiplication, that the linked
+// OpenBLAS gives the right answer for a tiny product, so that a misbuilt library stops the run with
+// a clear error instead of producing garbage or crashing part way through.
+func requireBLAS() error {
+	blasCheckOnce.Do(func() {
+		blasCheckErr = checkMatMul(func(a, b, c []complex128) {
+			Zgemm3m(Rowmajor, Notrans, Notrans, 2, 2, 2, complex(1.0, 0.0), a, 2, b, 2, complex(0.0, 0.0), c, 2)
+		})
+	})
+	if blasCheckErr != nil {
+		return exitWith(26, fmt.Errorf("\n\tBLAS not functioning correctly (%w).\n"+
+			"\tThe program was probably built without a working OpenBLAS library.\n", blasCheckErr))
+	}
+	return nil
+}
+
 func fresnelWeightsTopRow(NPts int, LKm, ZKm, WavelengthKm float64) []complex128 {
 
 	// To calculate the fresnel weights matrix, we only need the top row
@@ -45,25 +85,21 @@ func fresnelWeightsTopRow(NPts int, LKm, ZKm, WavelengthKm float64) []complex128
 	return fresnelWeightsRow
 }
 
-func fresnelWeights(NPts int, LKm, ZKm, WavelengthKm float64) [][]complex128 {
+// fresnelWeightsInto fills w (row major, NPts x NPts) with the full fresnel weights matrix.
+func fresnelWeightsInto(w []complex128, NPts int, LKm, ZKm, WavelengthKm float64) {
 
 	// This routine is called when we want to see a full image of the diffraction pattern.
 	// Usually, we only need to look at a single row, and there is a routine that does this
-	// simpler task with a minimal use of memory: memory_frugal_single_row_sinc_solution().
+	// simpler task with a minimal use of memory: SingleRowSincSolution().
 
 	topRow := fresnelWeightsTopRow(NPts, LKm, ZKm, WavelengthKm)
-	ans := make([][]complex128, NPts)
-	for i := 0; i < NPts; i++ {
-		ans[i] = make([]complex128, NPts)
-	}
 
 	// Build the full fresnel weights matrix from the top row
 	for row := range NPts {
 		for col := range NPts {
-			ans[row][col] = topRow[AbsInt(col-row)] // element by element
+			w[row*NPts+col] = topRow[AbsInt(col-row)] // element by element
 		}
 	}
-	return ans
 }
 
 func AbsInt(x int) int {
@@ -73,9 +109,57 @@ func AbsInt(x int) int {
 	return x
 }
 
+// CabillosPhaseFactor returns the exp(i k Z) factor (k = 2 pi / wavelength) of Cabillos's
+// formulation that FullObservationPlaneSincSolution leaves out. It multiplies the incident wave and
+// the diffracted e-field alike, so it has no effect on intensity. It is computed in float64 exactly
+// as the reference does; note that at asteroid distances k Z is ~1e18 radians, so the phase depends
+// on the last bits of Z and of the wavelength.
+func CabillosPhaseFactor(ZKm, WavelengthKm float64) complex128 {
+	k := math.Pi * 2.0 / WavelengthKm
+	return cmplx.Exp(complex(0.0, k*ZKm))
+}
+
 func FullObservationPlaneSincSolution(LKm, ZKm, WavelengthKm float64, sourcePlane [][]complex128) []complex128 {
+	return FullObservationPlaneSincSolutionWith(nil, LKm, ZKm, WavelengthKm, sourcePlane)
+}
+
+// SincWorkspace holds the Npts^2 complex buffers used by FullObservationPlaneSincSolutionWith, so
+// that repeated calls (one per wavelength bin with a QE table) reuse them instead of allocating four
+// new ones each time. The zero value is ready to use; the buffers are (re)allocated when the plane
+// size changes. A workspace is not goroutine-safe: give each goroutine its own.
+type SincWorkspace struct {
+	weights, source, product, result []complex128
+}
+
+// sized returns buf with length n, reusing its storage when it is large enough.
+func sized(buf []complex128, n int) []complex128 {
+	if cap(buf) < n {
+		return make([]complex128, n)
+	}
+	return buf[:n]
+}
+
+// FullObservationPlaneSincSolutionWith is FullObservationPlaneSincSolution using the buffers of ws
+// (nil allocates new ones, as FullObservationPlaneSincSolution does). The returned e-field is the
+// result buffer of ws, so it is overwritten by the next call with the same workspace: accumulate or
+// copy it before then.
+func FullObservationPlaneSincSolutionWith(ws *SincWorkspace, LKm, ZKm, WavelengthKm float64, sourcePlane [][]complex128) []complex128 {
+	ans, _ := FullObservationPlaneSincSolutionContext(context.Background(), ws, LKm, ZKm, WavelengthKm, sourcePlane)
+	return ans // The background context is never canceled
+}
+
+// FullObservationPlaneSincSolutionContext is FullObservationPlaneSincSolutionWith checking ctx before
+// and between its two matrix multiplications. It returns ctx.Err() if ctx has been canceled. A
+// multiplication that has started cannot be interrupted, so cancellation takes effect when it ends.
+func FullObservationPlaneSincSolutionContext(ctx context.Context, ws *SincWorkspace, LKm, ZKm, WavelengthKm float64,
+	sourcePlane [][]complex128) ([]complex128, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ws == nil {
+		ws = &SincWorkspace{}
+	}
 	Npts := len(sourcePlane)
-	wgts := fresnelWeights(Npts, LKm, ZKm, WavelengthKm)
 
 	// k := math.Pi * 2.0 / WavelengthKm
 
@@ -85,6 +169,7 @@ func FullObservationPlaneSincSolution(LKm, ZKm, WavelengthKm float64, sourcePlan
 	// an aperture to occulter simple using an incident wave as 1.0 + 0.0j
 	// All that term does in astronomical usage is added a phase angle to the e-field that disappears
 	// anyway when intensity is calculated by e_field * np.conj(e_field)
+	// (CabillosPhaseFactor gives the term for callers that want the reference e-field.)
 
 	M, N, K := Npts, Npts, Npts
 
@@ -93,38 +178,219 @@ func FullObservationPlaneSincSolution(LKm, ZKm, WavelengthKm float64, sourcePlan
 	ldb := K
 	ldc := M
 
-	A, err := Flatten2D(wgts)
-	if err != nil {
-		panic(err)
-	}
+	ws.weights = sized(ws.weights, Npts*Npts)
+	A := ws.weights
+	fresnelWeightsInto(A, Npts, LKm, ZKm, WavelengthKm)
 
-	B, err := Flatten2D(sourcePlane)
-	if err != nil {
-		panic(err)
+	ws.source = sized(ws.source, Npts*Npts)
+	B := ws.source
+	for row := range sourcePlane {
+		if len(sourcePlane[row]) != Npts {
+			panic("FullObservationPlaneSincSolution: the source plane is not square")
+		}
+		copy(B[row*Npts:(row+1)*Npts], sourcePlane[row])
 	}
 
-	C := make([]complex128, ldc*N)
+	ws.product = sized(ws.product, ldc*N)
+	C := ws.product
 
-	ans := make([]complex128, ldc*N)
+	ws.result = sized(ws.result, ldc*N)
+	ans := ws.result
 
 	alpha := complex(1.0, 0.0)
 	beta := complex(0.0, 0.0)
 
 	if Npts >= 1000 {
+		if err := requireBLAS(); err != nil {
+			return nil, err
+		}
+
 		// Compute wgts @ sourcePlane @ wgts
+		// Zgemm3m computes C <- alpha * A @ B + beta * C (which for us is C <- A @ B)
+		// These are long calls on big planes and BLAS gives no feedback, so we report around each one.
+		logInfo("Starting matmul 1 of 2 (%d x %d complex) ...\n", Npts, Npts)
+		start := time.Now()
 		Zgemm3m(Rowmajor, Notrans, Notrans, N, M, K, alpha, A, lda, B, ldb, beta, C, ldc)
+		first := time.Since(start)
+		logInfo("Matmul 1 of 2 complete in %s (estimated total for both: %s)\n",
+			first.Round(time.Millisecond), (2 * first).Round(time.Millisecond))
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		logInfo("Starting matmul 2 of 2 ...\n")
+		start = time.Now()
 		Zgemm3m(Rowmajor, Notrans, Notrans, N, M, K, alpha, C, lda, A, ldb, beta, ans, ldc)
-		// Zgemm3m computes C <- alpha * A @ B + beta * C (which for us is C <- A @ B)
+		logInfo("Matmul 2 of 2 complete in %s\n", time.Since(start).Round(time.Millisecond))
 	} else {
-		C, err = MatMulSquareComplex(A, B, Npts)
+		err := MatMulSquareComplexInto(C, A, B, Npts)
 		if err != nil {
-			fmt.Println(fmt.Errorf(err.Error()))
+			logError(fmt.Errorf("matrix multiplication failed: %w", err))
 		}
-		ans, err = MatMulSquareComplex(C, A, Npts)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		err = MatMulSquareComplexInto(ans, C, A, Npts)
 		if err != nil {
-			fmt.Println(fmt.Errorf(err.Error()))
+			logError(fmt.Errorf("matrix multiplication failed: %w", err))
 		}
 	}
 
-	return ans
+	return ans, nil
+}
+
+// PaddedSincSolutionContext is FullObservationPlaneSincSolutionContext on sourcePlane surrounded by
+// pad pixels of zero (no aperture: open sky in occulter mode) on every side, with the e-field cropped
+// back to the size of sourcePlane. LKm is the width of sourcePlane; the padded plane is wider at the
+// same spacing. pad 0 is the plain solution. The direct (matrix) solution has no wrap-around, so the
+// padding leaves the cropped field unchanged (to rounding), and the simulation does not use it: it
+// is kept for an FFT-based method, which would wrap around at the plane edges. The returned field is
+// a new buffer, not one of ws.
+func PaddedSincSolutionContext(ctx context.Context, ws *SincWorkspace, LKm, ZKm, WavelengthKm float64,
+	sourcePlane [][]complex128, pad int) ([]complex128, error) {
+	if pad <= 0 {
+		return FullObservationPlaneSincSolutionContext(ctx, ws, LKm, ZKm, WavelengthKm, sourcePlane)
+	}
+	n := len(sourcePlane)
+	padded := make([][]complex128, n+2*pad)
+	for row := range padded {
+		padded[row] = make([]complex128, n+2*pad)
+		if row >= pad && row < n+pad {
+			copy(padded[row][pad:], sourcePlane[row-pad])
+		}
+	}
+	paddedL := LKm * float64(n+2*pad) / float64(n)
+	field, err := FullObservationPlaneSincSolutionContext(ctx, ws, paddedL, ZKm, WavelengthKm, padded)
+	if err != nil {
+		return nil, err
+	}
+
+	cropped := make([]complex128, n*n)
+	for row := 0; row < n; row++ {
+		start := (row+pad)*(n+2*pad) + pad
+		copy(cropped[row*n:(row+1)*n], field[start:start+n])
+	}
+	return cropped, nil
+}
+
+// SingleRowSincSolution returns the e-field of the central row (row Npts/2) of the observation
+// plane. See SingleRowSincSolutionAt.
+func SingleRowSincSolution(LKm, ZKm, WavelengthKm float64, sourcePlane [][]complex128) ([]complex128, error) {
+	return SingleRowSincSolutionAt(LKm, ZKm, WavelengthKm, sourcePlane, len(sourcePlane)/2)
+}
+
+// SingleRowSincSolutionAt returns the e-field of a single row of the observation plane, the same
+// values as that row of FullObservationPlaneSincSolution. Row r of wgts @ sourcePlane @ wgts is
+// (row r of wgts) @ sourcePlane @ wgts, so only vector-matrix products are needed and the fresnel
+// weights matrix is never built: wgts[i][j] is simply topRow[|i-j|]. This is O(Npts^2) in time and
+// O(Npts) in extra memory, which makes it suitable for parameter sweeps along a single chord.
+// An error is returned for a row outside the plane.
+func SingleRowSincSolutionAt(LKm, ZKm, WavelengthKm float64, sourcePlane [][]complex128, row int) ([]complex128, error) {
+	Npts := len(sourcePlane)
+	if row < 0 || row >= Npts {
+		return nil, fmt.Errorf("row %d is outside the plane (0 to %d)", row, Npts-1)
+	}
+	topRow := fresnelWeightsTopRow(Npts, LKm, ZKm, WavelengthKm)
+
+	// v = (row of wgts) @ sourcePlane
+	v := make([]complex128, Npts)
+	for k := 0; k < Npts; k++ {
+		w := topRow[AbsInt(k-row)]
+		for col, value := range sourcePlane[k] {
+			v[col] += w * value
+		}
+	}
+
+	// ans = v @ wgts
+	ans := make([]complex128, Npts)
+	for col := 0; col < Npts; col++ {
+		var sum complex128
+		for k := 0; k < Npts; k++ {
+			sum += v[k] * topRow[AbsInt(col-k)]
+		}
+		ans[col] = sum
+	}
+	return ans, nil
+}
+
+// ScaleSourcePlane returns a copy of sourcePlane magnified by scale about the plane center (see
+// ScaleSourcePlaneAbout).
+func ScaleSourcePlane(sourcePlane [][]complex128, scale float64) ([][]complex128, error) {
+	if len(sourcePlane) == 0 {
+		return nil, fmt.Errorf("empty source plane")
+	}
+	return ScaleSourcePlaneAbout(sourcePlane, scale, float64(len(sourcePlane[0])-1)/2.0, float64(len(sourcePlane)-1)/2.0)
+}
+
+// ScaleSourcePlaneAbout returns a copy of sourcePlane magnified by scale about the point cx, cy (x
+// is the column and y the row, in pixels), using bilinear interpolation so that sub-pixel changes in
+// the occulter edge position are preserved. Samples that come from outside the plane are 0 (no
+// aperture).
+func ScaleSourcePlaneAbout(sourcePlane [][]complex128, scale, cx, cy float64) ([][]complex128, error) {
+	if scale <= 0.0 {
+		return nil, fmt.Errorf("source plane scale %g must be > 0", scale)
+	}
+	h := len(sourcePlane)
+	if h == 0 {
+		return nil, fmt.Errorf("empty source plane")
+	}
+	w := len(sourcePlane[0])
+
+	valueAt := func(x, y int) complex128 {
+		if x < 0 || x >= w || y < 0 || y >= h {
+			return complex(0.0, 0.0)
+		}
+		return sourcePlane[y][x]
+	}
+
+	out := make([][]complex128, h)
+	for y := 0; y < h; y++ {
+		out[y] = make([]complex128, w)
+		for x := 0; x < w; x++ {
+			// Inverse mapping: find where this output pixel comes from in the original plane.
+			srcX := cx + (float64(x)-cx)/scale
+			srcY := cy + (float64(y)-cy)/scale
+			x0 := int(math.Floor(srcX))
+			y0 := int(math.Floor(srcY))
+			xFrac := complex(srcX-float64(x0), 0.0)
+			yFrac := complex(srcY-float64(y0), 0.0)
+
+			v0 := valueAt(x0, y0)*(1-xFrac) + valueAt(x0+1, y0)*xFrac
+			v1 := valueAt(x0, y0+1)*(1-xFrac) + valueAt(x0+1, y0+1)*xFrac
+			out[y][x] = v0*(1-yFrac) + v1*yFrac
+		}
+	}
+	return out, nil
+}
+
+// ApodizeSourcePlane tapers the outer border of sourcePlane (in place) with a separable Tukey
+// (raised cosine) window. fraction is the width of the taper at each edge as a fraction of the
+// plane width; the central region is left untouched. Apodization suppresses the ringing that an
+// aperture cut off by the plane boundary produces in the sinc solution. fraction must be in [0, 0.25].
+func ApodizeSourcePlane(sourcePlane [][]complex128, fraction float64) error {
+	if fraction < 0.0 || fraction > 0.25 {
+		return fmt.Errorf("edge apodization fraction %g is outside the range 0 to 0.25", fraction)
+	}
+	n := len(sourcePlane)
+	taper := int(math.Round(fraction * float64(n)))
+	if taper < 1 {
+		return nil
+	}
+
+	window := make([]float64, n)
+	for i := 0; i < n; i++ {
+		window[i] = 1.0
+	}
+	for i := 0; i < taper; i++ {
+		w := 0.5 * (1.0 - math.Cos(math.Pi*(float64(i)+0.5)/float64(taper)))
+		window[i] = w
+		window[n-1-i] = w
+	}
+
+	for row := 0; row < n; row++ {
+		for col := 0; col < len(sourcePlane[row]); col++ {
+			sourcePlane[row][col] *= complex(window[row]*window[col], 0.0)
+		}
+	}
+	return nil
 }
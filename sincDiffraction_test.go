@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+// illuminatedVariance returns the variance of the occulter intensity (Babinet) over a block of
+// the plane well away from the occulter edge.
+func illuminatedVariance(eField []complex128, n, rowLo, rowHi, colLo, colHi int) float64 {
+	sum, sumSq, count := 0.0, 0.0, 0.0
+	for row := rowLo; row < rowHi; row++ {
+		for col := colLo; col < colHi; col++ {
+			v := complex(1.0, 0.0) - eField[row*n+col]
+			intensity := real(v)*real(v) + imag(v)*imag(v)
+			sum += intensity
+			sumSq += intensity * intensity
+			count++
+		}
+	}
+	mean := sum / count
+	return sumSq/count - mean*mean
+}
+
+func TestApodizationReducesEdgeRinging(t *testing.T) {
+	const n = 128
+	const lKm = 4.0
+	zKm := 2.33 * 1.495979e8
+	wavelengthKm := 500e-12
+
+	// An occulter strip along the left side that is cut off by the top, bottom and left
+	// plane boundaries, which is what produces the boundary ringing.
+	makePlane := func() [][]complex128 {
+		plane := make([][]complex128, n)
+		for row := range plane {
+			plane[row] = make([]complex128, n)
+			for col := 0; col < n/4; col++ {
+				plane[row][col] = complex(1.0, 0.0)
+			}
+		}
+		return plane
+	}
+
+	plain := makePlane()
+	apodized := makePlane()
+	if err := ApodizeSourcePlane(apodized, 0.1); err != nil {
+		t.Fatalf("ApodizeSourcePlane failed: %v", err)
+	}
+
+	// The taper must leave the central region untouched
+	for row := 20; row < n-20; row++ {
+		for col := 20; col < n-20; col++ {
+			if apodized[row][col] != plain[row][col] {
+				t.Fatalf("apodization changed the central plane at row %d col %d", row, col)
+			}
+		}
+	}
+
+	plainVar := illuminatedVariance(FullObservationPlaneSincSolution(lKm, zKm, wavelengthKm, plain), n, 40, 88, 70, 110)
+	apodizedVar := illuminatedVariance(FullObservationPlaneSincSolution(lKm, zKm, wavelengthKm, apodized), n, 40, 88, 70, 110)
+	t.Logf("illuminated region variance: no window %g, with window %g", plainVar, apodizedVar)
+	if !(apodizedVar < plainVar) {
+		t.Errorf("apodization did not reduce the illuminated region variance: %g >= %g", apodizedVar, plainVar)
+	}
+
+	if err := ApodizeSourcePlane(makePlane(), 0.3); err == nil {
+		t.Errorf("expected an error for an apodization fraction of 0.3")
+	}
+}
+
+func TestSingleRowSincSolutionMatchesFullSolution(t *testing.T) {
+	const n = 64
+	const lKm = 4.0
+	zKm := 2.33 * 1.495979e8
+	wavelengthKm := 500e-12
+
+	// An off-center disk so that the rows differ from one another
+	plane := make([][]complex128, n)
+	for row := range plane {
+		plane[row] = make([]complex128, n)
+		for col := range plane[row] {
+			if (row-28)*(row-28)+(col-36)*(col-36) < 100 {
+				plane[row][col] = complex(1.0, 0.0)
+			}
+		}
+	}
+
+	full := FullObservationPlaneSincSolution(lKm, zKm, wavelengthKm, plane)
+	check := func(row int, got []complex128, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("row %d: %v", row, err)
+		}
+		for col := 0; col < n; col++ {
+			if cmplx.Abs(got[col]-full[row*n+col]) > 1e-9 {
+				t.Fatalf("row %d col %d: got %v, want %v", row, col, got[col], full[row*n+col])
+			}
+		}
+	}
+	got, err := SingleRowSincSolution(lKm, zKm, wavelengthKm, plane)
+	check(n/2, got, err)
+	for _, row := range []int{0, 20, 28, n - 1} {
+		got, err := SingleRowSincSolutionAt(lKm, zKm, wavelengthKm, plane, row)
+		check(row, got, err)
+	}
+
+	for _, row := range []int{-1, n} {
+		if _, err := SingleRowSincSolutionAt(lKm, zKm, wavelengthKm, plane, row); err == nil {
+			t.Errorf("row %d is outside the plane but gave no error", row)
+		}
+	}
+	if _, err := SingleRowSincSolution(lKm, zKm, wavelengthKm, nil); err == nil {
+		t.Error("an empty plane gave no error")
+	}
+}
+
+func TestScaleSourcePlane(t *testing.T) {
+	// A disk of radius 20 pixels about the center of a 101 pixel plane
+	const n = 101
+	plane := make([][]complex128, n)
+	for row := range plane {
+		plane[row] = make([]complex128, n)
+		for col := range plane[row] {
+			if math.Hypot(float64(row-50), float64(col-50)) <= 20 {
+				plane[row][col] = complex(1.0, 0.0)
+			}
+		}
+	}
+
+	// edgeRadius returns where the center row falls through 0.5 right of the center, interpolating
+	// between pixels (the unscaled disk's edge is at 20.5). This locates a scaled edge to better than
+	// 0.1 pixel, enough to see the sub-pixel shift of a 2% scale.
+	edgeRadius := func(m [][]complex128) float64 {
+		for col := 50; col+1 < n; col++ {
+			a, b := real(m[50][col]), real(m[50][col+1])
+			if a >= 0.5 && b < 0.5 {
+				return float64(col-50) + (a-0.5)/(a-b)
+			}
+		}
+		return math.NaN()
+	}
+	for _, scale := range []float64{0.9, 1.0, 1.02, 1.1} {
+		scaled, err := ScaleSourcePlane(plane, scale)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := edgeRadius(scaled), 20.5*scale; math.Abs(got-want) > 0.1 {
+			t.Errorf("scale %g: edge at %g pixels from the center, want %g", scale, got, want)
+		}
+	}
+
+	for _, scale := range []float64{0, -1} {
+		if _, err := ScaleSourcePlane(plane, scale); err == nil {
+			t.Errorf("scale %g gave no error", scale)
+		}
+	}
+}
+
+func TestSincWorkspaceReuseMatchesFreshSolution(t *testing.T) {
+	const n = 48
+	const lKm = 4.0
+	zKm := 2.33 * 1.495979e8
+
+	plane := make([][]complex128, n)
+	for row := range plane {
+		plane[row] = make([]complex128, n)
+		for col := range plane[row] {
+			if (row-20)*(row-20)+(col-26)*(col-26) < 64 {
+				plane[row][col] = complex(1.0, 0.0)
+			}
+		}
+	}
+
+	var ws SincWorkspace
+	for _, wavelengthKm := range []float64{400e-12, 500e-12, 600e-12} {
+		fresh := FullObservationPlaneSincSolution(lKm, zKm, wavelengthKm, plane)
+		reused := FullObservationPlaneSincSolutionWith(&ws, lKm, zKm, wavelengthKm, plane)
+		for i := range fresh {
+			if cmplx.Abs(reused[i]-fresh[i]) > 1e-12 {
+				t.Fatalf("wavelength %g km, element %d: reused workspace gave %v, want %v",
+					wavelengthKm, i, reused[i], fresh[i])
+			}
+		}
+	}
+}
+
+func TestCheckMatMul(t *testing.T) {
+	goMul := func(a, b, c []complex128) {
+		if err := MatMulSquareComplexInto(c, a, b, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkMatMul(goMul); err != nil {
+		t.Errorf("correct multiplication rejected: %v", err)
+	}
+
+	// A library that leaves the output untouched (or transposes it) must be caught.
+	if err := checkMatMul(func(a, b, c []complex128) {}); err == nil {
+		t.Error("no-op multiplication accepted")
+	}
+	transposed := func(a, b, c []complex128) {
+		goMul(a, b, c)
+		c[1], c[2] = c[2], c[1]
+	}
+	if err := checkMatMul(transposed); err == nil {
+		t.Error("transposed product accepted")
+	}
+}
+
+func TestCabillosPhaseFactorKeepsIntensity(t *testing.T) {
+	const wavelengthKm = 500e-12
+
+	// The factor is periodic in Z with period one wavelength
+	if got := CabillosPhaseFactor(3*wavelengthKm, wavelengthKm); cmplx.Abs(got-1) > 1e-9 {
+		t.Errorf("factor after three wavelengths = %v, want 1", got)
+	}
+	if got := CabillosPhaseFactor(2.5*wavelengthKm, wavelengthKm); cmplx.Abs(got+1) > 1e-9 {
+		t.Errorf("factor after two and a half wavelengths = %v, want -1", got)
+	}
+
+	factor := CabillosPhaseFactor(2.33*1.495979e8, wavelengthKm)
+	for _, e := range []complex128{0, 0.3 - 0.4i, 1.2 + 0.05i, -0.7i} {
+		plain := cmplx.Abs(1 - e)
+		withPhase := cmplx.Abs(factor * (1 - e))
+		if math.Abs(withPhase*withPhase-plain*plain) > 1e-12 {
+			t.Errorf("intensity of 1 - %v is %g with the phase term, %g without", e, withPhase*withPhase, plain*plain)
+		}
+	}
+}
+
+// The direct (matrix) sinc solution has no wrap-around: an aperture at the very edge of the plane
+// does not reappear at the opposite edge, so padding the plane with sky leaves the field unchanged.
+// (An FFT-based solution would need the padding to stop the wrap.)
+func TestPaddedSincSolutionMatchesUnpadded(t *testing.T) {
+	const n = 48
+	const lKm = 4.0
+	zKm := 2.33 * 1.495979e8
+	wavelengthKm := 550e-12
+
+	// An aperture touching the left edge of the plane
+	plane := make([][]complex128, n)
+	for row := range plane {
+		plane[row] = make([]complex128, n)
+		for col := 0; col < 6; col++ {
+			if row > 18 && row < 30 {
+				plane[row][col] = 1
+			}
+		}
+	}
+
+	plain := FullObservationPlaneSincSolution(lKm, zKm, wavelengthKm, plane)
+	for _, pad := range []int{0, 5, 24} {
+		padded, err := PaddedSincSolutionContext(context.Background(), nil, lKm, zKm, wavelengthKm, plane, pad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(padded) != n*n {
+			t.Fatalf("pad %d: the cropped field has %d elements, want %d", pad, len(padded), n*n)
+		}
+		for i := range plain {
+			if cmplx.Abs(padded[i]-plain[i]) > 1e-9 {
+				t.Fatalf("pad %d, element (%d, %d): %v padded, %v unpadded", pad, i%n, i/n, padded[i], plain[i])
+			}
+		}
+	}
+
+	// No wrap-around: the far (right) edge sees much less light than the aperture's own edge
+	near := cmplx.Abs(plain[24*n])
+	far := cmplx.Abs(plain[24*n+n-1])
+	if far > 0.1*near {
+		t.Errorf("the field at the far edge (%g) is not small next to the aperture edge (%g)", far, near)
+	}
+}
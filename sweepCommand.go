@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"math"
+	"os"
+
+	json "github.com/KevinWang15/go-json5"
+	"github.com/bob-anderson-ok/IOTAdiffraction/lightcurve"
+)
+
+// maxSweepFrames limits the number of values (and so GIF frames) of a sweep.
+const maxSweepFrames = 500
+
+// sweepFrameDelay is the time each frame of the sweep animation is shown, in 100ths of a second.
+const sweepFrameDelay = 50
+
+// sweepValues returns start, start+step, ... up to and including stop (within a small tolerance
+// for rounding). step must move start towards stop.
+func sweepValues(start, stop, step float64) ([]float64, error) {
+	for _, v := range []float64{start, stop, step} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("start, stop and step must be finite numbers")
+		}
+	}
+	if step == 0.0 {
+		return nil, fmt.Errorf("step must not be zero")
+	}
+	if (stop-start)/step < 0.0 {
+		return nil, fmt.Errorf("a step of %g does not go from %g to %g", step, start, stop)
+	}
+	count := int(math.Floor((stop-start)/step+1e-9)) + 1
+	if count > maxSweepFrames {
+		return nil, fmt.Errorf("%d values from %g to %g in steps of %g is more than the limit of %d",
+			count, start, stop, step, maxSweepFrames)
+	}
+	values := make([]float64, count)
+	for i := range values {
+		values[i] = start + float64(i)*step
+	}
+	return values, nil
+}
+
+// runSweep runs the parameter file once for each value of key from start to stop in steps of step,
+// and assembles the light curve plots into the animated GIF gifFilename. As in a batch run, the
+// diffraction calculation is reused while only the observation path changes (for example when
+// key is path_perpendicular_offset_from_center_km), so such a sweep costs one calculation.
+func runSweep(paramPath, key string, start, stop, step float64, gifFilename string) error {
+	values, err := sweepValues(start, stop, step)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(paramPath)
+	if err != nil {
+		return fmt.Errorf("attempt to read input file %q failed: %w", paramPath, err)
+	}
+	var jsonTable map[string]interface{}
+	if err := json.Unmarshal(data, &jsonTable); err != nil {
+		return fmt.Errorf("format error in file %q: %w", paramPath, err)
+	}
+	jsonTable, err = includeTable(jsonTable, paramPath, nil)
+	if err != nil {
+		return fmt.Errorf("in file %q: %w", paramPath, err)
+	}
+	switch jsonTable[key].(type) {
+	case nil, float64:
+	default:
+		return fmt.Errorf("%s: only a key with a single number value can be swept", key)
+	}
+
+	animation := &gif.GIF{}
+	var previous *diffractionRun
+
+	for i, value := range values {
+		logInfo("\n========== Sweep frame %d of %d: %s = %g ==========\n", i+1, len(values), key, value)
+
+		table := make(map[string]interface{}, len(jsonTable))
+		for k, v := range jsonTable {
+			table[k] = v
+		}
+		table[key] = value
+
+		event, err := eventFromTable(table)
+		if err != nil {
+			return fmt.Errorf("%s = %g: %w", key, value, err)
+		}
+		previous, err = computeDiffraction(context.Background(), &event, false, func(name string) string { return name }, previous)
+		if err != nil {
+			return fmt.Errorf("%s = %g: %w", key, value, err)
+		}
+		if err := applyExposureSmear(&event, previous.resolution); err != nil {
+			return fmt.Errorf("%s = %g: %w", key, value, err)
+		}
+
+		if !event.PathDefined {
+			return fmt.Errorf("%s = %g: no observation path is defined (dX_km_per_sec and dY_km_per_sec are needed)", key, value)
+		}
+		if event.Title == "" {
+			event.Title = lightcurve.DefaultPlotTitle
+		}
+		event.Title += fmt.Sprintf("  (%s = %g)", key, value)
+		plotImg, err := makePlotImage(event.PathDirection, 1200, 500, event, FindEdgesInGeometricShadow(event))
+		if err != nil {
+			return fmt.Errorf("%s = %g: creating the light curve plot failed: %w", key, value, err)
+		}
+
+		frame := image.NewPaletted(plotImg.Bounds(), palette.Plan9)
+		draw.Draw(frame, frame.Rect, plotImg, plotImg.Bounds().Min, draw.Src)
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, sweepFrameDelay)
+	}
+
+	f, err := os.Create(gifFilename)
+	if err != nil {
+		return fmt.Errorf("creating %s failed: %w", gifFilename, err)
+	}
+	if err := gif.EncodeAll(f, animation); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("writing %s failed: %w", gifFilename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing %s failed: %w", gifFilename, err)
+	}
+	logInfo("\nSweep animation of %d frames saved to %s\n", len(values), gifFilename)
+	return nil
+}
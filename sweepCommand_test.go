@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"image/gif"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSweepValues(t *testing.T) {
+	values, err := sweepValues(-1, 1, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{-1, -0.5, 0, 0.5, 1}
+	if len(values) != len(want) {
+		t.Fatalf("got %v, want %v", values, want)
+	}
+	for i := range want {
+		if math.Abs(values[i]-want[i]) > 1e-12 {
+			t.Errorf("value %d is %g, want %g", i, values[i], want[i])
+		}
+	}
+
+	// 0.1 steps do not add up exactly, but stop must still be included
+	if values, err := sweepValues(0, 0.3, 0.1); err != nil || len(values) != 4 {
+		t.Errorf("sweepValues(0, 0.3, 0.1) = %v, %v: want 4 values", values, err)
+	}
+	if values, err := sweepValues(2, 1, -0.5); err != nil || len(values) != 3 {
+		t.Errorf("a downward sweep gave %v, %v: want 3 values", values, err)
+	}
+
+	bad := [][3]float64{{0, 1, 0}, {0, 1, -0.1}, {0, 1, 1e-6}, {0, math.Inf(1), 1}}
+	for _, b := range bad {
+		if _, err := sweepValues(b[0], b[1], b[2]); err == nil {
+			t.Errorf("sweepValues(%g, %g, %g) gave no error", b[0], b[1], b[2])
+		}
+	}
+}
+
+func TestRunSweep(t *testing.T) {
+	t.Chdir(t.TempDir())
+	params := `{
+		fundamental_plane_width_km : 8,
+		fundamental_plane_width_num_points : 64,
+		distance_au : 2.33,
+		observation_wavelength_nm : 500,
+		dX_km_per_sec : 5.0,
+		dY_km_per_sec : 0.0,
+		main_body : { x_center_km : 0, y_center_km : 0, major_axis_km : 3, minor_axis_km : 2, major_axis_pa_degrees : 0 },
+	}`
+	if err := os.WriteFile("sweep.json5", []byte(params), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSweep("sweep.json5", "path_perpendicular_offset_from_center_km", -1, 1, 1, "sweep.gif"); err != nil {
+		t.Fatalf("runSweep: %v", err)
+	}
+
+	f, err := os.Open("sweep.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	animation, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(animation.Image) != 3 {
+		t.Errorf("the animation has %d frames, want 3", len(animation.Image))
+	}
+
+	if err := runSweep("sweep.json5", "main_body", 0, 1, 1, "bad.gif"); err == nil {
+		t.Error("sweeping an object key gave no error")
+	}
+}
+
+func TestRunSweepSharesTheRunStages(t *testing.T) {
+	t.Chdir(t.TempDir())
+	params := `{
+		fundamental_plane_width_km : 8,
+		fundamental_plane_width_num_points : 64,
+		distance_au : 2.33,
+		observation_wavelength_nm : 500,
+		dX_km_per_sec : 5.0,
+		dY_km_per_sec : 0.0,
+		main_body : { x_center_km : 0, y_center_km : 0, major_axis_km : 3, minor_axis_km : 2, major_axis_pa_degrees : 0 },
+		satellite : { x_center_km : 2.5, y_center_km : 1, major_axis_km : 0.6, minor_axis_km : 0.6, major_axis_pa_degrees : 0 },
+		save_satellite_difference_bool : true,
+	}`
+	if err := os.WriteFile("sweep.json5", []byte(params), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	console = &out
+	defer func() { console = os.Stdout }()
+	if err := runSweep("sweep.json5", "path_perpendicular_offset_from_center_km", -1, 1, 1, "sweep.gif"); err != nil {
+		t.Fatalf("runSweep: %v", err)
+	}
+
+	// The sweep computes the diffraction as a single run does, satellite difference included, and
+	// reuses it for the frames that only move the path
+	if _, err := os.Stat("satelliteDifference8bit.png"); err != nil {
+		t.Errorf("the sweep made no satellite difference image: %v", err)
+	}
+	if reused := strings.Count(out.String(), "reusing its diffraction calculation"); reused != 2 {
+		t.Errorf("%d frames reused the diffraction calculation, want 2", reused)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// versionInfo returns the program version together with the Go version it was built with and,
+// when the binary was built from a git checkout, the VCS revision (marked "modified" if the
+// working tree had uncommitted changes) and commit time.
+func versionInfo() string {
+	info := fmt.Sprintf("OccultDiffractionApp version %s\nBuilt with %s (%s/%s)",
+		version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	settings := make(map[string]string)
+	for _, setting := range buildInfo.Settings {
+		settings[setting.Key] = setting.Value
+	}
+	if revision, found := settings["vcs.revision"]; found {
+		info += fmt.Sprintf("\nRevision %s", revision)
+		if settings["vcs.modified"] == "true" {
+			info += " (modified)"
+		}
+		if commitTime, found := settings["vcs.time"]; found {
+			info += fmt.Sprintf(" committed %s", commitTime)
+		}
+	}
+	return info
+}